@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"minitunnel/internal/config"
+	"minitunnel/pkg/agent"
+)
+
+// Files of a background agent in its -dir
+const (
+	daemonPIDFile    = "agent.pid"
+	daemonLogFile    = "agent.log"
+	daemonSocketFile = "agent.sock"
+)
+
+// daemonEnv marks the background process `mt_agent start` starts
+const daemonEnv = "MINITUNNEL_DAEMON"
+
+// defaultDaemonDir returns ~/.minitunnel, or the working directory if
+// there is no home directory
+func defaultDaemonDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(home, ".minitunnel")
+}
+
+// startCommand implements `mt_agent start [flags]`: it starts the agent in
+// the background, reconnecting on its own, and returns once the tunnel is up
+func startCommand(args []string) error {
+	cfg := &config.AgentConfig{}
+	fs := flag.NewFlagSet("start", flag.ExitOnError)
+	cfg.RegisterFlags(fs)
+	dir := fs.String("dir", defaultDaemonDir(), "Directory for the agent's pid file, log file and control socket")
+	wait := fs.Duration("wait", 15*time.Second, "How long to wait for the tunnel to come up")
+	fs.Parse(args)
+	cfg.Reconnect = cfg.PollInterval == 0
+
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	if os.Getenv(daemonEnv) == "1" {
+		return runDaemon(cfg, *dir)
+	}
+
+	if err := os.MkdirAll(*dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", *dir, err)
+	}
+	if st, err := agent.QueryStatus(filepath.Join(*dir, daemonSocketFile)); err == nil {
+		return fmt.Errorf("an agent is already running from %s (pid %d), stop it with: mt_agent stop", *dir, st.PID)
+	}
+	logPath := filepath.Join(*dir, daemonLogFile)
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer logFile.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the agent binary: %w", err)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	detach(cmd)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start agent: %w", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	deadline := time.After(*wait)
+	for {
+		select {
+		case <-exited:
+			return fmt.Errorf("agent exited: %s\n%s", cmd.ProcessState, tailFile(logPath, 10))
+		case <-deadline:
+			log.Printf("⚠ Agent running in the background (pid %d) but not connected yet, see mt_agent status and %s", cmd.Process.Pid, logPath)
+			return nil
+		case <-time.After(200 * time.Millisecond):
+		}
+		st, err := agent.QueryStatus(filepath.Join(*dir, daemonSocketFile))
+		if err != nil || (!st.Connected && cfg.PollInterval == 0) {
+			continue
+		}
+		log.Printf("✓ Agent running in the background (pid %d)", st.PID)
+		if st.TunnelURL != "" {
+			log.Printf("Tunnel URL: %s", st.TunnelURL)
+		}
+		log.Printf("Log: %s", logPath)
+		log.Printf("Stop it with: mt_agent stop")
+		return nil
+	}
+}
+
+// runDaemon runs the agent started by startCommand until it is stopped
+// through the control socket or by a signal
+func runDaemon(cfg *config.AgentConfig, dir string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	pidPath := filepath.Join(dir, daemonPIDFile)
+	if err := os.WriteFile(pidPath, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+		return fmt.Errorf("failed to write pid file: %w", err)
+	}
+	defer os.Remove(pidPath)
+
+	cfg.ControlSocket = filepath.Join(dir, daemonSocketFile)
+	log.Printf("Agent started in the background (pid %d)", os.Getpid())
+	err := agent.New(cfg).Run(ctx)
+	log.Printf("Agent stopped")
+	return err
+}
+
+// controlSocketFlags registers the flags choosing the control socket of
+// the agent to talk to, returning its path once they are parsed
+func controlSocketFlags(fs *flag.FlagSet) func() string {
+	dir := fs.String("dir", defaultDaemonDir(), "Directory the agent was started with by mt_agent start")
+	socket := fs.String("socket", "", "Control socket of an agent started with -control-socket, instead of -dir")
+	return func() string {
+		if *socket != "" {
+			return *socket
+		}
+		return filepath.Join(*dir, daemonSocketFile)
+	}
+}
+
+// stopCommand implements `mt_agent stop`, stopping a running agent and
+// waiting for it to finish its requests
+func stopCommand(args []string) error {
+	fs := flag.NewFlagSet("stop", flag.ExitOnError)
+	socketPath := controlSocketFlags(fs)
+	timeout := fs.Duration("timeout", 30*time.Second, "How long to wait for the agent to exit")
+	fs.Parse(args)
+	sockPath := socketPath()
+
+	// Only agents started by mt_agent start have a pid file
+	pidPath := filepath.Join(filepath.Dir(sockPath), daemonPIDFile)
+	pid := 0
+	if data, err := os.ReadFile(pidPath); err == nil {
+		pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	resp, err := agent.ControlClient(sockPath).Post("http://agent/stop", "", nil)
+	if err == nil {
+		resp.Body.Close()
+	} else {
+		// The control socket is gone but the process may not be
+		if pid <= 0 {
+			return fmt.Errorf("no agent running on %s", sockPath)
+		}
+		if !processAlive(pid) {
+			os.Remove(pidPath)
+			return fmt.Errorf("no agent running on %s (removed stale pid file)", sockPath)
+		}
+		if err := terminate(pid); err != nil {
+			return fmt.Errorf("failed to stop agent (pid %d): %w", pid, err)
+		}
+	}
+
+	// The agent closes its control socket and then removes its pid file
+	// last thing before exiting, unless it is killed first
+	deadline := time.Now().Add(*timeout)
+	for time.Now().Before(deadline) {
+		_, err := os.Stat(pidPath)
+		switch {
+		case pid > 0 && errors.Is(err, os.ErrNotExist):
+		case pid > 0 && !processAlive(pid):
+			os.Remove(pidPath)
+		case pid <= 0 && !controlAnswers(sockPath):
+		default:
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		log.Printf("✓ Agent stopped")
+		return nil
+	}
+	return fmt.Errorf("agent still running after %s", *timeout)
+}
+
+// controlAnswers reports whether an agent answers on the control socket
+func controlAnswers(path string) bool {
+	_, err := agent.QueryStatus(path)
+	return err == nil
+}
+
+// statusCommand implements `mt_agent status`, describing a running agent.
+// It fails if none is running, for scripts
+func statusCommand(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	socketPath := controlSocketFlags(fs)
+	asJSON := fs.Bool("json", false, "Print the status as JSON")
+	urlOnly := fs.Bool("url", false, "Print only the tunnel URL, failing if the agent hasn't connected yet")
+	fs.Parse(args)
+	sockPath := socketPath()
+
+	st, err := agent.QueryStatus(sockPath)
+	if err != nil {
+		return fmt.Errorf("no agent running on %s", sockPath)
+	}
+	switch {
+	case *asJSON:
+		return json.NewEncoder(os.Stdout).Encode(st)
+	case *urlOnly:
+		if st.TunnelURL == "" {
+			return fmt.Errorf("agent has not connected yet")
+		}
+		fmt.Println(st.TunnelURL)
+		return nil
+	}
+
+	fmt.Printf("Running (pid %d) for %s\n", st.PID, time.Since(st.Started).Round(time.Second))
+	switch {
+	case st.Connected:
+		fmt.Printf("Connected for %s\n", time.Since(st.Since).Round(time.Second))
+	case st.Since.IsZero():
+		fmt.Printf("Not connected yet\n")
+	default:
+		fmt.Printf("Disconnected for %s\n", time.Since(st.Since).Round(time.Second))
+	}
+	if st.TunnelURL != "" {
+		fmt.Printf("Tunnel URL: %s\n", st.TunnelURL)
+	}
+	fmt.Printf("Forwarding to: %s\n", st.LocalAddr)
+	fmt.Printf("Requests: %d (%d failed)\n", st.Requests, st.Failed)
+	if len(st.RecentErrors) > 0 {
+		fmt.Printf("Recent errors:\n")
+		for _, e := range st.RecentErrors {
+			fmt.Printf("  %s  %s\n", e.Time.Format("2006-01-02 15:04:05"), e.Error)
+		}
+	}
+	if logPath := filepath.Join(filepath.Dir(sockPath), daemonLogFile); fileExists(logPath) {
+		fmt.Printf("Log: %s\n", logPath)
+	}
+	return nil
+}
+
+// fileExists reports whether path exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// tailFile returns the last n lines of a file, for errors pointing at it
+func tailFile(path string, n int) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return string(bytes.Join(lines, []byte("\n")))
+}
@@ -0,0 +1,25 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// detach is a no-op on platforms without sessions
+func detach(cmd *exec.Cmd) {}
+
+// processAlive can't tell on these platforms, the control socket decides
+func processAlive(pid int) bool {
+	return false
+}
+
+// terminate kills the process
+func terminate(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
@@ -0,0 +1,25 @@
+//go:build unix
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// detach starts the command in a session of its own, so that it keeps
+// running after the terminal it was started from closes
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
+
+// processAlive reports whether a process with the pid exists
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// terminate asks the process to shut down
+func terminate(pid int) error {
+	return syscall.Kill(pid, syscall.SIGTERM)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+)
+
+// exportCommand implements `mt_agent export -har <file>`, fetching the
+// traffic recorded by a running agent's inspector
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	harFile := fs.String("har", "", "Write recorded traffic to this HAR file (- for stdout)")
+	inspectAddr := fs.String("inspect", "localhost:4040", "Inspector address of the running agent")
+	fs.Parse(args)
+
+	if *harFile == "" {
+		fs.Usage()
+		return fmt.Errorf("-har is required")
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/api/har", *inspectAddr))
+	if err != nil {
+		return fmt.Errorf("failed to reach inspector (is the agent running with -inspect %s?): %w", *inspectAddr, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("inspector returned %s", resp.Status)
+	}
+
+	var out io.Writer = os.Stdout
+	if *harFile != "-" {
+		f, err := os.Create(*harFile)
+		if err != nil {
+			return fmt.Errorf("failed to create HAR file: %w", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		return fmt.Errorf("failed to write HAR file: %w", err)
+	}
+	if *harFile != "-" {
+		log.Printf("✓ Wrote %s", *harFile)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+
+	"minitunnel/internal/config"
+	"minitunnel/pkg/agent"
+)
+
+// fileCommand implements `mt_agent file <dir> [flags]`, serving a local
+// directory through the tunnel from a file server on a loopback port
+func fileCommand(args []string) error {
+	cfg := &config.AgentConfig{}
+	flags := flag.NewFlagSet("file", flag.ExitOnError)
+	cfg.RegisterFlags(flags)
+	listing := flags.Bool("listing", false, "List the files of directories without an index.html")
+	spa := flags.Bool("spa", false, "Serve the top index.html for paths that don't exist, for single-page apps")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: mt_agent file <dir> [flags]\n")
+		flags.PrintDefaults()
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		flags.Usage()
+		return fmt.Errorf("directory is required")
+	}
+	dir := args[0]
+	flags.Parse(args[1:])
+
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer root.Close()
+	if *spa {
+		if _, err := fs.Stat(root.FS(), "index.html"); err != nil {
+			return fmt.Errorf("-spa needs an index.html in %s: %w", dir, err)
+		}
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("failed to start file server: %w", err)
+	}
+	defer ln.Close()
+	go http.Serve(ln, fileHandler(root.FS(), *listing, *spa))
+	cfg.LocalAddr = ln.Addr().String()
+
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	log.Printf("Serving files from %s", dir)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	return agent.New(cfg).Run(ctx)
+}
+
+// fileHandler serves the files of fsys. Hidden files, such as .git or .env,
+// are never served. Directories are served by their index.html, or listed
+// if listing is set. With spa, paths that don't exist get the top
+// index.html so that the app can route them itself
+func fileHandler(fsys fs.FS, listing, spa bool) http.Handler {
+	files := http.FileServerFS(fsys)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if name == "" {
+			name = "."
+		}
+		if hidden(name) {
+			http.NotFound(w, r)
+			return
+		}
+
+		info, err := fs.Stat(fsys, name)
+		switch {
+		case errors.Is(err, fs.ErrNotExist) && spa:
+			http.ServeFileFS(w, r, fsys, "index.html")
+			return
+		case err == nil && info.IsDir() && !listing:
+			if _, err := fs.Stat(fsys, path.Join(name, "index.html")); err != nil {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// hidden reports whether a slash-separated path has a dot file or
+// directory in it
+func hidden(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") && part != "." {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// setProcessGroup is a no-op on platforms without process groups
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup terminates the command
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	cmd.Process.Kill()
+}
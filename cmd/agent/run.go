@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"minitunnel/internal/config"
+	"minitunnel/pkg/agent"
+)
+
+// runCommand implements `mt_agent run [flags] -- <command>`: it starts the
+// local dev command, waits for it to listen on the local address, opens the
+// tunnel and tears both down together
+func runCommand(args []string) error {
+	cfg := &config.AgentConfig{}
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	cfg.RegisterFlags(fs)
+	waitTimeout := fs.Duration("wait", 60*time.Second, "How long to wait for the local service to start listening")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: mt_agent run [flags] -- <command> [args...]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	cmdArgs := fs.Args()
+	if len(cmdArgs) == 0 {
+		fs.Usage()
+		return fmt.Errorf("no command given")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	if cfg.JSONOutput || cfg.URLOnly {
+		// Keep stdout to the agent's output
+		cmd.Stdout = os.Stderr
+	}
+	cmd.Stderr = os.Stderr
+	setProcessGroup(cmd)
+
+	log.Printf("Starting %q...", cmdArgs)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start command: %w", err)
+	}
+
+	var waitErr error
+	exited := make(chan struct{})
+	go func() {
+		waitErr = cmd.Wait()
+		close(exited)
+	}()
+
+	// Make sure the child never outlives us
+	defer func() {
+		select {
+		case <-exited:
+		default:
+			killProcessGroup(cmd)
+			<-exited
+		}
+	}()
+
+	a := agent.New(cfg)
+	a.Watch(cmd.Process.Pid)
+
+	log.Printf("Waiting for %s to accept connections...", cfg.LocalAddr)
+	waitCtx, cancelWait := context.WithCancelCause(ctx)
+	defer cancelWait(nil)
+	go func() {
+		select {
+		case <-exited:
+			cancelWait(errCommandExited)
+		case <-waitCtx.Done():
+		}
+	}()
+	waitCtx, cancelTimeout := context.WithTimeoutCause(waitCtx, *waitTimeout, fmt.Errorf("timed out after %s waiting for %s", *waitTimeout, cfg.LocalAddr))
+	defer cancelTimeout()
+	if err := a.WaitForLocal(waitCtx); err != nil {
+		if errors.Is(err, errCommandExited) {
+			return fmt.Errorf("command exited before %s was listening: %s", cfg.LocalAddr, cmd.ProcessState)
+		}
+		return err
+	}
+
+	agentCtx, cancelAgent := context.WithCancel(ctx)
+	defer cancelAgent()
+
+	agentDone := make(chan error, 1)
+	go func() {
+		agentDone <- a.Run(agentCtx)
+	}()
+
+	select {
+	case <-exited:
+		cancelAgent()
+		<-agentDone
+		if waitErr != nil {
+			return fmt.Errorf("command exited: %w", waitErr)
+		}
+		log.Printf("Command exited, tunnel closed")
+		return nil
+	case err := <-agentDone:
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			log.Printf("Shutting down...")
+		}
+		return nil
+	}
+}
+
+var errCommandExited = errors.New("command exited")
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"minitunnel/pkg/agent"
+)
+
+// statsCommand implements `mt_agent stats [-follow]`, showing the protocol
+// statistics of a running agent through its inspector
+func statsCommand(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	follow := fs.Bool("follow", false, "Print per-second statistics until interrupted")
+	inspectAddr := fs.String("inspect", "localhost:4040", "Inspector address of the running agent")
+	fs.Parse(args)
+
+	path := "/api/stats"
+	if *follow {
+		path = "/api/stats/follow"
+	}
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", *inspectAddr, path))
+	if err != nil {
+		return fmt.Errorf("failed to reach inspector (is the agent running with -inspect %s?): %w", *inspectAddr, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("inspector returned %s", resp.Status)
+	}
+
+	if !*follow {
+		var stats agent.ProtocolStats
+		if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+			return fmt.Errorf("failed to parse statistics: %w", err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "Messages\t%d in\t%d out\n", stats.MessagesIn, stats.MessagesOut)
+		fmt.Fprintf(tw, "Bytes\t%s in\t%s out\n", formatBytes(int64(stats.BytesIn)), formatBytes(int64(stats.BytesOut)))
+		fmt.Fprintf(tw, "Packets\t%d in\t%d out\t%d lost\n", stats.PacketsIn, stats.PacketsOut, stats.PacketsLost)
+		fmt.Fprintf(tw, "RTT\t%.1f ms\n", stats.RTTMs)
+		fmt.Fprintf(tw, "Congestion window\t%s\t%s in flight\n", formatBytes(stats.CongestionWindow), formatBytes(stats.BytesInFlight))
+		fmt.Fprintf(tw, "Streams\t%d\n", stats.Streams)
+		fmt.Fprintf(tw, "Requests\t%d in flight\t%d messages queued\n", stats.Requests, stats.WriteQueue)
+		return tw.Flush()
+	}
+
+	const header = "TIME      MSG IN  MSG OUT  BYTES IN     BYTES OUT    PKT IN  PKT OUT  LOST  RTT      CWND       STREAMS  REQS  QUEUE"
+	scanner := bufio.NewScanner(resp.Body)
+	for lines := 0; scanner.Scan(); {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var s agent.ProtocolStats
+		if err := json.Unmarshal([]byte(data), &s); err != nil {
+			return fmt.Errorf("failed to parse statistics: %w", err)
+		}
+		// Repeat the header so it stays in view, like vmstat
+		if lines%20 == 0 {
+			fmt.Println(header)
+		}
+		lines++
+		fmt.Printf("%-8s  %6d  %7d  %-11s  %-11s  %6d  %7d  %4d  %-7s  %-9s  %7d  %4d  %5d\n",
+			s.Time.Format("15:04:05"), s.MessagesIn, s.MessagesOut,
+			formatBytes(int64(s.BytesIn))+"/s", formatBytes(int64(s.BytesOut))+"/s",
+			s.PacketsIn, s.PacketsOut, s.PacketsLost, fmt.Sprintf("%.1fms", s.RTTMs),
+			formatBytes(s.CongestionWindow), s.Streams, s.Requests, s.WriteQueue)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("statistics stream failed: %w", err)
+	}
+	return fmt.Errorf("agent stopped")
+}
+
+// formatBytes renders a byte count with a binary unit suffix
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
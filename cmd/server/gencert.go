@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"minitunnel/internal/certs"
+	"minitunnel/internal/config"
+	"minitunnel/pkg/server"
+)
+
+// genCertCommand implements `mt_server gen-cert [flags]`: it creates a
+// self-signed certificate and key for the server, without openssl
+func genCertCommand(args []string) error {
+	fs := flag.NewFlagSet("gen-cert", flag.ExitOnError)
+	certFile := fs.String("cert", config.DefaultCertFile, "Certificate file to write")
+	keyFile := fs.String("key", config.DefaultKeyFile, "Key file to write")
+	var hosts config.StringList
+	fs.Var(&hosts, "host", "Host name or IP address the certificate is for, repeatable (default: localhost, loopback addresses and this host's name)")
+	validity := fs.Duration("valid", server.SelfSignedValidity, "How long the certificate is valid")
+	force := fs.Bool("force", false, "Overwrite existing files")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s gen-cert [flags]\n\nCreate a self-signed TLS certificate for the server.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if len(hosts) == 0 {
+		hosts = certs.LocalHosts()
+	}
+	if !*force {
+		for _, path := range []string{*certFile, *keyFile} {
+			if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("%s already exists, use -force to overwrite it", path)
+			}
+		}
+	}
+	cert, err := certs.WriteSelfSigned(*certFile, *keyFile, hosts, *validity)
+	if err != nil {
+		return err
+	}
+	log.Printf("✓ Wrote %s and %s for %s, valid until %s", *certFile, *keyFile, strings.Join(hosts, ", "), cert.NotAfter.Format(time.DateOnly))
+	log.Printf("Agents can trust it with -ca %s or -pin-sha256 %s", *certFile, certs.PinSHA256(cert))
+	return nil
+}
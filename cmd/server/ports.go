@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"text/tabwriter"
+
+	"minitunnel/internal/config"
+	"minitunnel/pkg/server"
+)
+
+// portsCommand implements `mt_server ports [flags]`: it prints the ports
+// the server would open with the given flags and suggested firewall rules
+func portsCommand(args []string) error {
+	fs := flag.NewFlagSet("ports", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s ports [server flags]\n\nShow which ports to open for the given server flags.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	cfg := &config.ServerConfig{}
+	cfg.RegisterFlags(fs)
+	fs.Parse(args)
+	cfg.ApplyDefaults()
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	ls := server.Ports(cfg)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROLE\tADDRESS\tPROTOCOL\tREACHABLE BY")
+	for _, l := range ls {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", l.Role, l.Addr, l.Proto, l.Audience)
+	}
+	tw.Flush()
+
+	if err := server.CheckPorts(cfg); err != nil {
+		fmt.Printf("\nWarning: %v\n", err)
+	}
+
+	fmt.Println("\nFirewall rules (ufw):")
+	for _, l := range ls {
+		host, port, _ := net.SplitHostPort(l.Addr)
+		if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+			fmt.Printf("  # %s listens on loopback only, no rule needed\n", l.Role)
+		} else if l.Public {
+			fmt.Printf("  ufw allow %s/%s   # %s\n", port, l.Proto, l.Role)
+		} else {
+			fmt.Printf("  ufw allow from <trusted-network> to any port %s proto %s   # %s\n", port, l.Proto, l.Role)
+		}
+	}
+	return nil
+}
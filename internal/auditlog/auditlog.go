@@ -0,0 +1,142 @@
+// Package auditlog records administrative and security events, one JSON
+// object per line, for operators running a server for several users. The
+// file is only appended to, and rotated when it grows too large
+package auditlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	AgentConnected    = "agent_connected"
+	AgentDisconnected = "agent_disconnected"
+	AgentRejected     = "agent_rejected"      // Turned away at the hello, see Event.Reason
+	AdminAction       = "admin_action"        // A change made through the admin API
+	AdminAuthFailed   = "admin_auth_failed"   // Admin API request without the right token
+	ClusterAuthFailed = "cluster_auth_failed" // Cluster request without the right secret
+	VisitorAuthFailed = "visitor_auth_failed" // Wrong credentials for a tunnel with a password
+	AccessDenied      = "access_denied"       // Visitor refused by IP rules, login or the embedder's Authorizer
+)
+
+// Event describes something that happened. Only Time and Type are always
+// set
+type Event struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	Tunnel     string    `json:"tunnel,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Identity   string    `json:"identity,omitempty"` // Agent client certificate name, or visitor login
+	Method     string    `json:"method,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	Status     int       `json:"status,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// Logger appends events to a file. A nil Logger discards them
+type Logger struct {
+	mu         sync.Mutex
+	path       string
+	f          *os.File
+	size       int64
+	maxSize    int64 // Rotate when the file would grow past it, 0 for never
+	maxBackups int   // Rotated files kept as path.1 (newest) to path.<n>, at least 1
+}
+
+// Open creates a logger appending to path. When the file reaches maxSize
+// bytes it is renamed to path.1, older ones shifting to path.2 and so on,
+// and at most maxBackups of them are kept
+func Open(path string, maxSize int64, maxBackups int) (*Logger, error) {
+	l := &Logger{path: path, maxSize: maxSize, maxBackups: max(maxBackups, 1)}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the file at l.path for appending
+func (l *Logger) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+// Log appends an event, stamped with the current time if it has none
+func (l *Logger) Log(e Event) {
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Error encoding audit event: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			log.Printf("Error rotating audit log: %v", err)
+			// Keep appending to the file that couldn't be moved
+			if err := l.open(); err != nil {
+				log.Printf("Error reopening audit log: %v", err)
+				return
+			}
+		}
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+}
+
+// rotate moves the file to path.1, shifting older backups up and dropping
+// the oldest, then starts a new file. Callers hold l.mu
+func (l *Logger) rotate() error {
+	l.f.Close()
+	l.f = nil
+	os.Remove(fmt.Sprintf("%s.%d", l.path, l.maxBackups))
+	for i := l.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Close closes the file
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
@@ -0,0 +1,200 @@
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	caCertFile = "rootCA.pem"
+	caKeyFile  = "rootCA-key.pem"
+)
+
+// CA is a local certificate authority used to issue development certificates
+type CA struct {
+	Cert     *x509.Certificate
+	Key      crypto.Signer
+	CertFile string // Path of the PEM encoded CA certificate
+}
+
+// LoadOrCreateCA loads the local CA from dir, creating it on first use
+func LoadOrCreateCA(dir string) (*CA, error) {
+	certPath := filepath.Join(dir, caCertFile)
+	keyPath := filepath.Join(dir, caKeyFile)
+
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil {
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+		}
+		key, ok := pair.PrivateKey.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported CA key type %T", pair.PrivateKey)
+		}
+		return &CA{Cert: cert, Key: key, CertFile: certPath}, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to load CA: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate CA key: %w", err)
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject: pkix.Name{
+			Organization: []string{"Minitunnel development CA"},
+			CommonName:   "Minitunnel CA " + hostname,
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create CA directory: %w", err)
+	}
+	if err := WritePEM(certPath, keyPath, der, key); err != nil {
+		return nil, err
+	}
+	return &CA{Cert: cert, Key: key, CertFile: certPath}, nil
+}
+
+// Issue creates a leaf certificate for the given host names and IP
+// addresses, signed by the CA
+func (ca *CA) Issue(hosts []string, validity time.Duration) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate key: %w", err)
+	}
+	template := leafTemplate(hosts, validity)
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, key.Public(), ca.Key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der, ca.Cert.Raw},
+		PrivateKey:  key,
+	}, nil
+}
+
+// WriteSelfSigned creates a self-signed server certificate for the given
+// host names and IP addresses and writes it and its key as PEM files,
+// creating their directories as needed
+func WriteSelfSigned(certPath, keyPath string, hosts []string, validity time.Duration) (*x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	template := leafTemplate(hosts, validity)
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	for _, path := range []string{certPath, keyPath} {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create certificate directory: %w", err)
+		}
+	}
+	return cert, WritePEM(certPath, keyPath, der, key)
+}
+
+// PinSHA256 returns the public key pin of a certificate: the base64
+// SHA-256 digest of its SubjectPublicKeyInfo, as agents take it with
+// -pin-sha256. It stays the same when a certificate is renewed with the
+// same key
+func PinSHA256(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// LocalHosts returns the names a server on this machine is reached by
+// during development: localhost, the loopback addresses and the host name
+func LocalHosts() []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" && hostname != "localhost" {
+		hosts = append(hosts, hostname)
+	}
+	return hosts
+}
+
+// WritePEM writes a DER certificate and its private key as PEM files
+func WritePEM(certPath, keyPath string, der []byte, key crypto.Signer) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode private key: %w", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certPath, certPEM, 0o644); err != nil {
+		return fmt.Errorf("failed to write certificate: %w", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+		return fmt.Errorf("failed to write private key: %w", err)
+	}
+	return nil
+}
+
+// leafTemplate returns a server certificate template covering hosts
+func leafTemplate(hosts []string, validity time.Duration) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject: pkix.Name{
+			Organization: []string{"Minitunnel"},
+			CommonName:   hosts[0],
+		},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	return template
+}
+
+func randomSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		panic(fmt.Sprintf("failed to generate serial number: %v", err))
+	}
+	return serial
+}
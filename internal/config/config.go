@@ -1,52 +1,791 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"flag"
 	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"minitunnel/internal/httpheader"
+	"minitunnel/internal/ipfilter"
+	"minitunnel/internal/protocol"
+	"minitunnel/internal/quicconf"
+	"minitunnel/internal/tlspolicy"
+	"minitunnel/pkg/e2e"
 )
 
 // ServerConfig holds server configuration
 type ServerConfig struct {
-	Port     int
-	CertFile string
-	KeyFile  string
+	Port               int
+	AdminPort          int
+	ControlAddr        string // QUIC listener for agents, default :Port
+	HTTPAddr           string // Public HTTP listener for visitors, default :Port+1
+	HTTP3Addr          string // Public HTTP/3 listener for visitors over QUIC/UDP, disabled if empty
+	SinglePort         bool   // Visitors share ControlAddr over HTTP/3 and its port over HTTPS, told apart by ALPN
+	AdminAddr          string // Admin API and dashboard, default :AdminPort
+	MetricsAddr        string // Prometheus metrics, disabled if empty
+	PassthroughAddr    string // TLS listener passing connections through to agents by SNI, disabled if empty
+	PassthroughDomain  string // Connections for <name>.PassthroughDomain go to the tunnel name
+	AdminToken         string // Bearer token required by the admin API
+	DebugEndpoints     bool   // Serve pprof and expvar on the admin listener
+	CertFile           string
+	KeyFile            string
+	ClientCA           string           // CA bundle for agent certificates, required by the server if set
+	MaxTunnelLifetime  time.Duration    // Zero means tunnels never expire
+	Notice             string           // Announcement sent to agents as a welcome warning
+	HeartbeatTimeout   time.Duration    // Disconnect agents that are silent for this long
+	AccessLog          string           // Access log file, "-" for stdout, empty to disable
+	AuditLog           string           // JSON lines file of agent, admin and access events, empty to disable
+	AuditLogMaxSize    int64            // Rotate the audit log past this many bytes (0 = never)
+	AuditLogMaxBackups int              // Rotated audit logs kept
+	InspectRequests    int              // Recent requests kept per tunnel for the admin API (0 = none)
+	InspectBodyBytes   int              // Bytes of each body kept with them (0 = none)
+	OTLPEndpoint       string           // OpenTelemetry collector URL to export traces to over OTLP/HTTP, disabled if empty
+	TrustForwarded     bool             // Keep X-Forwarded-* headers sent by a proxy in front of the server
+	RequestHeaders     httpheader.Rules // Applied to requests sent to agents
+	ResponseHeaders    httpheader.Rules // Applied to responses sent to visitors
+	RequestTimeout     time.Duration    // How long to wait for the agent's response (0 = no limit)
+	MaxConcurrent      int              // Requests in flight per tunnel (0 = no limit)
+	QueueSize          int              // Requests waiting for a slot per tunnel before 503s
+	QueueTimeout       time.Duration    // How long a request waits for a slot before a 503
+	InboxMaxRequests   int              // Webhooks buffered per offline tunnel (0 = no inboxes)
+	InboxMaxBytes      int64            // Body bytes buffered per offline tunnel
+	InboxTTL           time.Duration    // How long buffered webhooks and inboxes of offline tunnels are kept
+	ReconnectGrace     time.Duration    // How long visitors of a named tunnel wait for its agent to reconnect (0 = not at all)
+	Balance            string           // How requests are spread over agents sharing a name, see Balance*
+	StickySessions     bool             // Keep visitors of a shared tunnel on one agent with a cookie
+	StatusPage         bool             // Serve StatusPagePath under every tunnel
+	ErrorPages         string           // Directory of HTML templates for tunnel errors, see pkg/server/errorpages.go
+	State              string           // JSON file keeping reservations and tunnel usage across restarts, empty for memory
+	RequireSigning     bool             // Refuse agents that don't sign their messages, see protocol.CapSigning
+	ZeroRTT            bool             // Accept hellos sent with 0-RTT by agents resuming a session
+	MaxHeaderBytes     int              // Largest request header block accepted from visitors
+	MaxRequestBody     int64            // Largest request body accepted from visitors
+	MaxResponseBody    int64            // Largest response body accepted from agents
+	URLTemplate        string           // Public tunnel URL, see TunnelURL
+	MaxMessageSize     int64            // Largest protocol message or frame accepted from agents
+	MaxReassembledSize int64            // Largest message accepted from agents in continuation frames
+	OAuthIssuer        string           // OIDC issuer for visitor login, or "github"; empty disables it
+	OAuthClientID      string
+	OAuthClientSecret  string
+	OAuthRedirectURL   string     // Public URL of the login callback, see OAuthCallbackPath
+	SessionSecret      string     // Key signing visitor session and affinity cookies, random if empty
+	AllowIP            StringList // Visitor CIDRs allowed into every tunnel, all if empty
+	DenyIP             StringList // Visitor CIDRs kept out of every tunnel
+	ClusterPeers       StringList // Admin URLs of the other servers of a cluster
+	ClusterSecret      string     // Shared by the servers of a cluster, required with ClusterPeers
+	TLS                tlspolicy.Policy
+	QUIC               quicconf.Options
 }
 
 // AgentConfig holds agent configuration
 type AgentConfig struct {
-	ServerAddr string
-	LocalAddr  string
-	Insecure   bool // Skip TLS verification for self-signed certs
+	ServerAddr         string
+	LocalAddr          string
+	Insecure           bool   // Skip TLS verification of the server, for testing only
+	CertFile           string // Client certificate for servers that require one, with KeyFile
+	KeyFile            string
+	CAFile             string           // PEM bundle of CAs trusted for the server, instead of the system roots
+	ServerName         string           // Name checked in the server certificate and sent in SNI, the -server host if empty
+	PinSHA256          StringList       // Public key pins of the server certificate, see certs.PinSHA256
+	Follow             string           // "", "auto" or a port range like "3000-3010"
+	InspectAddr        string           // Address of the local request inspector, empty to disable
+	ControlSocket      string           // Unix socket serving the agent's status and stopping it, disabled if empty
+	JSONOutput         bool             // Print lifecycle events to stdout as JSON lines
+	URLOnly            bool             // Print only the tunnel URL to stdout
+	HTTPSAddr          string           // Address to serve the local service over HTTPS, empty to disable
+	TLSLocal           string           // Local TLS service the server's passed-through connections go to, disabled if empty
+	UserAgent          string           // Sent to the server in the hello message, defaults to minitunnel-agent/<version>
+	Labels             Labels           // Free-form key=value labels identifying the tunnel to operators
+	DrainTimeout       time.Duration    // How long to wait for in-flight requests on shutdown
+	Name               string           // Requested tunnel name, random if empty
+	PollInterval       time.Duration    // Connect only when woken, checking this often (0 = stay connected)
+	Reconnect          bool             // Connect again when the connection is lost instead of exiting
+	IdleTimeout        time.Duration    // In polling mode, disconnect after this long without requests
+	Standby            bool             // Register as hot standby for the tunnel named Name
+	AccessLog          string           // Access log file, "-" for stdout, empty to disable
+	OTLPEndpoint       string           // OpenTelemetry collector URL to export traces to over OTLP/HTTP, disabled if empty
+	Tunnels            Tunnels          // Further named tunnels served by this agent, name to local address
+	Routes             Routes           // Path prefixes of the tunnel forwarded to other local addresses
+	RequestHeaders     httpheader.Rules // Applied to requests sent to the local service
+	ResponseHeaders    httpheader.Rules // Applied to responses sent to the server
+	HostHeader         string           // Host sent to the local service, see HostHeader*
+	ChaosLatency       string           // Delay added to requests, a duration or a range like 100ms-500ms, see ParseLatency
+	ChaosErrorRate     float64          // Percent of requests answered with a random 5xx
+	ChaosDropRate      float64          // Percent of requests cut off without a response
+	Record             string           // File requests and responses are appended to, see Replay
+	Replay             string           // File of recorded responses served instead of the local service
+	Mirror             string           // Second local address sent a copy of requests to LocalAddr, disabled if empty
+	MirrorPercent      float64          // Share of requests mirrored, in percent
+	LocalTimeout       time.Duration    // How long to wait for the local service, shortened by the server's deadline
+	LocalMaxIdle       int              // Idle connections kept for reuse per local address (0 = a connection per request)
+	LocalHTTP2         bool             // Speak cleartext HTTP/2 to local services instead of HTTP/1.1
+	LocalRetries       int              // Times a request is tried again when the local service can't be reached
+	LocalRetryBackoff  time.Duration    // Wait before the first retry, doubled for each next one
+	IdempotentOnly     bool             // Retry only idempotent requests, see LocalRetries
+	CircuitBreaker     int              // Failed requests in a row after which the local service is left alone (0 = never)
+	BreakerCooldown    time.Duration    // How long the local service is left alone before a request tries it again
+	HealthCheck        string           // Path of the local service to probe for health, disabled if empty
+	HealthInterval     time.Duration    // How often to probe HealthCheck
+	Hosts              Hosts            // Static host name to IP mappings for local addresses
+	Resolver           string           // DNS server for local addresses (host:port), system resolver if empty
+	PreferIP           string           // "ipv4", "ipv6" or "" to try local addresses in the resolver's order
+	MaxRequestBody     int64            // Largest request body forwarded to the local service
+	MaxResponseBody    int64            // Largest response body read from the local service
+	Compression        string           // Body compression to offer the server: "none", "gzip" or "zstd"
+	Plugins            StringList       // Built-in plugins applied to forwarded traffic, name or name=argument
+	Replace            Replacements     // Substitutions in the bodies of responses of ReplaceTypes
+	ReplaceTypes       StringList       // Media types, or type/*, whose bodies Replace applies to
+	MaxMessageSize     int64            // Largest protocol message or frame accepted from the server
+	MaxReassembledSize int64            // Largest message accepted from the server in continuation frames
+	BasicAuth          string           // "user:password" visitors must log in with, empty for a public tunnel
+	OAuth              bool             // Visitors must log in with the server's OAuth issuer
+	OAuthAllow         StringList       // Visitors allowed in: emails, @domains or GitHub logins; anyone logged in if empty
+	AllowIP            StringList       // Visitor CIDRs allowed into the tunnel, all if empty
+	CORS               bool             // Have the server answer CORS preflights and add CORS headers
+	CORSOrigins        StringList       // Origins CORS lets in, any if empty
+	CORSCredentials    bool             // Let CORS requests carry cookies and credentials
+	DenyIP             StringList       // Visitor CIDRs kept out of the tunnel
+	MaxConcurrent      int              // Requests the local service can take at once, asked of the server (0 = server's limit)
+	Inbox              StringList       // Path prefixes whose POSTs the server buffers while the agent is offline
+	Balance            bool             // Share the tunnel named Name with other agents that set Balance
+	StatusPage         bool             // Let the server show StatusPagePath for this tunnel
+	OfflinePage        string           // HTML file the server shows while the agent is disconnected
+	RewriteCookies     bool             // Let the server fit Set-Cookie Domain and Path to the public URL
+	Takeover           bool             // Replace a running agent holding Name instead of taking a random name
+	TakeoverSecret     string           // Shared by agents that may take over from each other
+	Token              string           // For the names reserved to it on the server
+	Sign               bool             // Sign every message with a key derived from Token, see protocol.CapSigning
+	E2EKey             string           // Key sealing response bodies for visitors' clients, see e2e.ParseKey
+	ZeroRTT            bool             // Resume sessions with the server and send the hello with 0-RTT
+	SessionFile        string           // File keeping session tickets across restarts, memory only if empty
+	TLS                tlspolicy.Policy
+	QUIC               quicconf.Options
+}
+
+// Labels is a set of key=value pairs that can be given as a repeatable flag
+type Labels map[string]string
+
+func (l *Labels) String() string {
+	if l == nil || *l == nil {
+		return ""
+	}
+	pairs := make([]string, 0, len(*l))
+	for k, v := range *l {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (l *Labels) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("label must be key=value, got %q", value)
+	}
+	if *l == nil {
+		*l = make(Labels)
+	}
+	(*l)[key] = val
+	return nil
+}
+
+// StringList collects the values of a repeatable flag
+type StringList []string
+
+func (l *StringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *StringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Tunnels maps tunnel names to local addresses, given as a repeatable
+// name=host:port flag
+type Tunnels map[string]string
+
+func (t *Tunnels) String() string {
+	if t == nil {
+		return ""
+	}
+	return (*Labels)(t).String()
+}
+
+func (t *Tunnels) Set(value string) error {
+	name, addr, ok := strings.Cut(value, "=")
+	if !ok || name == "" || addr == "" {
+		return fmt.Errorf("tunnel must be name=host:port, got %q", value)
+	}
+	return (*Labels)(t).Set(value)
+}
+
+// Route forwards the requests under a path prefix to another local address
+type Route struct {
+	Prefix string // Public path prefix without a trailing slash, e.g. /api, or /
+	Addr   string // Local host:port
+	Path   string // Replaces Prefix in the forwarded path if set, "/" to strip it
+}
+
+// Routes are given as a repeatable prefix=host:port[/path] flag
+type Routes []Route
+
+func (r *Routes) String() string {
+	if r == nil {
+		return ""
+	}
+	specs := make([]string, len(*r))
+	for i, route := range *r {
+		specs[i] = route.Prefix + "=" + route.Addr + route.Path
+	}
+	return strings.Join(specs, ",")
+}
+
+func (r *Routes) Set(value string) error {
+	prefix, target, ok := strings.Cut(value, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") || target == "" {
+		return fmt.Errorf("route must be /prefix=host:port[/path], got %q", value)
+	}
+	if strings.ContainsAny(prefix, "?#") {
+		return fmt.Errorf("route prefix %q must be a plain path", prefix)
+	}
+	if prefix != "/" {
+		prefix = strings.TrimSuffix(prefix, "/")
+	}
+	addr, path := target, ""
+	if i := strings.Index(target, "/"); i >= 0 {
+		addr, path = target[:i], target[i:]
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("invalid route address %q: %w", addr, err)
+	}
+	for _, route := range *r {
+		if route.Prefix == prefix {
+			return fmt.Errorf("route for %s given twice", prefix)
+		}
+	}
+	*r = append(*r, Route{Prefix: prefix, Addr: addr, Path: path})
+	return nil
+}
+
+// Replacement substitutes text in response bodies
+type Replacement struct {
+	Find    string         // Literal text, or the pattern of Regexp
+	Regexp  *regexp.Regexp // Set for re: replacements
+	Replace string         // May expand $1... with Regexp
+}
+
+// Replacements are given as a repeatable find=>replacement or
+// re:pattern=>replacement flag
+type Replacements []Replacement
+
+// DefaultReplaceTypes are the media types -replace applies to by default
+var DefaultReplaceTypes = []string{"text/*", "application/javascript", "application/json", "application/xml", "image/svg+xml"}
+
+func (r *Replacements) String() string {
+	if r == nil {
+		return ""
+	}
+	specs := make([]string, len(*r))
+	for i, rep := range *r {
+		specs[i] = rep.Find + "=>" + rep.Replace
+		if rep.Regexp != nil {
+			specs[i] = "re:" + specs[i]
+		}
+	}
+	return strings.Join(specs, ",")
+}
+
+func (r *Replacements) Set(value string) error {
+	find, replace, ok := strings.Cut(value, "=>")
+	if !ok || find == "" || find == "re:" {
+		return fmt.Errorf("replacement must be find=>replacement or re:pattern=>replacement, got %q", value)
+	}
+	rep := Replacement{Find: find, Replace: replace}
+	if pattern, isRegexp := strings.CutPrefix(find, "re:"); isRegexp {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid replacement pattern %q: %w", pattern, err)
+		}
+		rep.Find, rep.Regexp = pattern, re
+	}
+	*r = append(*r, rep)
+	return nil
+}
+
+// Hosts maps host names to IP addresses, given as a repeatable name=ip flag
+type Hosts map[string]string
+
+func (h *Hosts) String() string {
+	if h == nil {
+		return ""
+	}
+	return (*Labels)(h).String()
+}
+
+func (h *Hosts) Set(value string) error {
+	name, ip, ok := strings.Cut(value, "=")
+	if !ok || name == "" || net.ParseIP(ip) == nil {
+		return fmt.Errorf("host must be name=ip, got %q", value)
+	}
+	return (*Labels)(h).Set(value)
 }
 
 // ParseServerConfig parses server configuration from command line flags
 func ParseServerConfig() *ServerConfig {
 	cfg := &ServerConfig{}
-	flag.IntVar(&cfg.Port, "port", 8080, "Port to listen on")
-	flag.StringVar(&cfg.CertFile, "cert", "certs/server.crt", "TLS certificate file")
-	flag.StringVar(&cfg.KeyFile, "key", "certs/server.key", "TLS key file")
+	cfg.RegisterFlags(flag.CommandLine)
 	flag.Parse()
+	cfg.ApplyDefaults()
 	return cfg
 }
 
+// RegisterFlags registers the server flags on the given flag set so that
+// subcommands can share them
+func (c *ServerConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.IntVar(&c.Port, "port", 8080, "Port to listen on")
+	fs.IntVar(&c.AdminPort, "admin-port", 0, "Port for the admin API (default: port+2)")
+	fs.StringVar(&c.ControlAddr, "control-addr", "", "Address for agent connections over QUIC/UDP (default: :port)")
+	fs.StringVar(&c.HTTPAddr, "http-addr", "", "Address for public HTTP traffic (default: :port+1)")
+	fs.StringVar(&c.HTTP3Addr, "http3-addr", "", "Also serve visitors over HTTP/3 on this UDP address with the -cert certificate, advertised with Alt-Svc (e.g. :443; disabled if empty)")
+	fs.BoolVar(&c.SinglePort, "single-port", false, "Serve agents, HTTPS and HTTP/3 visitors all on -port (TCP and UDP), told apart by ALPN, e.g. -port 443")
+	fs.StringVar(&c.AdminAddr, "admin-addr", "", "Address for the admin API and dashboard (default: :admin-port)")
+	fs.StringVar(&c.MetricsAddr, "metrics-addr", "", "Address for Prometheus metrics (disabled if empty)")
+	fs.StringVar(&c.PassthroughAddr, "tls-passthrough-addr", "", "Pass TLS connections on this address through to agents started with -tls-local, routed by SNI without decrypting them (e.g. :443; disabled if empty, requires -tls-passthrough-domain)")
+	fs.StringVar(&c.PassthroughDomain, "tls-passthrough-domain", "", "Domain of passed-through tunnels: connections for <name>.<domain> go to the tunnel name")
+	fs.StringVar(&c.AdminToken, "admin-token", "", "Bearer token for the admin API (generated if empty)")
+	fs.BoolVar(&c.DebugEndpoints, "debug-endpoints", false, "Serve Go's pprof profiles at /debug/pprof/ and expvar at /debug/vars on the admin listener, behind the admin token")
+	fs.StringVar(&c.CertFile, "cert", DefaultCertFile, "TLS certificate file (a self-signed one is created on first run if the default is missing)")
+	fs.StringVar(&c.KeyFile, "key", DefaultKeyFile, "TLS key file")
+	fs.StringVar(&c.ClientCA, "client-ca", "", "Require agent certificates signed by a CA in this PEM file; agents are named after their certificate")
+	fs.DurationVar(&c.MaxTunnelLifetime, "max-tunnel-lifetime", 0, "Disconnect tunnels after this long (0 = never)")
+	fs.DurationVar(&c.HeartbeatTimeout, "heartbeat-timeout", 90*time.Second, "Disconnect agents that send no heartbeat for this long")
+	fs.StringVar(&c.AccessLog, "access-log", "", "Write an access log in Combined Log Format to this file (\"-\" for stdout)")
+	fs.StringVar(&c.AuditLog, "audit-log", "", "Append agent connections, auth failures, admin API changes and refused visitors to this file as JSON lines (disabled if empty)")
+	fs.Int64Var(&c.AuditLogMaxSize, "audit-log-max-size", 100<<20, "Rotate the audit log when it reaches this many bytes (0 = never)")
+	fs.IntVar(&c.AuditLogMaxBackups, "audit-log-max-backups", 5, "Rotated audit logs to keep as <file>.1 (newest) to <file>.<n>")
+	fs.IntVar(&c.InspectRequests, "inspect-requests", 0, "Keep this many recent requests of each tunnel, with headers, for GET /api/tunnels/{id}/requests (0 = none)")
+	fs.IntVar(&c.InspectBodyBytes, "inspect-body-bytes", 0, "Also keep the first bytes of each request and response body of inspected requests (0 = no bodies)")
+	fs.StringVar(&c.OTLPEndpoint, "otlp-endpoint", "", "Export OpenTelemetry traces over OTLP/HTTP to this collector (e.g. http://localhost:4318; disabled if empty)")
+	fs.DurationVar(&c.RequestTimeout, "request-timeout", 60*time.Second, "Answer 504 if the agent hasn't responded after this long (0 = no limit)")
+	fs.IntVar(&c.MaxConcurrent, "max-concurrent", 0, "Requests each tunnel may have in flight, more wait in a queue (0 = no limit)")
+	fs.IntVar(&c.QueueSize, "queue-size", 100, "Requests waiting per tunnel when -max-concurrent is reached, more get 503")
+	fs.DurationVar(&c.QueueTimeout, "queue-timeout", 10*time.Second, "Answer 503 to requests that waited this long in the queue")
+	fs.BoolVar(&c.StatusPage, "status-page", true, "Serve a status page at "+StatusPagePath+" under every tunnel, for visitors telling tunnel from app problems")
+	fs.StringVar(&c.State, "state", "", "JSON file keeping tunnel reservations and usage across restarts (created if missing, default: memory only)")
+	fs.BoolVar(&c.RequireSigning, "require-signing", false, "Only accept agents that sign every message with their reserved -token (mt_agent -sign), for when a proxy in front of the server terminates TLS")
+	fs.BoolVar(&c.ZeroRTT, "0rtt", true, "Let agents resuming a session send their hello with 0-RTT, saving a round trip on reconnects (-0rtt=false to require a full handshake first)")
+	fs.StringVar(&c.ErrorPages, "error-pages", "", "Directory of HTML templates for tunnel errors, named after the status (502.html) or error.html for any")
+	fs.StringVar(&c.Balance, "balance", BalanceRoundRobin, "How requests are spread over agents sharing a tunnel name: round-robin or least-connections")
+	fs.BoolVar(&c.StickySessions, "sticky-sessions", false, "Keep each visitor of a tunnel shared with -balance on the same agent, using a signed cookie")
+	fs.IntVar(&c.InboxMaxRequests, "inbox-max-requests", 100, "Webhooks buffered per offline tunnel that asked for an inbox (0 = no inboxes)")
+	fs.Int64Var(&c.InboxMaxBytes, "inbox-max-bytes", 10<<20, "Body bytes buffered per offline tunnel, more webhooks get 503")
+	fs.DurationVar(&c.InboxTTL, "inbox-ttl", 24*time.Hour, "Drop buffered webhooks, and the inboxes of tunnels offline, after this long")
+	fs.DurationVar(&c.ReconnectGrace, "reconnect-grace", 0, "Hold requests to a named tunnel this long after its agent disconnects, forwarding them if it reconnects in time (0 = fail them at once)")
+	fs.IntVar(&c.MaxHeaderBytes, "max-header-bytes", 64<<10, "Answer 431 to requests whose headers are larger than this")
+	fs.Int64Var(&c.MaxRequestBody, "max-request-body", 10<<20, "Answer 413 to requests with a larger body (bytes)")
+	fs.Int64Var(&c.MaxResponseBody, "max-response-body", 50<<20, "Answer 502 instead of relaying a larger response body (bytes)")
+	fs.Int64Var(&c.MaxMessageSize, "max-message-size", protocol.DefaultMaxMessageSize, "Disconnect agents that send a larger protocol message or frame (bytes)")
+	fs.Int64Var(&c.MaxReassembledSize, "max-reassembled-size", protocol.DefaultMaxReassembledSize, "Disconnect agents that send a larger message split into frames (bytes)")
+	fs.BoolVar(&c.TrustForwarded, "trust-forwarded", false, "Trust X-Forwarded-* and X-Real-IP headers from a proxy in front of the server instead of stripping them")
+	fs.Var(&c.RequestHeaders, "request-header", "Change a header of requests sent to agents: \"Name: value\" replaces it, \"+Name: value\" adds a value, -Name removes it, prefixed with tunnel= for one tunnel only (repeatable)")
+	fs.Var(&c.ResponseHeaders, "response-header", "Change a header of responses sent to visitors, like -request-header (repeatable)")
+	fs.StringVar(&c.URLTemplate, "url-template", DefaultURLTemplate, "Public tunnel URL given to agents, with {name}, {host} and {port} filled in (e.g. https://{name}.tunnels.example.com behind a proxy)")
+	fs.StringVar(&c.OAuthIssuer, "oauth-issuer", "", "OpenID Connect issuer for visitor login to tunnels that ask for it, e.g. https://accounts.google.com, or \"github\"")
+	fs.StringVar(&c.OAuthClientID, "oauth-client-id", "", "OAuth client ID registered with the issuer")
+	fs.StringVar(&c.OAuthClientSecret, "oauth-client-secret", "", "OAuth client secret registered with the issuer")
+	fs.StringVar(&c.OAuthRedirectURL, "oauth-redirect-url", "", "Public URL of the login callback, e.g. https://tunnels.example.com"+OAuthCallbackPath)
+	fs.StringVar(&c.SessionSecret, "session-secret", "", "Key for signing visitor session and affinity cookies (random if empty, logging everyone out on restart)")
+	fs.Var(&c.AllowIP, "allow-ip", "Only let visitors from this CIDR or address into any tunnel (repeatable)")
+	fs.Var(&c.ClusterPeers, "cluster-peer", "Admin URL of another server of the cluster, e.g. http://10.0.0.2:8082, whose tunnels visitors here are proxied to (repeatable)")
+	fs.StringVar(&c.ClusterSecret, "cluster-secret", "", "Secret shared by the servers of a cluster, required with -cluster-peer")
+	fs.Var(&c.DenyIP, "deny-ip", "Keep visitors from this CIDR or address out of every tunnel (repeatable, wins over -allow-ip)")
+	fs.StringVar(&c.Notice, "notice", "", "Announcement shown to connecting agents (e.g. planned maintenance)")
+	c.TLS.RegisterFlags(fs)
+	c.QUIC.RegisterFlags(fs)
+}
+
+// ApplyDefaults derives the listener addresses that weren't set explicitly
+// from the port flags
+func (c *ServerConfig) ApplyDefaults() {
+	if c.AdminPort == 0 {
+		c.AdminPort = c.Port + 2
+	}
+	if c.ControlAddr == "" {
+		c.ControlAddr = fmt.Sprintf(":%d", c.Port)
+	}
+	if c.HTTPAddr == "" {
+		c.HTTPAddr = fmt.Sprintf(":%d", c.Port+1)
+		if c.SinglePort {
+			c.HTTPAddr = c.ControlAddr
+		}
+	}
+	if c.AdminAddr == "" {
+		c.AdminAddr = fmt.Sprintf(":%d", c.AdminPort)
+	}
+}
+
 // ParseAgentConfig parses agent configuration from command line flags
 func ParseAgentConfig() *AgentConfig {
 	cfg := &AgentConfig{}
-	flag.StringVar(&cfg.ServerAddr, "server", "localhost:8080", "Server address (host:port)")
-	flag.StringVar(&cfg.LocalAddr, "local", "localhost:3000", "Local service address to forward to")
-	flag.BoolVar(&cfg.Insecure, "insecure", true, "Skip TLS certificate verification")
+	cfg.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 	return cfg
 }
 
+// RegisterFlags registers the agent flags on the given flag set so that
+// subcommands can share them
+func (c *AgentConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ServerAddr, "server", "localhost:8080", "Server address (host:port)")
+	fs.StringVar(&c.LocalAddr, "local", "localhost:3000", "Local service address to forward to")
+	fs.BoolVar(&c.Insecure, "insecure", false, "Skip TLS certificate verification (unsafe, for testing only)")
+	fs.StringVar(&c.CAFile, "ca", "", "Trust the CAs in this PEM file for the server certificate instead of the system roots (e.g. certs/server.crt)")
+	fs.StringVar(&c.ServerName, "server-name", "", "Server name to verify and send in SNI (default: host of -server)")
+	fs.Var(&c.PinSHA256, "pin-sha256", "Only accept a server certificate with this base64 SHA-256 public key pin, repeatable (printed by mt_server)")
+	fs.StringVar(&c.CertFile, "cert", "", "Client certificate to present to servers that require one (with -key)")
+	fs.StringVar(&c.KeyFile, "key", "", "Key of the client certificate")
+	fs.StringVar(&c.InspectAddr, "inspect", "", "Serve the request inspector on this address (e.g. localhost:4040)")
+	fs.StringVar(&c.ControlSocket, "control-socket", "", "Serve the agent's status on this Unix socket for mt_agent status and stop (disabled if empty)")
+	fs.BoolVar(&c.JSONOutput, "json", false, "Print the tunnel URL and connection events to stdout as JSON lines, for scripts (logs stay on stderr)")
+	fs.BoolVar(&c.URLOnly, "url-only", false, "Print only the tunnel URL to stdout, again whenever it changes (logs stay on stderr)")
+	fs.StringVar(&c.HTTPSAddr, "https", "", "Also serve the local service over HTTPS on this address (e.g. localhost:3443)")
+	fs.StringVar(&c.TLSLocal, "tls-local", "", "Local TLS service to pass the server's -tls-passthrough-addr connections for this tunnel through to, still encrypted (e.g. localhost:8443)")
+	fs.StringVar(&c.Name, "name", "", "Requested tunnel name (lowercase letters, digits and hyphens)")
+	fs.DurationVar(&c.PollInterval, "poll", 0, "Stay offline and poll the server this often, connecting only when traffic arrives (requires -name)")
+	fs.BoolVar(&c.Reconnect, "reconnect", false, "Connect again, waiting up to a minute between attempts, when the connection is lost or refused instead of exiting")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", 5*time.Minute, "In polling mode, disconnect after this long without requests")
+	fs.StringVar(&c.AccessLog, "access-log", "", "Write an access log in Combined Log Format to this file (\"-\" for stdout)")
+	fs.StringVar(&c.OTLPEndpoint, "otlp-endpoint", "", "Export OpenTelemetry traces over OTLP/HTTP to this collector (e.g. http://localhost:4318; disabled if empty)")
+	fs.Var(&c.Tunnels, "tunnel", "Also serve the tunnel name=host:port over this connection (repeatable, all names must be free)")
+	fs.Var(&c.Routes, "route", "Forward paths under a prefix to another local address: /api=localhost:8000 keeps the prefix, /api=localhost:8000/ strips it, /api=localhost:8000/v1 replaces it (repeatable)")
+	fs.Var(&c.RequestHeaders, "request-header", "Change a header of requests sent to the local service: \"Name: value\" replaces it, \"+Name: value\" adds a value, -Name removes it, prefixed with tunnel= for one of its tunnels only (repeatable)")
+	fs.Var(&c.ResponseHeaders, "response-header", "Change a header of the local service's responses, like -request-header (repeatable)")
+	fs.StringVar(&c.ChaosLatency, "chaos-latency", "", "For resilience testing, delay every request by this long, or by a random time in a range like 100ms-500ms")
+	fs.Float64Var(&c.ChaosErrorRate, "chaos-error-rate", 0, "For resilience testing, answer this percentage of requests with a 500, 502 or 503 instead of forwarding them")
+	fs.Float64Var(&c.ChaosDropRate, "chaos-drop-rate", 0, "For resilience testing, cut the visitor's connection for this percentage of requests instead of answering them")
+	fs.StringVar(&c.Record, "record", "", "Append requests and the local service's responses to this file, to serve them later with -replay")
+	fs.StringVar(&c.Replay, "replay", "", "Answer requests with the responses recorded in this -record file instead of forwarding them, e.g. for an offline demo")
+	fs.StringVar(&c.Mirror, "mirror", "", "Also send a copy of requests to this local address, e.g. a new version of the service on localhost:3001, and discard its responses (disabled if empty)")
+	fs.Float64Var(&c.MirrorPercent, "mirror-percent", 100, "Percentage of requests -mirror copies, picked at random")
+	fs.StringVar(&c.HostHeader, "host-header", HostHeaderRewrite, "Host header sent to the local service: rewrite (its local address), preserve (the public host) or custom:<host>")
+	fs.BoolVar(&c.Standby, "standby", false, "Register as a hot standby that takes over the named tunnel if its agent fails; it must share -takeover-secret or the client certificate (requires -name)")
+	fs.BoolVar(&c.StatusPage, "status-page", true, "Let the server show the tunnel's status at "+StatusPagePath+" (-status-page=false to forward that path to the local service)")
+	fs.StringVar(&c.OfflinePage, "offline-page", "", "HTML file the server shows visitors while this agent is disconnected (requires -name)")
+	fs.BoolVar(&c.RewriteCookies, "rewrite-cookies", true, "Let the server rewrite the Domain and Path of the local service's cookies to match the tunnel URL (-rewrite-cookies=false to pass them unchanged)")
+	fs.BoolVar(&c.Takeover, "takeover", false, "Replace the running agent of the named tunnel without downtime; it must share -takeover-secret or the client certificate (requires -name)")
+	fs.StringVar(&c.Token, "token", "", "Token for the tunnel names reserved for you on the server, the first one is used without -name")
+	fs.BoolVar(&c.Sign, "sign", false, "Sign every message with a key derived from -token and refuse servers that can't, for when a proxy on the way terminates TLS (requires -token)")
+	fs.StringVar(&c.E2EKey, "e2e-key", "", "Encrypt response bodies with this key (from mt_agent e2e-key) so only clients holding it can read them, not the server")
+	fs.BoolVar(&c.ZeroRTT, "0rtt", true, "Resume sessions with the server and send the hello with 0-RTT, saving a round trip on reconnects (-0rtt=false for a full handshake every time)")
+	fs.StringVar(&c.SessionFile, "session-file", "", "Keep session tickets in this file so a restarted agent resumes with 0-RTT too (memory only if empty)")
+	fs.StringVar(&c.TakeoverSecret, "takeover-secret", "", "Secret letting another agent started with the same one take this tunnel over or stand by for it")
+	fs.BoolVar(&c.Balance, "balance", false, "Share the named tunnel with other agents started with -balance, the server spreads requests across them (requires -name)")
+	fs.BoolVar(&c.OAuth, "oauth", false, "Require visitors to log in with the server's OAuth provider")
+	fs.Var(&c.OAuthAllow, "oauth-allow", "Only let in this visitor: an email, @domain or GitHub login (repeatable, implies -oauth)")
+	fs.StringVar(&c.BasicAuth, "basic-auth", "", "Require visitors to log in with HTTP Basic auth as user:password")
+	fs.Var(&c.AllowIP, "allow-ip", "Only let visitors from this CIDR or address into the tunnel (repeatable)")
+	fs.BoolVar(&c.CORS, "cors", false, "Have the server answer CORS preflights and add CORS headers letting pages on any origin call the tunnel")
+	fs.Var(&c.CORSOrigins, "cors-origin", "Only let pages on this origin call the tunnel with CORS, e.g. https://app.example.com (repeatable, implies -cors)")
+	fs.BoolVar(&c.CORSCredentials, "cors-credentials", false, "Let CORS requests carry cookies and credentials (requires -cors-origin)")
+	fs.Var(&c.DenyIP, "deny-ip", "Keep visitors from this CIDR or address out of the tunnel (repeatable, wins over -allow-ip)")
+	fs.IntVar(&c.MaxConcurrent, "max-concurrent", 0, "Ask the server to send at most this many requests at once, queueing the rest (0 = server's limit)")
+	fs.Var(&c.Inbox, "inbox", "Have the server buffer POSTs under this path prefix while the agent is offline, e.g. /webhooks (repeatable, requires -name)")
+	fs.StringVar(&c.UserAgent, "user-agent", "", "User agent reported to the server (default: minitunnel-agent/<version>)")
+	fs.Var(&c.Labels, "label", "Label the tunnel with key=value (repeatable)")
+	fs.Var(&c.Hosts, "host", "Resolve a local host name to an IP, e.g. myapp.local=127.0.0.1 (repeatable)")
+	fs.StringVar(&c.Resolver, "resolver", "", "DNS server for local addresses, e.g. 10.0.0.2:53 (default: system resolver)")
+	fs.StringVar(&c.PreferIP, "prefer-ip", "", "Try local addresses of this family first: ipv4 or ipv6")
+	fs.Int64Var(&c.MaxRequestBody, "max-request-body", 10<<20, "Answer 413 instead of forwarding a larger request body (bytes)")
+	fs.Int64Var(&c.MaxResponseBody, "max-response-body", 50<<20, "Answer 502 instead of returning a larger response body from the local service (bytes)")
+	fs.Int64Var(&c.MaxMessageSize, "max-message-size", protocol.DefaultMaxMessageSize, "Disconnect if the server sends a larger protocol message or frame (bytes)")
+	fs.Int64Var(&c.MaxReassembledSize, "max-reassembled-size", protocol.DefaultMaxReassembledSize, "Disconnect if the server sends a larger message split into frames (bytes)")
+	fs.Var(&c.Plugins, "plugin", "Post-process forwarded traffic with a built-in plugin: strip-scripts=<pattern> or noindex (repeatable)")
+	fs.Var(&c.Replace, "replace", "Replace text in response bodies as find=>replacement, or re:pattern=>replacement for a regular expression whose groups $1... the replacement may use (repeatable, applied in order)")
+	c.ReplaceTypes = append(StringList(nil), DefaultReplaceTypes...)
+	fs.Func("replace-types", "Comma-separated media types whose bodies -replace applies to, type/* for all of a type (default "+strings.Join(DefaultReplaceTypes, ",")+")", func(s string) error {
+		c.ReplaceTypes = nil
+		for _, t := range strings.Split(s, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				c.ReplaceTypes = append(c.ReplaceTypes, strings.ToLower(t))
+			}
+		}
+		return nil
+	})
+	fs.StringVar(&c.Compression, "compression", protocol.CompressionNone, "Compress request and response bodies in the tunnel: none, gzip or zstd (falling back to gzip on servers without zstd)")
+	fs.DurationVar(&c.LocalTimeout, "local-timeout", 30*time.Second, "Answer 504 if the local service hasn't responded after this long")
+	fs.IntVar(&c.LocalMaxIdle, "local-max-idle", 64, "Idle keep-alive connections kept open to each local address for the next requests (0 = a new connection per request)")
+	fs.IntVar(&c.LocalRetries, "local-retries", 0, "Try a request again up to this many times when the local service refuses the connection or drops it before answering, e.g. while a dev server restarts")
+	fs.DurationVar(&c.LocalRetryBackoff, "local-retry-backoff", 250*time.Millisecond, "Wait this long before the first -local-retries attempt, twice as long before each next one")
+	fs.BoolVar(&c.IdempotentOnly, "local-retry-idempotent", true, "Retry only GET, HEAD, OPTIONS, TRACE, PUT and DELETE requests and those with an Idempotency-Key (-local-retry-idempotent=false to retry POST and PATCH too)")
+	fs.IntVar(&c.CircuitBreaker, "circuit-breaker", 0, "After this many requests in a row fail to reach the local service, answer 503 at once for -circuit-breaker-cooldown instead of forwarding (0 = never)")
+	fs.DurationVar(&c.BreakerCooldown, "circuit-breaker-cooldown", 30*time.Second, "How long -circuit-breaker answers 503 before letting a request try the local service again")
+	fs.BoolVar(&c.LocalHTTP2, "local-http2", false, "Speak cleartext HTTP/2 (h2c) to the local service, multiplexing requests over a single connection")
+	fs.StringVar(&c.HealthCheck, "health-check", "", "Probe this path of the local service (e.g. /healthz) and let the server answer 503 while it fails (disabled if empty)")
+	fs.DurationVar(&c.HealthInterval, "health-interval", 10*time.Second, "How often to probe -health-check")
+	fs.DurationVar(&c.DrainTimeout, "drain-timeout", 10*time.Second, "How long to wait for in-flight requests when shutting down")
+	fs.StringVar(&c.Follow, "follow", "", "Follow the local service when it changes port: \"auto\" (run mode) or a range like 3000-3010")
+	c.TLS.RegisterFlags(fs)
+	c.QUIC.RegisterFlags(fs)
+}
+
 // Validate validates server configuration
 func (c *ServerConfig) Validate() error {
 	if c.Port < 1 || c.Port > 65535 {
 		return fmt.Errorf("invalid port: %d", c.Port)
 	}
+	if c.AdminPort < 1 || c.AdminPort > 65535 {
+		return fmt.Errorf("invalid admin port: %d", c.AdminPort)
+	}
+	// The control listener is UDP, so only the TCP listeners can clash
+	tcpAddrs := map[string]string{}
+	for _, l := range []struct{ flag, addr string }{
+		{"control-addr", c.ControlAddr},
+		{"http-addr", c.HTTPAddr},
+		{"admin-addr", c.AdminAddr},
+		{"metrics-addr", c.MetricsAddr},
+		{"tls-passthrough-addr", c.PassthroughAddr},
+	} {
+		if l.addr == "" && (l.flag == "metrics-addr" || l.flag == "tls-passthrough-addr") {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(l.addr); err != nil {
+			return fmt.Errorf("invalid -%s %q: %w", l.flag, l.addr, err)
+		}
+		if l.flag == "control-addr" {
+			continue
+		}
+		if other, ok := tcpAddrs[l.addr]; ok {
+			return fmt.Errorf("-%s and -%s both use %s", other, l.flag, l.addr)
+		}
+		tcpAddrs[l.addr] = l.flag
+	}
+	if c.HTTP3Addr != "" {
+		if _, _, err := net.SplitHostPort(c.HTTP3Addr); err != nil {
+			return fmt.Errorf("invalid -http3-addr %q: %w", c.HTTP3Addr, err)
+		}
+		if c.SinglePort {
+			return fmt.Errorf("-http3-addr can't be used with -single-port, which serves HTTP/3 on -control-addr")
+		}
+		if c.HTTP3Addr == c.ControlAddr {
+			return fmt.Errorf("-control-addr and -http3-addr both use %s: use -single-port to share it", c.HTTP3Addr)
+		}
+	}
+	if (c.PassthroughAddr == "") != (c.PassthroughDomain == "") {
+		return fmt.Errorf("-tls-passthrough-addr and -tls-passthrough-domain must be given together")
+	}
+	if c.PassthroughDomain != "" && strings.Trim(c.PassthroughDomain, ".") == "" {
+		return fmt.Errorf("invalid -tls-passthrough-domain %q", c.PassthroughDomain)
+	}
+	if c.HeartbeatTimeout <= 0 {
+		return fmt.Errorf("invalid heartbeat timeout: %s", c.HeartbeatTimeout)
+	}
+	if c.MaxHeaderBytes <= 0 {
+		return fmt.Errorf("invalid max header bytes: %d", c.MaxHeaderBytes)
+	}
+	if c.MaxRequestBody <= 0 || c.MaxResponseBody <= 0 {
+		return fmt.Errorf("body size limits must be positive")
+	}
+	if c.MaxMessageSize <= 0 {
+		return fmt.Errorf("invalid max message size: %d", c.MaxMessageSize)
+	}
+	if c.MaxReassembledSize < c.MaxMessageSize {
+		return fmt.Errorf("max reassembled size must be at least the max message size")
+	}
+	if c.RequestTimeout < 0 {
+		return fmt.Errorf("invalid request timeout: %s", c.RequestTimeout)
+	}
+	if c.MaxConcurrent < 0 || c.QueueSize < 0 {
+		return fmt.Errorf("concurrency limit and queue size must not be negative")
+	}
+	if c.MaxConcurrent > 0 && c.QueueTimeout <= 0 {
+		return fmt.Errorf("invalid queue timeout: %s", c.QueueTimeout)
+	}
+	if c.Balance != BalanceRoundRobin && c.Balance != BalanceLeastConnections {
+		return fmt.Errorf("invalid -balance %q: use %s or %s", c.Balance, BalanceRoundRobin, BalanceLeastConnections)
+	}
+	if c.InboxMaxRequests < 0 {
+		return fmt.Errorf("invalid inbox max requests: %d", c.InboxMaxRequests)
+	}
+	if c.InboxMaxRequests > 0 && (c.InboxMaxBytes <= 0 || c.InboxTTL <= 0) {
+		return fmt.Errorf("-inbox-max-bytes and -inbox-ttl must be positive")
+	}
+	if c.ReconnectGrace < 0 {
+		return fmt.Errorf("invalid reconnect grace: %s", c.ReconnectGrace)
+	}
+	if c.MaxTunnelLifetime < 0 {
+		return fmt.Errorf("invalid max tunnel lifetime: %s", c.MaxTunnelLifetime)
+	}
+	if c.InspectRequests < 0 || c.InspectBodyBytes < 0 {
+		return fmt.Errorf("-inspect-requests and -inspect-body-bytes must not be negative")
+	}
+	if c.AuditLog != "" && (c.AuditLogMaxSize < 0 || c.AuditLogMaxBackups < 1) {
+		return fmt.Errorf("-audit-log-max-size must not be negative and -audit-log-max-backups must be at least 1")
+	}
+	if c.OAuthIssuer != "" {
+		if c.OAuthClientID == "" || c.OAuthClientSecret == "" || c.OAuthRedirectURL == "" {
+			return fmt.Errorf("-oauth-issuer requires -oauth-client-id, -oauth-client-secret and -oauth-redirect-url")
+		}
+		u, err := url.Parse(c.OAuthRedirectURL)
+		if err != nil || u.Host == "" || u.Path != OAuthCallbackPath {
+			return fmt.Errorf("invalid -oauth-redirect-url %q: must be an absolute URL ending in %s", c.OAuthRedirectURL, OAuthCallbackPath)
+		}
+	}
+	if err := validateOTLPEndpoint(c.OTLPEndpoint); err != nil {
+		return err
+	}
+	for _, peer := range c.ClusterPeers {
+		u, err := url.Parse(peer)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid -cluster-peer %q: use the admin URL of the server, like http://10.0.0.2:8082", peer)
+		}
+	}
+	if len(c.ClusterPeers) > 0 && c.ClusterSecret == "" {
+		return fmt.Errorf("-cluster-peer requires -cluster-secret")
+	}
+	if _, err := ipfilter.Parse(c.AllowIP, c.DenyIP); err != nil {
+		return err
+	}
+	if err := c.validateURLTemplate(); err != nil {
+		return fmt.Errorf("invalid -url-template %q: %w", c.URLTemplate, err)
+	}
+	if err := validateHeaderRules(c.RequestHeaders, c.ResponseHeaders); err != nil {
+		return err
+	}
+	if err := c.QUIC.Validate(); err != nil {
+		return err
+	}
+	return c.TLS.Validate()
+}
+
+// OAuthCallbackPath is where the public listener receives visitors back
+// from the OAuth issuer
+const OAuthCallbackPath = "/_minitunnel/oauth/callback"
+
+// StatusPagePath is where, under each tunnel, the server describes the
+// tunnel's health
+const StatusPagePath = "/_minitunnel/status"
+
+// Ways the server spreads requests over agents sharing a tunnel name
+const (
+	BalanceRoundRobin       = "round-robin"       // Each agent in turn
+	BalanceLeastConnections = "least-connections" // The agent with the fewest requests in flight
+)
+
+// Host headers the agent can send to the local service, see -host-header
+const (
+	HostHeaderRewrite  = "rewrite"  // The local address the request goes to
+	HostHeaderPreserve = "preserve" // The host the visitor asked for
+	HostHeaderCustom   = "custom:"  // Prefix of a fixed host, e.g. custom:myapp.test
+)
+
+// Default locations of the server's certificate and key. If neither exists
+// the server creates a self-signed pair there, see certs.WriteSelfSigned
+const (
+	DefaultCertFile = "certs/server.crt"
+	DefaultKeyFile  = "certs/server.key"
+)
+
+// ParsePin decodes a -pin-sha256 value: the base64 SHA-256 digest of a
+// certificate's public key, optionally prefixed with sha256// as curl does
+func ParsePin(pin string) ([]byte, error) {
+	digest, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256//"))
+	if err != nil || len(digest) != sha256.Size {
+		return nil, fmt.Errorf("invalid -pin-sha256 %q: expected the base64 SHA-256 digest of a public key", pin)
+	}
+	return digest, nil
+}
+
+// validateOTLPEndpoint checks that a -otlp-endpoint is an http or https
+// URL, if set
+func validateOTLPEndpoint(endpoint string) error {
+	if endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid -otlp-endpoint %q: use a URL like http://localhost:4318", endpoint)
+	}
 	return nil
 }
 
+// DefaultURLTemplate points at the server's own public listener, with
+// tunnels routed by path prefix. With -single-port the scheme is https
+const DefaultURLTemplate = "http://{host}:{port}/{name}"
+
+// TunnelURL returns the public URL of the named tunnel from URLTemplate.
+// {name} (or {id}) is the tunnel name, {host} the host of the public
+// listener (localhost if it listens on all addresses) and {port} its port
+func (c *ServerConfig) TunnelURL(name string) string {
+	template := c.URLTemplate
+	if c.SinglePort && template == DefaultURLTemplate {
+		// The public listener speaks HTTPS
+		template = "https" + strings.TrimPrefix(template, "http")
+	}
+	return strings.NewReplacer(
+		"{name}", name,
+		"{id}", name,
+		"{host}", c.publicHost(),
+		"{port}", c.HTTPPort(),
+	).Replace(template)
+}
+
+// TunnelBasePath returns the path under which visitors see the named
+// tunnel, with a trailing slash, for rewriting relative links
+func (c *ServerConfig) TunnelBasePath(name string) string {
+	u, err := url.Parse(c.TunnelURL(name))
+	if err != nil {
+		return "/" + name + "/"
+	}
+	return strings.TrimSuffix(u.Path, "/") + "/"
+}
+
+// publicHost returns the host of the public listener as it goes in a URL
+func (c *ServerConfig) publicHost() string {
+	host, _, _ := net.SplitHostPort(c.HTTPAddr)
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		return "localhost"
+	} else if ip != nil && ip.To4() == nil {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+func (c *ServerConfig) validateURLTemplate() error {
+	if !strings.Contains(c.URLTemplate, "{name}") && !strings.Contains(c.URLTemplate, "{id}") {
+		return fmt.Errorf("must contain {name}")
+	}
+	u, err := url.Parse(c.TunnelURL("example"))
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("missing host")
+	}
+	return nil
+}
+
+// HTTPPort returns the port of the public HTTP listener, used to build
+// tunnel URLs
+func (c *ServerConfig) HTTPPort() string {
+	_, port, _ := net.SplitHostPort(c.HTTPAddr)
+	return port
+}
+
 // Validate validates agent configuration
 func (c *AgentConfig) Validate() error {
 	if c.ServerAddr == "" {
@@ -55,5 +794,291 @@ func (c *AgentConfig) Validate() error {
 	if c.LocalAddr == "" {
 		return fmt.Errorf("local address is required")
 	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("-cert and -key must be used together")
+	}
+	if err := validateOTLPEndpoint(c.OTLPEndpoint); err != nil {
+		return err
+	}
+	if c.Insecure && (c.CAFile != "" || len(c.PinSHA256) > 0) {
+		return fmt.Errorf("-insecure cannot be combined with -ca or -pin-sha256")
+	}
+	for _, pin := range c.PinSHA256 {
+		if _, err := ParsePin(pin); err != nil {
+			return err
+		}
+	}
+	if c.BasicAuth != "" {
+		if user, _, ok := strings.Cut(c.BasicAuth, ":"); !ok || user == "" {
+			return fmt.Errorf("invalid basic auth: use user:password")
+		}
+	}
+	if _, err := ipfilter.Parse(c.AllowIP, c.DenyIP); err != nil {
+		return err
+	}
+	if c.TLSLocal != "" {
+		if _, _, err := net.SplitHostPort(c.TLSLocal); err != nil {
+			return fmt.Errorf("invalid -tls-local %q: %w", c.TLSLocal, err)
+		}
+		if c.BasicAuth != "" || c.OAuth || len(c.OAuthAllow) > 0 {
+			// The server can't see the requests to ask for a login
+			return fmt.Errorf("-tls-local cannot be combined with -basic-auth or -oauth")
+		}
+	}
+	for _, origin := range c.CORSOrigins {
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+			return fmt.Errorf("invalid -cors-origin %q: use scheme://host[:port], like https://app.example.com", origin)
+		}
+	}
+	if err := ValidateChaos(c.ChaosLatency, c.ChaosErrorRate, c.ChaosDropRate); err != nil {
+		return err
+	}
+	if c.Record != "" && c.Replay != "" {
+		return fmt.Errorf("-record cannot be combined with -replay")
+	}
+	if c.Mirror != "" {
+		if _, _, err := net.SplitHostPort(c.Mirror); err != nil {
+			return fmt.Errorf("invalid -mirror %q: %w", c.Mirror, err)
+		}
+		if c.Mirror == c.LocalAddr {
+			return fmt.Errorf("-mirror must differ from the local address")
+		}
+		if c.MirrorPercent <= 0 || c.MirrorPercent > 100 {
+			return fmt.Errorf("invalid -mirror-percent %g: use more than 0 and at most 100", c.MirrorPercent)
+		}
+	}
+	if c.CORSCredentials && len(c.CORSOrigins) == 0 {
+		// Any site could act as the visitor otherwise
+		return fmt.Errorf("-cors-credentials requires -cors-origin")
+	}
+	if c.MaxConcurrent < 0 {
+		return fmt.Errorf("invalid max concurrent requests: %d", c.MaxConcurrent)
+	}
+	if len(c.Inbox) > 0 {
+		if c.Name == "" {
+			return fmt.Errorf("-inbox requires -name")
+		}
+		if c.OAuth || len(c.OAuthAllow) > 0 {
+			return fmt.Errorf("-inbox can't be used with -oauth: webhook senders can't log in")
+		}
+		for _, p := range c.Inbox {
+			if !strings.HasPrefix(p, "/") {
+				return fmt.Errorf("invalid -inbox %q: must start with /", p)
+			}
+		}
+	}
+	if _, _, err := c.FollowRange(); err != nil {
+		return err
+	}
+	if c.Name != "" && !protocol.ValidName(c.Name) {
+		return fmt.Errorf("invalid tunnel name %q: use 1-63 lowercase letters, digits and hyphens", c.Name)
+	}
+	if err := validateHeaderRules(c.RequestHeaders, c.ResponseHeaders); err != nil {
+		return err
+	}
+	for _, t := range c.ReplaceTypes {
+		if typ, sub, ok := strings.Cut(t, "/"); !ok || typ == "" || sub == "" || strings.ContainsAny(t, " ;") {
+			return fmt.Errorf("invalid -replace-types %q: use media types like text/html or text/*", t)
+		}
+	}
+	switch custom, isCustom := strings.CutPrefix(c.HostHeader, HostHeaderCustom); {
+	case c.HostHeader == HostHeaderRewrite, c.HostHeader == HostHeaderPreserve:
+	case isCustom && custom != "" && !strings.ContainsAny(custom, " /?#@"):
+	default:
+		return fmt.Errorf("invalid -host-header %q: use %s, %s or %s<host>", c.HostHeader, HostHeaderRewrite, HostHeaderPreserve, HostHeaderCustom)
+	}
+	if c.PreferIP != "" && c.PreferIP != "ipv4" && c.PreferIP != "ipv6" {
+		return fmt.Errorf("invalid IP preference %q: use ipv4 or ipv6", c.PreferIP)
+	}
+	if c.Resolver != "" {
+		if _, _, err := net.SplitHostPort(c.Resolver); err != nil {
+			return fmt.Errorf("invalid resolver address %q: %w", c.Resolver, err)
+		}
+	}
+	if c.MaxRequestBody <= 0 || c.MaxResponseBody <= 0 {
+		return fmt.Errorf("body size limits must be positive")
+	}
+	if c.MaxMessageSize <= 0 {
+		return fmt.Errorf("invalid max message size: %d", c.MaxMessageSize)
+	}
+	if c.MaxReassembledSize < c.MaxMessageSize {
+		return fmt.Errorf("max reassembled size must be at least the max message size")
+	}
+	if c.Compression != protocol.CompressionNone && protocol.NegotiateCompression([]string{c.Compression}) == "" {
+		return fmt.Errorf("invalid compression %q: use none, gzip or zstd", c.Compression)
+	}
+	if c.LocalTimeout <= 0 {
+		return fmt.Errorf("invalid local timeout: %s", c.LocalTimeout)
+	}
+	if c.LocalMaxIdle < 0 {
+		return fmt.Errorf("invalid -local-max-idle %d", c.LocalMaxIdle)
+	}
+	if c.LocalRetries < 0 || c.LocalRetries > 10 {
+		return fmt.Errorf("invalid -local-retries %d: use 0 to 10", c.LocalRetries)
+	}
+	if c.LocalRetries > 0 && c.LocalRetryBackoff <= 0 {
+		return fmt.Errorf("invalid -local-retry-backoff %s", c.LocalRetryBackoff)
+	}
+	if c.CircuitBreaker < 0 {
+		return fmt.Errorf("invalid -circuit-breaker %d", c.CircuitBreaker)
+	}
+	if c.CircuitBreaker > 0 && c.BreakerCooldown <= 0 {
+		return fmt.Errorf("invalid -circuit-breaker-cooldown %s", c.BreakerCooldown)
+	}
+	if c.HealthCheck != "" && !strings.HasPrefix(c.HealthCheck, "/") {
+		return fmt.Errorf("invalid -health-check %q: must be a path starting with /", c.HealthCheck)
+	}
+	if c.HealthInterval <= 0 {
+		return fmt.Errorf("invalid health interval: %s", c.HealthInterval)
+	}
+	if c.PollInterval < 0 {
+		return fmt.Errorf("invalid poll interval: %s", c.PollInterval)
+	}
+	if c.PollInterval > 0 && c.Name == "" {
+		return fmt.Errorf("polling mode requires a tunnel name (-name)")
+	}
+	if c.PollInterval > 0 && c.Reconnect {
+		return fmt.Errorf("-reconnect cannot be combined with -poll, which connects again on its own")
+	}
+	if c.Standby && c.Name == "" {
+		return fmt.Errorf("standby mode requires a tunnel name (-name)")
+	}
+	if c.Standby && c.TakeoverSecret == "" && c.CertFile == "" {
+		return fmt.Errorf("standby mode requires -takeover-secret or a client certificate (-cert) matching the primary agent's")
+	}
+	if c.OfflinePage != "" {
+		if c.Name == "" {
+			return fmt.Errorf("-offline-page requires -name")
+		}
+		info, err := os.Stat(c.OfflinePage)
+		if err != nil {
+			return fmt.Errorf("invalid -offline-page: %w", err)
+		}
+		if info.Size() > protocol.MaxOfflinePageSize {
+			return fmt.Errorf("-offline-page %s is larger than %d bytes", c.OfflinePage, protocol.MaxOfflinePageSize)
+		}
+	}
+	for name := range c.Tunnels {
+		if !protocol.ValidName(name) {
+			return fmt.Errorf("invalid tunnel name %q: use 1-63 lowercase letters, digits and hyphens", name)
+		}
+		if name == c.Name {
+			return fmt.Errorf("tunnel %q is already the main tunnel (-name)", name)
+		}
+	}
+	if len(c.Tunnels) > 0 && (c.PollInterval > 0 || c.Standby) {
+		return fmt.Errorf("-tunnel cannot be combined with -poll or -standby")
+	}
+	if c.Takeover {
+		if c.Name == "" {
+			return fmt.Errorf("-takeover requires a tunnel name (-name)")
+		}
+		if c.TakeoverSecret == "" && c.CertFile == "" {
+			return fmt.Errorf("-takeover requires -takeover-secret or a client certificate (-cert) matching the running agent's")
+		}
+		if c.Standby || c.Balance || len(c.Tunnels) > 0 {
+			return fmt.Errorf("-takeover cannot be combined with -standby, -balance or -tunnel")
+		}
+	}
+	if c.Sign && c.Token == "" {
+		return fmt.Errorf("-sign requires -token")
+	}
+	if c.JSONOutput && c.URLOnly {
+		return fmt.Errorf("-json and -url-only cannot be combined")
+	}
+	if (c.JSONOutput || c.URLOnly) && c.AccessLog == "-" {
+		return fmt.Errorf("-access-log - cannot be combined with -json or -url-only, which print to stdout")
+	}
+	if c.SessionFile != "" && !c.ZeroRTT {
+		return fmt.Errorf("-session-file cannot be combined with -0rtt=false")
+	}
+	if c.E2EKey != "" {
+		if _, err := e2e.ParseKey(c.E2EKey); err != nil {
+			return err
+		}
+	}
+	if c.Balance {
+		if c.Name == "" {
+			return fmt.Errorf("-balance requires a tunnel name (-name)")
+		}
+		if c.Standby || len(c.Tunnels) > 0 || c.PollInterval > 0 {
+			return fmt.Errorf("-balance cannot be combined with -standby, -tunnel or -poll")
+		}
+	}
+	if err := c.QUIC.Validate(); err != nil {
+		return err
+	}
+	return c.TLS.Validate()
+}
+
+// ParseLatency parses a -chaos-latency: a duration, or a range of them
+// like 100ms-500ms. An empty string is no latency
+func ParseLatency(s string) (low, high time.Duration, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	first, last, isRange := strings.Cut(s, "-")
+	if low, err = time.ParseDuration(first); err == nil {
+		high = low
+		if isRange {
+			high, err = time.ParseDuration(last)
+		}
+	}
+	if err != nil || low < 0 || high < low {
+		return 0, 0, fmt.Errorf("invalid latency %q: use a duration like 200ms or a range like 100ms-500ms", s)
+	}
+	return low, high, nil
+}
+
+// ValidateChaos checks the fault injection settings of -chaos-latency,
+// -chaos-error-rate and -chaos-drop-rate
+func ValidateChaos(latency string, errorRate, dropRate float64) error {
+	if _, _, err := ParseLatency(latency); err != nil {
+		return err
+	}
+	if errorRate < 0 || dropRate < 0 || errorRate+dropRate > 100 {
+		return fmt.Errorf("invalid chaos rates: error and drop rates are percentages adding up to at most 100")
+	}
+	return nil
+}
+
+// validateHeaderRules checks the tunnel names of -request-header and
+// -response-header rules
+func validateHeaderRules(lists ...httpheader.Rules) error {
+	for _, rules := range lists {
+		for _, rule := range rules {
+			if rule.Tunnel != "" && !protocol.ValidName(rule.Tunnel) {
+				return fmt.Errorf("invalid tunnel name %q in header rule %q", rule.Tunnel, rule)
+			}
+			if rule.Name == "Host" {
+				return fmt.Errorf("header rule %q can't change Host, see mt_agent -host-header", rule)
+			}
+		}
+	}
 	return nil
 }
+
+// FollowRange returns the port range to scan when following the local
+// service. Both values are zero when following is disabled or set to "auto"
+func (c *AgentConfig) FollowRange() (int, int, error) {
+	if c.Follow == "" || c.Follow == "auto" {
+		return 0, 0, nil
+	}
+	lo, hi, ok := strings.Cut(c.Follow, "-")
+	if !ok {
+		hi = lo
+	}
+	min, err := strconv.Atoi(lo)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid follow range: %q", c.Follow)
+	}
+	max, err := strconv.Atoi(hi)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid follow range: %q", c.Follow)
+	}
+	if min < 1 || max > 65535 || min > max {
+		return 0, 0, fmt.Errorf("invalid follow range: %q", c.Follow)
+	}
+	return min, max, nil
+}
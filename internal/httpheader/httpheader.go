@@ -0,0 +1,64 @@
+// Package httpheader implements the header handling both ends of the tunnel
+// need as an HTTP proxy
+package httpheader
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// hopByHop are the headers that describe a single connection rather than
+// the message, per RFC 7230 section 6.1. Upgrade is always dropped since
+// the tunnel can't carry an upgraded connection, so it is never negotiated
+var hopByHop = []string{
+	"Connection",
+	"Keep-Alive",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// RemoveHopByHop deletes hop-by-hop headers from h, including any headers
+// the Connection header names and all Proxy-* headers
+func RemoveHopByHop(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHop {
+		h.Del(name)
+	}
+	for name := range h {
+		if strings.HasPrefix(name, "Proxy-") {
+			delete(h, name)
+		}
+	}
+}
+
+// Normalize returns a copy of headers received over the protocol with
+// canonical names, merging values whose names differ only in case. Agents
+// and servers written in other languages may not canonicalize
+func Normalize(headers map[string][]string) http.Header {
+	h := make(http.Header, len(headers))
+	for name, values := range headers {
+		key := textproto.CanonicalMIMEHeaderKey(name)
+		h[key] = append(h[key], values...)
+	}
+	return h
+}
+
+// AddVia records this proxy in the Via header of a message received with
+// the given protocol version
+func AddVia(h http.Header, protoMajor, protoMinor int) {
+	via := fmt.Sprintf("%d.%d minitunnel", protoMajor, protoMinor)
+	if prior := h.Get("Via"); prior != "" {
+		via = prior + ", " + via
+	}
+	h.Set("Via", via)
+}
@@ -0,0 +1,130 @@
+package httpheader
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// RuleOp is what a Rule does to its header
+type RuleOp int
+
+const (
+	RuleSet    RuleOp = iota // Replace the values of the header
+	RuleAdd                  // Add a value to those already there
+	RuleRemove               // Remove the header
+)
+
+// Rule adds, replaces or removes a header of the messages of one tunnel,
+// or of every tunnel
+type Rule struct {
+	Tunnel string // Empty for every tunnel
+	Op     RuleOp
+	Name   string // Canonical header name
+	Value  string // Unused by RuleRemove
+}
+
+// ParseRule parses a rule written as [tunnel=]rule, where rule is
+// "Name: value" to replace a header, "+Name: value" to add a value to it
+// and "-Name" to remove it
+func ParseRule(s string) (Rule, error) {
+	var rule Rule
+	text := s
+	// Header names can't hold '=', nor tunnel names ':'
+	if scope, rest, ok := strings.Cut(s, "="); ok && !strings.Contains(scope, ":") {
+		rule.Tunnel, text = scope, rest
+	}
+	switch {
+	case strings.HasPrefix(text, "-"):
+		rule.Op, rule.Name = RuleRemove, text[1:]
+	case strings.HasPrefix(text, "+"):
+		rule.Op, text = RuleAdd, text[1:]
+		fallthrough
+	default:
+		name, value, ok := strings.Cut(text, ":")
+		if !ok {
+			return Rule{}, fmt.Errorf("header rule must be [tunnel=]Name: value, +Name: value or -Name, got %q", s)
+		}
+		rule.Name, rule.Value = name, strings.TrimSpace(value)
+		if strings.ContainsAny(rule.Value, "\r\n\x00") {
+			return Rule{}, fmt.Errorf("invalid header value in rule %q", s)
+		}
+	}
+	if !validName(rule.Name) {
+		return Rule{}, fmt.Errorf("invalid header name %q in rule %q", rule.Name, s)
+	}
+	rule.Name = textproto.CanonicalMIMEHeaderKey(rule.Name)
+	return rule, nil
+}
+
+// String returns the rule as ParseRule reads it
+func (r Rule) String() string {
+	var s string
+	switch r.Op {
+	case RuleRemove:
+		s = "-" + r.Name
+	case RuleAdd:
+		s = "+" + r.Name + ": " + r.Value
+	default:
+		s = r.Name + ": " + r.Value
+	}
+	if r.Tunnel != "" {
+		s = r.Tunnel + "=" + s
+	}
+	return s
+}
+
+// validName reports whether name is a header field name, a token per RFC
+// 9110 section 5.6.2
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range []byte(name) {
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Rules are header rules applied in order, given as a repeatable flag
+type Rules []Rule
+
+func (r *Rules) String() string {
+	if r == nil {
+		return ""
+	}
+	specs := make([]string, len(*r))
+	for i, rule := range *r {
+		specs[i] = rule.String()
+	}
+	return strings.Join(specs, ",")
+}
+
+func (r *Rules) Set(value string) error {
+	rule, err := ParseRule(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+// Apply applies the rules for the tunnel to h
+func (r Rules) Apply(h http.Header, tunnel string) {
+	for _, rule := range r {
+		if rule.Tunnel != "" && rule.Tunnel != tunnel {
+			continue
+		}
+		switch rule.Op {
+		case RuleSet:
+			h.Set(rule.Name, rule.Value)
+		case RuleAdd:
+			h.Add(rule.Name, rule.Value)
+		case RuleRemove:
+			h.Del(rule.Name)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Package ipfilter decides which visitor addresses may reach a tunnel by
+// CIDR allow and deny rules
+package ipfilter
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Rules are CIDR allow and deny lists. Deny rules win; an empty allow list
+// lets in every address that isn't denied
+type Rules struct {
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+}
+
+// Parse parses allow and deny lists of CIDRs or single addresses
+func Parse(allow, deny []string) (Rules, error) {
+	var r Rules
+	for _, s := range allow {
+		p, err := ParsePrefix(s)
+		if err != nil {
+			return Rules{}, err
+		}
+		r.Allow = append(r.Allow, p)
+	}
+	for _, s := range deny {
+		p, err := ParsePrefix(s)
+		if err != nil {
+			return Rules{}, err
+		}
+		r.Deny = append(r.Deny, p)
+	}
+	return r, nil
+}
+
+// ParsePrefix parses a CIDR like 10.0.0.0/8 or a single address, which
+// stands for itself alone
+func ParsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid IP or CIDR %q", s)
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP or CIDR %q", s)
+	}
+	if p.Addr().Is4In6() {
+		// ::ffff:10.0.0.0/104 means 10.0.0.0/8
+		bits := p.Bits() - 96
+		if bits < 0 {
+			return netip.Prefix{}, fmt.Errorf("invalid IP or CIDR %q", s)
+		}
+		p = netip.PrefixFrom(p.Addr().Unmap(), bits)
+	}
+	return p.Masked(), nil
+}
+
+// Empty reports whether the rules let in every address
+func (r Rules) Empty() bool {
+	return len(r.Allow) == 0 && len(r.Deny) == 0
+}
+
+// Allows reports whether addr may pass
+func (r Rules) Allows(addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+	for _, p := range r.Deny {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	if len(r.Allow) == 0 {
+		return true
+	}
+	for _, p := range r.Allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// String lists the rules for logs, like "allow 10.0.0.0/8, deny 10.0.9.0/24"
+func (r Rules) String() string {
+	var parts []string
+	for _, p := range r.Allow {
+		parts = append(parts, "allow "+p.String())
+	}
+	for _, p := range r.Deny {
+		parts = append(parts, "deny "+p.String())
+	}
+	return strings.Join(parts, ", ")
+}
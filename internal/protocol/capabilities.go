@@ -0,0 +1,77 @@
+package protocol
+
+import "strings"
+
+// ProtocolVersion is the version of the control protocol spoken by this
+// build. Agents that send no version predate negotiation and are treated
+// as version 1 with no capabilities
+const ProtocolVersion = 2
+
+// Capabilities is a bitset of optional protocol features. Each side sends
+// what it supports and the server answers with the intersection; a feature
+// is used on a connection only if its bit is in the welcome
+type Capabilities uint64
+
+const (
+	CapConcurrentRequests Capabilities = 1 << iota // Several requests in flight at once, matched by ID
+	CapCompression                                 // Bodies may be compressed, see HelloPayload.Compression
+	CapBinaryFraming                               // Binary frames after the welcome, see Framing
+	CapContinuation                                // Binary messages may be split into continuation frames
+	CapStreaming                                   // Calls may stream bodies both ways on streams of their own, see stream.go
+	CapHealth                                      // The agent reports the health of its local service, see HealthPayload
+	CapSigning                                     // Messages are signed with the token's key, see signing.go
+	CapPassthrough                                 // TLS connections may be passed through on streams of their own, see passthrough.go
+)
+
+// SupportedCapabilities are the capabilities implemented by this build
+const SupportedCapabilities = CapConcurrentRequests | CapCompression | CapBinaryFraming | CapContinuation | CapStreaming | CapHealth | CapSigning | CapPassthrough
+
+var capabilityNames = []struct {
+	cap  Capabilities
+	name string
+}{
+	{CapConcurrentRequests, "concurrent-requests"},
+	{CapCompression, "compression"},
+	{CapBinaryFraming, "binary-framing"},
+	{CapContinuation, "continuation"},
+	{CapStreaming, "streaming"},
+	{CapHealth, "health"},
+	{CapSigning, "signing"},
+	{CapPassthrough, "tls-passthrough"},
+}
+
+// Has reports whether all capabilities in c2 are set
+func (c Capabilities) Has(c2 Capabilities) bool {
+	return c&c2 == c2
+}
+
+// String lists the capability names, unknown bits are left out
+func (c Capabilities) String() string {
+	var names []string
+	for _, n := range capabilityNames {
+		if c.Has(n.cap) {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// NegotiateCapabilities returns the capabilities to use with an agent
+// that sent hello. Signing needs HelloPayload.Signing, and rules out
+// streaming on call streams, which aren't signed
+func NegotiateCapabilities(hello HelloPayload) Capabilities {
+	if hello.ProtocolVersion < 2 {
+		return 0
+	}
+	caps := hello.Capabilities & SupportedCapabilities
+	if hello.Signing == nil {
+		caps &^= CapSigning
+	}
+	if caps.Has(CapSigning) {
+		caps &^= CapStreaming
+	}
+	return caps
+}
@@ -0,0 +1,165 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms for request and response bodies, negotiated in
+// the hello/welcome exchange
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// SupportedCompression lists the algorithms this build can negotiate, in
+// order of preference
+var SupportedCompression = []string{CompressionZstd, CompressionGzip}
+
+// zstdEncoder compresses bodies with EncodeAll, which is safe for
+// concurrent use
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+
+// minCompressSize is the smallest body worth compressing
+const minCompressSize = 512
+
+// ErrBodyTooLarge is returned when a decompressed body exceeds its limit
+var ErrBodyTooLarge = errors.New("body too large")
+
+// NegotiateCompression picks the first algorithm the agent offered that
+// this side supports, or "" for none
+func NegotiateCompression(offered []string) string {
+	for _, algo := range offered {
+		for _, supported := range SupportedCompression {
+			if algo == supported {
+				return algo
+			}
+		}
+	}
+	return ""
+}
+
+// CompressBody compresses the request body with algo if that makes it
+// smaller
+func (r *HTTPRequest) CompressBody(algo string) {
+	if contentEncoded(r.Headers) {
+		return
+	}
+	r.Body, r.BodyEncoding = compressBody(algo, r.Body, r.BodyEncoding)
+}
+
+// DecompressBody restores a compressed request body, failing with
+// ErrBodyTooLarge if it would exceed limit bytes
+func (r *HTTPRequest) DecompressBody(limit int64) error {
+	body, err := decompressBody(r.BodyEncoding, r.Body, limit)
+	if err != nil {
+		return err
+	}
+	r.Body, r.BodyEncoding = body, ""
+	return nil
+}
+
+// CompressBody compresses the response body with algo if that makes it
+// smaller
+func (r *HTTPResponse) CompressBody(algo string) {
+	if contentEncoded(r.Headers) {
+		return
+	}
+	r.Body, r.BodyEncoding = compressBody(algo, r.Body, r.BodyEncoding)
+}
+
+// contentEncoded reports whether a body was already compressed by the
+// application, per its Content-Encoding header. Such bodies are carried
+// through the tunnel untouched, compressing them again would only cost time
+func contentEncoded(headers map[string][]string) bool {
+	for key, values := range headers {
+		if strings.EqualFold(key, "Content-Encoding") {
+			for _, v := range values {
+				if v = strings.TrimSpace(v); v != "" && !strings.EqualFold(v, "identity") {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// DecompressBody restores a compressed response body, failing with
+// ErrBodyTooLarge if it would exceed limit bytes
+func (r *HTTPResponse) DecompressBody(limit int64) error {
+	body, err := decompressBody(r.BodyEncoding, r.Body, limit)
+	if err != nil {
+		return err
+	}
+	r.Body, r.BodyEncoding = body, ""
+	return nil
+}
+
+func compressBody(algo string, body []byte, encoding string) ([]byte, string) {
+	if encoding != "" || len(body) < minCompressSize {
+		return body, encoding
+	}
+	var out []byte
+	switch algo {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		if err := zw.Close(); err != nil {
+			return body, encoding
+		}
+		out = buf.Bytes()
+	case CompressionZstd:
+		out = zstdEncoder.EncodeAll(body, nil)
+	default:
+		return body, encoding
+	}
+	if len(out) >= len(body) {
+		// Already compressed content, such as images, doesn't shrink
+		return body, encoding
+	}
+	return out, algo
+}
+
+func decompressBody(encoding string, body []byte, limit int64) ([]byte, error) {
+	switch encoding {
+	case "":
+		return body, nil
+	case CompressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress body: %w", err)
+		}
+		return readLimited(zr, limit)
+	case CompressionZstd:
+		zr, err := zstd.NewReader(bytes.NewReader(body), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress body: %w", err)
+		}
+		defer zr.Close()
+		return readLimited(zr, limit)
+	default:
+		return nil, fmt.Errorf("unsupported body encoding %q", encoding)
+	}
+}
+
+// readLimited reads a decompressed body, failing with ErrBodyTooLarge past
+// limit bytes
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	// Read one byte past the limit to tell a full body from a cut one
+	out, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress body: %w", err)
+	}
+	if int64(len(out)) > limit {
+		return nil, ErrBodyTooLarge
+	}
+	return out, nil
+}
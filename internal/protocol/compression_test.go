@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCompressBody(t *testing.T) {
+	text := bytes.Repeat([]byte("minitunnel "), 200)
+	tests := []struct {
+		name     string
+		algo     string
+		body     []byte
+		headers  map[string][]string
+		encoding string // Expected BodyEncoding after compressing
+	}{
+		{"gzip", CompressionGzip, text, nil, CompressionGzip},
+		{"zstd", CompressionZstd, text, nil, CompressionZstd},
+		{"none", CompressionNone, text, nil, ""},
+		{"unknown", "br", text, nil, ""},
+		{"small body", CompressionZstd, []byte("short"), nil, ""},
+		{"content encoded", CompressionZstd, text, map[string][]string{"Content-Encoding": {"gzip"}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := HTTPResponse{Headers: tt.headers, Body: bytes.Clone(tt.body)}
+			resp.CompressBody(tt.algo)
+			if resp.BodyEncoding != tt.encoding {
+				t.Fatalf("BodyEncoding = %q, want %q", resp.BodyEncoding, tt.encoding)
+			}
+			if tt.encoding != "" && len(resp.Body) >= len(tt.body) {
+				t.Errorf("compressed body is %d bytes, not smaller than %d", len(resp.Body), len(tt.body))
+			}
+			if err := resp.DecompressBody(int64(len(tt.body))); err != nil {
+				t.Fatalf("DecompressBody: %v", err)
+			}
+			if !bytes.Equal(resp.Body, tt.body) || resp.BodyEncoding != "" {
+				t.Errorf("round trip changed the body")
+			}
+		})
+	}
+}
+
+func TestDecompressBodyLimit(t *testing.T) {
+	text := bytes.Repeat([]byte("minitunnel "), 200)
+	for _, algo := range SupportedCompression {
+		t.Run(algo, func(t *testing.T) {
+			req := HTTPRequest{Body: bytes.Clone(text)}
+			req.CompressBody(algo)
+			if err := req.DecompressBody(int64(len(text)) - 1); !errors.Is(err, ErrBodyTooLarge) {
+				t.Errorf("DecompressBody past the limit = %v, want ErrBodyTooLarge", err)
+			}
+		})
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	tests := []struct {
+		offered []string
+		want    string
+	}{
+		{nil, ""},
+		{[]string{"br"}, ""},
+		{[]string{CompressionGzip}, CompressionGzip},
+		{[]string{CompressionZstd, CompressionGzip}, CompressionZstd},
+		{[]string{"br", CompressionGzip}, CompressionGzip},
+	}
+	for _, tt := range tests {
+		if got := NegotiateCompression(tt.offered); got != tt.want {
+			t.Errorf("NegotiateCompression(%q) = %q, want %q", tt.offered, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Framing is how messages are delimited on the stream. Connections start
+// with JSON and switch to the framing named in the welcome right after it
+type Framing string
+
+const (
+	FramingJSON   Framing = "json"   // One JSON object per line, bodies base64 encoded
+	FramingBinary Framing = "binary" // Length-prefixed frames with raw bodies, see WriteBinaryMessage
+)
+
+// NegotiateFraming picks the framing to use after the welcome from the
+// ones the agent offered
+func NegotiateFraming(offered []Framing) Framing {
+	for _, f := range offered {
+		if f == FramingBinary {
+			return FramingBinary
+		}
+	}
+	return FramingJSON
+}
+
+// WriteOptions is how messages are written to a peer, as negotiated in
+// the hello and welcome
+type WriteOptions struct {
+	Framing      Framing
+	MaxFrameSize int64   // Largest message or frame the peer reads, 0 if it didn't say
+	Continuation bool    // Split binary messages over MaxFrameSize into continuation frames
+	Signer       *Signer // Signs every message, nil for none, see CapSigning
+}
+
+// Write writes msg to w. Messages the peer would refuse fail with
+// ErrMessageTooLarge before anything is written, so the connection stays
+// usable
+func (o WriteOptions) Write(w io.Writer, msg Message) (err error) {
+	if o.Signer != nil {
+		// JSON framing signs the body inlined, as the peer reads it
+		if o.Framing != FramingBinary && msg.Body != nil {
+			if msg.Payload, err = withInlineBody(msg.Payload, msg.Body); err != nil {
+				return err
+			}
+			msg.Body = nil
+		}
+		o.Signer.sign(&msg)
+		defer func() {
+			// Nothing was written, the next message takes the number
+			if errors.Is(err, ErrMessageTooLarge) {
+				o.Signer.unsign()
+			}
+		}()
+	}
+	if o.Framing != FramingBinary {
+		data, err := encodeJSON(msg)
+		if err != nil {
+			return err
+		}
+		if o.MaxFrameSize > 0 && int64(len(data)) > o.MaxFrameSize {
+			return fmt.Errorf("%w: %d bytes, peer accepts %d", ErrMessageTooLarge, len(data), o.MaxFrameSize)
+		}
+		_, err = w.Write(data)
+		return err
+	}
+
+	size := int64(len(msg.Type) + len(msg.Payload) + len(msg.Body))
+	if o.MaxFrameSize == 0 || size <= o.MaxFrameSize {
+		return WriteBinaryMessage(w, msg)
+	}
+	signed := msg.MAC != nil
+	room := o.MaxFrameSize - int64(len(msg.Type))
+	if !o.Continuation || room <= 0 {
+		return fmt.Errorf("%w: %d bytes, peer accepts %d", ErrMessageTooLarge, size, o.MaxFrameSize)
+	}
+
+	// Fill each frame with the rest of the payload, then the body
+	var flags byte
+	if msg.Body != nil {
+		flags |= frameFlagBody
+	}
+	payload, body := msg.Payload, msg.Body
+	for {
+		n := min(room, int64(len(payload)))
+		p := payload[:n]
+		payload = payload[n:]
+		n = min(room-n, int64(len(body)))
+		b := body[:n]
+		body = body[n:]
+
+		more := len(payload)+len(body) > 0
+		frameFlags := flags
+		if more {
+			frameFlags |= frameFlagMore
+		}
+		// The first frame carries the signature of the whole message
+		frame := Message{Type: msg.Type, Payload: p, Body: b}
+		if signed {
+			frame.Seq, frame.MAC = msg.Seq, msg.MAC
+			signed = false
+		}
+		if err := writeFrame(w, frame, frameFlags); err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+	}
+}
+
+// Binary frames start with a fixed header:
+//
+//	version    1 byte, binaryFrameVersion
+//	flags      1 byte, see frameFlag*
+//	type len   1 byte
+//	payload    4 bytes, big endian length of the JSON payload
+//	body       4 bytes, big endian length of the raw body
+//
+// followed by the message type, the payload and the body. A message too
+// large for the peer may be split over several frames of the same type,
+// all but the last flagged frameFlagMore; their payloads and bodies are
+// concatenated. Signed messages, see CapSigning, have an 8 byte big endian
+// sequence number and the MAC between the header and the type of their
+// first frame
+const (
+	binaryFrameVersion = 1
+	frameHeaderSize    = 11
+	frameSignatureSize = 8 + macSize
+
+	frameFlagBody   = 1 << 0 // The frame carries a raw body
+	frameFlagMore   = 1 << 1 // Continuation frames of the same message follow
+	frameFlagSigned = 1 << 2 // The frame carries a signature
+)
+
+// WriteBinaryMessage writes msg as a binary frame. Request and response
+// bodies are sent as raw bytes after the payload instead of base64 inside
+// it
+func WriteBinaryMessage(w io.Writer, msg Message) error {
+	var flags byte
+	if msg.Body != nil {
+		flags |= frameFlagBody
+	}
+	return writeFrame(w, msg, flags)
+}
+
+// writeFrame writes msg as one frame, with its signature if it has one
+func writeFrame(w io.Writer, msg Message, flags byte) error {
+	if len(msg.Type) > 255 {
+		return fmt.Errorf("message type too long: %q", msg.Type)
+	}
+	if msg.MAC != nil {
+		flags |= frameFlagSigned
+	}
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+frameSignatureSize+len(msg.Type)+len(msg.Payload)+len(msg.Body))
+	frame[0] = binaryFrameVersion
+	frame[1] = flags
+	frame[2] = byte(len(msg.Type))
+	binary.BigEndian.PutUint32(frame[3:7], uint32(len(msg.Payload)))
+	binary.BigEndian.PutUint32(frame[7:11], uint32(len(msg.Body)))
+	if msg.MAC != nil {
+		frame = binary.BigEndian.AppendUint64(frame, msg.Seq)
+		frame = append(frame, msg.MAC...)
+	}
+	frame = append(frame, msg.Type...)
+	frame = append(frame, msg.Payload...)
+	frame = append(frame, msg.Body...)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// readBinaryMessage reads a binary message, reassembling continuation
+// frames up to the reader's reassembly limit
+func (r *Reader) readBinaryMessage() (*Message, error) {
+	msg, more, err := r.readFrame()
+	if err != nil || !more {
+		return msg, err
+	}
+	size := int64(len(msg.Type) + len(msg.Payload) + len(msg.Body))
+	for more {
+		var next *Message
+		next, more, err = r.readFrame()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if next.Type != msg.Type {
+			return nil, fmt.Errorf("continuation of %s message has type %s", msg.Type, next.Type)
+		}
+		size += int64(len(next.Type) + len(next.Payload) + len(next.Body))
+		if size > r.maxReassembled {
+			return nil, fmt.Errorf("%w: over %d bytes in continuation frames", ErrMessageTooLarge, r.maxReassembled)
+		}
+		msg.Payload = append(msg.Payload, next.Payload...)
+		if next.Body != nil {
+			msg.Body = append(msg.Body, next.Body...)
+		}
+	}
+	return msg, nil
+}
+
+// readFrame reads one binary frame and reports whether continuation frames
+// follow
+func (r *Reader) readFrame() (*Message, bool, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r.br, header[:]); err != nil {
+		return nil, false, err
+	}
+	if header[0] != binaryFrameVersion {
+		return nil, false, fmt.Errorf("unsupported frame version %d", header[0])
+	}
+	typeLen := int(header[2])
+	payloadLen := int(binary.BigEndian.Uint32(header[3:7]))
+	bodyLen := int(binary.BigEndian.Uint32(header[7:11]))
+	if size := int64(typeLen) + int64(payloadLen) + int64(bodyLen); size > r.maxSize {
+		return nil, false, fmt.Errorf("%w: %d bytes, limit %d", ErrMessageTooLarge, size, r.maxSize)
+	}
+	var signature [frameSignatureSize]byte
+	signed := header[1]&frameFlagSigned != 0
+	if signed {
+		if _, err := io.ReadFull(r.br, signature[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, false, err
+		}
+	}
+
+	data := make([]byte, typeLen+payloadLen+bodyLen)
+	if _, err := io.ReadFull(r.br, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, false, err
+	}
+
+	// Cap the payload so appending continuations can't overwrite the body
+	payloadEnd := typeLen + payloadLen
+	msg := &Message{
+		Type:    MessageType(data[:typeLen]),
+		Payload: json.RawMessage(data[typeLen:payloadEnd:payloadEnd]),
+	}
+	if header[1]&frameFlagBody != 0 {
+		msg.Body = data[payloadEnd:]
+	}
+	if signed {
+		msg.Seq = binary.BigEndian.Uint64(signature[:8])
+		msg.MAC = signature[8:]
+	}
+	return msg, header[1]&frameFlagMore != 0, nil
+}
+
+// withInlineBody returns the payload with the raw body added as the base64
+// "body" field, the way JSON framing carries it
+func withInlineBody(payload json.RawMessage, body []byte) (json.RawMessage, error) {
+	if body == nil {
+		return payload, nil
+	}
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < 2 || payload[len(payload)-1] != '}' {
+		return nil, fmt.Errorf("payload is not a JSON object")
+	}
+	out := make([]byte, 0, len(payload)+len(encoded)+8)
+	out = append(out, payload[:len(payload)-1]...)
+	if len(payload) > 2 {
+		out = append(out, ',')
+	}
+	out = append(out, `"body":`...)
+	out = append(out, encoded...)
+	out = append(out, '}')
+	return out, nil
+}
@@ -0,0 +1,34 @@
+package protocol
+
+import "embed"
+
+// OpenAPIPath is where the server's admin API and the agent's inspector
+// serve the OpenAPI documents of their APIs
+const OpenAPIPath = "/api/openapi.json"
+
+// The documents are kept next to the protocol so that changes to the APIs
+// and to their descriptions are reviewed together. info.version follows
+// semantic versioning: additions bump the minor version, anything that can
+// break a generated client the major one
+//
+//go:embed openapi/*.json
+var openAPIFS embed.FS
+
+// AdminOpenAPI returns the OpenAPI document of the server's admin API
+func AdminOpenAPI() []byte {
+	return mustReadOpenAPI("openapi/admin.json")
+}
+
+// AgentOpenAPI returns the OpenAPI document of the agent's control API,
+// served by the request inspector
+func AgentOpenAPI() []byte {
+	return mustReadOpenAPI("openapi/agent.json")
+}
+
+func mustReadOpenAPI(name string) []byte {
+	data, err := openAPIFS.ReadFile(name)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
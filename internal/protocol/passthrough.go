@@ -0,0 +1,37 @@
+package protocol
+
+import "encoding/json"
+
+// With CapPassthrough, a server listening for TLS connections routes them
+// by the server name in their ClientHello to the agent of the tunnel of
+// that name, which asked for them with HelloPayload.TLSPassthrough. Each
+// connection gets a QUIC stream of its own, a passthrough stream:
+//
+//	server → agent: connect, then the connection's bytes
+//	agent → server: the local service's bytes
+//
+// Only the connect message is framed, always in binary. The bytes after it
+// are the TLS connection as the visitor sent it, ClientHello included, so
+// the local service terminates TLS with its own certificate and the server
+// never sees the plaintext. Each side closes its direction when its end of
+// the connection does, and resets the stream with CallErrCanceled on
+// errors
+
+// ConnectPayload describes a passed-through connection
+type ConnectPayload struct {
+	Tunnel     string `json:"tunnel"`
+	ServerName string `json:"server_name"` // From the ClientHello
+	RemoteAddr string `json:"remote_addr"` // The visitor's
+}
+
+// NewConnectMessage creates the message opening a passthrough stream
+func NewConnectMessage(payload ConnectPayload) (Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Type:    MsgTypeConnect,
+		Payload: data,
+	}, nil
+}
@@ -1,8 +1,12 @@
 package protocol
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"time"
 )
 
 // MessageType defines the type of message being sent
@@ -11,70 +15,546 @@ type MessageType string
 const (
 	// Agent -> Server messages (connection init)
 	MsgTypeHello MessageType = "hello" // Agent initiates connection
+	MsgTypePoll  MessageType = "poll"  // Sleeping agent asks whether it should connect
 
 	// Server -> Agent messages
-	MsgTypeWelcome MessageType = "welcome" // Initial connection, sends tunnel URL
-	MsgTypeRequest MessageType = "request" // HTTP request to forward
+	MsgTypeWelcome    MessageType = "welcome"     // Initial connection, sends tunnel URL
+	MsgTypeRequest    MessageType = "request"     // HTTP request to forward
+	MsgTypePong       MessageType = "pong"        // Reply to a heartbeat
+	MsgTypePollResult MessageType = "poll_result" // Reply to a poll
+	MsgTypePromote    MessageType = "promote"     // Standby connection now carries the tunnel's traffic
+	MsgTypeReject     MessageType = "reject"      // Hello refused, sent instead of a welcome
 
 	// Agent -> Server messages
-	MsgTypeResponse  MessageType = "response"  // HTTP response from local service
-	MsgTypeHeartbeat MessageType = "heartbeat" // Keep-alive ping
+	MsgTypeResponse   MessageType = "response"   // HTTP response from local service
+	MsgTypeHeartbeat  MessageType = "heartbeat"  // Keep-alive ping
+	MsgTypeDisconnect MessageType = "disconnect" // Agent is shutting down, stop sending requests
+	MsgTypeHealth     MessageType = "health"     // Local service went down or came back, see CapHealth
+
+	// Either direction
+	MsgTypeError MessageType = "error" // The sender is closing the connection because of a protocol violation
+	MsgTypeData  MessageType = "data"  // Body chunk of a streamed call, see CapStreaming
+	MsgTypeEnd   MessageType = "end"   // Last message of a streamed body, see EndPayload
+
+	MsgTypeConnect MessageType = "connect" // Opens a passed-through TLS connection, see ConnectPayload
+)
+
+// ALPN is the TLS application protocol of agent connections. Servers
+// sharing their port with HTTP/3 visitors tell them apart by it
+const ALPN = "minitunnel"
+
+// ValidName reports whether name can be used as a tunnel name: 1 to 63
+// lowercase letters, digits or hyphens, not starting or ending with a hyphen
+func ValidName(name string) bool {
+	if len(name) == 0 || len(name) > 63 || name[0] == '-' || name[len(name)-1] == '-' {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// ErrorCode is the application error code used when closing a connection
+type ErrorCode uint64
+
+const (
+	ErrCodeNone     ErrorCode = 0 // Normal close
+	ErrCodeEvicted  ErrorCode = 1 // Disconnected by a server operator
+	ErrCodeExpired  ErrorCode = 2 // Tunnel reached its maximum lifetime
+	ErrCodeTimeout  ErrorCode = 3 // Agent stopped sending heartbeats
+	ErrCodeShutdown ErrorCode = 4 // Agent shut down after draining
+	ErrCodeProtocol ErrorCode = 5 // Peer broke the protocol, see ErrorPayload
+	ErrCodeReplaced ErrorCode = 6 // A newer agent took the tunnel over, see HelloPayload.Takeover
+)
+
+// Features advertised by the server in the welcome message
+const (
+	FeatureHTTP       = "http"        // HTTP request forwarding
+	FeatureStats      = "stats"       // Per-tunnel statistics in the admin API
+	FeatureAdminEvict = "admin-evict" // Operators can disconnect tunnels
 )
 
 // Message is the base structure for all protocol messages
 type Message struct {
 	Type    MessageType     `json:"type"`
 	Payload json.RawMessage `json:"payload"`
+
+	// Body is the raw HTTP body of request and response messages, kept out
+	// of Payload so binary framing can send it unencoded. Use
+	// DecodeRequest and DecodeResponse to read both
+	Body []byte `json:"-"`
+
+	// Seq and MAC sign the message on connections with CapSigning, see
+	// signing.go
+	Seq uint64 `json:"seq,omitempty"`
+	MAC []byte `json:"mac,omitempty"`
+}
+
+// HelloPayload is sent by the agent to open a tunnel and identifies the
+// agent to server operators
+type HelloPayload struct {
+	ProtocolVersion int          `json:"protocol_version,omitempty"` // Missing in agents older than version 2
+	Capabilities    Capabilities `json:"capabilities,omitempty"`     // Supported by the agent, see Cap*
+
+	Name      string            `json:"name,omitempty"`    // Requested tunnel name, random if empty or taken
+	Standby   bool              `json:"standby,omitempty"` // Register as hot standby for an existing tunnel with this name
+	UserAgent string            `json:"user_agent,omitempty"`
+	Hostname  string            `json:"hostname,omitempty"`
+	OS        string            `json:"os,omitempty"`
+	Arch      string            `json:"arch,omitempty"`
+	Version   string            `json:"version,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"` // e.g. team=payments, service=checkout
+
+	// Tunnels lists further names served over this connection. They are
+	// granted together with Name, all or none, never replaced by random IDs
+	Tunnels []string `json:"tunnels,omitempty"`
+
+	Compression []string  `json:"compression,omitempty"` // Body compression algorithms accepted, preferred first
+	Framing     []Framing `json:"framing,omitempty"`     // Framings the agent can switch to after the welcome
+
+	MaxMessageSize int64 `json:"max_message_size,omitempty"` // Largest message or frame the agent reads
+
+	BasicAuth *BasicAuth   `json:"basic_auth,omitempty"` // Visitors must log in with these credentials
+	OAuth     *OAuthPolicy `json:"oauth,omitempty"`      // Visitors must log in with the server's OAuth issuer
+	IPFilter  *IPFilter    `json:"ip_filter,omitempty"`  // Only these visitor addresses may reach the tunnel
+	CORS      *CORSPolicy  `json:"cors,omitempty"`       // The server answers CORS preflights and adds CORS headers
+
+	MaxConcurrent int `json:"max_concurrent,omitempty"` // Requests the agent wants in flight at most, 0 for the server's limit
+
+	Inbox []string `json:"inbox,omitempty"` // Path prefixes whose POSTs the server buffers while the agent is offline
+
+	// Balance asks to share Name with other agents that set it, instead of
+	// falling back to a random name when Name is taken
+	Balance bool `json:"balance,omitempty"`
+
+	HideStatus bool `json:"hide_status,omitempty"` // Forward the status page path instead of serving it
+
+	// OfflinePage is an HTML page the server shows visitors of the named
+	// tunnels while the agent is disconnected, at most MaxOfflinePageSize
+	OfflinePage string `json:"offline_page,omitempty"`
+
+	Token      string        `json:"token,omitempty"`       // Proves the agent may use the names reserved for it on the server
+	Signing    *HelloSigning `json:"signing,omitempty"`     // Sign the connection with the key of a token, sent instead of Token, see CapSigning
+	RawCookies bool          `json:"raw_cookies,omitempty"` // Pass Set-Cookie headers on without rewriting Domain and Path
+
+	// LocalHosts are the hosts the agent forwards to. The server rewrites
+	// redirects to them, as it does for loopback addresses
+	LocalHosts []string `json:"local_hosts,omitempty"`
+
+	// Takeover asks to replace the agent holding Name, which must have the
+	// same client certificate identity or TakeoverSecret. The old agent is
+	// drained and disconnected with ErrCodeReplaced
+	Takeover       bool   `json:"takeover,omitempty"`
+	TakeoverSecret string `json:"takeover_secret,omitempty"` // Proves a takeover comes from the same owner
+
+	// TLSPassthrough asks the server to pass TLS connections for the tunnel
+	// name through to the agent unopened, see CapPassthrough
+	TLSPassthrough bool `json:"tls_passthrough,omitempty"`
+}
+
+// IPFilter limits the visitor addresses that reach a tunnel, on top of the
+// server's own rules. Entries are CIDRs or single addresses; deny wins
+type IPFilter struct {
+	Allow []string `json:"allow,omitempty"` // Any address that isn't denied if empty
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// CORSPolicy has the server handle CORS for a tunnel: it answers
+// preflights itself and sets the Access-Control-* headers of responses,
+// replacing the local service's
+type CORSPolicy struct {
+	Origins     []string `json:"origins,omitempty"`     // Origins allowed, like https://app.example.com; any if empty
+	Credentials bool     `json:"credentials,omitempty"` // Let browsers send cookies and HTTP auth along
+}
+
+// OAuthPolicy lists who may visit a tunnel behind the server's OAuth login
+type OAuthPolicy struct {
+	Allow []string `json:"allow,omitempty"` // Emails, @domains or GitHub logins; anyone logged in if empty
+}
+
+// BasicAuth are the HTTP Basic credentials visitors of a tunnel must send
+type BasicAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// PollPayload is sent by an agent in polling mode instead of a hello. The
+// server remembers the name so that traffic for it queues a wake-up
+type PollPayload struct {
+	Name            string `json:"name"`
+	IntervalSeconds int    `json:"interval_seconds"` // How often the agent polls
 }
 
-// WelcomePayload is sent by server to agent upon connection
+// PollResultPayload tells a polling agent whether traffic is waiting for it
+type PollResultPayload struct {
+	Wake bool `json:"wake"`
+}
+
+// WelcomePayload is sent by server to agent upon connection. Besides the
+// tunnel URL it describes what the URL guarantees so that the agent and
+// scripts can act on it
 type WelcomePayload struct {
-	ClientID  string `json:"client_id"`
+	ProtocolVersion int          `json:"protocol_version,omitempty"`
+	Capabilities    Capabilities `json:"capabilities,omitempty"` // Enabled on this connection, see Cap*
+
+	ClientID  string     `json:"client_id"`
+	TunnelURL string     `json:"tunnel_url"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // Nil if the tunnel lives as long as the connection
+	Reserved  bool       `json:"reserved"`             // False if the URL changes on reconnect
+	Standby   bool       `json:"standby,omitempty"`    // Registered as standby, traffic starts after a promote message
+	Quota     *Quota     `json:"quota,omitempty"`      // Nil if the agent has no quota
+	Features  []string   `json:"features"`             // Server features, see Feature*
+	Warnings  []Warning  `json:"warnings,omitempty"`   // Conditions the agent should tell the user about
+
+	Tunnels []TunnelGrant `json:"tunnels,omitempty"` // URLs of the names requested in HelloPayload.Tunnels
+
+	Compression string  `json:"compression,omitempty"` // Body compression used on this connection, none if empty
+	Framing     Framing `json:"framing,omitempty"`     // Framing of the messages after this one, JSON if empty
+
+	MaxMessageSize int64 `json:"max_message_size,omitempty"` // Largest message or frame the server reads
+
+	BasicAuth bool `json:"basic_auth,omitempty"` // Visitors are challenged for HelloPayload.BasicAuth
+	OAuth     bool `json:"oauth,omitempty"`      // Visitors are sent to the OAuth login, see HelloPayload.OAuth
+	IPFilter  bool `json:"ip_filter,omitempty"`  // Visitors are checked against HelloPayload.IPFilter
+	CORS      bool `json:"cors,omitempty"`       // CORS is handled as HelloPayload.CORS asks
+
+	MaxConcurrent int `json:"max_concurrent,omitempty"` // Requests sent at once, more are queued by the server; 0 for no limit
+
+	Inbox bool `json:"inbox,omitempty"` // Webhooks to HelloPayload.Inbox are buffered while the agent is offline
+
+	Balance bool `json:"balance,omitempty"` // Sharing the tunnel name with other agents, see HelloPayload.Balance
+
+	Takeover bool `json:"takeover,omitempty"` // Replaced the agent that held the name, see HelloPayload.Takeover
+
+	SigningNonce []byte `json:"signing_nonce,omitempty"` // Set with CapSigning, see HelloSigning
+
+	TLSPassthrough string `json:"tls_passthrough,omitempty"` // host:port passed through to the agent, see HelloPayload.TLSPassthrough
+}
+
+// TunnelGrant is an additional tunnel granted in the welcome
+type TunnelGrant struct {
+	Name      string `json:"name"`
 	TunnelURL string `json:"tunnel_url"`
 }
 
+// RejectPayload explains why a hello was refused. Per-name problems are
+// listed so the agent can report every conflict at once
+type RejectPayload struct {
+	Message string      `json:"message"`
+	Names   []NameError `json:"names,omitempty"`
+}
+
+// ErrorPayload tells the peer why the connection is about to be closed
+type ErrorPayload struct {
+	Code    string `json:"code"` // See ProtocolErr*
+	Message string `json:"message"`
+}
+
+// Protocol error codes sent in an error message
+const (
+	ProtocolErrMessageTooLarge = "message_too_large" // A message exceeded the receiver's size limit
+	ProtocolErrBadSignature    = "bad_signature"     // A message failed signature checks, see CapSigning
+)
+
+// Name error codes sent in a reject message
+const (
+	NameErrInvalid    = "invalid"     // Not a valid tunnel name, see ValidName
+	NameErrInUse      = "in_use"      // Another agent holds the name
+	NameErrDuplicate  = "duplicate"   // Requested more than once in the same hello
+	NameErrNotAllowed = "not_allowed" // Outside the names the agent's client certificate may use
+	NameErrReserved   = "reserved"    // Reserved on the server for another token
+)
+
+// NameError is the reason a single requested name could not be granted
+type NameError struct {
+	Name    string `json:"name"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Warning codes sent in the welcome message
+const (
+	WarnNameNotReserved = "name_not_reserved" // Requested name unavailable, a random one was assigned
+	WarnQuotaLow        = "quota_low"         // Most of the quota has been consumed
+	WarnTunnelExpires   = "tunnel_expires"    // The tunnel will be disconnected at ExpiresAt
+	WarnServerNotice    = "server_notice"     // Operator announcement, e.g. planned maintenance
+)
+
+// Warning is a structured, human readable condition reported at welcome time
+type Warning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Quota summarizes the usage limits that apply to a tunnel. Zero limits
+// mean unlimited
+type Quota struct {
+	RequestsLimit int64      `json:"requests_limit"`
+	RequestsUsed  int64      `json:"requests_used"`
+	BytesLimit    int64      `json:"bytes_limit"`
+	BytesUsed     int64      `json:"bytes_used"`
+	ResetsAt      *time.Time `json:"resets_at,omitempty"`
+}
+
+// HeartbeatPayload is sent periodically by the agent to show it is alive
+type HeartbeatPayload struct {
+	SentAt time.Time `json:"sent_at"` // Agent clock, echoed back in the pong
+}
+
+// PongPayload answers a heartbeat so the agent can measure round-trip time
+type PongPayload struct {
+	SentAt     time.Time `json:"sent_at"`     // Copied from the heartbeat
+	ServerTime time.Time `json:"server_time"` // Server clock when the pong was sent
+}
+
+// DisconnectPayload announces that the agent is going away. The server stops
+// routing new requests to it; in-flight responses still arrive
+type DisconnectPayload struct {
+	Reason string `json:"reason"`
+}
+
+// HealthPayload reports a change in the health of the agent's local
+// service. The server assumes a healthy service until told otherwise, and
+// answers visitors itself while it is down
+type HealthPayload struct {
+	Healthy bool   `json:"healthy"`
+	Reason  string `json:"reason,omitempty"` // Why the health check failed
+}
+
 // HTTPRequest represents an HTTP request to be forwarded
 type HTTPRequest struct {
+	ID      uint64              `json:"id"` // Echoed in the response to match it to the request
 	Method  string              `json:"method"`
 	Path    string              `json:"path"`
 	Headers map[string][]string `json:"headers"`
-	Body    []byte              `json:"body"`
+	Body    []byte              `json:"body,omitempty"`
+
+	Tunnel       string `json:"tunnel,omitempty"`        // Name the visitor addressed, for agents serving several tunnels
+	BodyEncoding string `json:"body_encoding,omitempty"` // Compression applied to Body, see Compression*
+
+	// TimeoutMs is the request's deadline, as the time the server will
+	// still wait for the response when it sends the request. Zero means
+	// no deadline
+	TimeoutMs int64 `json:"timeout_ms,omitempty"`
+
+	// Streaming marks a request sent on a call stream of its own, whose
+	// body follows in data messages, see CapStreaming
+	Streaming bool `json:"streaming,omitempty"`
 }
 
 // HTTPResponse represents an HTTP response from the local service
 type HTTPResponse struct {
+	ID         uint64              `json:"id"`
 	StatusCode int                 `json:"status_code"`
 	Headers    map[string][]string `json:"headers"`
-	Body       []byte              `json:"body"`
+	Body       []byte              `json:"body,omitempty"`
+	Error      string              `json:"error,omitempty"` // Set when the agent answered on the local service's behalf, see ForwardErr*
+
+	BodyEncoding string `json:"body_encoding,omitempty"` // Compression applied to Body, see Compression*
 }
 
-// WriteMessage writes a message to the writer
+// Forwarding error codes, reported in HTTPResponse.Error
+const (
+	ForwardErrTimeout     = "local_timeout"     // The local service didn't answer before the deadline
+	ForwardErrUnreachable = "local_unreachable" // The local service couldn't be reached or failed mid-response
+	ForwardErrTooLarge    = "body_too_large"    // The request or response body exceeded the agent's limit
+	ForwardErrDropped     = "dropped"           // The visitor's connection is to be cut without a response, see mt_agent -chaos-drop-rate
+)
+
+// WriteMessage writes a message to the writer as a line of JSON
 func WriteMessage(w io.Writer, msg Message) error {
-	data, err := json.Marshal(msg)
+	data, err := encodeJSON(msg)
 	if err != nil {
 		return err
 	}
-	data = append(data, '\n')
 	_, err = w.Write(data)
 	return err
 }
 
-// ReadMessage reads a message from the reader
-func ReadMessage(r io.Reader) (*Message, error) {
-	decoder := json.NewDecoder(r)
+// encodeJSON encodes msg as a line of JSON, with the body inlined
+func encodeJSON(msg Message) ([]byte, error) {
+	payload, err := withInlineBody(msg.Payload, msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	msg.Payload = payload
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// Size limits for incoming messages
+const (
+	DefaultMaxMessageSize     = 100 << 20 // Room for the default body limits, base64 encoded
+	DefaultMaxReassembledSize = 256 << 20 // Message split into continuation frames, see WriteOptions
+	MaxHelloSize              = 64 << 10  // First message on a connection, before the peer is known
+	MaxOfflinePageSize        = 32 << 10  // HelloPayload.OfflinePage, so that the hello stays below MaxHelloSize
+)
+
+// ErrMessageTooLarge is returned by ReadMessage for messages over the
+// reader's size limit. The stream can't be read any further
+var ErrMessageTooLarge = errors.New("message too large")
+
+// Reader reads messages from a stream. Use a single Reader per stream: it
+// buffers, so bytes past the current message belong to the next call
+type Reader struct {
+	br             *bufio.Reader
+	framing        Framing
+	maxSize        int64
+	maxReassembled int64
+	verifier       *Verifier // Checks the signature of every message, nil for none
+}
+
+// NewReader creates a message reader on top of r, reading JSON framing
+// with the default size limit
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		br:             bufio.NewReader(r),
+		framing:        FramingJSON,
+		maxSize:        DefaultMaxMessageSize,
+		maxReassembled: DefaultMaxReassembledSize,
+	}
+}
+
+// SetFraming switches the framing of the following messages
+func (r *Reader) SetFraming(f Framing) {
+	r.framing = f
+}
+
+// SetMaxSize sets the largest message or frame ReadMessage accepts, in
+// bytes
+func (r *Reader) SetMaxSize(n int64) {
+	r.maxSize = n
+}
+
+// SetMaxReassembledSize sets the largest message ReadMessage accepts in
+// continuation frames, in bytes
+func (r *Reader) SetMaxReassembledSize(n int64) {
+	r.maxReassembled = n
+}
+
+// SetVerifier makes ReadMessage refuse the following messages unless v
+// accepts their signature, see CapSigning
+func (r *Reader) SetVerifier(v *Verifier) {
+	r.verifier = v
+}
+
+// ReadMessage reads the next message
+func (r *Reader) ReadMessage() (*Message, error) {
+	msg, err := r.readMessage()
+	if err != nil || r.verifier == nil {
+		return msg, err
+	}
+	if err := r.verifier.verify(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Raw returns what follows the messages read so far, for streams that
+// carry raw bytes after a head message
+func (r *Reader) Raw() io.Reader {
+	return r.br
+}
+
+// readMessage reads the next message in the reader's framing
+func (r *Reader) readMessage() (*Message, error) {
+	if r.framing == FramingBinary {
+		return r.readBinaryMessage()
+	}
+	// Read the line in buffer-sized pieces so an endless line is cut off
+	// at the limit instead of growing without bound
+	var line []byte
+	for {
+		chunk, err := r.br.ReadSlice('\n')
+		if int64(len(line)+len(chunk)) > r.maxSize {
+			return nil, fmt.Errorf("%w: over %d bytes", ErrMessageTooLarge, r.maxSize)
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
 	var msg Message
-	if err := decoder.Decode(&msg); err != nil {
+	if err := json.Unmarshal(line, &msg); err != nil {
 		return nil, err
 	}
 	return &msg, nil
 }
 
-// NewWelcomeMessage creates a welcome message
-func NewWelcomeMessage(clientID, tunnelURL string) (Message, error) {
-	payload := WelcomePayload{
-		ClientID:  clientID,
-		TunnelURL: tunnelURL,
+// DecodeRequest parses a request message, whichever framing carried it
+func (m *Message) DecodeRequest() (HTTPRequest, error) {
+	var req HTTPRequest
+	if err := json.Unmarshal(m.Payload, &req); err != nil {
+		return HTTPRequest{}, err
+	}
+	if m.Body != nil {
+		req.Body = m.Body
+	}
+	return req, nil
+}
+
+// DecodeResponse parses a response message, whichever framing carried it
+func (m *Message) DecodeResponse() (HTTPResponse, error) {
+	var resp HTTPResponse
+	if err := json.Unmarshal(m.Payload, &resp); err != nil {
+		return HTTPResponse{}, err
 	}
+	if m.Body != nil {
+		resp.Body = m.Body
+	}
+	return resp, nil
+}
+
+// NewHelloMessage creates a hello message
+func NewHelloMessage(payload HelloPayload) (Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Type:    MsgTypeHello,
+		Payload: data,
+	}, nil
+}
+
+// NewPollMessage creates a poll message
+func NewPollMessage(payload PollPayload) (Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Type:    MsgTypePoll,
+		Payload: data,
+	}, nil
+}
+
+// NewPollResultMessage creates a poll result message
+func NewPollResultMessage(payload PollResultPayload) (Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Type:    MsgTypePollResult,
+		Payload: data,
+	}, nil
+}
+
+// NewWelcomeMessage creates a welcome message
+func NewWelcomeMessage(payload WelcomePayload) (Message, error) {
 	data, err := json.Marshal(payload)
 	if err != nil {
 		return Message{}, err
@@ -85,8 +565,90 @@ func NewWelcomeMessage(clientID, tunnelURL string) (Message, error) {
 	}, nil
 }
 
+// NewHeartbeatMessage creates a heartbeat message
+func NewHeartbeatMessage(payload HeartbeatPayload) (Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Type:    MsgTypeHeartbeat,
+		Payload: data,
+	}, nil
+}
+
+// NewPongMessage creates a pong message
+func NewPongMessage(payload PongPayload) (Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Type:    MsgTypePong,
+		Payload: data,
+	}, nil
+}
+
+// NewDisconnectMessage creates a disconnect message
+func NewDisconnectMessage(payload DisconnectPayload) (Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Type:    MsgTypeDisconnect,
+		Payload: data,
+	}, nil
+}
+
+// NewHealthMessage creates a health message
+func NewHealthMessage(payload HealthPayload) (Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Type:    MsgTypeHealth,
+		Payload: data,
+	}, nil
+}
+
+// NewPromoteMessage creates a promote message
+func NewPromoteMessage() Message {
+	return Message{
+		Type:    MsgTypePromote,
+		Payload: json.RawMessage("{}"),
+	}
+}
+
+// NewRejectMessage creates a reject message
+func NewRejectMessage(payload RejectPayload) (Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Type:    MsgTypeReject,
+		Payload: data,
+	}, nil
+}
+
+// NewErrorMessage creates a protocol error message
+func NewErrorMessage(payload ErrorPayload) (Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Type:    MsgTypeError,
+		Payload: data,
+	}, nil
+}
+
 // NewRequestMessage creates an HTTP request message
 func NewRequestMessage(req HTTPRequest) (Message, error) {
+	body := req.Body
+	req.Body = nil
 	data, err := json.Marshal(req)
 	if err != nil {
 		return Message{}, err
@@ -94,11 +656,14 @@ func NewRequestMessage(req HTTPRequest) (Message, error) {
 	return Message{
 		Type:    MsgTypeRequest,
 		Payload: data,
+		Body:    body,
 	}, nil
 }
 
 // NewResponseMessage creates an HTTP response message
 func NewResponseMessage(resp HTTPResponse) (Message, error) {
+	body := resp.Body
+	resp.Body = nil
 	data, err := json.Marshal(resp)
 	if err != nil {
 		return Message{}, err
@@ -106,5 +671,6 @@ func NewResponseMessage(resp HTTPResponse) (Message, error) {
 	return Message{
 		Type:    MsgTypeResponse,
 		Payload: data,
+		Body:    body,
 	}, nil
 }
@@ -0,0 +1,154 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// With CapSigning, every message on the control stream after the welcome
+// carries a sequence number, counting from 1 in each direction, and an
+// HMAC-SHA256 of it with the message. A reader refuses messages whose MAC
+// doesn't match or whose number isn't the next one, so frames injected,
+// replayed, dropped or reordered by a middlebox that terminates TLS end
+// the connection.
+//
+// The keys come from the SHA-256 digest of the agent's token, which the
+// server keeps with its reservation, and the hello and welcome payloads as
+// sent, which carry a fresh nonce each. A signing agent leaves the token
+// out of its hello and names it by TokenID, so the middlebox never sees
+// anything the keys can be derived from. A hello or welcome altered on the
+// way yields different keys on both sides, failing the first message.
+//
+// Call streams aren't signed, so signing connections don't negotiate
+// CapStreaming: streamed calls are forwarded as whole messages instead
+
+// SigningNonceSize is the size of HelloSigning.Nonce and
+// WelcomePayload.SigningNonce
+const SigningNonceSize = 16
+
+// macSize is the size of Message.MAC
+const macSize = sha256.Size
+
+// ErrBadSignature is returned by ReadMessage for a message that isn't
+// signed with the connection's key or is out of sequence. The connection
+// can't be trusted any further
+var ErrBadSignature = errors.New("bad message signature")
+
+// HelloSigning asks the server to sign the connection with the key of a
+// reserved token
+type HelloSigning struct {
+	TokenID string `json:"token_id"` // See TokenID
+	Nonce   []byte `json:"nonce"`    // SigningNonceSize random bytes
+}
+
+// TokenDigest returns the SHA-256 digest of a token, the secret signing
+// keys are derived from
+func TokenDigest(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// TokenID names a token by its digest without revealing either: the hex
+// SHA-256 of the digest
+func TokenID(digest []byte) string {
+	sum := sha256.Sum256(digest)
+	return hex.EncodeToString(sum[:])
+}
+
+// SigningKeys derives the keys of the messages the agent and the server
+// send from the token digest and the hello and welcome payloads exchanged
+func SigningKeys(digest, hello, welcome []byte) (agent, server []byte) {
+	transcript := sha256.New()
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(hello)))
+	transcript.Write(n[:])
+	transcript.Write(hello)
+	transcript.Write(welcome)
+	sum := transcript.Sum(nil)
+
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, digest)
+		mac.Write([]byte(label))
+		mac.Write(sum)
+		return mac.Sum(nil)
+	}
+	return derive("minitunnel signing agent v1"), derive("minitunnel signing server v1")
+}
+
+// Signer signs the messages one side sends. Sign is called by
+// WriteOptions.Write, under the writer's lock
+type Signer struct {
+	key  []byte
+	next uint64
+}
+
+// NewSigner returns a signer numbering messages from 1
+func NewSigner(key []byte) *Signer {
+	return &Signer{key: key, next: 1}
+}
+
+// sign numbers msg and sets its MAC
+func (s *Signer) sign(msg *Message) {
+	msg.Seq = s.next
+	msg.MAC = messageMAC(hmac.New(sha256.New, s.key), msg)
+	s.next++
+}
+
+// unsign gives back the number of a message that wasn't sent
+func (s *Signer) unsign() {
+	s.next--
+}
+
+// Verifier checks the messages one side receives, see Reader.SetVerifier
+type Verifier struct {
+	mac  hash.Hash
+	next uint64
+}
+
+// NewVerifier returns a verifier expecting messages numbered from 1
+func NewVerifier(key []byte) *Verifier {
+	return &Verifier{mac: hmac.New(sha256.New, key), next: 1}
+}
+
+// verify checks msg's MAC and number
+func (v *Verifier) verify(msg *Message) error {
+	if msg.MAC == nil {
+		return fmt.Errorf("%w: %s message not signed", ErrBadSignature, msg.Type)
+	}
+	v.mac.Reset()
+	if !hmac.Equal(msg.MAC, messageMAC(v.mac, msg)) {
+		return fmt.Errorf("%w: %s message %d", ErrBadSignature, msg.Type, msg.Seq)
+	}
+	if msg.Seq != v.next {
+		return fmt.Errorf("%w: %s message %d, expected %d", ErrBadSignature, msg.Type, msg.Seq, v.next)
+	}
+	v.next++
+	return nil
+}
+
+// messageMAC returns the MAC of msg's number, type, payload and body
+func messageMAC(mac hash.Hash, msg *Message) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], msg.Seq)
+	mac.Write(buf[:])
+	for _, part := range [][]byte{[]byte(msg.Type), msg.Payload} {
+		binary.BigEndian.PutUint32(buf[:4], uint32(len(part)))
+		mac.Write(buf[:4])
+		mac.Write(part)
+	}
+	// A missing body is told apart from an empty one
+	if msg.Body == nil {
+		mac.Write([]byte{0})
+	} else {
+		mac.Write([]byte{1})
+		binary.BigEndian.PutUint32(buf[:4], uint32(len(msg.Body)))
+		mac.Write(buf[:4])
+		mac.Write(msg.Body)
+	}
+	return mac.Sum(nil)
+}
@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Calls whose bodies stream both ways while they last, such as gRPC, can't
+// be forwarded as a single request and response message. With
+// CapStreaming the server sends them on a QUIC stream of their own, a call
+// stream, instead of the control stream:
+//
+//	server → agent: request (Streaming set, no body), data..., end
+//	agent → server: response (no body), data..., end
+//
+// Each direction is closed after its end message. Messages on call streams
+// are always binary framed. Either side resets the stream with
+// CallErrCanceled to abort the call
+const CallErrCanceled = 1
+
+// StreamChunkSize is the most body bytes sent in one data message
+const StreamChunkSize = 32 << 10
+
+// EndPayload closes a streamed body
+type EndPayload struct {
+	Trailers map[string][]string `json:"trailers,omitempty"` // Response trailers, e.g. grpc-status
+	Error    string              `json:"error,omitempty"`    // The body was cut short, see ForwardErr*
+}
+
+// NewCallReader creates a reader for the messages of a call stream
+func NewCallReader(r io.Reader) *Reader {
+	reader := NewReader(r)
+	reader.SetFraming(FramingBinary)
+	return reader
+}
+
+// NewDataMessage creates a message carrying a chunk of a streamed body
+func NewDataMessage(chunk []byte) Message {
+	return Message{
+		Type:    MsgTypeData,
+		Payload: json.RawMessage("{}"),
+		Body:    chunk,
+	}
+}
+
+// NewEndMessage creates the message closing a streamed body
+func NewEndMessage(payload EndPayload) (Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Type:    MsgTypeEnd,
+		Payload: data,
+	}, nil
+}
+
+// CopyBody sends what r yields to a call stream as data messages, each as
+// soon as it is read, until r ends. It returns the body bytes sent
+func CopyBody(w io.Writer, r io.Reader) (int64, error) {
+	buf := make([]byte, StreamChunkSize)
+	var sent int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if werr := WriteBinaryMessage(w, NewDataMessage(buf[:n])); werr != nil {
+				return sent, werr
+			}
+			sent += int64(n)
+		}
+		if err == io.EOF {
+			return sent, nil
+		}
+		if err != nil {
+			return sent, err
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Package quicconf lets operators tune how the QUIC control connection
+// between agents and the server is kept alive, so NATs and firewalls that
+// forget quiet UDP flows after 30 seconds or so don't drop idle tunnels
+package quicconf
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Options are the QUIC settings given on the command line
+type Options struct {
+	KeepAlive        time.Duration // Send a keep-alive packet after this long without traffic, none if 0
+	IdleTimeout      time.Duration // Close the connection after this long without hearing from the peer
+	HandshakeTimeout time.Duration // Give up on a handshake the peer stops answering for this long
+}
+
+// RegisterFlags registers the options' command line flags
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&o.KeepAlive, "quic-keep-alive", 15*time.Second, "Send a QUIC keep-alive packet after this long without traffic, to keep NAT mappings open (0 to disable)")
+	fs.DurationVar(&o.IdleTimeout, "quic-idle-timeout", 60*time.Second, "Close the QUIC connection after this long without hearing from the other side (the lower of both sides' values applies)")
+	fs.DurationVar(&o.HandshakeTimeout, "quic-handshake-timeout", 10*time.Second, "Give up on a QUIC handshake the other side stops answering for this long")
+}
+
+// Validate checks the options
+func (o *Options) Validate() error {
+	if o.KeepAlive < 0 {
+		return fmt.Errorf("-quic-keep-alive cannot be negative")
+	}
+	if o.IdleTimeout <= 0 {
+		return fmt.Errorf("-quic-idle-timeout must be positive")
+	}
+	if o.HandshakeTimeout <= 0 {
+		return fmt.Errorf("-quic-handshake-timeout must be positive")
+	}
+	if o.KeepAlive >= o.IdleTimeout {
+		return fmt.Errorf("-quic-keep-alive (%s) must be shorter than -quic-idle-timeout (%s)", o.KeepAlive, o.IdleTimeout)
+	}
+	return nil
+}
+
+// Apply sets the options on cfg. Zero options, as in a config built
+// without RegisterFlags, leave quic-go's defaults
+func (o *Options) Apply(cfg *quic.Config) *quic.Config {
+	if cfg == nil {
+		cfg = &quic.Config{}
+	}
+	cfg.KeepAlivePeriod = o.KeepAlive
+	if o.IdleTimeout > 0 {
+		cfg.MaxIdleTimeout = o.IdleTimeout
+	}
+	if o.HandshakeTimeout > 0 {
+		cfg.HandshakeIdleTimeout = o.HandshakeTimeout
+	}
+	return cfg
+}
+
+// String describes the options for startup logs
+func (o *Options) String() string {
+	keepAlive := "off"
+	if o.KeepAlive > 0 {
+		keepAlive = o.KeepAlive.String()
+	}
+	return fmt.Sprintf("keep-alive %s, idle timeout %s, handshake timeout %s", keepAlive, o.IdleTimeout, o.HandshakeTimeout)
+}
@@ -0,0 +1,96 @@
+package rewrite
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+var (
+	// ErrUnsupportedEncoding is returned for a Content-Encoding that can't
+	// be decoded, such as zstd or several encodings stacked
+	ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+	// ErrTooLarge is returned when a decoded body exceeds its limit
+	ErrTooLarge = errors.New("decoded body too large")
+)
+
+// Supported reports whether bodies with the given Content-Encoding can be
+// decoded and encoded again
+func Supported(encoding string) bool {
+	switch normalize(encoding) {
+	case "", "gzip", "x-gzip", "br", "deflate":
+		return true
+	}
+	return false
+}
+
+// Decode returns body without its Content-Encoding, failing with
+// ErrTooLarge if it would exceed limit bytes
+func Decode(body []byte, encoding string, limit int64) ([]byte, error) {
+	var r io.Reader
+	switch normalize(encoding) {
+	case "":
+		return body, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gzip body: %w", err)
+		}
+		r = zr
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	case "deflate":
+		r = flate.NewReader(bytes.NewReader(body))
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+	}
+	decoded, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s body: %w", encoding, err)
+	}
+	if int64(len(decoded)) > limit {
+		return nil, ErrTooLarge
+	}
+	return decoded, nil
+}
+
+// Encode applies a Content-Encoding to body
+func Encode(body []byte, encoding string) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch normalize(encoding) {
+	case "":
+		return body, nil
+	case "gzip", "x-gzip":
+		w = gzip.NewWriter(&buf)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, fmt.Errorf("failed to encode %s body: %w", encoding, err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode %s body: %w", encoding, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// normalize lowercases an encoding, treating identity as none
+func normalize(encoding string) string {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	if encoding == "identity" {
+		return ""
+	}
+	return encoding
+}
@@ -0,0 +1,186 @@
+// Package rewrite adapts pages of a local service to the public URL of its
+// tunnel, for tunnels served under a path prefix. Local services believe
+// they are served from the root of their own host, so the links they write
+// miss the prefix or name the local address
+package rewrite
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// urlAttrs lists, per element, the attributes holding a single URL
+var urlAttrs = map[string][]string{
+	"a":      {"href"},
+	"area":   {"href"},
+	"audio":  {"src"},
+	"base":   {"href"},
+	"button": {"formaction"},
+	"embed":  {"src"},
+	"form":   {"action"},
+	"iframe": {"src"},
+	"img":    {"src"},
+	"input":  {"formaction", "src"},
+	"link":   {"href"},
+	"object": {"data"},
+	"script": {"src"},
+	"source": {"src"},
+	"track":  {"src"},
+	"video":  {"src", "poster"},
+}
+
+// Rewriter rewrites the URLs in a page with URL
+type Rewriter struct {
+	// URL returns the public form of a URL found in the page. It is given
+	// every URL, relative or on other hosts too
+	URL func(string) string
+}
+
+// Body rewrites an HTML body sent with the given Content-Encoding,
+// decoding it first and encoding the result the same way. Bodies larger
+// than limit once decoded fail with ErrTooLarge, bodies in an encoding
+// this package doesn't support with ErrUnsupportedEncoding
+func (rw *Rewriter) Body(body []byte, encoding string, limit int64) ([]byte, error) {
+	page, err := Decode(body, encoding, limit)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := rw.HTML(&out, bytes.NewReader(page)); err != nil {
+		return nil, err
+	}
+	return Encode(out.Bytes(), encoding)
+}
+
+// HTML copies a page from r to w, rewriting the URLs in its tags. Everything
+// else, including scripts, styles, comments and formatting, is copied as it
+// is
+func (rw *Rewriter) HTML(w io.Writer, r io.Reader) error {
+	z := html.NewTokenizer(r)
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			if err := z.Err(); !errors.Is(err, io.EOF) {
+				return err
+			}
+			return nil
+		case html.StartTagToken, html.SelfClosingTagToken:
+			raw := bytes.Clone(z.Raw())
+			tok := z.Token()
+			if rw.rewriteTag(&tok) {
+				_, err := io.WriteString(w, tok.String())
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := w.Write(raw); err != nil {
+				return err
+			}
+		default:
+			if _, err := w.Write(z.Raw()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// rewriteTag rewrites the URLs in a tag's attributes, reporting whether
+// any changed
+func (rw *Rewriter) rewriteTag(tok *html.Token) bool {
+	names := urlAttrs[tok.Data]
+	changed := false
+	for i, attr := range tok.Attr {
+		if attr.Namespace != "" {
+			continue
+		}
+		value := attr.Val
+		switch {
+		case slices.Contains(names, attr.Key):
+			value = rw.url(attr.Val)
+		case attr.Key == "srcset" && (tok.Data == "img" || tok.Data == "source"):
+			value = rw.srcset(attr.Val)
+		case attr.Key == "content" && tok.Data == "meta" && refreshMeta(tok.Attr):
+			value = rw.Refresh(attr.Val)
+		}
+		if value != attr.Val {
+			tok.Attr[i].Val = value
+			changed = true
+		}
+	}
+	return changed
+}
+
+// url rewrites a URL, keeping the whitespace browsers ignore around it
+func (rw *Rewriter) url(raw string) string {
+	trimmed := strings.TrimSpace(raw)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return raw
+	}
+	return rw.URL(trimmed)
+}
+
+// srcset rewrites the URLs of a srcset attribute: comma-separated URLs,
+// each optionally followed by a width or density
+func (rw *Rewriter) srcset(value string) string {
+	candidates := strings.Split(value, ",")
+	for i, c := range candidates {
+		fields := strings.Fields(c)
+		if len(fields) == 0 {
+			continue
+		}
+		fields[0] = rw.url(fields[0])
+		candidates[i] = strings.Join(fields, " ")
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// Refresh rewrites the URL of a Refresh header or meta tag, e.g.
+// "5; url=/next"
+func (rw *Rewriter) Refresh(value string) string {
+	idx := strings.Index(strings.ToLower(value), "url=")
+	if idx < 0 {
+		return value
+	}
+	target := strings.Trim(strings.TrimSpace(value[idx+len("url="):]), `"'`)
+	return value[:idx+len("url=")] + rw.url(target)
+}
+
+// CSP rewrites the sources of a Content-Security-Policy that name URLs,
+// such as http://localhost:3000 or a report-uri path, so that the policy
+// allows the rewritten page. Keywords, schemes and bare hosts are kept
+func (rw *Rewriter) CSP(policy string) string {
+	directives := strings.Split(policy, ";")
+	for i, d := range directives {
+		fields := strings.Fields(d)
+		if len(fields) < 2 {
+			continue
+		}
+		for j, source := range fields[1:] {
+			if strings.Contains(source, "://") || strings.HasPrefix(source, "/") {
+				fields[j+1] = rw.url(source)
+			}
+		}
+		directives[i] = " " + strings.Join(fields, " ")
+		if i == 0 {
+			directives[i] = directives[i][1:]
+		}
+	}
+	return strings.Join(directives, ";")
+}
+
+// refreshMeta reports whether a meta tag's attributes make it a refresh
+func refreshMeta(attrs []html.Attribute) bool {
+	for _, a := range attrs {
+		if a.Key == "http-equiv" && strings.EqualFold(strings.TrimSpace(a.Val), "refresh") {
+			return true
+		}
+	}
+	return false
+}
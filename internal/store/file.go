@@ -0,0 +1,123 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// flushInterval is how often File writes out changed usage. Reservations
+// are written at once
+const flushInterval = 30 * time.Second
+
+// File is a Store kept in a JSON file. The whole file is rewritten on every
+// change, through a temporary file so that a crash never leaves half of
+// it: fine for the hundreds of tunnels a server has, not for millions
+type File struct {
+	*Memory
+	path string
+	stop chan struct{}
+	done chan struct{}
+}
+
+// OpenFile loads the store at path, or starts an empty one that is created
+// on the first change
+func OpenFile(path string) (*File, error) {
+	f := &File{
+		Memory: NewMemory(),
+		path:   path,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read state: %w", err)
+	default:
+		if err := json.Unmarshal(data, &f.state); err != nil {
+			return nil, fmt.Errorf("failed to parse state %s: %w", path, err)
+		}
+		if f.state.Reservations == nil {
+			f.state.Reservations = []Reservation{}
+		}
+		if f.state.TokenUsage == nil {
+			f.state.TokenUsage = map[string]TokenUsage{}
+		}
+		if f.state.Tunnels == nil {
+			f.state.Tunnels = map[string]Tunnel{}
+		}
+		for i, res := range f.state.Reservations {
+			if len(res.Names) == 0 || res.TokenSHA256 == "" {
+				return nil, fmt.Errorf("reservation %d in %s needs names and a token_sha256", i+1, path)
+			}
+		}
+	}
+	f.persist = f.write
+	go f.flushLoop()
+	return f, nil
+}
+
+// flushLoop writes out usage changes every flushInterval
+func (f *File) flushLoop() {
+	defer close(f.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.flush(); err != nil {
+				log.Printf("Error saving state: %v", err)
+			}
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// flush writes the state if usage changed since it was last written
+func (f *File) flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.dirty {
+		return nil
+	}
+	return f.write()
+}
+
+// write replaces the file with the current state. Callers hold f.mu
+func (f *File) write() error {
+	data, err := json.MarshalIndent(f.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), "."+filepath.Base(f.path)+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	f.dirty = false
+	return nil
+}
+
+// Close stops the periodic writes and writes out the latest usage
+func (f *File) Close() error {
+	close(f.stop)
+	<-f.done
+	return f.flush()
+}
@@ -0,0 +1,309 @@
+// Package store keeps the server state that has to survive a restart: the
+// tunnel names reserved for agent tokens with the usage of each token, and
+// the named tunnels seen with their accumulated usage. Memory keeps it for the life of the process,
+// File in a JSON file
+package store
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned for a name that isn't reserved
+	ErrNotFound = errors.New("not found")
+	// ErrReserved is returned when reserving a name that already is
+	ErrReserved = errors.New("name already reserved")
+)
+
+// Reservation gives the agents presenting a token its tunnel names, which
+// no other agent may use
+type Reservation struct {
+	Names       []string  `json:"names"`
+	Note        string    `json:"note,omitempty"`  // Who the names are for
+	TokenSHA256 string    `json:"token_sha256"`    // Hex digest of the token, which is not kept
+	Quota       *Quota    `json:"quota,omitempty"` // Nil for unlimited use
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Limits caps the traffic over a period, 0 for no cap
+type Limits struct {
+	Requests int64 `json:"requests,omitempty"`
+	Bytes    int64 `json:"bytes,omitempty"` // Request and response bodies together
+}
+
+// Reached reports whether usage is at one of the caps
+func (l Limits) Reached(usage Usage) bool {
+	return (l.Requests > 0 && usage.Requests >= l.Requests) ||
+		(l.Bytes > 0 && usage.BytesIn+usage.BytesOut >= l.Bytes)
+}
+
+// Quota caps what the agents of a token may serve per calendar day and
+// month, in UTC
+type Quota struct {
+	Daily   Limits `json:"daily"`
+	Monthly Limits `json:"monthly"`
+}
+
+// Usage counts the traffic of a tunnel
+type Usage struct {
+	Requests int64 `json:"requests"`
+	Errors   int64 `json:"errors"`    // Failed by the tunnel or answered with a 5xx
+	BytesIn  int64 `json:"bytes_in"`  // Request bodies received from visitors
+	BytesOut int64 `json:"bytes_out"` // Response bodies sent to visitors
+}
+
+// Add adds the counts of other to u
+func (u *Usage) Add(other Usage) {
+	u.Requests += other.Requests
+	u.Errors += other.Errors
+	u.BytesIn += other.BytesIn
+	u.BytesOut += other.BytesOut
+}
+
+// TokenUsage counts the traffic of the agents of a token, in the current
+// day and month and in total
+type TokenUsage struct {
+	Day     string `json:"day"` // UTC date Daily counts, as 2006-01-02
+	Daily   Usage  `json:"daily"`
+	Month   string `json:"month"` // UTC month Monthly counts, as 2006-01
+	Monthly Usage  `json:"monthly"`
+	Total   Usage  `json:"total"`
+}
+
+// rollover starts new periods if at is past the ones counted
+func (u *TokenUsage) rollover(at time.Time) {
+	at = at.UTC()
+	if day := at.Format(time.DateOnly); u.Day != day {
+		u.Day, u.Daily = day, Usage{}
+	}
+	if month := at.Format("2006-01"); u.Month != month {
+		u.Month, u.Monthly = month, Usage{}
+	}
+}
+
+// Tunnel is a named tunnel as seen over all its connections
+type Tunnel struct {
+	Name        string    `json:"name"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`   // When an agent last connected to it
+	Connections int64     `json:"connections"` // Agents that connected to it
+	Usage
+}
+
+// Store keeps the server's state. Its methods may be called concurrently
+type Store interface {
+	// Reservations returns every reservation, oldest first
+	Reservations() ([]Reservation, error)
+
+	// AddReservation stores res, or returns ErrReserved if one of its
+	// names is reserved already
+	AddReservation(res Reservation) error
+
+	// DeleteReservation removes the reservation holding name, with all its
+	// names and the usage of its token, and returns it. It returns
+	// ErrNotFound if there is none
+	DeleteReservation(name string) (Reservation, error)
+
+	// SetQuota replaces the quota of the reservation holding name, nil for
+	// none, and returns the reservation. It returns ErrNotFound if there is
+	// none
+	SetQuota(name string, quota *Quota) (Reservation, error)
+
+	// AddTokenUsage adds to the usage of the token with the hex SHA-256
+	// digest, counting it in the day and month of at
+	AddTokenUsage(digest string, usage Usage, at time.Time) error
+
+	// TokenUsage returns the usage of the token with the digest, with the
+	// day and month of at
+	TokenUsage(digest string, at time.Time) (TokenUsage, error)
+
+	// TunnelConnected records that an agent connected to the named tunnel
+	TunnelConnected(name string, at time.Time) error
+
+	// AddUsage adds to the usage of the named tunnel
+	AddUsage(name string, usage Usage) error
+
+	// Tunnels returns the named tunnels seen, by name
+	Tunnels() ([]Tunnel, error)
+
+	// Close writes out what is still buffered
+	Close() error
+}
+
+// state is what a store holds, as written by File
+type state struct {
+	Reservations []Reservation         `json:"reservations"`
+	TokenUsage   map[string]TokenUsage `json:"token_usage"` // By token digest
+	Tunnels      map[string]Tunnel     `json:"tunnels"`
+}
+
+// Memory is a Store that forgets everything when the process exits, for
+// servers that don't need to keep their state and for tests
+type Memory struct {
+	mu    sync.Mutex
+	state state
+	dirty bool // Usage changed since the last flush
+
+	// persist writes the state after a reservation changed, which is
+	// undone if it fails. Called with mu held, nil for memory only
+	persist func() error
+}
+
+// NewMemory returns an empty in-memory store
+func NewMemory() *Memory {
+	return &Memory{state: state{
+		Reservations: []Reservation{},
+		TokenUsage:   map[string]TokenUsage{},
+		Tunnels:      map[string]Tunnel{},
+	}}
+}
+
+// Reservations implements Store
+func (m *Memory) Reservations() ([]Reservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.state.Reservations), nil
+}
+
+// AddReservation implements Store
+func (m *Memory) AddReservation(res Reservation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, name := range res.Names {
+		if m.reservationOf(name) >= 0 {
+			return ErrReserved
+		}
+	}
+	old := m.state.Reservations
+	m.state.Reservations = append(slices.Clone(old), res)
+	return m.commit(old)
+}
+
+// DeleteReservation implements Store
+func (m *Memory) DeleteReservation(name string) (Reservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.reservationOf(name)
+	if i < 0 {
+		return Reservation{}, ErrNotFound
+	}
+	old := m.state.Reservations
+	res := old[i]
+	m.state.Reservations = slices.Delete(slices.Clone(old), i, i+1)
+	if err := m.commit(old); err != nil {
+		return Reservation{}, err
+	}
+	if _, ok := m.state.TokenUsage[res.TokenSHA256]; ok {
+		delete(m.state.TokenUsage, res.TokenSHA256)
+		m.dirty = true
+	}
+	return res, nil
+}
+
+// SetQuota implements Store
+func (m *Memory) SetQuota(name string, quota *Quota) (Reservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.reservationOf(name)
+	if i < 0 {
+		return Reservation{}, ErrNotFound
+	}
+	old := m.state.Reservations
+	m.state.Reservations = slices.Clone(old)
+	m.state.Reservations[i].Quota = quota
+	return m.state.Reservations[i], m.commit(old)
+}
+
+// reservationOf returns the index of the reservation holding name, or -1.
+// Callers hold m.mu
+func (m *Memory) reservationOf(name string) int {
+	return slices.IndexFunc(m.state.Reservations, func(res Reservation) bool {
+		return slices.Contains(res.Names, name)
+	})
+}
+
+// commit persists a change to the reservations, restoring old if that
+// fails. Callers hold m.mu
+func (m *Memory) commit(old []Reservation) error {
+	if m.persist == nil {
+		return nil
+	}
+	if err := m.persist(); err != nil {
+		m.state.Reservations = old
+		return err
+	}
+	return nil
+}
+
+// TunnelConnected implements Store
+func (m *Memory) TunnelConnected(name string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.state.Tunnels[name]
+	if !ok {
+		t = Tunnel{Name: name, FirstSeen: at}
+	}
+	t.LastSeen = at
+	t.Connections++
+	m.state.Tunnels[name] = t
+	m.dirty = true
+	return nil
+}
+
+// AddUsage implements Store
+func (m *Memory) AddUsage(name string, usage Usage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.state.Tunnels[name]
+	if !ok {
+		t = Tunnel{Name: name, FirstSeen: time.Now()}
+	}
+	t.Usage.Add(usage)
+	m.state.Tunnels[name] = t
+	m.dirty = true
+	return nil
+}
+
+// AddTokenUsage implements Store
+func (m *Memory) AddTokenUsage(digest string, usage Usage, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.state.TokenUsage[digest]
+	u.rollover(at)
+	u.Daily.Add(usage)
+	u.Monthly.Add(usage)
+	u.Total.Add(usage)
+	m.state.TokenUsage[digest] = u
+	m.dirty = true
+	return nil
+}
+
+// TokenUsage implements Store
+func (m *Memory) TokenUsage(digest string, at time.Time) (TokenUsage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.state.TokenUsage[digest]
+	u.rollover(at)
+	return u, nil
+}
+
+// Tunnels implements Store
+func (m *Memory) Tunnels() ([]Tunnel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tunnels := make([]Tunnel, 0, len(m.state.Tunnels))
+	for _, t := range m.state.Tunnels {
+		tunnels = append(tunnels, t)
+	}
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].Name < tunnels[j].Name })
+	return tunnels, nil
+}
+
+// Close implements Store
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,158 @@
+// Package tlspolicy lets operators control the TLS versions, cipher suites
+// and key exchange curves used by the server and agent, and require FIPS
+// 140-3 mode
+package tlspolicy
+
+import (
+	"crypto/fips140"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Policy is the TLS policy given on the command line
+type Policy struct {
+	MinVersion string // "1.2" or "1.3"
+	Ciphers    string // Comma-separated TLS 1.2 cipher suite names, Go's defaults if empty
+	Curves     string // Comma-separated key exchange curve names, Go's defaults if empty
+	FIPS       bool   // Refuse to start unless running in FIPS 140-3 mode
+}
+
+var versions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var curves = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"P256":           tls.CurveP256,
+	"P384":           tls.CurveP384,
+	"P521":           tls.CurveP521,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+}
+
+// fipsCurves and fipsCiphers are the choices approved for FIPS 140-3
+var fipsCurves = []tls.CurveID{tls.CurveP256, tls.CurveP384, tls.CurveP521}
+
+var fipsCiphers = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// RegisterFlags registers the policy's command line flags
+func (p *Policy) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&p.MinVersion, "tls-min-version", "1.2", "Lowest TLS version accepted: 1.2 or 1.3 (the QUIC control connection always uses 1.3)")
+	fs.StringVar(&p.Ciphers, "tls-ciphers", "", "Comma-separated TLS 1.2 cipher suites to allow, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (Go's defaults if empty)")
+	fs.StringVar(&p.Curves, "tls-curves", "", "Comma-separated key exchange curves in order of preference: X25519, P256, P384, P521, X25519MLKEM768 (Go's defaults if empty)")
+	fs.BoolVar(&p.FIPS, "fips", false, "Refuse to start unless running in FIPS 140-3 mode, and allow only approved TLS settings")
+}
+
+// Validate checks the policy and, with FIPS set, that the binary runs in
+// FIPS 140-3 mode and only approved ciphers and curves are chosen
+func (p *Policy) Validate() error {
+	if p.MinVersion == "" {
+		p.MinVersion = "1.2"
+	}
+	if _, ok := versions[p.MinVersion]; !ok {
+		return fmt.Errorf("invalid -tls-min-version %q: use 1.2 or 1.3", p.MinVersion)
+	}
+	ciphers, err := p.cipherSuites()
+	if err != nil {
+		return err
+	}
+	curveIDs, err := p.curvePreferences()
+	if err != nil {
+		return err
+	}
+	if !p.FIPS {
+		return nil
+	}
+	if !fips140.Enabled() {
+		return fmt.Errorf("-fips requires FIPS 140-3 mode: build with `make fips` or run with GODEBUG=fips140=on")
+	}
+	for _, id := range ciphers {
+		if !slices.Contains(fipsCiphers, id) {
+			return fmt.Errorf("cipher suite %s is not FIPS approved", tls.CipherSuiteName(id))
+		}
+	}
+	for _, id := range curveIDs {
+		if !slices.Contains(fipsCurves, id) {
+			return fmt.Errorf("curve %s is not FIPS approved", id)
+		}
+	}
+	return nil
+}
+
+// Apply sets the policy on cfg. The policy must have been validated
+func (p *Policy) Apply(cfg *tls.Config) {
+	cfg.MinVersion = versions[p.MinVersion]
+	cfg.CipherSuites, _ = p.cipherSuites()
+	cfg.CurvePreferences, _ = p.curvePreferences()
+	if p.FIPS {
+		if cfg.CipherSuites == nil {
+			cfg.CipherSuites = fipsCiphers
+		}
+		if cfg.CurvePreferences == nil {
+			cfg.CurvePreferences = fipsCurves
+		}
+	}
+}
+
+// String describes the policy for the startup log
+func (p *Policy) String() string {
+	parts := []string{"TLS " + p.MinVersion + "+"}
+	if p.Ciphers != "" {
+		parts = append(parts, "ciphers "+p.Ciphers)
+	}
+	if p.Curves != "" {
+		parts = append(parts, "curves "+p.Curves)
+	}
+	if fips140.Enabled() {
+		parts = append(parts, "FIPS 140-3 mode")
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (p *Policy) cipherSuites() ([]uint16, error) {
+	if p.Ciphers == "" {
+		return nil, nil
+	}
+	// Only TLS 1.2 suites Go considers secure can be chosen; Go doesn't
+	// let TLS 1.3 suites be configured
+	byName := map[string]uint16{}
+	for _, s := range tls.CipherSuites() {
+		if slices.Contains(s.SupportedVersions, tls.VersionTLS12) {
+			byName[s.Name] = s.ID
+		}
+	}
+	var ids []uint16
+	for _, name := range strings.Split(p.Ciphers, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown, insecure or TLS 1.3 cipher suite %q (only TLS 1.2 suites can be chosen)", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (p *Policy) curvePreferences() ([]tls.CurveID, error) {
+	if p.Curves == "" {
+		return nil, nil
+	}
+	var ids []tls.CurveID
+	for _, name := range strings.Split(p.Curves, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := curves[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q: use X25519, P256, P384, P521 or X25519MLKEM768", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
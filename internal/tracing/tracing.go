@@ -0,0 +1,116 @@
+// Package tracing follows requests through the tunnel with OpenTelemetry:
+// the server's span for the visitor's request, its span for the trip
+// through the tunnel, and the agent's spans for the request and the call to
+// the local service. Spans go to the global tracer provider, set up by
+// Setup or by a program embedding the server or agent, and are free when
+// there is none
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentation names the tracer of the spans
+const instrumentation = "minitunnel"
+
+// tracesPath is where OTLP/HTTP collectors take traces, added to endpoints
+// given without a path
+const tracesPath = "/v1/traces"
+
+// Tunnel is the attribute naming the tunnel of a request
+var Tunnel = attribute.Key("minitunnel.tunnel")
+
+// Setup exports spans over OTLP/HTTP to the collector at endpoint, such as
+// http://localhost:4318, and passes trace context on in traceparent
+// headers. The version of the service may be empty. The returned function flushes the spans still buffered and
+// stops the export
+func Setup(ctx context.Context, endpoint, service, version string) (func(context.Context) error, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTLP endpoint: %w", err)
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		u.Path = tracesPath
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	attrs := []attribute.KeyValue{semconv.ServiceName(service)}
+	if version != "" {
+		attrs = append(attrs, semconv.ServiceVersion(version))
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attrs...)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// Start starts a span with the global tracer
+func Start(ctx context.Context, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+}
+
+// Extract returns ctx with the trace context carried in headers, if any
+func Extract(ctx context.Context, headers map[string][]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(headers))
+}
+
+// Inject writes the trace context of ctx into headers, replacing what they
+// carried. Without tracing set up headers are left alone, so trace context
+// from visitors still reaches the local service
+func Inject(ctx context.Context, headers map[string][]string) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(headers))
+}
+
+// End records the status of the response and ends the span. Spans of
+// failed requests and of 5xx responses are marked as errors
+func End(span trace.Span, status int, err error) {
+	if status != 0 {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	}
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	case status >= http.StatusInternalServerError:
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// VisitorAttributes describes a visitor's request, from the client
+// address, on the server's span
+func VisitorAttributes(r *http.Request, client string) []attribute.KeyValue {
+	return append(RequestAttributes(r.Method, r.URL.Path),
+		semconv.ServerAddress(r.Host),
+		semconv.ClientAddress(client),
+		semconv.UserAgentOriginal(r.UserAgent()),
+	)
+}
+
+// RequestAttributes describes an HTTP request on a span
+func RequestAttributes(method, path string) []attribute.KeyValue {
+	path, _, _ = strings.Cut(path, "?")
+	return []attribute.KeyValue{
+		semconv.HTTPRequestMethodKey.String(method),
+		semconv.URLPath(path),
+	}
+}
@@ -0,0 +1,1064 @@
+// Package agent opens minitunnel tunnels from Go programs. It is the agent
+// mt_agent runs, so a program or test suite can put a local service on a
+// public URL without starting the command:
+//
+//	opts := agent.DefaultOptions()
+//	opts.ServerAddr = "tunnel.example.com:8080"
+//	opts.LocalAddr = "localhost:3000"
+//	a := agent.New(opts)
+//	go a.Run(ctx)
+//	for ev := range a.Events() {
+//		if ev.Type == agent.EventConnected {
+//			log.Printf("Serving on %s", ev.TunnelURL)
+//		}
+//	}
+//
+// The agent logs what it does with the standard logger, like mt_agent
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"minitunnel/internal/accesslog"
+	"minitunnel/internal/config"
+	"minitunnel/internal/httpheader"
+	"minitunnel/internal/protocol"
+	"minitunnel/internal/tracing"
+	"minitunnel/pkg/e2e"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Version is the agent version, set at build time with
+// -ldflags "-X minitunnel/pkg/agent.Version=..."
+var Version = "dev"
+
+// Options configures an agent. The fields are the mt_agent flags of the
+// same names, see DefaultOptions
+type Options = config.AgentConfig
+
+// DefaultOptions returns the options mt_agent runs with when no flags are
+// given. Options built from scratch lack limits and timeouts the agent needs
+func DefaultOptions() *Options {
+	opts := &Options{}
+	opts.RegisterFlags(flag.NewFlagSet("agent", flag.ContinueOnError))
+	return opts
+}
+
+// Request and Response are the requests forwarded through a tunnel and
+// the responses to them, as plugins see them
+type (
+	Request  = protocol.HTTPRequest
+	Response = protocol.HTTPResponse
+)
+
+type Agent struct {
+	config    *config.AgentConfig
+	watchPID  int // Process group whose listening ports are followed, if any
+	inspector *Inspector
+	dialer    *localDialer      // Resolves and connects to local services
+	transport *http.Transport   // HTTP transport to local services, using dialer
+	client    *http.Client      // Forwards requests over transport, see forwardToLocal
+	h2c       *http.Transport   // Cleartext HTTP/2 transport for streamed calls, e.g. gRPC
+	access    *accesslog.Logger // Nil unless -access-log is set
+	plugins   []Plugin          // Applied to traffic in forwardToLocal, see Use
+	e2eKey    []byte            // Seals response bodies if set, see -e2e-key
+	sessions  *sessionCache     // Session tickets for 0-RTT reconnects, nil without -0rtt
+	mirror    *mirror           // Copies requests to -mirror, nil without it
+	breaker   *breaker          // Nil unless -circuit-breaker is set
+	recorder  *recorder         // Nil unless -record is set
+	replay    *replayer         // Answers requests instead of the local service if -replay is set
+	status    agentStatus       // See Status
+	chaos     chaosState        // Faults injected into requests, see Chaos
+
+	outputMu   sync.Mutex // Serializes -json and -url-only output
+	printedURL string     // Last URL printed with -url-only
+
+	mu        sync.RWMutex
+	localAddr string // Current forwarding target, may change when following
+	tunnelURL string // Public URL of the last connection
+
+	events chan Event // See Events
+
+	rtt   atomic.Int64 // Last heartbeat round-trip time in nanoseconds
+	stats protoStats   // Protocol counters, see `mt_agent stats`
+}
+
+// New creates an agent for the given options, see DefaultOptions. Nothing
+// happens until it is started with Run or Start
+func New(opts *Options) *Agent {
+	a := &Agent{
+		config:    opts,
+		localAddr: opts.LocalAddr,
+		dialer:    newLocalDialer(opts),
+		events:    make(chan Event, eventBuffer),
+	}
+	a.status.started = time.Now()
+	a.transport = http.DefaultTransport.(*http.Transport).Clone()
+	a.transport.DialContext = a.dialer.DialContext
+	// Requests arrive concurrently, and the default of 2 idle connections
+	// per host would close most of them after each burst
+	a.transport.MaxIdleConns = 0
+	a.transport.MaxIdleConnsPerHost = opts.LocalMaxIdle
+	a.transport.DisableKeepAlives = opts.LocalMaxIdle == 0
+	a.h2c = a.transport.Clone()
+	a.h2c.Protocols = new(http.Protocols)
+	a.h2c.Protocols.SetUnencryptedHTTP2(true)
+	if opts.LocalHTTP2 {
+		a.transport = a.h2c
+	}
+	// Redirects go back to the visitor, whose browser follows them through
+	// the tunnel
+	a.client = &http.Client{
+		Transport: a.transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	if opts.E2EKey != "" {
+		a.e2eKey, _ = e2e.ParseKey(opts.E2EKey)
+	}
+	if opts.ZeroRTT {
+		a.sessions = newSessionCache(opts.SessionFile)
+	}
+	if opts.Mirror != "" {
+		a.mirror = newMirror()
+	}
+	if opts.CircuitBreaker > 0 {
+		a.breaker = newBreaker(opts.CircuitBreaker, opts.BreakerCooldown)
+	}
+	a.SetChaos(Chaos{Latency: opts.ChaosLatency, ErrorRate: opts.ChaosErrorRate, DropRate: opts.ChaosDropRate})
+	if opts.InspectAddr != "" {
+		a.inspector = NewInspector(100)
+		a.inspector.stats = &a.stats
+		a.inspector.agent = a
+	}
+	return a
+}
+
+// TunnelURL returns the public URL of the tunnel, empty until the agent
+// first connects
+func (a *Agent) TunnelURL() string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.tunnelURL
+}
+
+// LocalAddr returns the address requests are currently forwarded to
+func (a *Agent) LocalAddr() string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.localAddr
+}
+
+// SetLocalAddr changes the forwarding target of a running agent
+func (a *Agent) SetLocalAddr(addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.localAddr = addr
+}
+
+// Run starts the agent's local services and keeps the tunnel up until ctx
+// is cancelled: continuously, or in polling mode whenever the server wakes
+// the agent
+func (a *Agent) Run(ctx context.Context) (err error) {
+	defer func() { a.printStopped(err) }()
+	if a.config.ControlSocket != "" {
+		ln, err := listenControl(a.config.ControlSocket)
+		if err != nil {
+			return err
+		}
+		defer ln.Close()
+		var stop context.CancelFunc
+		ctx, stop = context.WithCancel(ctx)
+		defer stop()
+		go a.serveControl(ln, stop)
+		log.Printf("Control socket: %s", a.config.ControlSocket)
+	}
+
+	if a.config.AccessLog != "" {
+		access, err := accesslog.Open(a.config.AccessLog)
+		if err != nil {
+			return err
+		}
+		defer access.Close()
+		a.access = access
+	}
+
+	if a.config.Record != "" {
+		rec, err := openRecorder(a.config.Record)
+		if err != nil {
+			return err
+		}
+		defer rec.Close()
+		a.recorder = rec
+		log.Printf("Recording requests to %s", a.config.Record)
+	}
+	if a.config.Replay != "" {
+		replay, n, err := loadReplayer(a.config.Replay, a.config.Tunnels)
+		if err != nil {
+			return err
+		}
+		a.replay = replay
+		log.Printf("Replaying %d recorded request(s) from %s, the local service is not contacted", n, a.config.Replay)
+	}
+
+	for _, spec := range a.config.Plugins {
+		p, err := newPlugin(spec)
+		if err != nil {
+			return err
+		}
+		a.Use(p)
+	}
+	if len(a.config.Replace) > 0 {
+		a.Use(replaceBody{a.config.Replace, a.config.ReplaceTypes})
+	}
+
+	if a.inspector != nil {
+		go a.inspector.Serve(a.config.InspectAddr)
+	}
+
+	if a.config.HTTPSAddr != "" {
+		go func() {
+			if err := a.serveLocalHTTPS(a.config.HTTPSAddr); err != nil {
+				log.Printf("Local HTTPS error: %v", err)
+			}
+		}()
+	}
+
+	if a.config.OTLPEndpoint != "" {
+		stopTracing, err := tracing.Setup(ctx, a.config.OTLPEndpoint, "mt_agent", Version)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			// ctx is done by now, the spans still buffered get a moment of their own
+			flushCtx, cancel := context.WithTimeout(context.Background(), traceFlushTimeout)
+			defer cancel()
+			if err := stopTracing(flushCtx); err != nil {
+				log.Printf("Error flushing traces: %v", err)
+			}
+		}()
+		log.Printf("Exporting traces to %s", a.config.OTLPEndpoint)
+	}
+
+	if a.config.PollInterval > 0 {
+		return a.runPolling(ctx)
+	}
+	if a.config.Reconnect {
+		return a.runReconnecting(ctx)
+	}
+	return a.Start(ctx)
+}
+
+// traceFlushTimeout bounds how long Run waits to export the last spans
+const traceFlushTimeout = 5 * time.Second
+
+// Start connects to the server and forwards requests until ctx is cancelled
+// or the server goes away. Unlike Run, it leaves out the inspector, local
+// HTTPS, the access log, -plugin and -replace plugins, -record, -replay
+// and polling
+func (a *Agent) Start(ctx context.Context) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if a.config.E2EKey != "" && a.e2eKey == nil {
+		// Never fall back to sending bodies in the clear
+		_, err := e2e.ParseKey(a.config.E2EKey)
+		return err
+	}
+
+	log.Printf("Connecting to server at %s...", a.config.ServerAddr)
+
+	// Connect to server
+	conn, err := a.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.CloseWithError(0, "")
+
+	g, err := a.greet(ctx, conn)
+	if errors.Is(err, quic.Err0RTTRejected) {
+		// The server no longer knows the session, e.g. after a restart, and
+		// dropped the hello sent with it. The handshake went on in full
+		log.Printf("Server rejected 0-RTT, sending the hello again")
+		var next quic.Connection
+		if next, err = conn.NextConnection(ctx); err == nil {
+			g, err = a.greet(ctx, next)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	stream, reader, helloMsg, msg := g.stream, g.reader, g.hello, g.answer
+	defer stream.Close()
+	defer a.stats.streams.Add(-1)
+	if conn.ConnectionState().Used0RTT {
+		log.Printf("✓ Resumed the session, the hello went out with 0-RTT")
+	}
+
+	log.Printf("Received message type: %s", msg.Type)
+
+	if msg.Type == protocol.MsgTypeReject {
+		return rejectError(msg)
+	}
+	if msg.Type != protocol.MsgTypeWelcome {
+		return fmt.Errorf("expected welcome message, got %s", msg.Type)
+	}
+
+	// Parse welcome payload
+	var welcome protocol.WelcomePayload
+	if err := json.Unmarshal(msg.Payload, &welcome); err != nil {
+		return fmt.Errorf("failed to parse welcome message: %w", err)
+	}
+	if a.config.BasicAuth != "" && !welcome.BasicAuth {
+		// Don't serve the tunnel unprotected on servers that ignore it
+		return fmt.Errorf("server does not support -basic-auth")
+	}
+	if (a.config.OAuth || len(a.config.OAuthAllow) > 0) && !welcome.OAuth {
+		return fmt.Errorf("server has no OAuth login configured (see its -oauth-issuer)")
+	}
+	if (len(a.config.AllowIP) > 0 || len(a.config.DenyIP) > 0) && !welcome.IPFilter {
+		return fmt.Errorf("server does not support -allow-ip and -deny-ip")
+	}
+	if (a.config.CORS || len(a.config.CORSOrigins) > 0) && !welcome.CORS {
+		return fmt.Errorf("server does not support -cors")
+	}
+	var signer *protocol.Signer
+	if a.config.Sign {
+		if !welcome.Capabilities.Has(protocol.CapSigning) || len(welcome.SigningNonce) != protocol.SigningNonceSize {
+			return fmt.Errorf("server does not support -sign")
+		}
+		agentKey, serverKey := protocol.SigningKeys(protocol.TokenDigest(a.config.Token), helloMsg.Payload, msg.Payload)
+		signer = protocol.NewSigner(agentKey)
+		reader.SetVerifier(protocol.NewVerifier(serverKey))
+	}
+	if len(a.config.Inbox) > 0 && !welcome.Inbox {
+		log.Printf("⚠ Server does not buffer webhooks (-inbox): they fail while the agent is offline")
+	}
+
+	sess := newSession(stream, welcome, signer)
+	a.mu.Lock()
+	a.tunnelURL = welcome.TunnelURL
+	a.mu.Unlock()
+	reader.SetFraming(welcome.Framing)
+	if a.inspector != nil {
+		a.inspector.SetBaseURL(a.TunnelURL())
+	}
+
+	if a.config.Balance && !welcome.Balance {
+		log.Printf("⚠ Not sharing the tunnel name (-balance): the server doesn't support it or another agent holds the name alone")
+	}
+	if welcome.Balance {
+		log.Printf("✓ Sharing the tunnel name, the server spreads requests across agents started with -balance")
+	}
+	if a.config.Takeover && !welcome.Takeover && a.config.Name != "" && welcome.ClientID != a.config.Name {
+		log.Printf("⚠ Not taking over the tunnel (-takeover): the server doesn't support it")
+	}
+	if welcome.Takeover {
+		log.Printf("✓ Took the tunnel over, the previous agent finishes its requests and disconnects")
+	}
+	if welcome.Standby {
+		log.Printf("✓ Registered as standby, will take over if the primary agent fails")
+	} else {
+		log.Printf("✓ Tunnel established!")
+	}
+	log.Printf("Client ID: %s", sess.clientID)
+	log.Printf("Tunnel URL: %s", a.TunnelURL())
+	log.Printf("Forwarding to: %s", a.LocalAddr())
+	for _, r := range a.config.Routes {
+		log.Printf("Forwarding %s to: %s%s", r.Prefix, r.Addr, r.Path)
+	}
+	if a.mirror != nil {
+		log.Printf("Mirroring %g%% of requests to: %s", a.config.MirrorPercent, a.config.Mirror)
+	}
+	for _, t := range welcome.Tunnels {
+		log.Printf("Tunnel URL: %s → %s", t.TunnelURL, a.config.Tunnels[t.Name])
+	}
+	printWelcomeDetails(welcome)
+	log.Printf("\nPress Ctrl+C to stop...")
+	a.emit(Event{Type: EventConnected, TunnelURL: welcome.TunnelURL})
+	defer func() {
+		a.emit(Event{Type: EventDisconnected, TunnelURL: welcome.TunnelURL, Err: err})
+	}()
+
+	defer sess.printSummary()
+
+	// Drain and tear the connection down when the caller cancels
+	go func() {
+		select {
+		case <-ctx.Done():
+			a.shutdown(conn, sess)
+		case <-conn.Context().Done():
+		}
+	}()
+
+	// In polling mode, go back to sleep once traffic stops
+	if a.config.PollInterval > 0 && a.config.IdleTimeout > 0 {
+		go sess.watchIdle(ctx, a.config.IdleTimeout, cancel)
+	}
+
+	// Start heartbeat
+	go a.sendHeartbeats(ctx, sess)
+
+	// Streamed calls such as gRPC and passed-through TLS connections arrive
+	// on streams of their own
+	if welcome.Capabilities.Has(protocol.CapStreaming) || welcome.TLSPassthrough != "" {
+		go a.acceptCalls(ctx, conn, sess)
+	}
+	if a.config.TLSLocal != "" && welcome.TLSPassthrough == "" {
+		log.Printf("⚠ Server does not pass TLS connections through (-tls-passthrough-addr), -tls-local is unused")
+	}
+
+	// Tell the server when the local service fails its health check
+	if a.config.HealthCheck != "" && a.replay == nil {
+		if welcome.Capabilities.Has(protocol.CapHealth) {
+			go a.checkHealth(ctx, sess)
+		} else {
+			log.Printf("⚠ Server does not support -health-check, visitors get errors while the local service is down")
+		}
+	}
+
+	// Let the server answer visitors while the circuit breaker is open,
+	// unless the health check speaks for the local service
+	if a.breaker != nil && a.config.HealthCheck == "" {
+		if welcome.Capabilities.Has(protocol.CapHealth) {
+			a.breaker.connected(a.notifyHealth(sess))
+			defer a.breaker.connected(nil)
+		} else {
+			log.Printf("⚠ Server does not support health reports, the agent answers 503 itself while the circuit breaker is open")
+		}
+	}
+
+	// Follow the local service if it changes port
+	if a.config.Follow != "" {
+		go a.followLocalService(ctx)
+	}
+
+	// Handle incoming requests
+	if err := a.handleRequests(reader, sess); err != nil && ctx.Err() == nil {
+		var appErr *quic.ApplicationError
+		if errors.As(err, &appErr) && appErr.Remote && appErr.ErrorCode == quic.ApplicationErrorCode(protocol.ErrCodeReplaced) {
+			log.Printf("Replaced by a newer agent, exiting")
+			return nil
+		}
+		if errors.Is(err, protocol.ErrMessageTooLarge) || errors.Is(err, protocol.ErrBadSignature) {
+			// Give the server a moment to read why and hang up
+			select {
+			case <-conn.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// greeting is the opening of the control stream
+type greeting struct {
+	stream quic.Stream
+	reader *protocol.Reader
+	hello  protocol.Message  // As sent, for the signing keys
+	answer *protocol.Message // The welcome, or a reject
+}
+
+// greet opens the control stream, sends the hello and reads the server's
+// answer to it. The server answers once the handshake completes, but the
+// hello goes out before with 0-RTT if the session was resumed
+func (a *Agent) greet(ctx context.Context, conn quic.Connection) (*greeting, error) {
+	log.Printf("Opening stream to server...")
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+	a.stats.streams.Add(1)
+	fail := func(err error) (*greeting, error) {
+		stream.Close()
+		a.stats.streams.Add(-1)
+		return nil, err
+	}
+
+	log.Printf("Stream opened successfully")
+
+	// Send hello message to establish the stream
+	helloMsg, err := protocol.NewHelloMessage(a.hello())
+	if err != nil {
+		return fail(fmt.Errorf("failed to create hello message: %w", err))
+	}
+	a.stats.messagesOut.Add(1)
+	if err := protocol.WriteMessage(countingWriter{stream, &a.stats.bytesOut}, helloMsg); err != nil {
+		return fail(fmt.Errorf("failed to send hello message: %w", err))
+	}
+
+	log.Printf("Waiting for welcome message...")
+
+	// Wait for welcome message
+	reader := protocol.NewReader(countingReader{stream, &a.stats.bytesIn})
+	reader.SetMaxSize(a.config.MaxMessageSize)
+	reader.SetMaxReassembledSize(a.config.MaxReassembledSize)
+	msg, err := reader.ReadMessage()
+	if err != nil {
+		return fail(fmt.Errorf("failed to read welcome message: %w", err))
+	}
+	a.stats.messagesIn.Add(1)
+	return &greeting{stream, reader, helloMsg, msg}, nil
+}
+
+// localHosts returns the hosts of the local services, for the server to
+// rewrite redirects to them
+func (a *Agent) localHosts() []string {
+	var hosts []string
+	addrs := append([]string{a.LocalAddr()}, slices.Collect(maps.Values(a.config.Tunnels))...)
+	for _, r := range a.config.Routes {
+		addrs = append(addrs, r.Addr)
+	}
+	if custom, ok := strings.CutPrefix(a.config.HostHeader, config.HostHeaderCustom); ok {
+		addrs = append(addrs, custom)
+	}
+	for _, addr := range addrs {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		if host != "" && !slices.Contains(hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// hello builds the hello payload identifying this agent to the server
+func (a *Agent) hello() protocol.HelloPayload {
+	hostname, _ := os.Hostname()
+	userAgent := a.config.UserAgent
+	if userAgent == "" {
+		userAgent = fmt.Sprintf("minitunnel-agent/%s (%s/%s)", Version, runtime.GOOS, runtime.GOARCH)
+	}
+	hello := protocol.HelloPayload{
+		ProtocolVersion: protocol.ProtocolVersion,
+		Capabilities:    protocol.SupportedCapabilities,
+		UserAgent:       userAgent,
+		Hostname:        hostname,
+		OS:              runtime.GOOS,
+		Arch:            runtime.GOARCH,
+		Version:         Version,
+		Labels:          a.config.Labels,
+		Name:            a.config.Name,
+		Standby:         a.config.Standby,
+		Tunnels:         slices.Sorted(maps.Keys(a.config.Tunnels)),
+		Framing:         []protocol.Framing{protocol.FramingBinary},
+		MaxMessageSize:  a.config.MaxMessageSize,
+		MaxConcurrent:   a.config.MaxConcurrent,
+		Inbox:           a.config.Inbox,
+		Balance:         a.config.Balance,
+		Takeover:        a.config.Takeover,
+		TakeoverSecret:  a.config.TakeoverSecret,
+		Token:           a.config.Token,
+		HideStatus:      !a.config.StatusPage,
+		RawCookies:      !a.config.RewriteCookies,
+		LocalHosts:      a.localHosts(),
+		TLSPassthrough:  a.config.TLSLocal != "",
+	}
+	if user, password, ok := strings.Cut(a.config.BasicAuth, ":"); ok {
+		hello.BasicAuth = &protocol.BasicAuth{Username: user, Password: password}
+	}
+	if a.config.OAuth || len(a.config.OAuthAllow) > 0 {
+		hello.OAuth = &protocol.OAuthPolicy{Allow: a.config.OAuthAllow}
+	}
+	if len(a.config.AllowIP) > 0 || len(a.config.DenyIP) > 0 {
+		hello.IPFilter = &protocol.IPFilter{Allow: a.config.AllowIP, Deny: a.config.DenyIP}
+	}
+	if a.config.CORS || len(a.config.CORSOrigins) > 0 {
+		hello.CORS = &protocol.CORSPolicy{Origins: a.config.CORSOrigins, Credentials: a.config.CORSCredentials}
+	}
+	switch a.config.Compression {
+	case protocol.CompressionNone:
+	case protocol.CompressionZstd:
+		// Servers from before zstd still get to compress
+		hello.Compression = []string{protocol.CompressionZstd, protocol.CompressionGzip}
+	default:
+		hello.Compression = []string{a.config.Compression}
+	}
+	if a.e2eKey != nil {
+		// Call streams would carry bodies past sealResponse
+		hello.Capabilities &^= protocol.CapStreaming
+	}
+	if a.config.Sign {
+		// The token stays out of the hello, it keys the signatures instead
+		hello.Token = ""
+		hello.Signing = &protocol.HelloSigning{
+			TokenID: protocol.TokenID(protocol.TokenDigest(a.config.Token)),
+			Nonce:   make([]byte, protocol.SigningNonceSize),
+		}
+		rand.Read(hello.Signing.Nonce)
+	}
+	if a.config.OfflinePage != "" {
+		// Read on every connect, so edits show after the next reconnect
+		page, err := os.ReadFile(a.config.OfflinePage)
+		switch {
+		case err != nil:
+			log.Printf("⚠ Offline page not sent: %v", err)
+		case len(page) > protocol.MaxOfflinePageSize:
+			log.Printf("⚠ Offline page not sent: %s is larger than %d bytes", a.config.OfflinePage, protocol.MaxOfflinePageSize)
+		default:
+			hello.OfflinePage = string(page)
+		}
+	}
+	return hello
+}
+
+// rejectError logs why the server refused the hello and turns it into an
+// error
+func rejectError(msg *protocol.Message) error {
+	var reject protocol.RejectPayload
+	if err := json.Unmarshal(msg.Payload, &reject); err != nil {
+		return fmt.Errorf("failed to parse reject message: %w", err)
+	}
+	for _, n := range reject.Names {
+		log.Printf("✗ %s: %s (%s)", n.Name, n.Message, n.Code)
+	}
+	return fmt.Errorf("server rejected the tunnels: %s", reject.Message)
+}
+
+// printWelcomeDetails logs the guarantees the server gives for the tunnel URL
+func printWelcomeDetails(welcome protocol.WelcomePayload) {
+	if welcome.Reserved {
+		log.Printf("URL type: reserved")
+	} else {
+		log.Printf("URL type: ephemeral (released when the agent disconnects)")
+	}
+
+	if welcome.ExpiresAt != nil {
+		log.Printf("Expires: %s (in %s)", welcome.ExpiresAt.Local().Format(time.RFC1123), time.Until(*welcome.ExpiresAt).Round(time.Second))
+	} else {
+		log.Printf("Expires: never (while connected)")
+	}
+
+	if q := welcome.Quota; q != nil {
+		log.Printf("Quota: %s requests, %s bytes", formatUsage(q.RequestsUsed, q.RequestsLimit), formatUsage(q.BytesUsed, q.BytesLimit))
+		if q.ResetsAt != nil {
+			log.Printf("Quota resets: %s", q.ResetsAt.Local().Format(time.RFC1123))
+		}
+	}
+
+	if len(welcome.Features) > 0 {
+		log.Printf("Server features: %s", strings.Join(welcome.Features, ", "))
+	}
+	if welcome.ProtocolVersion > 0 {
+		log.Printf("Protocol: v%d (%s)", welcome.ProtocolVersion, welcome.Capabilities)
+	}
+	if welcome.Compression != "" {
+		log.Printf("Compression: %s", welcome.Compression)
+	}
+	if welcome.BasicAuth {
+		log.Printf("Visitors must log in with the -basic-auth credentials")
+	}
+	if welcome.OAuth {
+		log.Printf("Visitors must log in with the server's OAuth provider")
+	}
+	if welcome.IPFilter {
+		log.Printf("Visitors are checked against the -allow-ip and -deny-ip rules")
+	}
+	if welcome.CORS {
+		log.Printf("CORS preflights are answered by the server, which sets the CORS headers")
+	}
+	if welcome.TLSPassthrough != "" {
+		log.Printf("TLS passthrough: %s", welcome.TLSPassthrough)
+	}
+	if welcome.MaxConcurrent > 0 {
+		log.Printf("Concurrency: at most %d requests at once, the server queues the rest", welcome.MaxConcurrent)
+	}
+	if welcome.Inbox {
+		log.Printf("Webhooks are buffered by the server while the agent is offline")
+	}
+
+	for _, w := range welcome.Warnings {
+		log.Printf("⚠ %s (%s)", w.Message, w.Code)
+	}
+}
+
+// formatUsage renders used/limit, treating a zero limit as unlimited
+func formatUsage(used, limit int64) string {
+	if limit == 0 {
+		return fmt.Sprintf("%d/unlimited", used)
+	}
+	return fmt.Sprintf("%d/%d", used, limit)
+}
+
+// send writes a message to the server on the connection of sess,
+// serializing concurrent writers
+func (a *Agent) send(sess *session, msg protocol.Message) error {
+	a.stats.writeQueue.Add(1)
+	sess.writeMu.Lock()
+	defer sess.writeMu.Unlock()
+	a.stats.writeQueue.Add(-1)
+	a.stats.messagesOut.Add(1)
+	return sess.out.Write(countingWriter{sess.stream, &a.stats.bytesOut}, msg)
+}
+
+// RTT returns the round-trip time measured by the last heartbeat
+func (a *Agent) RTT() time.Duration {
+	return time.Duration(a.rtt.Load())
+}
+
+func (a *Agent) sendHeartbeats(ctx context.Context, sess *session) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		msg, err := protocol.NewHeartbeatMessage(protocol.HeartbeatPayload{SentAt: time.Now()})
+		if err != nil {
+			log.Printf("Error creating heartbeat: %v", err)
+			continue
+		}
+		if err := a.send(sess, msg); err != nil {
+			log.Printf("Error sending heartbeat: %v", err)
+			return
+		}
+	}
+}
+
+func (a *Agent) handleRequests(reader *protocol.Reader, sess *session) error {
+	for {
+		// Read request from server
+		msg, err := reader.ReadMessage()
+		if errors.Is(err, protocol.ErrMessageTooLarge) {
+			a.sendProtocolError(sess, protocol.ProtocolErrMessageTooLarge, err.Error())
+			return fmt.Errorf("error reading request: %w", err)
+		}
+		if errors.Is(err, protocol.ErrBadSignature) {
+			a.sendProtocolError(sess, protocol.ProtocolErrBadSignature, err.Error())
+			return fmt.Errorf("error reading request: %w", err)
+		}
+		if err != nil {
+			if err == io.EOF {
+				log.Printf("Server disconnected")
+				return nil
+			}
+			return fmt.Errorf("error reading request: %w", err)
+		}
+		a.stats.messagesIn.Add(1)
+
+		switch msg.Type {
+		case protocol.MsgTypeRequest:
+			// Parse HTTP request
+			httpReq, err := msg.DecodeRequest()
+			if err != nil {
+				log.Printf("Error parsing request: %v", err)
+				continue
+			}
+			if !sess.begin() {
+				a.rejectDraining(sess, httpReq)
+				continue
+			}
+			go func() {
+				resp := a.handleRequest(sess, httpReq)
+				sess.end(httpReq, resp)
+			}()
+
+		case protocol.MsgTypeError:
+			var perr protocol.ErrorPayload
+			json.Unmarshal(msg.Payload, &perr)
+			return fmt.Errorf("server reported a protocol error: %s (%s)", perr.Message, perr.Code)
+
+		case protocol.MsgTypePromote:
+			log.Printf("✓ Promoted: the primary agent went away, now serving %s", a.TunnelURL())
+
+		case protocol.MsgTypePong:
+			var pong protocol.PongPayload
+			if err := json.Unmarshal(msg.Payload, &pong); err != nil {
+				log.Printf("Error parsing pong: %v", err)
+				continue
+			}
+			a.rtt.Store(int64(time.Since(pong.SentAt)))
+
+		default:
+			log.Printf("Unexpected message type: %s", msg.Type)
+		}
+	}
+}
+
+// sendProtocolError tells the server why the agent is about to hang up
+func (a *Agent) sendProtocolError(sess *session, code, message string) {
+	msg, err := protocol.NewErrorMessage(protocol.ErrorPayload{Code: code, Message: message})
+	if err != nil {
+		log.Printf("Error creating protocol error message: %v", err)
+		return
+	}
+	if err := a.send(sess, msg); err != nil {
+		log.Printf("Error sending protocol error: %v", err)
+	}
+}
+
+// handleRequest forwards a single request to the local service and sends
+// the response back to the server on the connection of sess
+func (a *Agent) handleRequest(sess *session, httpReq protocol.HTTPRequest) protocol.HTTPResponse {
+	a.stats.requests.Add(1)
+	defer a.stats.requests.Add(-1)
+	log.Printf("→ %s %s", httpReq.Method, httpReq.Path)
+
+	// Forward to local service
+	start := time.Now()
+	timeout := a.config.LocalTimeout
+	if httpReq.TimeoutMs > 0 {
+		timeout = min(timeout, time.Duration(httpReq.TimeoutMs)*time.Millisecond)
+	}
+	ctx, span := startSpan(httpReq)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var resp protocol.HTTPResponse
+	err := httpReq.DecompressBody(a.config.MaxRequestBody)
+	var fault *protocol.HTTPResponse
+	if err == nil {
+		fault, err = a.injectChaos(ctx)
+	}
+	if fault == nil && err == nil {
+		fault = a.breaker.reject()
+	}
+	switch {
+	case fault != nil:
+		resp = *fault
+	case err == nil && a.replay != nil:
+		resp = a.replay.respond(httpReq)
+	case err == nil:
+		resp, err = a.forwardToLocal(ctx, httpReq)
+		a.breaker.record(err)
+		if err == nil {
+			a.recorder.record(start, httpReq, resp)
+		}
+	}
+	if err != nil {
+		log.Printf("Error forwarding request: %v", err)
+		a.status.requestFailed(httpReq, err)
+		// Send error response
+		resp = protocol.HTTPResponse{
+			StatusCode: http.StatusBadGateway,
+			Headers:    make(map[string][]string),
+			Body:       []byte(fmt.Sprintf("Error: %v", err)),
+			Error:      protocol.ForwardErrUnreachable,
+		}
+		switch {
+		case errors.Is(err, errRequestTooLarge), errors.Is(err, protocol.ErrBodyTooLarge):
+			resp.StatusCode = http.StatusRequestEntityTooLarge
+			resp.Error = protocol.ForwardErrTooLarge
+		case errors.Is(err, errResponseTooLarge):
+			resp.Error = protocol.ForwardErrTooLarge
+		case errors.Is(err, context.DeadlineExceeded):
+			resp.StatusCode = http.StatusGatewayTimeout
+			resp.Body = []byte(fmt.Sprintf("Error: local service did not respond within %s", timeout))
+			resp.Error = protocol.ForwardErrTimeout
+		}
+	}
+	resp.ID = httpReq.ID
+
+	if a.inspector != nil {
+		a.inspector.Record(start, httpReq, resp, err)
+	}
+
+	log.Printf("← %d %s %s", resp.StatusCode, httpReq.Method, httpReq.Path)
+	a.logAccess(sess, start, httpReq, resp.StatusCode, int64(len(resp.Body)))
+	a.emitRequest(start, httpReq, resp.StatusCode)
+	tracing.End(span, resp.StatusCode, err)
+
+	// Send response back to server, sealing and compressing a copy so the
+	// caller still sees the plain body
+	wire, err := a.sealResponse(resp)
+	if err != nil {
+		log.Printf("Error encrypting response: %v", err)
+		wire = protocol.HTTPResponse{
+			ID:         httpReq.ID,
+			StatusCode: http.StatusBadGateway,
+			Headers:    map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}},
+			Body:       []byte("Failed to encrypt the response\n"),
+			Error:      protocol.ForwardErrUnreachable,
+		}
+	}
+	wire.CompressBody(sess.compression)
+	respMsg, err := protocol.NewResponseMessage(wire)
+	if err != nil {
+		log.Printf("Error creating response message: %v", err)
+		return resp
+	}
+
+	err = a.send(sess, respMsg)
+	if errors.Is(err, protocol.ErrMessageTooLarge) {
+		// Tell the server the request failed instead of leaving it waiting
+		log.Printf("Response to %s %s is too large for the tunnel: %v", httpReq.Method, httpReq.Path, err)
+		respMsg, err = protocol.NewResponseMessage(protocol.HTTPResponse{
+			ID:         httpReq.ID,
+			StatusCode: http.StatusBadGateway,
+			Headers:    map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}},
+			Body:       []byte("Response too large for the tunnel\n"),
+			Error:      protocol.ForwardErrTooLarge,
+		})
+		if err == nil {
+			err = a.send(sess, respMsg)
+		}
+	}
+	if err != nil {
+		log.Printf("Error sending response: %v", err)
+	}
+	return resp
+}
+
+// sealResponse returns resp with its body sealed for the visitor's client
+// when -e2e-key is set. Errors of the agent's own aren't sealed
+func (a *Agent) sealResponse(resp protocol.HTTPResponse) (protocol.HTTPResponse, error) {
+	if a.e2eKey == nil || resp.Error != "" {
+		return resp, nil
+	}
+	headers := http.Header(resp.Headers).Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	body, err := e2e.SealResponse(a.e2eKey, headers, resp.Body)
+	if err != nil {
+		return protocol.HTTPResponse{}, err
+	}
+	resp.Headers, resp.Body = headers, body
+	return resp, nil
+}
+
+// logAccess writes a request forwarded on the connection of sess to the
+// access log
+func (a *Agent) logAccess(sess *session, start time.Time, httpReq protocol.HTTPRequest, status int, bytes int64) {
+	a.access.Log(accesslog.Entry{
+		Time:       start,
+		RemoteAddr: http.Header(httpReq.Headers).Get("X-Real-Ip"),
+		Method:     httpReq.Method,
+		Path:       httpReq.Path,
+		Status:     status,
+		Bytes:      bytes,
+		Referer:    http.Header(httpReq.Headers).Get("Referer"),
+		UserAgent:  http.Header(httpReq.Headers).Get("User-Agent"),
+		TunnelID:   sess.clientID,
+		Duration:   time.Since(start),
+	})
+}
+
+var (
+	errRequestTooLarge  = errors.New("request body too large")
+	errResponseTooLarge = errors.New("local service response body too large")
+)
+
+func (a *Agent) forwardToLocal(ctx context.Context, httpReq protocol.HTTPRequest) (protocol.HTTPResponse, error) {
+	if size := int64(len(httpReq.Body)); size > a.config.MaxRequestBody {
+		return protocol.HTTPResponse{}, fmt.Errorf("%w: %d bytes, limit is %d", errRequestTooLarge, size, a.config.MaxRequestBody)
+	}
+
+	for _, p := range a.plugins {
+		if err := p.ProcessRequest(&httpReq); err != nil {
+			return protocol.HTTPResponse{}, fmt.Errorf("plugin failed: %w", err)
+		}
+	}
+	a.mirrorRequest(httpReq)
+
+	// Create request with body if present
+	var bodyReader io.Reader
+	if len(httpReq.Body) > 0 {
+		bodyReader = bytes.NewReader(httpReq.Body)
+	}
+	req, err := a.newLocalRequest(ctx, httpReq, bodyReader)
+	if err != nil {
+		return protocol.HTTPResponse{}, err
+	}
+
+	// Send request, bounded by the deadline in ctx
+	req, span := startLocalSpan(req)
+	resp, err := a.doLocal(req)
+	if err != nil {
+		tracing.End(span, 0, err)
+		return protocol.HTTPResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	// Read response body, one byte past the limit to detect oversized ones
+	body, err := io.ReadAll(io.LimitReader(resp.Body, a.config.MaxResponseBody+1))
+	tracing.End(span, resp.StatusCode, err)
+	if err != nil {
+		return protocol.HTTPResponse{}, err
+	}
+	if int64(len(body)) > a.config.MaxResponseBody {
+		return protocol.HTTPResponse{}, fmt.Errorf("%w: more than %d bytes", errResponseTooLarge, a.config.MaxResponseBody)
+	}
+
+	httpheader.RemoveHopByHop(resp.Header)
+	httpheader.AddVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+	_, _, route := a.localTarget(httpReq)
+	unrouteLocation(route, resp.Header)
+	a.config.ResponseHeaders.Apply(resp.Header, httpReq.Tunnel)
+
+	// Create response
+	httpResp := protocol.HTTPResponse{
+		StatusCode: resp.StatusCode,
+		Headers:    resp.Header,
+		Body:       body,
+	}
+	for i := len(a.plugins) - 1; i >= 0; i-- {
+		if err := a.plugins[i].ProcessResponse(&httpReq, &httpResp); err != nil {
+			return protocol.HTTPResponse{}, fmt.Errorf("plugin failed: %w", err)
+		}
+	}
+	return httpResp, nil
+}
+
+// newLocalRequest creates the request to the local service for a request
+// received from the server
+func (a *Agent) newLocalRequest(ctx context.Context, httpReq protocol.HTTPRequest, body io.Reader) (*http.Request, error) {
+	localAddr, path, _ := a.localTarget(httpReq)
+	url := fmt.Sprintf("http://%s%s", localAddr, path)
+
+	req, err := http.NewRequestWithContext(ctx, httpReq.Method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy headers, but set the Host header per -host-header. By default it
+	// is the local address, which keeps the local service from generating
+	// absolute URLs with the tunnel domain
+	headers := httpheader.Normalize(httpReq.Headers)
+	httpheader.RemoveHopByHop(headers)
+	for key, values := range headers {
+		// Skip Host header - we'll set it below
+		if key == "Host" {
+			continue
+		}
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	a.config.RequestHeaders.Apply(req.Header, httpReq.Tunnel)
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// Keep Go from sending its own when the visitor sent none
+		req.Header.Set("User-Agent", "")
+	}
+
+	host := a.localHostHeader(localAddr, headers.Get("X-Forwarded-Host"))
+	req.Host = host
+	req.Header.Set("Host", host)
+	return req, nil
+}
@@ -0,0 +1,168 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"minitunnel/internal/protocol"
+)
+
+// breaker is the circuit breaker of -circuit-breaker: after that many
+// requests in a row fail to reach the local service it opens, and requests
+// are answered with a 503 at once rather than each waiting on the service.
+// After -circuit-breaker-cooldown it lets a single request through, and
+// closes again if that one is answered. A nil breaker never opens
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu         sync.Mutex
+	failures   int                          // Failed requests in a row
+	openedAt   time.Time                    // Zero while closed
+	trying     bool                         // A request is trying the local service after the cooldown
+	reason     string                       // Last failure
+	notify     func(protocol.HealthPayload) // Tells the server, nil if it can't be told
+	serverDown bool                         // Whether the server was told the local service is down
+	timer      *time.Timer                  // Ends the cooldown
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// connected sets how the server of a new connection is told about the
+// breaker opening and closing, nil when it can't be, and tells it at once
+// if the breaker is open
+func (b *breaker) connected(notify func(protocol.HealthPayload)) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.notify, b.serverDown = notify, false
+	cooling := !b.openedAt.IsZero() && time.Since(b.openedAt) < b.cooldown
+	if cooling && notify != nil {
+		b.serverDown = true
+	}
+	reason := b.reason
+	b.mu.Unlock()
+	if cooling && notify != nil {
+		notify(breakerHealth(reason))
+	}
+}
+
+// reject returns the response to a request while the breaker is open, or
+// nil if the request may go to the local service
+func (b *breaker) reject() *protocol.HTTPResponse {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openedAt.IsZero() {
+		return nil
+	}
+	wait := b.cooldown - time.Since(b.openedAt)
+	if wait <= 0 && !b.trying {
+		b.trying = true
+		return nil
+	}
+	retryAfter := max(int(wait.Round(time.Second).Seconds()), 1)
+	return &protocol.HTTPResponse{
+		StatusCode: http.StatusServiceUnavailable,
+		Headers: map[string][]string{
+			"Content-Type": {"text/plain; charset=utf-8"},
+			"Retry-After":  {strconv.Itoa(retryAfter)},
+		},
+		Body: []byte(fmt.Sprintf("Local service unavailable: %d requests in a row failed, the last with: %s\n", b.failures, b.reason)),
+	}
+}
+
+// record counts the outcome of a request forwarded to the local service,
+// opening or closing the breaker
+func (b *breaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	// Errors the local service isn't to blame for don't count either way,
+	// but free the trial for the next request
+	if errors.Is(err, errRequestTooLarge) || errors.Is(err, errResponseTooLarge) || errors.Is(err, context.Canceled) {
+		b.trying = false
+		b.mu.Unlock()
+		return
+	}
+	var health *protocol.HealthPayload
+	switch {
+	case err == nil && !b.openedAt.IsZero():
+		log.Printf("✓ Circuit breaker closed, the local service answers again")
+		b.openedAt, b.trying, b.failures = time.Time{}, false, 0
+		b.timer.Stop()
+		if b.serverDown {
+			b.serverDown = false
+			health = &protocol.HealthPayload{Healthy: true}
+		}
+	case err == nil:
+		b.failures = 0
+	default:
+		b.failures++
+		b.reason = err.Error()
+		if b.trying || (b.openedAt.IsZero() && b.failures >= b.threshold) {
+			log.Printf("⚠ Circuit breaker open after %d failed requests in a row, answering 503 for %s: %v", b.failures, b.cooldown, err)
+			opened := time.Now()
+			b.openedAt, b.trying = opened, false
+			if b.timer != nil {
+				b.timer.Stop()
+			}
+			b.timer = time.AfterFunc(b.cooldown, func() { b.cooled(opened) })
+			if b.notify != nil {
+				b.serverDown = true
+				down := breakerHealth(b.reason)
+				health = &down
+			}
+		}
+	}
+	notify := b.notify
+	b.mu.Unlock()
+	if health != nil {
+		notify(*health)
+	}
+}
+
+// cooled lets the server send requests again once the cooldown of the
+// breaker opened at opened is over, for one of them to try the local
+// service
+func (b *breaker) cooled(opened time.Time) {
+	b.mu.Lock()
+	if !b.openedAt.Equal(opened) || !b.serverDown {
+		b.mu.Unlock()
+		return
+	}
+	b.serverDown = false
+	notify := b.notify
+	b.mu.Unlock()
+	notify(protocol.HealthPayload{Healthy: true})
+}
+
+// breakerHealth is the health reported while the breaker is open
+func breakerHealth(reason string) protocol.HealthPayload {
+	return protocol.HealthPayload{Reason: fmt.Sprintf("circuit breaker open: %s", reason)}
+}
+
+// notifyHealth returns a function telling the server on the connection of
+// sess about the health of the local service
+func (a *Agent) notifyHealth(sess *session) func(protocol.HealthPayload) {
+	return func(health protocol.HealthPayload) {
+		msg, err := protocol.NewHealthMessage(health)
+		if err != nil {
+			log.Printf("Error creating health message: %v", err)
+		} else if err := a.send(sess, msg); err != nil {
+			log.Printf("Error sending health message: %v", err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"minitunnel/internal/protocol"
+)
+
+// healthLog records what a breaker tells the server
+type healthLog struct {
+	mu      sync.Mutex
+	reports []bool // Healthy of each report
+}
+
+func (h *healthLog) notify(health protocol.HealthPayload) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reports = append(h.reports, health.Healthy)
+}
+
+func (h *healthLog) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.reports)
+}
+
+func TestBreaker(t *testing.T) {
+	const cooldown = 20 * time.Millisecond
+	failure := syscall.ECONNREFUSED
+
+	// A step waits out the cooldown if cool is set, sends requests with the
+	// given outcomes, then checks whether the next request is rejected
+	type step struct {
+		cool     bool
+		outcomes []error
+		rejected bool
+	}
+	tests := []struct {
+		name    string
+		steps   []step
+		reports []bool // Told to the server, healthy or not
+	}{
+		{"stays closed below the threshold", []step{
+			{false, []error{failure, failure}, false},
+			{false, []error{nil, failure, failure}, false},
+		}, nil},
+		{"trips", []step{
+			{false, []error{failure, failure, failure}, true},
+		}, []bool{false, true}},
+		{"ignored errors don't count", []step{
+			{false, []error{failure, failure, errResponseTooLarge, context.Canceled, errRequestTooLarge}, false},
+			{false, []error{failure}, true},
+		}, []bool{false, true}},
+		{"trial success closes", []step{
+			{false, []error{failure, failure, failure}, true},
+			{true, []error{nil}, false},
+			{false, []error{failure, failure}, false},
+		}, []bool{false, true}},
+		{"trial failure reopens", []step{
+			{false, []error{failure, failure, failure}, true},
+			{true, []error{failure}, true},
+			{true, []error{nil}, false},
+		}, []bool{false, true, false, true}},
+		{"cancelled trial", []step{
+			{false, []error{failure, failure, failure}, true},
+			{true, []error{context.Canceled}, false},
+			{false, []error{nil}, false},
+		}, []bool{false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			health := &healthLog{}
+			b := newBreaker(3, cooldown)
+			b.connected(health.notify)
+			for i, s := range tt.steps {
+				if s.cool {
+					time.Sleep(cooldown + 10*time.Millisecond)
+				}
+				for _, err := range s.outcomes {
+					if resp := b.reject(); resp != nil {
+						t.Fatalf("step %d: request rejected before recording %v", i, err)
+					}
+					b.record(err)
+				}
+				resp := b.reject()
+				if (resp != nil) != s.rejected {
+					t.Fatalf("step %d: rejected = %v, want %v", i, resp != nil, s.rejected)
+				}
+				if resp == nil {
+					// Give back the trial the check may have taken
+					b.record(context.Canceled)
+				} else if resp.StatusCode != http.StatusServiceUnavailable || len(resp.Headers["Retry-After"]) != 1 {
+					t.Fatalf("step %d: rejected with %d %v", i, resp.StatusCode, resp.Headers)
+				}
+			}
+			// Let the last cooldown end and tell the server
+			time.Sleep(2 * cooldown)
+			deadline := time.Now().Add(time.Second)
+			for health.count() < len(tt.reports) && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			health.mu.Lock()
+			defer health.mu.Unlock()
+			if !slices.Equal(health.reports, tt.reports) {
+				t.Fatalf("reports = %v, want %v", health.reports, tt.reports)
+			}
+		})
+	}
+}
+
+func TestBreakerSingleTrial(t *testing.T) {
+	b := newBreaker(1, 10*time.Millisecond)
+	b.record(errors.New("connection refused"))
+	if b.reject() == nil {
+		t.Fatal("breaker didn't open")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if b.reject() != nil {
+		t.Fatal("no trial after the cooldown")
+	}
+	if b.reject() == nil {
+		t.Fatal("a second request went through during the trial")
+	}
+	b.record(context.Canceled)
+	if b.reject() != nil {
+		t.Fatal("no new trial after the cancelled one")
+	}
+}
+
+func TestNilBreaker(t *testing.T) {
+	var b *breaker
+	b.connected(nil)
+	b.record(errors.New("failed"))
+	if b.reject() != nil {
+		t.Error("nil breaker rejected a request")
+	}
+}
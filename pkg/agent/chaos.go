@@ -0,0 +1,180 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"minitunnel/internal/config"
+	"minitunnel/internal/protocol"
+)
+
+// Chaos are the faults injected into forwarded requests to test how
+// clients cope with a flaky service. The zero value injects none
+type Chaos struct {
+	Latency   string  `json:"latency,omitempty"` // Delay added to every request, a duration or a range like 100ms-500ms
+	ErrorRate float64 `json:"error_rate"`        // Percent of requests answered with a 500, 502 or 503
+	DropRate  float64 `json:"drop_rate"`         // Percent of requests whose connection is cut without a response
+}
+
+// enabled reports whether c injects any fault
+func (c Chaos) enabled() bool {
+	return c.Latency != "" || c.ErrorRate > 0 || c.DropRate > 0
+}
+
+func (c Chaos) String() string {
+	if !c.enabled() {
+		return "off"
+	}
+	latency := c.Latency
+	if latency == "" {
+		latency = "0s"
+	}
+	return fmt.Sprintf("latency %s, %g%% errors, %g%% drops", latency, c.ErrorRate, c.DropRate)
+}
+
+// chaosErrors are the statuses -chaos-error-rate answers with
+var chaosErrors = []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable}
+
+// chaosState holds the agent's Chaos, which the inspector can change
+type chaosState struct {
+	mu        sync.RWMutex
+	chaos     Chaos
+	low, high time.Duration // Latency parsed
+}
+
+// Chaos returns the faults the agent injects
+func (a *Agent) Chaos() Chaos {
+	a.chaos.mu.RLock()
+	defer a.chaos.mu.RUnlock()
+	return a.chaos.chaos
+}
+
+// SetChaos changes the faults the agent injects from the next request on
+func (a *Agent) SetChaos(c Chaos) error {
+	if err := config.ValidateChaos(c.Latency, c.ErrorRate, c.DropRate); err != nil {
+		return err
+	}
+	low, high, _ := config.ParseLatency(c.Latency)
+	a.chaos.mu.Lock()
+	was := a.chaos.chaos
+	a.chaos.chaos, a.chaos.low, a.chaos.high = c, low, high
+	a.chaos.mu.Unlock()
+	if c.enabled() {
+		log.Printf("⚠ Chaos mode: %s", c)
+	} else if was.enabled() {
+		log.Printf("✓ Chaos mode off")
+	}
+	return nil
+}
+
+// injectChaos applies the agent's Chaos to a request about to be
+// forwarded: it waits out the latency, then returns the response standing
+// in for the local service's if the request is to fail
+func (a *Agent) injectChaos(ctx context.Context) (*protocol.HTTPResponse, error) {
+	a.chaos.mu.RLock()
+	c, low, high := a.chaos.chaos, a.chaos.low, a.chaos.high
+	a.chaos.mu.RUnlock()
+	if !c.enabled() {
+		return nil, nil
+	}
+
+	if delay := low + rand.N(high-low+1); delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	roll := rand.Float64() * 100
+	switch {
+	case roll < c.DropRate:
+		// Servers that don't know the error answer the 502
+		return &protocol.HTTPResponse{
+			StatusCode: http.StatusBadGateway,
+			Headers:    map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}},
+			Body:       []byte("Connection dropped by chaos mode\n"),
+			Error:      protocol.ForwardErrDropped,
+		}, nil
+	case roll < c.DropRate+c.ErrorRate:
+		status := chaosErrors[rand.IntN(len(chaosErrors))]
+		return &protocol.HTTPResponse{
+			StatusCode: status,
+			Headers:    map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}},
+			Body:       []byte(fmt.Sprintf("%d %s (chaos mode)\n", status, http.StatusText(status))),
+		}, nil
+	}
+	return nil, nil
+}
+
+// handleChaos serves the agent's Chaos on GET and changes it on PUT
+func (in *Inspector) handleChaos(w http.ResponseWriter, r *http.Request) {
+	if in.agent == nil {
+		http.Error(w, "Chaos mode not available", http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodPut {
+		var c Chaos
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&c); err != nil {
+			http.Error(w, "Invalid chaos settings: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := in.agent.SetChaos(c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, in.agent.Chaos())
+}
+
+// chaosPage is what the chaos template shows
+type chaosPage struct {
+	Chaos Chaos
+	Error string
+}
+
+// handleChaosPage shows the agent's Chaos with a form changing it
+func (in *Inspector) handleChaosPage(w http.ResponseWriter, r *http.Request) {
+	if in.agent == nil {
+		http.Error(w, "Chaos mode not available", http.StatusNotFound)
+		return
+	}
+	page := chaosPage{Chaos: in.agent.Chaos()}
+	if r.Method == http.MethodPost {
+		c := Chaos{Latency: strings.TrimSpace(r.FormValue("latency"))}
+		var err error
+		if c.ErrorRate, err = parseRate(r.FormValue("error_rate")); err == nil {
+			c.DropRate, err = parseRate(r.FormValue("drop_rate"))
+		}
+		if err == nil {
+			err = in.agent.SetChaos(c)
+		}
+		if err == nil {
+			http.Redirect(w, r, "/chaos", http.StatusSeeOther)
+			return
+		}
+		page = chaosPage{Chaos: c, Error: err.Error()}
+	}
+	in.render(w, "chaos", page)
+}
+
+// parseRate parses a percentage from the chaos form, empty for zero
+func parseRate(s string) (float64, error) {
+	if s = strings.TrimSpace(s); s == "" {
+		return 0, nil
+	}
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return rate, nil
+}
@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"minitunnel/internal/protocol"
+)
+
+func TestSetChaos(t *testing.T) {
+	tests := []struct {
+		name      string
+		chaos     Chaos
+		ok        bool
+		low, high time.Duration
+	}{
+		{"off", Chaos{}, true, 0, 0},
+		{"fixed latency", Chaos{Latency: "200ms"}, true, 200 * time.Millisecond, 200 * time.Millisecond},
+		{"latency range", Chaos{Latency: "100ms-500ms"}, true, 100 * time.Millisecond, 500 * time.Millisecond},
+		{"rates", Chaos{ErrorRate: 40, DropRate: 60}, true, 0, 0},
+		{"bad latency", Chaos{Latency: "soon"}, false, 0, 0},
+		{"inverted range", Chaos{Latency: "500ms-100ms"}, false, 0, 0},
+		{"negative latency", Chaos{Latency: "-1s"}, false, 0, 0},
+		{"negative rate", Chaos{ErrorRate: -1}, false, 0, 0},
+		{"rates over 100", Chaos{ErrorRate: 60, DropRate: 50}, false, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Agent{}
+			err := a.SetChaos(tt.chaos)
+			if (err == nil) != tt.ok {
+				t.Fatalf("SetChaos = %v, want ok %v", err, tt.ok)
+			}
+			if !tt.ok {
+				if a.Chaos() != (Chaos{}) {
+					t.Errorf("rejected settings were applied: %+v", a.Chaos())
+				}
+				return
+			}
+			if a.Chaos() != tt.chaos || a.chaos.low != tt.low || a.chaos.high != tt.high {
+				t.Errorf("chaos = %+v (%s-%s), want %+v (%s-%s)", a.Chaos(), a.chaos.low, a.chaos.high, tt.chaos, tt.low, tt.high)
+			}
+		})
+	}
+}
+
+func TestInjectChaos(t *testing.T) {
+	tests := []struct {
+		name    string
+		chaos   Chaos
+		dropped bool // Every request is dropped
+		failed  bool // Every request is answered with an error status
+	}{
+		{"off", Chaos{}, false, false},
+		{"latency only", Chaos{Latency: "1ms"}, false, false},
+		{"all errors", Chaos{ErrorRate: 100}, false, true},
+		{"all drops", Chaos{DropRate: 100}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Agent{}
+			if err := a.SetChaos(tt.chaos); err != nil {
+				t.Fatal(err)
+			}
+			for range 50 {
+				resp, err := a.injectChaos(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				switch {
+				case tt.dropped:
+					if resp == nil || resp.Error != protocol.ForwardErrDropped {
+						t.Fatalf("response = %+v, want a dropped connection", resp)
+					}
+				case tt.failed:
+					if resp == nil || !slices.Contains(chaosErrors, resp.StatusCode) || resp.Error != "" {
+						t.Fatalf("response = %+v, want a 500, 502 or 503", resp)
+					}
+				case resp != nil:
+					t.Fatalf("response = %+v, want the request forwarded", resp)
+				}
+			}
+		})
+	}
+}
+
+func TestInjectChaosRates(t *testing.T) {
+	a := &Agent{}
+	if err := a.SetChaos(Chaos{ErrorRate: 30, DropRate: 20}); err != nil {
+		t.Fatal(err)
+	}
+	const n = 10000
+	var errs, drops int
+	for range n {
+		resp, _ := a.injectChaos(context.Background())
+		switch {
+		case resp == nil:
+		case resp.Error == protocol.ForwardErrDropped:
+			drops++
+		default:
+			errs++
+		}
+	}
+	// Far wider than the binomial spread, so that the test doesn't flake
+	if errs < n*25/100 || errs > n*35/100 || drops < n*15/100 || drops > n*25/100 {
+		t.Errorf("%d errors and %d drops of %d requests, want about 30%% and 20%%", errs, drops, n)
+	}
+}
+
+func TestInjectChaosCancelled(t *testing.T) {
+	a := &Agent{}
+	if err := a.SetChaos(Chaos{Latency: "1h"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := a.injectChaos(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("injectChaos = %v, want context.Canceled", err)
+	}
+}
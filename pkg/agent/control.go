@@ -0,0 +1,195 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// maxRecentErrors is how many errors Status keeps
+const maxRecentErrors = 10
+
+// Status is the state of a running agent, as served on its control socket
+type Status struct {
+	PID          int           `json:"pid"`
+	Started      time.Time     `json:"started"`
+	Connected    bool          `json:"connected"`
+	Since        time.Time     `json:"since,omitzero"` // Of the last connect or disconnect
+	TunnelURL    string        `json:"tunnel_url,omitempty"`
+	LocalAddr    string        `json:"local_addr"`
+	Requests     int64         `json:"requests"`      // Forwarded since the agent started
+	Failed       int64         `json:"failed"`        // Requests the local service didn't answer
+	RecentErrors []StatusError `json:"recent_errors"` // Oldest first
+}
+
+// StatusError is an error of the connection or of forwarding a request
+type StatusError struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// agentStatus is the part of Status the agent follows as it runs
+type agentStatus struct {
+	mu      sync.Mutex
+	started time.Time
+	status  Status
+}
+
+// Status returns the agent's state
+func (a *Agent) Status() Status {
+	a.status.mu.Lock()
+	st := a.status.status
+	st.RecentErrors = append([]StatusError{}, st.RecentErrors...)
+	a.status.mu.Unlock()
+	st.PID = os.Getpid()
+	st.Started = a.status.started
+	st.LocalAddr = a.LocalAddr()
+	return st
+}
+
+// track updates the status with an event, see emit
+func (s *agentStatus) track(ev Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch ev.Type {
+	case EventConnected:
+		s.status.Connected = true
+		s.status.Since = ev.Time
+		s.status.TunnelURL = ev.TunnelURL
+	case EventDisconnected:
+		s.status.Connected = false
+		s.status.Since = ev.Time
+		if ev.Err != nil {
+			s.addError(ev.Time, ev.Err.Error())
+		}
+	case EventRequest:
+		s.status.Requests++
+	}
+}
+
+// requestFailed records a request the local service didn't answer
+func (s *agentStatus) requestFailed(httpReq Request, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Failed++
+	s.addError(time.Now(), fmt.Sprintf("%s %s: %v", httpReq.Method, httpReq.Path, err))
+}
+
+// addError keeps the last maxRecentErrors errors. Callers hold s.mu
+func (s *agentStatus) addError(t time.Time, msg string) {
+	if len(s.status.RecentErrors) == maxRecentErrors {
+		s.status.RecentErrors = slices.Delete(s.status.RecentErrors, 0, 1)
+	}
+	s.status.RecentErrors = append(s.status.RecentErrors, StatusError{Time: t, Error: msg})
+}
+
+// listenControl opens the control socket at path, replacing one left
+// behind by an agent that is gone
+func listenControl(path string) (net.Listener, error) {
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("control socket %s is in use by another agent", path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale control socket: %w", err)
+	}
+
+	// Only the user running the agent may stop it. The socket is created
+	// in a directory nobody else can enter and moved in place once private,
+	// as it is created with the umask's permissions. The names are short, as
+	// socket paths are limited to about 100 bytes
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".ctl")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open control socket: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	private := filepath.Join(dir, "s")
+	ln, err := net.Listen("unix", private)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open control socket: %w", err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	err = os.Chmod(private, 0o600)
+	if err == nil {
+		err = os.Rename(private, path)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to open control socket: %w", err)
+	}
+	return &controlListener{Listener: ln, path: path}, nil
+}
+
+// controlListener removes the control socket at path when closed, which
+// the listener can't do itself since the socket was moved
+type controlListener struct {
+	net.Listener
+	path string
+	once sync.Once
+}
+
+func (l *controlListener) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(func() { os.Remove(l.path) })
+	return err
+}
+
+// serveControl answers on the control socket until ln is closed: GET
+// /status with Status, and POST /stop cancelling Run through stop
+func (a *Agent) serveControl(ln net.Listener, stop context.CancelFunc) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a.Status())
+	})
+	mux.HandleFunc("POST /stop", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Stop requested through the control socket")
+		stop()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("Control socket error: %v", err)
+	}
+}
+
+// ControlClient returns an HTTP client talking to the control socket at
+// path, for URLs like http://agent/status
+func ControlClient(path string) *http.Client {
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
+
+// QueryStatus asks the agent listening on the control socket at path for
+// its status
+func QueryStatus(path string) (*Status, error) {
+	resp, err := ControlClient(path).Get("http://agent/status")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("control socket returned %s", resp.Status)
+	}
+	var st Status
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return nil, fmt.Errorf("failed to parse status: %w", err)
+	}
+	return &st, nil
+}
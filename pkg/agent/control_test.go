@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListenControl(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name  string
+		setup func(path string) // Leaves something at path before listening
+		ok    bool
+	}{
+		{"fresh", func(string) {}, true},
+		{"stale file", func(path string) { os.WriteFile(path, nil, 0o644) }, true},
+		{"in use", func(path string) {
+			ln, err := listenControl(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { ln.Close() })
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name+".sock")
+			tt.setup(path)
+			ln, err := listenControl(path)
+			if (err == nil) != tt.ok {
+				t.Fatalf("listenControl = %v, want ok %v", err, tt.ok)
+			}
+			if !tt.ok {
+				return
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if perm := info.Mode().Perm(); perm != 0o600 || info.Mode().Type() != os.ModeSocket {
+				t.Errorf("socket mode = %s, want a socket with 0600", info.Mode())
+			}
+			a := &Agent{config: DefaultOptions()}
+			go a.serveControl(ln, func() {})
+			if _, err := QueryStatus(path); err != nil {
+				t.Errorf("QueryStatus: %v", err)
+			}
+			ln.Close()
+			if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("socket left behind after closing: %v", err)
+			}
+			entries, _ := os.ReadDir(dir)
+			for _, e := range entries {
+				if !strings.HasSuffix(e.Name(), ".sock") {
+					t.Errorf("left behind %s", e.Name())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// attemptDelay is how long a connection attempt gets before the next
+// address is tried in parallel, as recommended by RFC 8305
+const attemptDelay = 250 * time.Millisecond
+
+// dial opens a QUIC connection to the server. When the server name resolves
+// to several addresses they are raced happy-eyeballs style: attempts start
+// attemptDelay apart, alternating address families, and the first to
+// complete the handshake wins. A resumed session is ready at once, to send
+// 0-RTT data on
+func (a *Agent) dial(ctx context.Context) (quic.EarlyConnection, error) {
+	host, port, err := net.SplitHostPort(a.config.ServerAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server address: %w", err)
+	}
+	tlsConfig, err := a.tlsConfig(host)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	if net.ParseIP(host) != nil {
+		addrs = []string{a.config.ServerAddr}
+	} else {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve server address: %w", err)
+		}
+		for _, ip := range interleaveFamilies(ips) {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+		}
+	}
+
+	conn, err := raceDial(ctx, addrs, tlsConfig, a.config.QUIC.Apply(a.stats.quicConfig()))
+	if err != nil {
+		if hint := verifyHint(err); hint != "" {
+			return nil, fmt.Errorf("failed to connect to server: %w (%s)", err, hint)
+		}
+		return nil, fmt.Errorf("failed to connect to server: %w", err)
+	}
+	return conn, nil
+}
+
+// raceDial dials addrs in order, starting the next attempt when the
+// previous one fails or attemptDelay passes, and returns the first
+// connection established. Connections that complete later are closed
+func raceDial(ctx context.Context, addrs []string, tlsConfig *tls.Config, quicConfig *quic.Config) (quic.EarlyConnection, error) {
+	if len(addrs) == 1 {
+		return quic.DialAddrEarly(ctx, addrs[0], tlsConfig, quicConfig)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn quic.EarlyConnection
+		addr string
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	start := func(addr string) {
+		go func() {
+			conn, err := quic.DialAddrEarly(ctx, addr, tlsConfig, quicConfig)
+			results <- result{conn, addr, err}
+		}()
+	}
+
+	next, pending := 0, 0
+	var errs []error
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if next < len(addrs) {
+				start(addrs[next])
+				next++
+				pending++
+				timer.Reset(attemptDelay)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if next > 1 {
+					log.Printf("Connected via %s", res.addr)
+				}
+				// Close any attempt that finishes after the winner
+				go func(remaining int) {
+					for ; remaining > 0; remaining-- {
+						if late := <-results; late.err == nil {
+							late.conn.CloseWithError(0, "")
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", res.addr, res.err))
+			if next < len(addrs) {
+				// Don't wait out the delay after a failure
+				timer.Reset(0)
+			} else if pending == 0 {
+				return nil, errors.Join(errs...)
+			}
+		}
+	}
+}
+
+// interleaveFamilies orders addresses IPv6 first, alternating families so
+// that a broken network for one family costs at most one attempt delay
+func interleaveFamilies(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	ordered := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			ordered = append(ordered, v6[i])
+		}
+		if i < len(v4) {
+			ordered = append(ordered, v4[i])
+		}
+	}
+	return ordered
+}
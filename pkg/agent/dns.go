@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"minitunnel/internal/config"
+)
+
+// localDialer connects to the local service, resolving names with the
+// agent's static host mappings, resolver and address family preference
+// instead of only the system's settings
+type localDialer struct {
+	hosts    config.Hosts // Static name to IP mappings, checked first
+	resolver *net.Resolver
+	prefer   string // "ipv4", "ipv6" or "" for the resolver's order
+	dialer   net.Dialer
+}
+
+func newLocalDialer(cfg *config.AgentConfig) *localDialer {
+	d := &localDialer{
+		hosts:    cfg.Hosts,
+		resolver: net.DefaultResolver,
+		prefer:   cfg.PreferIP,
+	}
+	if cfg.Resolver != "" {
+		d.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return d.dialer.DialContext(ctx, network, cfg.Resolver)
+			},
+		}
+	}
+	return d
+}
+
+// DialContext dials addr, trying each resolved address in preference
+// order until one accepts the connection
+func (d *localDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip, ok := d.hosts[host]; ok {
+		return d.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+	}
+	if net.ParseIP(host) != nil {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+
+	ips, err := d.resolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	sort.SliceStable(ips, func(i, j int) bool {
+		return d.preferred(ips[i]) && !d.preferred(ips[j])
+	})
+
+	var firstErr error
+	for _, ip := range ips {
+		conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+func (d *localDialer) preferred(ip net.IP) bool {
+	switch d.prefer {
+	case "ipv4":
+		return ip.To4() != nil
+	case "ipv6":
+		return ip.To4() == nil
+	}
+	return false
+}
+
+// isListening reports whether addr accepts TCP connections
+func (d *localDialer) isListening(addr string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
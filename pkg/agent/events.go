@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"net/http"
+	"time"
+)
+
+// eventBuffer is how many events wait in Events before new ones are dropped
+const eventBuffer = 64
+
+// EventType tells what an Event reports
+type EventType int
+
+const (
+	EventConnected    EventType = iota + 1 // The tunnel is up at TunnelURL
+	EventDisconnected                      // The tunnel went down, Err says why
+	EventRequest                           // A request was forwarded to the local service
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventConnected:
+		return "connected"
+	case EventDisconnected:
+		return "disconnected"
+	case EventRequest:
+		return "request"
+	default:
+		return "unknown"
+	}
+}
+
+// Event reports a change in the state of the tunnel or a request that went
+// through it
+type Event struct {
+	Type      EventType
+	Time      time.Time
+	TunnelURL string // Public URL of the tunnel
+	Err       error  // Why the tunnel went down, nil if it was closed or drained
+
+	// Set for EventRequest
+	Method     string
+	Path       string
+	RemoteAddr string        // Visitor address, as the server saw it
+	Status     int           // Status sent back, including agent errors such as 502
+	Duration   time.Duration // Time to the response head
+}
+
+// Events returns the channel the agent reports its events on. The channel
+// is never closed. Events that would block are dropped, so a program that
+// doesn't read them never stalls the tunnel
+func (a *Agent) Events() <-chan Event {
+	return a.events
+}
+
+// emit reports an event without blocking
+func (a *Agent) emit(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	a.status.track(ev)
+	a.printOutput(ev)
+	select {
+	case a.events <- ev:
+	default:
+	}
+}
+
+// emitRequest reports a forwarded request
+func (a *Agent) emitRequest(start time.Time, httpReq Request, status int) {
+	a.emit(Event{
+		Type:       EventRequest,
+		Time:       start,
+		TunnelURL:  a.TunnelURL(),
+		Method:     httpReq.Method,
+		Path:       httpReq.Path,
+		RemoteAddr: http.Header(httpReq.Headers).Get("X-Real-Ip"),
+		Status:     status,
+		Duration:   time.Since(start),
+	})
+}
@@ -0,0 +1,133 @@
+package agent
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// followInterval is how often the agent checks whether the local service
+// is still listening on the current port
+const followInterval = 2 * time.Second
+
+// followLocalService watches the forwarding target and switches to the port
+// the local service actually listens on when it moves
+func (a *Agent) followLocalService(ctx context.Context) {
+	ticker := time.NewTicker(followInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current := a.LocalAddr()
+		if a.dialer.isListening(current) && !a.watchedElsewhere(current) {
+			continue
+		}
+
+		addr, ok := a.detectLocalAddr()
+		if !ok || addr == current {
+			continue
+		}
+
+		log.Printf("⚠ Local service moved: now forwarding to %s (was %s)", addr, current)
+		a.SetLocalAddr(addr)
+	}
+}
+
+// Watch makes the agent follow the ports the process group pid listens on,
+// for a local service it started itself, when Options.Follow is set. Call
+// it before Run
+func (a *Agent) Watch(pid int) {
+	a.watchPID = pid
+}
+
+// WaitForLocal polls the local address until it accepts TCP connections,
+// returning the cause of ctx's end if that comes first. When following is
+// enabled, the local service may also come up on another port
+func (a *Agent) WaitForLocal(ctx context.Context) error {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		addr := a.LocalAddr()
+		if a.dialer.isListening(addr) && !a.watchedElsewhere(addr) {
+			return nil
+		}
+		if a.config.Follow != "" {
+			if found, ok := a.detectLocalAddr(); ok {
+				log.Printf("⚠ Local service is listening on %s instead of %s", found, addr)
+				a.SetLocalAddr(found)
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-ticker.C:
+		}
+	}
+}
+
+// watchedElsewhere reports whether we are watching a process that listens
+// on other ports but not on addr, meaning addr belongs to someone else
+func (a *Agent) watchedElsewhere(addr string) bool {
+	if a.watchPID == 0 || a.config.Follow == "" {
+		return false
+	}
+	ports, err := listeningPorts(a.watchPID)
+	if err != nil || len(ports) == 0 {
+		return false
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	for _, p := range ports {
+		if strconv.Itoa(p) == port {
+			return false
+		}
+	}
+	return true
+}
+
+// detectLocalAddr finds the address the local service listens on, preferring
+// ports owned by the watched process and falling back to scanning the
+// configured range
+func (a *Agent) detectLocalAddr() (string, bool) {
+	host, _, err := net.SplitHostPort(a.config.LocalAddr)
+	if err != nil {
+		return "", false
+	}
+	min, max, _ := a.config.FollowRange()
+	inRange := func(port int) bool {
+		return max == 0 || (port >= min && port <= max)
+	}
+
+	if a.watchPID != 0 {
+		if ports, err := listeningPorts(a.watchPID); err == nil {
+			sort.Ints(ports)
+			for _, port := range ports {
+				addr := net.JoinHostPort(host, strconv.Itoa(port))
+				if inRange(port) && a.dialer.isListening(addr) {
+					return addr, true
+				}
+			}
+		}
+	}
+
+	for port := min; max != 0 && port <= max; port++ {
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		if a.dialer.isListening(addr) {
+			return addr, true
+		}
+	}
+	return "", false
+}
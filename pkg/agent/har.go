@@ -0,0 +1,189 @@
+package agent
+
+import (
+	"encoding/base64"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR 1.2 document structures, see http://www.softwareishard.com/blog/har-12-spec/
+
+type harDocument struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// HAR converts the recorded exchanges to a HAR document
+func (in *Inspector) HAR() harDocument {
+	in.mu.RLock()
+	baseURL := in.baseURL
+	in.mu.RUnlock()
+
+	doc := harDocument{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "minitunnel", Version: Version},
+		Entries: []harEntry{},
+	}}
+	for _, ex := range in.Exchanges() {
+		doc.Log.Entries = append(doc.Log.Entries, harEntryFor(baseURL, ex))
+	}
+	return doc
+}
+
+func harEntryFor(baseURL string, ex *Exchange) harEntry {
+	ms := float64(ex.Duration) / float64(time.Millisecond)
+	header := http.Header(ex.Request.Headers)
+
+	entry := harEntry{
+		StartedDateTime: ex.Time,
+		Time:            ms,
+		Request: harRequest{
+			Method:      ex.Request.Method,
+			URL:         strings.TrimSuffix(baseURL, "/") + ex.Request.Path,
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(ex.Request.Headers),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    len(ex.Request.Body),
+		},
+		Response: harResponse{
+			Status:      ex.Response.StatusCode,
+			StatusText:  http.StatusText(ex.Response.StatusCode),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(ex.Response.Headers),
+			Content:     harContentFor(ex.Response.Body, http.Header(ex.Response.Headers).Get("Content-Type")),
+			RedirectURL: http.Header(ex.Response.Headers).Get("Location"),
+			HeadersSize: -1,
+			BodySize:    len(ex.Response.Body),
+		},
+		Timings: harTimings{Send: 0, Wait: ms, Receive: 0},
+		Comment: ex.Error,
+	}
+
+	if u, err := url.Parse(ex.Request.Path); err == nil {
+		for name, values := range u.Query() {
+			for _, v := range values {
+				entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{name, v})
+			}
+		}
+	}
+	for _, c := range (&http.Request{Header: header}).Cookies() {
+		entry.Request.Cookies = append(entry.Request.Cookies, harNameValue{c.Name, c.Value})
+	}
+	for _, c := range (&http.Response{Header: http.Header(ex.Response.Headers)}).Cookies() {
+		entry.Response.Cookies = append(entry.Response.Cookies, harNameValue{c.Name, c.Value})
+	}
+	if len(ex.Request.Body) > 0 {
+		entry.Request.PostData = &harPostData{
+			MimeType: header.Get("Content-Type"),
+			Text:     string(ex.Request.Body),
+		}
+	}
+	return entry
+}
+
+func harHeaders(headers map[string][]string) []harNameValue {
+	out := []harNameValue{}
+	for name, values := range headers {
+		for _, v := range values {
+			out = append(out, harNameValue{name, v})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// harContentFor stores text bodies verbatim and binary bodies as base64
+func harContentFor(body []byte, contentType string) harContent {
+	content := harContent{Size: len(body), MimeType: contentType}
+	if len(body) == 0 {
+		return content
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if utf8.Valid(body) && !strings.HasPrefix(mediaType, "image/") {
+		content.Text = string(body)
+	} else {
+		content.Text = base64.StdEncoding.EncodeToString(body)
+		content.Encoding = "base64"
+	}
+	return content
+}
+
+func (in *Inspector) handleHAR(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Disposition", `attachment; filename="minitunnel.har"`)
+	writeJSON(w, in.HAR())
+}
@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"minitunnel/internal/protocol"
+)
+
+// healthFailures is how many health checks in a row have to fail before
+// the local service is reported down, so a single slow answer doesn't
+// take the tunnel offline
+const healthFailures = 2
+
+// healthTimeout bounds a single health check
+const healthTimeout = 5 * time.Second
+
+// checkHealth probes the local service every -health-interval and tells
+// the server of sess when it goes down or comes back, until ctx is done
+func (a *Agent) checkHealth(ctx context.Context, sess *session) {
+	ticker := time.NewTicker(a.config.HealthInterval)
+	defer ticker.Stop()
+
+	healthy, failures := true, 0
+	for {
+		err := a.probeLocal(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			failures++
+		} else {
+			failures = 0
+		}
+
+		if up := err == nil; up != healthy && (up || failures >= healthFailures) {
+			healthy = up
+			health := protocol.HealthPayload{Healthy: up}
+			if up {
+				log.Printf("✓ Local service is healthy again")
+			} else {
+				health.Reason = err.Error()
+				log.Printf("⚠ Local service is down, the server answers visitors with 503: %v", err)
+			}
+			msg, err := protocol.NewHealthMessage(health)
+			if err != nil {
+				log.Printf("Error creating health message: %v", err)
+			} else if err := a.send(sess, msg); err != nil {
+				log.Printf("Error sending health message: %v", err)
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeLocal asks the local service for the -health-check path. Any 2xx or
+// 3xx response passes
+func (a *Agent) probeLocal(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, min(a.config.HealthInterval, healthTimeout))
+	defer cancel()
+	url := fmt.Sprintf("http://%s%s", a.LocalAddr(), a.config.HealthCheck)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = a.localHostHeader(a.LocalAddr(), "")
+	resp, err := a.transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("%s answered %s", a.config.HealthCheck, resp.Status)
+	}
+	return nil
+}
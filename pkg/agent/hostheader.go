@@ -0,0 +1,29 @@
+package agent
+
+import (
+	"net/url"
+	"strings"
+
+	"minitunnel/internal/config"
+)
+
+// localHostHeader returns the Host sent to the local service at localAddr
+// for a request the visitor sent to publicHost, following -host-header.
+// Without a public host, as for health checks, the tunnel URL's is used
+func (a *Agent) localHostHeader(localAddr, publicHost string) string {
+	if custom, ok := strings.CutPrefix(a.config.HostHeader, config.HostHeaderCustom); ok {
+		return custom
+	}
+	if a.config.HostHeader != config.HostHeaderPreserve {
+		return localAddr
+	}
+	// X-Forwarded-Host may list the hosts of several proxies, the visitor's first
+	publicHost, _, _ = strings.Cut(publicHost, ",")
+	if publicHost = strings.TrimSpace(publicHost); publicHost != "" {
+		return publicHost
+	}
+	if u, err := url.Parse(a.TunnelURL()); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return localAddr
+}
@@ -0,0 +1,259 @@
+package agent
+
+import (
+	"embed"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"minitunnel/internal/protocol"
+)
+
+//go:embed web/inspector.html
+var webFS embed.FS
+
+var inspectorTemplates = template.Must(template.New("").Funcs(template.FuncMap{
+	"body": displayBody,
+	"ms":   func(d time.Duration) string { return strconv.FormatInt(d.Milliseconds(), 10) + "ms" },
+}).ParseFS(webFS, "web/inspector.html"))
+
+// maxCapturedBody is how much of each request and response body the
+// inspector keeps in memory
+const maxCapturedBody = 1 << 20
+
+// Exchange is a request/response pair recorded by the inspector
+type Exchange struct {
+	ID       int                   `json:"id"`
+	Time     time.Time             `json:"time"`
+	Duration time.Duration         `json:"duration_ns"`
+	Request  protocol.HTTPRequest  `json:"request"`
+	Response protocol.HTTPResponse `json:"response"`
+	Error    string                `json:"error,omitempty"`
+}
+
+// Inspector records recent traffic flowing through the tunnel and serves
+// it on a local web UI
+type Inspector struct {
+	mu        sync.RWMutex
+	exchanges []*Exchange // Oldest first
+	limit     int
+	nextID    int
+	baseURL   string                      // Public tunnel URL, used to build absolute URLs
+	watchers  map[chan *Exchange]struct{} // Live tail viewers
+	stats     *protoStats                 // Protocol counters of the agent, nil if unknown
+	agent     *Agent                      // Agent whose Chaos can be changed, nil if unknown
+}
+
+func NewInspector(limit int) *Inspector {
+	return &Inspector{limit: limit, nextID: 1}
+}
+
+// SetBaseURL sets the public tunnel URL that recorded paths are relative to
+func (in *Inspector) SetBaseURL(baseURL string) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.baseURL = baseURL
+}
+
+// Record stores an exchange, evicting the oldest once the limit is reached
+func (in *Inspector) Record(start time.Time, req protocol.HTTPRequest, resp protocol.HTTPResponse, fwdErr error) {
+	req.Body = truncateBody(req.Body)
+	resp.Body = truncateBody(resp.Body)
+	ex := &Exchange{
+		Time:     start,
+		Duration: time.Since(start),
+		Request:  req,
+		Response: resp,
+	}
+	if fwdErr != nil {
+		ex.Error = fwdErr.Error()
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	ex.ID = in.nextID
+	in.nextID++
+	in.exchanges = append(in.exchanges, ex)
+	if len(in.exchanges) > in.limit {
+		in.exchanges = in.exchanges[len(in.exchanges)-in.limit:]
+	}
+	in.broadcast(ex)
+}
+
+// Exchanges returns the recorded exchanges, oldest first
+func (in *Inspector) Exchanges() []*Exchange {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+	return append([]*Exchange(nil), in.exchanges...)
+}
+
+// Exchange returns a recorded exchange by ID
+func (in *Inspector) Exchange(id int) (*Exchange, bool) {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+	for _, ex := range in.exchanges {
+		if ex.ID == id {
+			return ex, true
+		}
+	}
+	return nil, false
+}
+
+// Clear forgets all recorded exchanges
+func (in *Inspector) Clear() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.exchanges = nil
+}
+
+// Serve runs the inspector web UI on addr
+func (in *Inspector) Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", in.handleList)
+	mux.HandleFunc("GET /requests/{id}", in.handleDetail)
+	mux.HandleFunc("GET /live", in.handleLive)
+	mux.HandleFunc("GET /api/requests", in.handleAPIList)
+	mux.HandleFunc("GET /api/requests/{id}", in.handleAPIDetail)
+	mux.HandleFunc("DELETE /api/requests", sameOrigin(in.handleAPIClear))
+	mux.HandleFunc("GET /api/har", in.handleHAR)
+	mux.HandleFunc("GET /api/tail", in.handleTail)
+	mux.HandleFunc("GET /api/stats", in.handleStats)
+	mux.HandleFunc("GET /api/stats/follow", in.handleStatsFollow)
+	mux.HandleFunc("GET /api/chaos", in.handleChaos)
+	mux.HandleFunc("PUT /api/chaos", sameOrigin(in.handleChaos))
+	mux.HandleFunc("GET /chaos", in.handleChaosPage)
+	mux.HandleFunc("POST /chaos", sameOrigin(in.handleChaosPage))
+	mux.HandleFunc("GET "+protocol.OpenAPIPath, in.handleOpenAPI)
+
+	log.Printf("Inspector listening on http://%s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("Inspector error: %v", err)
+	}
+}
+
+func (in *Inspector) handleList(w http.ResponseWriter, r *http.Request) {
+	exchanges := in.Exchanges()
+	// Newest first
+	for i, j := 0, len(exchanges)-1; i < j; i, j = i+1, j-1 {
+		exchanges[i], exchanges[j] = exchanges[j], exchanges[i]
+	}
+	in.render(w, "list", exchanges)
+}
+
+func (in *Inspector) handleDetail(w http.ResponseWriter, r *http.Request) {
+	ex, ok := in.lookup(w, r)
+	if !ok {
+		return
+	}
+	in.render(w, "detail", ex)
+}
+
+func (in *Inspector) handleAPIList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, in.Exchanges())
+}
+
+func (in *Inspector) handleAPIDetail(w http.ResponseWriter, r *http.Request) {
+	ex, ok := in.lookup(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, ex)
+}
+
+func (in *Inspector) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(protocol.AgentOpenAPI())
+}
+
+func (in *Inspector) handleAPIClear(w http.ResponseWriter, r *http.Request) {
+	in.Clear()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lookup finds the exchange named by the {id} path value, writing a 404
+// if there is none
+func (in *Inspector) lookup(w http.ResponseWriter, r *http.Request) (*Exchange, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid request ID", http.StatusBadRequest)
+		return nil, false
+	}
+	ex, ok := in.Exchange(id)
+	if !ok {
+		http.Error(w, "Request not found", http.StatusNotFound)
+		return nil, false
+	}
+	return ex, true
+}
+
+func (in *Inspector) render(w http.ResponseWriter, name string, data any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := inspectorTemplates.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("Error rendering inspector: %v", err)
+	}
+}
+
+// writeJSON writes v as an indented JSON response
+// sameOrigin refuses requests that browsers send on behalf of other sites,
+// so that a page the developer visits can't change the inspector's state
+// on localhost. Clients that aren't browsers send neither header
+func sameOrigin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !fromSameOrigin(r) {
+			http.Error(w, "Cross-origin request refused", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// fromSameOrigin reports whether r comes from the inspector's own pages,
+// going by Sec-Fetch-Site or else Origin
+func fromSameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return true
+	case "":
+	default:
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
+	}
+}
+
+func truncateBody(body []byte) []byte {
+	if len(body) > maxCapturedBody {
+		return body[:maxCapturedBody]
+	}
+	return body
+}
+
+// displayBody renders a body as text, or a placeholder if it is binary
+func displayBody(body []byte) string {
+	if len(body) == 0 {
+		return "(empty)"
+	}
+	if !utf8.Valid(body) {
+		return "(binary, " + strconv.Itoa(len(body)) + " bytes)"
+	}
+	return string(body)
+}
@@ -0,0 +1,47 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestChaosPageSameOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		allowed bool
+	}{
+		{"not a browser", nil, true},
+		{"same origin", map[string]string{"Sec-Fetch-Site": "same-origin", "Origin": "http://localhost:4040"}, true},
+		{"typed by the user", map[string]string{"Sec-Fetch-Site": "none"}, true},
+		{"other site", map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "https://evil.example"}, false},
+		{"same site, other origin", map[string]string{"Sec-Fetch-Site": "same-site", "Origin": "http://localhost:3000"}, false},
+		{"matching origin only", map[string]string{"Origin": "http://localhost:4040"}, true},
+		{"other origin only", map[string]string{"Origin": "http://localhost:3000"}, false},
+		{"opaque origin", map[string]string{"Origin": "null"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Agent{}
+			in := &Inspector{agent: a}
+			form := url.Values{"error_rate": {"100"}}
+			r := httptest.NewRequest(http.MethodPost, "http://localhost:4040/chaos", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			sameOrigin(in.handleChaosPage)(w, r)
+
+			if changed := a.Chaos().ErrorRate == 100; changed != tt.allowed {
+				t.Errorf("chaos changed = %v, want %v (status %d)", changed, tt.allowed, w.Code)
+			}
+			if !tt.allowed && w.Code != http.StatusForbidden {
+				t.Errorf("status = %d, want 403", w.Code)
+			}
+		})
+	}
+}
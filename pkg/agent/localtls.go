@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"minitunnel/internal/certs"
+)
+
+// serveLocalHTTPS terminates HTTPS on addr with a certificate from the local
+// development CA and proxies to the current local service address
+func (a *Agent) serveLocalHTTPS(addr string) error {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return fmt.Errorf("failed to locate config directory: %w", err)
+	}
+	ca, err := certs.LoadOrCreateCA(filepath.Join(configDir, "minitunnel"))
+	if err != nil {
+		return err
+	}
+
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "" && host != "localhost" {
+		hosts = append(hosts, host)
+	}
+	cert, err := ca.Issue(hosts, 30*24*time.Hour)
+	if err != nil {
+		return err
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme = "http"
+			r.Out.URL.Host = a.LocalAddr()
+			r.SetXForwarded()
+		},
+		Transport: a.transport,
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	a.config.TLS.Apply(tlsConfig)
+	server := &http.Server{
+		Addr:      addr,
+		Handler:   proxy,
+		TLSConfig: tlsConfig,
+	}
+
+	log.Printf("Local HTTPS: https://%s → %s", addr, a.LocalAddr())
+	log.Printf("Trust %s in your browser or system store to avoid certificate warnings", ca.CertFile)
+	return server.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"math/rand/v2"
+	"sync"
+
+	"minitunnel/internal/protocol"
+)
+
+// maxMirrorsInFlight bounds the copies waiting on a slow -mirror. Copies
+// past it are dropped rather than queued, so that the mirror never holds
+// up the tunnel
+const maxMirrorsInFlight = 64
+
+// mirror sends copies of requests to -mirror, see mirrorRequest
+type mirror struct {
+	slots   chan struct{}
+	mu      sync.Mutex
+	failing bool // Whether the last copy failed, to log changes only
+}
+
+func newMirror() *mirror {
+	return &mirror{slots: make(chan struct{}, maxMirrorsInFlight)}
+}
+
+// mirrorRequest sends a copy of a request bound for the forwarding target
+// to -mirror for -mirror-percent of requests, in the background. The
+// mirror's response is discarded
+func (a *Agent) mirrorRequest(httpReq protocol.HTTPRequest) {
+	m := a.mirror
+	if m == nil || rand.Float64()*100 >= a.config.MirrorPercent {
+		return
+	}
+	// Only requests for -local, not for a -tunnel or a -route
+	if addr, _, _ := a.localTarget(httpReq); addr != a.LocalAddr() {
+		return
+	}
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		return
+	}
+	go func() {
+		defer func() { <-m.slots }()
+		m.report(a.sendMirror(httpReq))
+	}()
+}
+
+// sendMirror sends a copy of httpReq to -mirror and reads its response
+func (a *Agent) sendMirror(httpReq protocol.HTTPRequest) error {
+	ctx, cancel := context.WithTimeout(context.Background(), a.config.LocalTimeout)
+	defer cancel()
+	var body io.Reader
+	if len(httpReq.Body) > 0 {
+		body = bytes.NewReader(httpReq.Body)
+	}
+	req, err := a.newLocalRequest(ctx, httpReq, body)
+	if err != nil {
+		return err
+	}
+	if req.Host == req.URL.Host {
+		// The Host header names the local address, see -host-header
+		req.Host = a.config.Mirror
+	}
+	req.URL.Host = a.config.Mirror
+	resp, err := a.transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(io.Discard, io.LimitReader(resp.Body, a.config.MaxResponseBody))
+	return err
+}
+
+// report logs when copies start failing and when they work again, rather
+// than every failure
+func (m *mirror) report(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case err != nil && !m.failing:
+		log.Printf("⚠ Error mirroring request: %v", err)
+	case err == nil && m.failing:
+		log.Printf("✓ Mirroring requests again")
+	}
+	m.failing = err != nil
+}
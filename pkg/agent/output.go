@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// outputEvent is a lifecycle event as printed to stdout with -json
+type outputEvent struct {
+	Event     string    `json:"event"` // "connected", "disconnected" or "stopped"
+	Time      time.Time `json:"time"`
+	TunnelURL string    `json:"tunnel_url,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// printOutput writes the machine-readable output of an event to stdout:
+// a JSON line with -json, or the tunnel URL whenever it changes with
+// -url-only. Logs stay on stderr
+func (a *Agent) printOutput(ev Event) {
+	if !a.config.JSONOutput && !a.config.URLOnly {
+		return
+	}
+	a.outputMu.Lock()
+	defer a.outputMu.Unlock()
+	if a.config.URLOnly {
+		if ev.Type == EventConnected && ev.TunnelURL != a.printedURL {
+			fmt.Fprintln(os.Stdout, ev.TunnelURL)
+			a.printedURL = ev.TunnelURL
+		}
+		return
+	}
+	out := outputEvent{Time: ev.Time, TunnelURL: ev.TunnelURL}
+	switch ev.Type {
+	case EventConnected:
+		out.Event = "connected"
+	case EventDisconnected:
+		out.Event = "disconnected"
+	default:
+		return
+	}
+	if ev.Err != nil {
+		out.Error = ev.Err.Error()
+	}
+	json.NewEncoder(os.Stdout).Encode(out)
+}
+
+// printStopped ends the -json output when Run returns err
+func (a *Agent) printStopped(err error) {
+	if !a.config.JSONOutput {
+		return
+	}
+	a.outputMu.Lock()
+	defer a.outputMu.Unlock()
+	out := outputEvent{Event: "stopped", Time: time.Now()}
+	if err != nil {
+		out.Error = err.Error()
+	}
+	json.NewEncoder(os.Stdout).Encode(out)
+}
@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+
+	"minitunnel/internal/protocol"
+
+	"github.com/quic-go/quic-go"
+)
+
+// handleConnect passes a TLS connection the server didn't open through to
+// -tls-local, see protocol.CapPassthrough. It returns the bytes copied to
+// the local service and back
+func (a *Agent) handleConnect(stream quic.Stream, r io.Reader, w io.Writer, msg *protocol.Message) (int64, int64) {
+	var conn protocol.ConnectPayload
+	if err := json.Unmarshal(msg.Payload, &conn); err != nil {
+		log.Printf("Error reading passthrough connection: %v", err)
+		stream.CancelWrite(protocol.CallErrCanceled)
+		return 0, 0
+	}
+	if a.config.TLSLocal == "" {
+		log.Printf("Error: TLS connection from %s for %s, but -tls-local is not set", conn.RemoteAddr, conn.ServerName)
+		stream.CancelWrite(protocol.CallErrCanceled)
+		return 0, 0
+	}
+	log.Printf("→ TLS %s from %s", conn.ServerName, conn.RemoteAddr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.config.LocalTimeout)
+	local, err := a.dialer.DialContext(ctx, "tcp", a.config.TLSLocal)
+	cancel()
+	if err != nil {
+		log.Printf("Error connecting to %s: %v", a.config.TLSLocal, err)
+		stream.CancelWrite(protocol.CallErrCanceled)
+		return 0, 0
+	}
+	defer local.Close()
+
+	a.stats.requests.Add(1)
+	defer a.stats.requests.Add(-1)
+	done := make(chan int64)
+	go func() {
+		n, err := io.Copy(local, r)
+		if err != nil {
+			local.Close()
+		} else if tcp, ok := local.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		done <- n
+	}()
+	sent, err := io.Copy(w, local)
+	if err != nil {
+		stream.CancelWrite(protocol.CallErrCanceled)
+	} else {
+		stream.Close()
+	}
+	received := <-done
+	log.Printf("← TLS %s from %s closed", conn.ServerName, conn.RemoteAddr)
+	return received, sent
+}
@@ -0,0 +1,158 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"minitunnel/internal/config"
+	"minitunnel/internal/protocol"
+	"minitunnel/internal/rewrite"
+)
+
+// Plugin post-processes traffic as it passes through forwardToLocal.
+// Requests go through the chain in order before reaching the local service,
+// and responses in reverse order on the way back. Returning an error fails
+// the request with a 502
+type Plugin interface {
+	ProcessRequest(req *Request) error
+	ProcessResponse(req *Request, resp *Response) error
+}
+
+// Use appends plugins to the agent's chain. Call it before Run
+func (a *Agent) Use(plugins ...Plugin) {
+	a.plugins = append(a.plugins, plugins...)
+}
+
+// newPlugin creates a built-in plugin from a -plugin flag value of the form
+// name or name=argument
+func newPlugin(spec string) (Plugin, error) {
+	name, arg, _ := strings.Cut(spec, "=")
+	switch name {
+	case "strip-scripts":
+		if arg == "" {
+			return nil, fmt.Errorf("strip-scripts needs a pattern, e.g. strip-scripts=googletagmanager.com")
+		}
+		return stripScripts{pattern: []byte(arg)}, nil
+	case "noindex":
+		return noindex{}, nil
+	default:
+		return nil, fmt.Errorf("unknown plugin %q (available: strip-scripts, noindex)", name)
+	}
+}
+
+// maxDecodedPage bounds the size of a compressed page once decoded for
+// rewriting; larger pages are passed on untouched
+const maxDecodedPage = 64 << 20
+
+// scriptElement matches a whole <script> element, inline or external
+var scriptElement = regexp.MustCompile(`(?is)<script\b[^>]*>.*?</script\s*>`)
+
+// stripScripts removes script elements mentioning pattern from HTML
+// responses, e.g. analytics that shouldn't run for external visitors
+type stripScripts struct {
+	pattern []byte
+}
+
+func (stripScripts) ProcessRequest(req *protocol.HTTPRequest) error { return nil }
+
+func (p stripScripts) ProcessResponse(req *protocol.HTTPRequest, resp *protocol.HTTPResponse) error {
+	h := http.Header(resp.Headers)
+	if !strings.Contains(h.Get("Content-Type"), "text/html") {
+		return nil
+	}
+	// Pages compressed by the local service are decoded and encoded again
+	encoding := h.Get("Content-Encoding")
+	if !rewrite.Supported(encoding) {
+		return nil
+	}
+	page, err := rewrite.Decode(resp.Body, encoding, maxDecodedPage)
+	if errors.Is(err, rewrite.ErrTooLarge) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read page: %w", err)
+	}
+	page = scriptElement.ReplaceAllFunc(page, func(script []byte) []byte {
+		if bytes.Contains(script, p.pattern) {
+			return nil
+		}
+		return script
+	})
+	body, err := rewrite.Encode(page, encoding)
+	if err != nil {
+		return err
+	}
+	resp.Body = body
+	return nil
+}
+
+// noindex asks search engines not to index anything served through the
+// tunnel
+type noindex struct{}
+
+func (noindex) ProcessRequest(req *protocol.HTTPRequest) error { return nil }
+
+func (noindex) ProcessResponse(req *protocol.HTTPRequest, resp *protocol.HTTPResponse) error {
+	if resp.Headers == nil {
+		resp.Headers = make(map[string][]string)
+	}
+	http.Header(resp.Headers).Set("X-Robots-Tag", "noindex, nofollow")
+	return nil
+}
+
+// replaceBody applies -replace to the bodies of responses whose media type
+// is one of types
+type replaceBody struct {
+	replacements config.Replacements
+	types        []string
+}
+
+func (replaceBody) ProcessRequest(req *protocol.HTTPRequest) error { return nil }
+
+func (p replaceBody) ProcessResponse(req *protocol.HTTPRequest, resp *protocol.HTTPResponse) error {
+	h := http.Header(resp.Headers)
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if !p.matches(mediaType) {
+		return nil
+	}
+	// Bodies compressed by the local service are decoded and encoded again
+	encoding := h.Get("Content-Encoding")
+	if !rewrite.Supported(encoding) {
+		return nil
+	}
+	body, err := rewrite.Decode(resp.Body, encoding, maxDecodedPage)
+	if errors.Is(err, rewrite.ErrTooLarge) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read body: %w", err)
+	}
+	for _, r := range p.replacements {
+		if r.Regexp != nil {
+			body = r.Regexp.ReplaceAll(body, []byte(r.Replace))
+		} else {
+			body = bytes.ReplaceAll(body, []byte(r.Find), []byte(r.Replace))
+		}
+	}
+	if resp.Body, err = rewrite.Encode(body, encoding); err != nil {
+		return err
+	}
+	// The validator was for the body before it was changed
+	h.Del("Etag")
+	return nil
+}
+
+// matches reports whether mediaType is one of the types, or of a type/*
+// among them
+func (p replaceBody) matches(mediaType string) bool {
+	typ, _, _ := strings.Cut(mediaType, "/")
+	for _, t := range p.types {
+		if t == mediaType || t == typ+"/*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"minitunnel/internal/protocol"
+)
+
+// runPolling keeps the agent offline, checking in with the server every
+// poll interval, and opens a full tunnel only when the server has queued a
+// wake-up because traffic arrived for the tunnel name
+func (a *Agent) runPolling(ctx context.Context) error {
+	log.Printf("Polling mode: checking %s for traffic to %q every %s", a.config.ServerAddr, a.config.Name, a.config.PollInterval)
+
+	for {
+		wake, err := a.poll(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Printf("Poll failed: %v", err)
+		}
+
+		if wake {
+			log.Printf("Traffic is waiting, opening tunnel...")
+			if err := a.Start(ctx); err != nil {
+				log.Printf("Tunnel error: %v", err)
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			// Poll again right away in case more traffic queued a wake-up
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(a.config.PollInterval):
+		}
+	}
+}
+
+// poll asks the server whether traffic is waiting for this agent
+func (a *Agent) poll(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	conn, err := a.dial(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.CloseWithError(0, "")
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to open stream: %w", err)
+	}
+	defer stream.Close()
+
+	msg, err := protocol.NewPollMessage(protocol.PollPayload{
+		Name:            a.config.Name,
+		IntervalSeconds: int((a.config.PollInterval + time.Second - 1) / time.Second),
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := protocol.WriteMessage(stream, msg); err != nil {
+		return false, fmt.Errorf("failed to send poll: %w", err)
+	}
+
+	reply, err := protocol.NewReader(stream).ReadMessage()
+	if err != nil {
+		return false, fmt.Errorf("failed to read poll result: %w", err)
+	}
+	if reply.Type != protocol.MsgTypePollResult {
+		return false, fmt.Errorf("expected poll result, got %s", reply.Type)
+	}
+	var result protocol.PollResultPayload
+	if err := json.Unmarshal(reply.Payload, &result); err != nil {
+		return false, fmt.Errorf("failed to parse poll result: %w", err)
+	}
+	return result.Wake, nil
+}
@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// listeningPorts returns the TCP ports that processes in the given process
+// group are listening on, using /proc
+func listeningPorts(pgid int) ([]int, error) {
+	inodes := make(map[string]bool)
+
+	procs, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	for _, proc := range procs {
+		stat, err := os.ReadFile(filepath.Join(proc, "stat"))
+		if err != nil {
+			continue
+		}
+		// The command name may contain spaces, so parse after the last ')'
+		fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+		if len(fields) < 3 || fields[2] != strconv.Itoa(pgid) {
+			continue
+		}
+
+		fds, err := os.ReadDir(filepath.Join(proc, "fd"))
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(proc, "fd", fd.Name()))
+			if err != nil {
+				continue
+			}
+			if inode, ok := strings.CutPrefix(link, "socket:["); ok {
+				inodes[strings.TrimSuffix(inode, "]")] = true
+			}
+		}
+	}
+
+	var ports []int
+	seen := make(map[int]bool)
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		found, err := scanListenTable(table, inodes)
+		if err != nil {
+			continue
+		}
+		for _, port := range found {
+			if !seen[port] {
+				seen[port] = true
+				ports = append(ports, port)
+			}
+		}
+	}
+	return ports, nil
+}
+
+// scanListenTable returns the ports of listening sockets in a /proc/net/tcp
+// style table whose inode is in inodes
+func scanListenTable(path string, inodes map[string]bool) ([]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ports []int
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // Skip header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[3] != "0A" { // 0A = TCP_LISTEN
+			continue
+		}
+		if !inodes[fields[9]] {
+			continue
+		}
+		_, hexPort, ok := strings.Cut(fields[1], ":")
+		if !ok {
+			continue
+		}
+		port, err := strconv.ParseInt(hexPort, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port in %s: %w", path, err)
+		}
+		ports = append(ports, int(port))
+	}
+	return ports, scanner.Err()
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package agent
+
+import "errors"
+
+// listeningPorts is only implemented on Linux; elsewhere following relies on
+// scanning the configured port range
+func listeningPorts(pgid int) ([]int, error) {
+	return nil, errors.New("listening port detection is not supported on this platform")
+}
@@ -0,0 +1,198 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// protoStats counts the agent's traffic with the server at the protocol
+// and QUIC level, for `mt_agent stats`
+type protoStats struct {
+	messagesIn  atomic.Uint64
+	messagesOut atomic.Uint64
+	bytesIn     atomic.Uint64 // Control stream bytes, including framing
+	bytesOut    atomic.Uint64
+	packetsIn   atomic.Uint64
+	packetsOut  atomic.Uint64
+	packetsLost atomic.Uint64 // Declared lost by QUIC and retransmitted
+	rtt         atomic.Int64  // Smoothed QUIC round-trip time in nanoseconds
+	cwnd        atomic.Int64  // Congestion window in bytes
+	inFlight    atomic.Int64  // Bytes sent but not yet acknowledged
+	streams     atomic.Int64  // Open QUIC streams
+	requests    atomic.Int64  // Requests being forwarded to the local service
+	writeQueue  atomic.Int64  // Messages waiting for the control stream
+}
+
+// ProtocolStats is a snapshot of protoStats. In samples of the follow
+// stream the counters are per second; the gauges are current values
+type ProtocolStats struct {
+	Time        time.Time `json:"time"`
+	MessagesIn  uint64    `json:"messages_in"`
+	MessagesOut uint64    `json:"messages_out"`
+	BytesIn     uint64    `json:"bytes_in"`
+	BytesOut    uint64    `json:"bytes_out"`
+	PacketsIn   uint64    `json:"packets_in"`
+	PacketsOut  uint64    `json:"packets_out"`
+	PacketsLost uint64    `json:"packets_lost"`
+
+	RTTMs            float64 `json:"rtt_ms"`
+	CongestionWindow int64   `json:"congestion_window"`
+	BytesInFlight    int64   `json:"bytes_in_flight"`
+	Streams          int64   `json:"streams"`
+	Requests         int64   `json:"requests"`
+	WriteQueue       int64   `json:"write_queue"`
+}
+
+func (s *protoStats) snapshot() ProtocolStats {
+	return ProtocolStats{
+		Time:             time.Now(),
+		MessagesIn:       s.messagesIn.Load(),
+		MessagesOut:      s.messagesOut.Load(),
+		BytesIn:          s.bytesIn.Load(),
+		BytesOut:         s.bytesOut.Load(),
+		PacketsIn:        s.packetsIn.Load(),
+		PacketsOut:       s.packetsOut.Load(),
+		PacketsLost:      s.packetsLost.Load(),
+		RTTMs:            float64(s.rtt.Load()) / float64(time.Millisecond),
+		CongestionWindow: s.cwnd.Load(),
+		BytesInFlight:    s.inFlight.Load(),
+		Streams:          s.streams.Load(),
+		Requests:         s.requests.Load(),
+		WriteQueue:       s.writeQueue.Load(),
+	}
+}
+
+// rate turns the counters of p into per-second rates since prev
+func (p ProtocolStats) rate(prev ProtocolStats) ProtocolStats {
+	secs := p.Time.Sub(prev.Time).Seconds()
+	if secs <= 0 {
+		secs = 1
+	}
+	per := func(now, before uint64) uint64 { return uint64(float64(now-before)/secs + 0.5) }
+	r := p
+	r.MessagesIn = per(p.MessagesIn, prev.MessagesIn)
+	r.MessagesOut = per(p.MessagesOut, prev.MessagesOut)
+	r.BytesIn = per(p.BytesIn, prev.BytesIn)
+	r.BytesOut = per(p.BytesOut, prev.BytesOut)
+	r.PacketsIn = per(p.PacketsIn, prev.PacketsIn)
+	r.PacketsOut = per(p.PacketsOut, prev.PacketsOut)
+	r.PacketsLost = per(p.PacketsLost, prev.PacketsLost)
+	return r
+}
+
+// quicConfig returns the QUIC configuration of connections to the server,
+// reporting packet events to s
+func (s *protoStats) quicConfig() *quic.Config {
+	return &quic.Config{
+		Tracer: func(context.Context, logging.Perspective, quic.ConnectionID) *logging.ConnectionTracer {
+			return s.tracer()
+		},
+	}
+}
+
+func (s *protoStats) tracer() *logging.ConnectionTracer {
+	return &logging.ConnectionTracer{
+		SentLongHeaderPacket: func(*logging.ExtendedHeader, logging.ByteCount, logging.ECN, *logging.AckFrame, []logging.Frame) {
+			s.packetsOut.Add(1)
+		},
+		SentShortHeaderPacket: func(*logging.ShortHeader, logging.ByteCount, logging.ECN, *logging.AckFrame, []logging.Frame) {
+			s.packetsOut.Add(1)
+		},
+		ReceivedLongHeaderPacket: func(*logging.ExtendedHeader, logging.ByteCount, logging.ECN, []logging.Frame) {
+			s.packetsIn.Add(1)
+		},
+		ReceivedShortHeaderPacket: func(*logging.ShortHeader, logging.ByteCount, logging.ECN, []logging.Frame) {
+			s.packetsIn.Add(1)
+		},
+		LostPacket: func(logging.EncryptionLevel, logging.PacketNumber, logging.PacketLossReason) {
+			s.packetsLost.Add(1)
+		},
+		UpdatedMetrics: func(rtt *logging.RTTStats, cwnd, bytesInFlight logging.ByteCount, _ int) {
+			s.rtt.Store(int64(rtt.SmoothedRTT()))
+			s.cwnd.Store(int64(cwnd))
+			s.inFlight.Store(int64(bytesInFlight))
+		},
+	}
+}
+
+// countingReader counts the bytes read from the control stream
+type countingReader struct {
+	r     io.Reader
+	count *atomic.Uint64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.count.Add(uint64(n))
+	return n, err
+}
+
+// countingWriter counts the bytes written to the control stream
+type countingWriter struct {
+	w     io.Writer
+	count *atomic.Uint64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count.Add(uint64(n))
+	return n, err
+}
+
+// handleStats returns the protocol counters since the agent started
+func (in *Inspector) handleStats(w http.ResponseWriter, r *http.Request) {
+	if in.stats == nil {
+		http.Error(w, "No statistics available", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(in.stats.snapshot())
+}
+
+// handleStatsFollow streams per-second protocol statistics as server-sent
+// events until the viewer disconnects
+func (in *Inspector) handleStatsFollow(w http.ResponseWriter, r *http.Request) {
+	if in.stats == nil {
+		http.Error(w, "No statistics available", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	prev := in.stats.snapshot()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			now := in.stats.snapshot()
+			data, err := json.Marshal(now.rate(prev))
+			if err != nil {
+				log.Printf("Error encoding statistics: %v", err)
+				continue
+			}
+			prev = now
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		}
+	}
+}
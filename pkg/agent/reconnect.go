@@ -0,0 +1,41 @@
+package agent
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Delays between reconnect attempts: doubling from the first to the last,
+// and starting over once a connection has lasted reconnectReset
+const (
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = time.Minute
+	reconnectReset    = time.Minute
+)
+
+// runReconnecting keeps the tunnel up until ctx is cancelled, connecting
+// again whenever the connection is lost or refused
+func (a *Agent) runReconnecting(ctx context.Context) error {
+	delay := reconnectMinDelay
+	for {
+		started := time.Now()
+		err := a.Start(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if time.Since(started) >= reconnectReset {
+			delay = reconnectMinDelay
+		}
+		if err != nil {
+			log.Printf("Tunnel error: %v", err)
+		}
+		log.Printf("Reconnecting in %s...", delay)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, reconnectMaxDelay)
+	}
+}
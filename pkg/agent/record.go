@@ -0,0 +1,148 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"minitunnel/internal/config"
+	"minitunnel/internal/protocol"
+)
+
+// recorder appends the requests forwarded to the local service and their
+// responses to -record, one Exchange per line, for -replay to serve. A nil
+// recorder records nothing
+type recorder struct {
+	mu     sync.Mutex
+	f      *os.File
+	enc    *json.Encoder
+	nextID int
+}
+
+// openRecorder opens path for appending, creating it readable by its
+// owner only since recordings hold cookies and credentials
+func openRecorder(path string) (*recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+	return &recorder{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// record appends a request and the local service's response to it
+func (r *recorder) record(start time.Time, req protocol.HTTPRequest, resp protocol.HTTPResponse) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ex := Exchange{ID: r.nextID, Time: start, Duration: time.Since(start), Request: req, Response: resp}
+	r.nextID++
+	if err := r.enc.Encode(ex); err != nil {
+		log.Printf("Error recording %s %s: %v", req.Method, req.Path, err)
+	}
+}
+
+func (r *recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	return r.f.Close()
+}
+
+// replayKey identifies the recorded responses a request is answered with
+type replayKey struct {
+	tunnel, method, path string
+}
+
+// replayKeyFor returns the key of httpReq. The main tunnel's name is left
+// out, as it may be another one when replaying
+func replayKeyFor(httpReq protocol.HTTPRequest, tunnels config.Tunnels) replayKey {
+	key := replayKey{method: httpReq.Method, path: httpReq.Path}
+	if _, ok := tunnels[httpReq.Tunnel]; ok {
+		key.tunnel = httpReq.Tunnel
+	}
+	return key
+}
+
+// replayer answers requests with the responses of a -record file instead
+// of forwarding them. Responses to the same request are served in the
+// order they were recorded, the last one again once they run out
+type replayer struct {
+	tunnels   config.Tunnels // -tunnel, see replayKeyFor
+	mu        sync.Mutex
+	responses map[replayKey][]protocol.HTTPResponse
+	served    map[replayKey]int
+}
+
+// loadReplayer reads the recording at path
+func loadReplayer(path string, tunnels config.Tunnels) (*replayer, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open recording: %w", err)
+	}
+	defer f.Close()
+
+	r := &replayer{
+		tunnels:   tunnels,
+		responses: make(map[replayKey][]protocol.HTTPResponse),
+		served:    make(map[replayKey]int),
+	}
+	dec := json.NewDecoder(f)
+	n := 0
+	for {
+		var ex Exchange
+		if err := dec.Decode(&ex); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, 0, fmt.Errorf("failed to parse recording %s, entry %d: %w", path, n+1, err)
+		}
+		n++
+		key := replayKeyFor(ex.Request, tunnels)
+		r.responses[key] = append(r.responses[key], ex.Response)
+		// Also answer the path with another query, when nothing closer was recorded
+		if bare, _, ok := strings.Cut(key.path, "?"); ok {
+			loose := replayKey{key.tunnel, key.method, bare + "?"}
+			r.responses[loose] = append(r.responses[loose], ex.Response)
+		}
+	}
+	if n == 0 {
+		return nil, 0, fmt.Errorf("no requests recorded in %s", path)
+	}
+	return r, n, nil
+}
+
+// respond returns the recorded response to httpReq, or a 404 if none
+// was recorded
+func (r *replayer) respond(httpReq protocol.HTTPRequest) protocol.HTTPResponse {
+	key := replayKeyFor(httpReq, r.tunnels)
+	path, _, _ := strings.Cut(key.path, "?")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, k := range []replayKey{key, {key.tunnel, key.method, path}, {key.tunnel, key.method, path + "?"}} {
+		responses := r.responses[k]
+		if len(responses) == 0 {
+			continue
+		}
+		i := min(r.served[k], len(responses)-1)
+		r.served[k] = i + 1
+		resp := responses[i]
+		resp.Headers = http.Header(resp.Headers).Clone()
+		return resp
+	}
+
+	log.Printf("⚠ No recorded response for %s %s", httpReq.Method, httpReq.Path)
+	return protocol.HTTPResponse{
+		StatusCode: http.StatusNotFound,
+		Headers:    map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:       []byte(fmt.Sprintf("No recorded response for %s %s\n", httpReq.Method, httpReq.Path)),
+	}
+}
@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"minitunnel/internal/config"
+	"minitunnel/internal/protocol"
+)
+
+// recordExchanges writes a recording of requests, each answered with the
+// body at the same index
+func recordExchanges(t *testing.T, exchanges []protocol.HTTPRequest, bodies []string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	rec, err := openRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, req := range exchanges {
+		rec.record(time.Now(), req, protocol.HTTPResponse{
+			StatusCode: http.StatusOK,
+			Headers:    map[string][]string{"X-Order": {bodies[i]}},
+			Body:       []byte(bodies[i]),
+		})
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReplayer(t *testing.T) {
+	tunnels := config.Tunnels{"docs": "localhost:3001"}
+	path := recordExchanges(t, []protocol.HTTPRequest{
+		{Method: "GET", Path: "/items", Tunnel: "app"},
+		{Method: "GET", Path: "/items", Tunnel: "app"},
+		{Method: "GET", Path: "/search?q=a", Tunnel: "app"},
+		{Method: "POST", Path: "/items", Tunnel: "app"},
+		{Method: "GET", Path: "/items", Tunnel: "docs"},
+	}, []string{"first", "second", "search a", "created", "docs"})
+	r, n, err := loadReplayer(path, tunnels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Fatalf("loaded %d requests, want 5", n)
+	}
+
+	// Run in order, as responses to the same request are served in turn
+	steps := []struct {
+		name   string
+		req    protocol.HTTPRequest
+		status int
+		body   string
+	}{
+		{"first in order", protocol.HTTPRequest{Method: "GET", Path: "/items"}, http.StatusOK, "first"},
+		{"second in order", protocol.HTTPRequest{Method: "GET", Path: "/items"}, http.StatusOK, "second"},
+		{"last repeated", protocol.HTTPRequest{Method: "GET", Path: "/items"}, http.StatusOK, "second"},
+		{"main tunnel renamed", protocol.HTTPRequest{Method: "GET", Path: "/items", Tunnel: "other"}, http.StatusOK, "second"},
+		{"other tunnel", protocol.HTTPRequest{Method: "GET", Path: "/items", Tunnel: "docs"}, http.StatusOK, "docs"},
+		{"method", protocol.HTTPRequest{Method: "POST", Path: "/items"}, http.StatusOK, "created"},
+		{"exact query", protocol.HTTPRequest{Method: "GET", Path: "/search?q=a"}, http.StatusOK, "search a"},
+		{"other query", protocol.HTTPRequest{Method: "GET", Path: "/search?q=b"}, http.StatusOK, "search a"},
+		{"no query", protocol.HTTPRequest{Method: "GET", Path: "/search"}, http.StatusOK, "search a"},
+		{"query on unqueried path", protocol.HTTPRequest{Method: "POST", Path: "/items?x=1"}, http.StatusOK, "created"},
+		{"unknown path", protocol.HTTPRequest{Method: "GET", Path: "/missing"}, http.StatusNotFound, ""},
+		{"unknown method", protocol.HTTPRequest{Method: "DELETE", Path: "/items"}, http.StatusNotFound, ""},
+	}
+	for _, step := range steps {
+		resp := r.respond(step.req)
+		if resp.StatusCode != step.status {
+			t.Fatalf("%s: status = %d, want %d", step.name, resp.StatusCode, step.status)
+		}
+		if step.status == http.StatusOK && string(resp.Body) != step.body {
+			t.Fatalf("%s: body = %q, want %q", step.name, resp.Body, step.body)
+		}
+	}
+
+	// Changing a served response's headers must not change the recording
+	resp := r.respond(protocol.HTTPRequest{Method: "GET", Path: "/items", Tunnel: "docs"})
+	resp.Headers["X-Order"][0] = "changed"
+	if got := r.respond(protocol.HTTPRequest{Method: "GET", Path: "/items", Tunnel: "docs"}); got.Headers["X-Order"][0] != "docs" {
+		t.Errorf("recorded header changed to %q", got.Headers["X-Order"][0])
+	}
+}
+
+func TestLoadReplayerErrors(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"missing", filepath.Join(dir, "missing.jsonl")},
+		{"empty", write("empty.jsonl", "")},
+		{"malformed", write("malformed.jsonl", "{\"id\": 0}\nnot json\n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := loadReplayer(tt.path, nil); err == nil {
+				t.Error("loadReplayer succeeded, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// sessionCache keeps the session tickets the server hands out, so that a
+// reconnecting agent resumes its session and sends the hello with 0-RTT
+// instead of waiting out a full handshake. With -session-file the tickets
+// are written to a file too, for agents restarted by a supervisor
+type sessionCache struct {
+	mu       sync.Mutex
+	path     string // Empty to keep tickets in memory only
+	sessions map[string]*tls.ClientSessionState
+}
+
+// savedSession is a ticket as written to -session-file
+type savedSession struct {
+	Ticket []byte `json:"ticket"`
+	State  []byte `json:"state"`
+}
+
+// newSessionCache returns a cache holding the tickets saved in path, if set
+func newSessionCache(path string) *sessionCache {
+	c := &sessionCache{path: path, sessions: make(map[string]*tls.ClientSessionState)}
+	if path == "" {
+		return c
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c
+	}
+	var saved map[string]savedSession
+	if err == nil {
+		err = json.Unmarshal(data, &saved)
+	}
+	if err != nil {
+		log.Printf("⚠ Ignoring session file %s: %v", path, err)
+		return c
+	}
+	for key, s := range saved {
+		state, err := tls.ParseSessionState(s.State)
+		if err != nil {
+			continue
+		}
+		if session, err := tls.NewResumptionState(s.Ticket, state); err == nil {
+			c.sessions[key] = session
+		}
+	}
+	return c
+}
+
+// Get implements tls.ClientSessionCache
+func (c *sessionCache) Get(key string) (*tls.ClientSessionState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	session, ok := c.sessions[key]
+	return session, ok
+}
+
+// Put implements tls.ClientSessionCache, saving the tickets to the file
+func (c *sessionCache) Put(key string, session *tls.ClientSessionState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if session == nil {
+		delete(c.sessions, key)
+	} else {
+		c.sessions[key] = session
+	}
+	if c.path == "" {
+		return
+	}
+	if err := c.save(); err != nil {
+		log.Printf("Error saving session file: %v", err)
+	}
+}
+
+// save replaces the file with the current tickets. Callers hold c.mu
+func (c *sessionCache) save() error {
+	saved := make(map[string]savedSession, len(c.sessions))
+	for key, session := range c.sessions {
+		ticket, state, err := session.ResumptionState()
+		if err != nil || state == nil {
+			continue
+		}
+		data, err := state.Bytes()
+		if err != nil {
+			continue
+		}
+		saved[key] = savedSession{Ticket: ticket, State: data}
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	// CreateTemp makes the file readable to its owner only: the tickets
+	// are secrets that resume the session
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), "."+filepath.Base(c.path)+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to save session tickets: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save session tickets: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save session tickets: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return fmt.Errorf("failed to save session tickets: %w", err)
+	}
+	return nil
+}
+
+// keyedSessionCache files a cache's tickets under the settings the server
+// was verified with. A resumed session skips verification, so a ticket
+// from before a change of -ca, -pin-sha256 or -insecure must not be used,
+// nor one presenting an old client certificate
+type keyedSessionCache struct {
+	*sessionCache
+	prefix string
+}
+
+func (c keyedSessionCache) Get(key string) (*tls.ClientSessionState, bool) {
+	return c.sessionCache.Get(c.prefix + key)
+}
+
+func (c keyedSessionCache) Put(key string, session *tls.ClientSessionState) {
+	c.sessionCache.Put(c.prefix+key, session)
+}
+
+// sessionCacheFor returns the agent's session cache for the current
+// verification settings, nil without -0rtt
+func (a *Agent) sessionCacheFor() tls.ClientSessionCache {
+	if a.sessions == nil {
+		return nil
+	}
+	settings := strings.Join([]string{
+		a.config.CAFile,
+		strings.Join(a.config.PinSHA256, ","),
+		strconv.FormatBool(a.config.Insecure),
+		a.config.CertFile,
+	}, "\n")
+	sum := sha256.Sum256([]byte(settings))
+	return keyedSessionCache{a.sessions, hex.EncodeToString(sum[:8]) + "/"}
+}
@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// doLocal sends req to the local service. When the service refuses the
+// connection or drops it before answering, as while a dev server restarts,
+// the request is tried again up to -local-retries times, waiting
+// -local-retry-backoff and twice as long for each next attempt
+func (a *Agent) doLocal(req *http.Request) (*http.Response, error) {
+	resp, err := a.client.Do(req)
+	if a.config.LocalRetries == 0 || (a.config.IdempotentOnly && !idempotent(req)) {
+		return resp, err
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		// The body can't be sent again
+		return resp, err
+	}
+	backoff := a.config.LocalRetryBackoff
+	for attempt := 1; attempt <= a.config.LocalRetries && retryable(err); attempt++ {
+		log.Printf("⚠ Local service failed %s %s, retrying in %s (%d/%d): %v", req.Method, req.URL.Path, backoff, attempt, a.config.LocalRetries, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
+
+		retry := req.Clone(req.Context())
+		if req.GetBody != nil {
+			if retry.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		resp, err = a.client.Do(retry)
+	}
+	return resp, err
+}
+
+// retryable reports whether err means the local service didn't get to
+// answer, so that the request can be sent again
+func retryable(err error) bool {
+	return err != nil && (errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF))
+}
+
+// idempotent reports whether sending req twice has the same effect as
+// sending it once, going by its method or an idempotency key like
+// net/http does
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != "" || req.Header.Get("X-Idempotency-Key") != ""
+}
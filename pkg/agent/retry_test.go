@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"minitunnel/internal/config"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{syscall.ECONNREFUSED, true},
+		{fmt.Errorf("dial tcp: %w", syscall.ECONNREFUSED), true},
+		{syscall.ECONNRESET, true},
+		{io.EOF, true},
+		{io.ErrUnexpectedEOF, true},
+		{errors.New("timeout awaiting response headers"), false},
+		{errResponseTooLarge, false},
+	}
+	for _, tt := range tests {
+		if got := retryable(tt.err); got != tt.want {
+			t.Errorf("retryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	tests := []struct {
+		method string
+		header string // Set to a key, if any
+		want   bool
+	}{
+		{http.MethodGet, "", true},
+		{http.MethodHead, "", true},
+		{http.MethodOptions, "", true},
+		{http.MethodPut, "", true},
+		{http.MethodDelete, "", true},
+		{http.MethodPost, "", false},
+		{http.MethodPatch, "", false},
+		{http.MethodPost, "Idempotency-Key", true},
+		{http.MethodPatch, "X-Idempotency-Key", true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/", nil)
+		if tt.header != "" {
+			req.Header.Set(tt.header, "key")
+		}
+		if got := idempotent(req); got != tt.want {
+			t.Errorf("idempotent(%s with %q) = %v, want %v", tt.method, tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestDoLocal(t *testing.T) {
+	tests := []struct {
+		name           string
+		retries        int
+		idempotentOnly bool
+		fails          int // Connections the local service drops before answering
+		status         int // It answers with
+		method         string
+		body           io.Reader
+		header         string
+		ok             bool
+		attempts       int64
+	}{
+		{"no retries", 0, false, 1, http.StatusOK, http.MethodGet, nil, "", false, 1},
+		{"recovers", 3, false, 2, http.StatusOK, http.MethodGet, nil, "", true, 3},
+		{"gives up", 2, false, 5, http.StatusOK, http.MethodGet, nil, "", false, 3},
+		{"answered", 3, false, 0, http.StatusOK, http.MethodGet, nil, "", true, 1},
+		{"error status not retried", 3, false, 0, http.StatusInternalServerError, http.MethodGet, nil, "", true, 1},
+		{"post with body", 3, false, 1, http.StatusOK, http.MethodPost, strings.NewReader("payload"), "", true, 2},
+		{"post not idempotent", 3, true, 1, http.StatusOK, http.MethodPost, strings.NewReader("payload"), "", false, 1},
+		{"post with idempotency key", 3, true, 1, http.StatusOK, http.MethodPost, strings.NewReader("payload"), "Idempotency-Key", true, 2},
+		{"body can't be sent again", 3, false, 1, http.StatusOK, http.MethodPut, io.NopCloser(strings.NewReader("payload")), "", false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int64
+			local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := attempts.Add(1)
+				if body, _ := io.ReadAll(r.Body); tt.body != nil && string(body) != "payload" {
+					t.Errorf("attempt %d got body %q", n, body)
+				}
+				if n <= int64(tt.fails) {
+					conn, _, _ := w.(http.Hijacker).Hijack()
+					conn.Close()
+					return
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer local.Close()
+
+			a := &Agent{
+				config: &config.AgentConfig{
+					LocalRetries:      tt.retries,
+					LocalRetryBackoff: time.Millisecond,
+					IdempotentOnly:    tt.idempotentOnly,
+				},
+				client: &http.Client{Transport: &http.Transport{DisableKeepAlives: true}},
+			}
+			req, err := http.NewRequest(tt.method, local.URL, tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.header != "" {
+				req.Header.Set(tt.header, "key")
+			}
+			resp, err := a.doLocal(req)
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode != tt.status {
+					t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+				}
+			}
+			if (err == nil) != tt.ok {
+				t.Errorf("doLocal = %v, want ok %v", err, tt.ok)
+			}
+			if got := attempts.Load(); got != tt.attempts {
+				t.Errorf("%d attempts, want %d", got, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestDoLocalRefused(t *testing.T) {
+	local := httptest.NewServer(http.NotFoundHandler())
+	addr := local.URL
+	local.Close()
+
+	a := &Agent{
+		config: &config.AgentConfig{LocalRetries: 2, LocalRetryBackoff: 10 * time.Millisecond},
+		client: &http.Client{},
+	}
+	req, _ := http.NewRequest(http.MethodGet, addr, nil)
+	start := time.Now()
+	if _, err := a.doLocal(req); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("doLocal = %v, want connection refused", err)
+	}
+	// 10ms before the first retry and 20ms before the second
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("gave up after %s, before backing off", elapsed)
+	}
+}
@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"minitunnel/internal/config"
+	"minitunnel/internal/protocol"
+)
+
+// localTarget returns the local address and path a request goes to: the
+// address of a further -tunnel, that of the longest -route matching the
+// path, or the forwarding target. route is the matching route, if any
+func (a *Agent) localTarget(httpReq protocol.HTTPRequest) (addr, path string, route *config.Route) {
+	if addr, ok := a.config.Tunnels[httpReq.Tunnel]; ok {
+		return addr, httpReq.Path, nil
+	}
+	if route = matchRoute(a.config.Routes, httpReq.Path); route != nil {
+		return route.Addr, routedPath(route, httpReq.Path), route
+	}
+	return a.LocalAddr(), httpReq.Path, nil
+}
+
+// matchRoute returns the route with the longest prefix that path, with
+// its query, is under, or nil
+func matchRoute(routes config.Routes, path string) *config.Route {
+	path, _, _ = strings.Cut(path, "?")
+	var best *config.Route
+	for i, r := range routes {
+		if !underPrefix(path, r.Prefix) {
+			continue
+		}
+		if best == nil || len(r.Prefix) > len(best.Prefix) {
+			best = &routes[i]
+		}
+	}
+	return best
+}
+
+// underPrefix reports whether path is prefix or below it, so /api matches
+// /api and /api/users but not /apis
+func underPrefix(path, prefix string) bool {
+	return prefix == "/" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// routedPath returns the path a request goes to on the route's address
+func routedPath(r *config.Route, path string) string {
+	if r.Path == "" {
+		return path
+	}
+	path, query, hasQuery := strings.Cut(path, "?")
+	rest := path
+	if r.Prefix != "/" {
+		rest = strings.TrimPrefix(path, r.Prefix)
+	}
+	path = strings.TrimSuffix(r.Path, "/") + rest
+	if path == "" {
+		path = "/"
+	}
+	if hasQuery {
+		path += "?" + query
+	}
+	return path
+}
+
+// unrouteLocation puts redirects of a route that rewrites paths back under
+// its public prefix, so that /api=localhost:8000/ redirecting to /login
+// sends the visitor to /api/login. Redirects elsewhere are left alone
+func unrouteLocation(r *config.Route, h http.Header) {
+	if r == nil || r.Path == "" {
+		return
+	}
+	target := strings.TrimSuffix(r.Path, "/")
+	public := strings.TrimSuffix(r.Prefix, "/")
+	for _, key := range []string{"Location", "Content-Location"} {
+		for i, v := range h[key] {
+			u, err := url.Parse(v)
+			if err != nil || !strings.HasPrefix(u.Path, "/") || (u.Host != "" && !strings.EqualFold(u.Host, r.Addr)) {
+				continue
+			}
+			if target != "" && !underPrefix(u.Path, target) {
+				continue
+			}
+			u.Path = public + strings.TrimPrefix(u.Path, target)
+			if u.Path == "" {
+				u.Path = "/"
+			}
+			u.RawPath = ""
+			h[key][i] = u.String()
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"minitunnel/internal/protocol"
+
+	"github.com/quic-go/quic-go"
+)
+
+// session tracks the requests handled during one tunnel connection so the
+// agent can drain them on shutdown and report a summary. It also holds what
+// the connection's welcome negotiated, so that requests still running after
+// a reconnect answer on their own connection
+type session struct {
+	stream      quic.Stream // Control stream
+	clientID    string
+	compression string // Body compression, none if empty
+
+	writeMu sync.Mutex            // Serializes writes to stream
+	out     protocol.WriteOptions // Framing, limits and signer of messages after the welcome
+
+	started      time.Time
+	lastActivity atomic.Int64 // Unix nanoseconds of the last request start or end
+	requests     atomic.Int64
+	errors       atomic.Int64
+	bytesIn      atomic.Int64 // Request bodies received from the server
+	bytesOut     atomic.Int64 // Response bodies sent to the server
+
+	mu            sync.Mutex // Guards draining together with inflight.Add
+	draining      bool
+	inflight      sync.WaitGroup
+	inflightCount atomic.Int64
+}
+
+func newSession(stream quic.Stream, welcome protocol.WelcomePayload, signer *protocol.Signer) *session {
+	s := &session{
+		stream:      stream,
+		clientID:    welcome.ClientID,
+		compression: welcome.Compression,
+		out: protocol.WriteOptions{
+			Framing:      welcome.Framing,
+			MaxFrameSize: welcome.MaxMessageSize,
+			Continuation: welcome.Framing == protocol.FramingBinary && welcome.Capabilities.Has(protocol.CapContinuation),
+			Signer:       signer,
+		},
+		started: time.Now(),
+	}
+	s.touch()
+	return s
+}
+
+func (s *session) touch() {
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+// begin registers an in-flight request. It returns false once the session
+// is draining and no new requests should be started
+func (s *session) begin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return false
+	}
+	s.inflight.Add(1)
+	s.inflightCount.Add(1)
+	s.touch()
+	return true
+}
+
+// end records a finished request
+func (s *session) end(req protocol.HTTPRequest, resp protocol.HTTPResponse) {
+	s.requests.Add(1)
+	if resp.StatusCode >= 500 {
+		s.errors.Add(1)
+	}
+	s.bytesIn.Add(int64(len(req.Body)))
+	s.bytesOut.Add(int64(len(resp.Body)))
+	s.touch()
+	s.inflightCount.Add(-1)
+	s.inflight.Done()
+}
+
+// watchIdle calls stop once no request has been active for timeout
+func (s *session) watchIdle(ctx context.Context, timeout time.Duration, stop func()) {
+	ticker := time.NewTicker(timeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			idle := time.Since(time.Unix(0, s.lastActivity.Load()))
+			if s.inflightCount.Load() == 0 && idle >= timeout {
+				log.Printf("No requests for %s, going back to sleep", timeout)
+				stop()
+				return
+			}
+		}
+	}
+}
+
+// drain stops new requests and waits up to timeout for in-flight ones,
+// reporting whether they all finished
+func (s *session) drain(timeout time.Duration) bool {
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// printSummary logs what the session did
+func (s *session) printSummary() {
+	log.Printf("Session summary:")
+	log.Printf("  Duration: %s", time.Since(s.started).Round(time.Second))
+	log.Printf("  Requests: %d (%d errors)", s.requests.Load(), s.errors.Load())
+	log.Printf("  Received: %s", formatBytes(s.bytesIn.Load()))
+	log.Printf("  Sent:     %s", formatBytes(s.bytesOut.Load()))
+}
+
+// shutdown tells the server we are leaving, finishes in-flight requests and
+// closes the connection
+func (a *Agent) shutdown(conn quic.Connection, sess *session) {
+	log.Printf("Shutting down, draining in-flight requests...")
+
+	msg, err := protocol.NewDisconnectMessage(protocol.DisconnectPayload{Reason: "agent shutting down"})
+	if err == nil {
+		err = a.send(sess, msg)
+	}
+	if err != nil {
+		log.Printf("Error sending disconnect message: %v", err)
+	}
+
+	if !sess.drain(a.config.DrainTimeout) {
+		log.Printf("Drain timeout of %s reached, abandoning in-flight requests", a.config.DrainTimeout)
+	}
+	conn.CloseWithError(quic.ApplicationErrorCode(protocol.ErrCodeShutdown), "agent shut down")
+}
+
+// rejectDraining answers a request that arrived after shutdown started
+func (a *Agent) rejectDraining(sess *session, req protocol.HTTPRequest) {
+	resp := protocol.HTTPResponse{
+		ID:         req.ID,
+		StatusCode: http.StatusServiceUnavailable,
+		Headers:    map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:       []byte("Tunnel is shutting down\n"),
+	}
+	msg, err := protocol.NewResponseMessage(resp)
+	if err != nil {
+		log.Printf("Error creating response message: %v", err)
+		return
+	}
+	if err := a.send(sess, msg); err != nil {
+		log.Printf("Error sending response: %v", err)
+	}
+}
+
+// formatBytes renders a byte count with a binary unit suffix
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"minitunnel/internal/protocol"
+
+	"github.com/quic-go/quic-go"
+)
+
+// bufferStream is a control stream whose writes go to a buffer
+type bufferStream struct {
+	quic.Stream
+	buf bytes.Buffer
+}
+
+func (s *bufferStream) Write(p []byte) (int, error) {
+	return s.buf.Write(p)
+}
+
+func TestSendUsesSessionSigner(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	welcome := protocol.WelcomePayload{ClientID: "app"}
+	oldStream, newStream := &bufferStream{}, &bufferStream{}
+	old := newSession(oldStream, welcome, protocol.NewSigner(key))
+	current := newSession(newStream, welcome, protocol.NewSigner(key))
+
+	a := &Agent{}
+	heartbeat, err := protocol.NewHeartbeatMessage(protocol.HeartbeatPayload{SentAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A request of the dropped connection answering late must not take
+	// sequence numbers from the new one
+	for _, sess := range []*session{current, old, current, old, current} {
+		if err := a.send(sess, heartbeat); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, stream := range map[string]*bufferStream{"old": oldStream, "new": newStream} {
+		reader := protocol.NewReader(&stream.buf)
+		reader.SetVerifier(protocol.NewVerifier(key))
+		for stream.buf.Len() > 0 {
+			if _, err := reader.ReadMessage(); err != nil {
+				t.Fatalf("%s connection: %v", name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"minitunnel/internal/httpheader"
+	"minitunnel/internal/protocol"
+	"minitunnel/internal/tracing"
+
+	"github.com/quic-go/quic-go"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// acceptCalls serves the call streams the server opens for streamed
+// requests, see protocol.CapStreaming, and the passthrough streams of TLS
+// connections, see protocol.CapPassthrough, until the connection closes
+func (a *Agent) acceptCalls(ctx context.Context, conn quic.Connection, sess *session) {
+	for {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+		go a.handleCall(stream, sess)
+	}
+}
+
+// handleCall reads the request head of a call stream and forwards the call
+func (a *Agent) handleCall(stream quic.Stream, sess *session) {
+	a.stats.streams.Add(1)
+	defer a.stats.streams.Add(-1)
+
+	reader := protocol.NewCallReader(countingReader{stream, &a.stats.bytesIn})
+	reader.SetMaxSize(a.config.MaxMessageSize)
+	msg, err := reader.ReadMessage()
+	if err == nil && msg.Type == protocol.MsgTypeConnect {
+		if !sess.begin() {
+			stream.CancelRead(protocol.CallErrCanceled)
+			stream.CancelWrite(protocol.CallErrCanceled)
+			return
+		}
+		received, sent := a.handleConnect(stream, reader.Raw(), countingWriter{stream, &a.stats.bytesOut}, msg)
+		stream.CancelRead(protocol.CallErrCanceled)
+		sess.bytesIn.Add(received)
+		sess.bytesOut.Add(sent)
+		sess.end(protocol.HTTPRequest{}, protocol.HTTPResponse{})
+		return
+	}
+	if err == nil && msg.Type != protocol.MsgTypeRequest {
+		err = fmt.Errorf("expected request message, got %s", msg.Type)
+	}
+	var httpReq protocol.HTTPRequest
+	if err == nil {
+		httpReq, err = msg.DecodeRequest()
+	}
+	if err != nil {
+		log.Printf("Error reading streamed call: %v", err)
+		stream.CancelRead(protocol.CallErrCanceled)
+		stream.CancelWrite(protocol.CallErrCanceled)
+		return
+	}
+
+	w := countingWriter{stream, &a.stats.bytesOut}
+	if !sess.begin() {
+		a.failCall(w, httpReq, http.StatusServiceUnavailable, "Tunnel is shutting down\n", "")
+		stream.CancelRead(protocol.CallErrCanceled)
+		stream.Close()
+		return
+	}
+	resp, received, sent := a.forwardCall(sess, w, reader, httpReq)
+	stream.CancelRead(protocol.CallErrCanceled)
+	stream.Close()
+	sess.bytesIn.Add(received)
+	sess.bytesOut.Add(sent)
+	sess.end(httpReq, resp)
+}
+
+// forwardCall sends a streamed call to the local service over cleartext
+// HTTP/2, passing the request body on as it arrives and the response body
+// back as it is read, then the response trailers. The local timeout bounds
+// the wait for the response head only. It returns the response head and
+// the body bytes received and sent
+func (a *Agent) forwardCall(sess *session, w io.Writer, reader *protocol.Reader, httpReq protocol.HTTPRequest) (protocol.HTTPResponse, int64, int64) {
+	a.stats.requests.Add(1)
+	defer a.stats.requests.Add(-1)
+	log.Printf("→ %s %s (streamed)", httpReq.Method, httpReq.Path)
+	start := time.Now()
+
+	ctx, span := startSpan(httpReq)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The server resets the stream if the visitor gives up, which ends the
+	// local call too
+	var received atomic.Int64
+	body, bodyWriter := io.Pipe()
+	go func() {
+		for {
+			msg, err := reader.ReadMessage()
+			if err != nil {
+				bodyWriter.CloseWithError(err)
+				cancel()
+				return
+			}
+			switch msg.Type {
+			case protocol.MsgTypeData:
+				received.Add(int64(len(msg.Body)))
+				if _, err := bodyWriter.Write(msg.Body); err != nil {
+					// The local service stopped reading
+					return
+				}
+			case protocol.MsgTypeEnd:
+				bodyWriter.Close()
+				return
+			}
+		}
+	}()
+
+	timeout := a.config.LocalTimeout
+	if httpReq.TimeoutMs > 0 {
+		timeout = min(timeout, time.Duration(httpReq.TimeoutMs)*time.Millisecond)
+	}
+	timer := time.AfterFunc(timeout, cancel)
+	req, err := a.newLocalRequest(ctx, httpReq, body)
+	var localResp *http.Response
+	if err == nil {
+		if strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") {
+			// Dropped by the server as hop-by-hop, but gRPC servers want it
+			req.Header.Set("Te", "trailers")
+		}
+		var localSpan trace.Span
+		req, localSpan = startLocalSpan(req)
+		localResp, err = a.h2c.RoundTrip(req)
+		endLocalSpan(localSpan, localResp, err)
+	}
+	timedOut := !timer.Stop()
+	if err != nil {
+		log.Printf("Error forwarding request: %v", err)
+		a.status.requestFailed(httpReq, err)
+		resp := protocol.HTTPResponse{StatusCode: http.StatusBadGateway, Error: protocol.ForwardErrUnreachable}
+		text := fmt.Sprintf("Error: %v", err)
+		if timedOut {
+			resp = protocol.HTTPResponse{StatusCode: http.StatusGatewayTimeout, Error: protocol.ForwardErrTimeout}
+			text = fmt.Sprintf("Error: local service did not respond within %s", timeout)
+		}
+		resp = a.failCall(w, httpReq, resp.StatusCode, text, resp.Error)
+		a.finishCall(sess, span, start, httpReq, resp, int64(len(text)), err)
+		return resp, received.Load(), int64(len(text))
+	}
+	defer localResp.Body.Close()
+
+	httpheader.RemoveHopByHop(localResp.Header)
+	httpheader.AddVia(localResp.Header, localResp.ProtoMajor, localResp.ProtoMinor)
+	_, _, route := a.localTarget(httpReq)
+	unrouteLocation(route, localResp.Header)
+	a.config.ResponseHeaders.Apply(localResp.Header, httpReq.Tunnel)
+	resp := protocol.HTTPResponse{
+		ID:         httpReq.ID,
+		StatusCode: localResp.StatusCode,
+		Headers:    localResp.Header,
+	}
+	head, err := protocol.NewResponseMessage(resp)
+	if err == nil {
+		err = protocol.WriteBinaryMessage(w, head)
+	}
+	if err != nil {
+		log.Printf("Error sending response: %v", err)
+		a.finishCall(sess, span, start, httpReq, resp, 0, err)
+		return resp, received.Load(), 0
+	}
+
+	sent, err := protocol.CopyBody(w, localResp.Body)
+	var streamErr *quic.StreamError
+	if ctx.Err() != nil || errors.As(err, &streamErr) && streamErr.Remote {
+		// The visitor went away
+		a.finishCall(sess, span, start, httpReq, resp, sent, nil)
+		return resp, received.Load(), sent
+	}
+	end := protocol.EndPayload{Trailers: localResp.Trailer}
+	if err != nil {
+		log.Printf("Error streaming response: %v", err)
+		end = protocol.EndPayload{Error: protocol.ForwardErrUnreachable}
+	}
+	msg, err := protocol.NewEndMessage(end)
+	if err == nil {
+		err = protocol.WriteBinaryMessage(w, msg)
+	}
+	if err != nil {
+		log.Printf("Error sending response: %v", err)
+	}
+	a.finishCall(sess, span, start, httpReq, resp, sent, nil)
+	return resp, received.Load(), sent
+}
+
+// failCall answers a call on the local service's behalf with a plain text
+// body and returns the response head sent
+func (a *Agent) failCall(w io.Writer, httpReq protocol.HTTPRequest, status int, text, code string) protocol.HTTPResponse {
+	resp := protocol.HTTPResponse{
+		ID:         httpReq.ID,
+		StatusCode: status,
+		Headers:    map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}},
+		Error:      code,
+	}
+	end, err := protocol.NewEndMessage(protocol.EndPayload{})
+	if err != nil {
+		log.Printf("Error creating end message: %v", err)
+		return resp
+	}
+	head, err := protocol.NewResponseMessage(resp)
+	if err == nil {
+		err = protocol.WriteBinaryMessage(w, head)
+	}
+	if err == nil {
+		err = protocol.WriteBinaryMessage(w, protocol.NewDataMessage([]byte(text)))
+	}
+	if err == nil {
+		err = protocol.WriteBinaryMessage(w, end)
+	}
+	if err != nil {
+		log.Printf("Error sending response: %v", err)
+	}
+	return resp
+}
+
+// finishCall records a finished call in the inspector and access log and
+// ends its span
+func (a *Agent) finishCall(sess *session, span trace.Span, start time.Time, httpReq protocol.HTTPRequest, resp protocol.HTTPResponse, sent int64, err error) {
+	tracing.End(span, resp.StatusCode, err)
+	if a.inspector != nil {
+		a.inspector.Record(start, httpReq, resp, err)
+	}
+	log.Printf("← %d %s %s", resp.StatusCode, httpReq.Method, httpReq.Path)
+	a.logAccess(sess, start, httpReq, resp.StatusCode, sent)
+	a.emitRequest(start, httpReq, resp.StatusCode)
+}
@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// tailFilter selects which exchanges a live tail viewer sees
+type tailFilter struct {
+	method string // Exact method, any if empty
+	path   string // Path prefix, any if empty
+	status int    // Exact status such as 404, or a class such as 5 for 5xx, any if zero
+}
+
+// parseTailFilter reads a filter from the method, path and status query
+// parameters, e.g. ?method=POST&path=/webhooks&status=5xx
+func parseTailFilter(r *http.Request) (tailFilter, error) {
+	q := r.URL.Query()
+	f := tailFilter{
+		method: strings.ToUpper(q.Get("method")),
+		path:   q.Get("path"),
+	}
+	if status := strings.ToLower(q.Get("status")); status != "" {
+		class, isClass := strings.CutSuffix(status, "xx")
+		n, err := strconv.Atoi(class)
+		if err != nil || (isClass && (n < 1 || n > 5)) || (!isClass && (n < 100 || n > 599)) {
+			return f, fmt.Errorf("invalid status filter %q", status)
+		}
+		f.status = n
+	}
+	return f, nil
+}
+
+func (f tailFilter) match(ex *Exchange) bool {
+	if f.method != "" && ex.Request.Method != f.method {
+		return false
+	}
+	if f.path != "" && !strings.HasPrefix(ex.Request.Path, f.path) {
+		return false
+	}
+	switch {
+	case f.status == 0:
+	case f.status < 10:
+		if ex.Response.StatusCode/100 != f.status {
+			return false
+		}
+	default:
+		if ex.Response.StatusCode != f.status {
+			return false
+		}
+	}
+	return true
+}
+
+// subscribe registers a live tail viewer. Exchanges are dropped rather than
+// blocking Record if the viewer falls behind
+func (in *Inspector) subscribe() chan *Exchange {
+	ch := make(chan *Exchange, 64)
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.watchers == nil {
+		in.watchers = make(map[chan *Exchange]struct{})
+	}
+	in.watchers[ch] = struct{}{}
+	return ch
+}
+
+func (in *Inspector) unsubscribe(ch chan *Exchange) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	delete(in.watchers, ch)
+}
+
+// broadcast sends an exchange to every viewer. Callers hold in.mu
+func (in *Inspector) broadcast(ex *Exchange) {
+	for ch := range in.watchers {
+		select {
+		case ch <- ex:
+		default:
+		}
+	}
+}
+
+// handleTail streams exchanges matching the viewer's filter as server-sent
+// events until the viewer disconnects
+func (in *Inspector) handleTail(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseTailFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := in.subscribe()
+	defer in.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ex := <-ch:
+			if !filter.match(ex) {
+				continue
+			}
+			data, err := json.Marshal(ex)
+			if err != nil {
+				log.Printf("Error encoding exchange: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", ex.ID, data)
+			flusher.Flush()
+		}
+	}
+}
+
+func (in *Inspector) handleLive(w http.ResponseWriter, r *http.Request) {
+	in.render(w, "live", nil)
+}
@@ -0,0 +1,41 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+
+	"minitunnel/internal/protocol"
+	"minitunnel/internal/tracing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// startSpan starts the agent's span for a request from the server,
+// continuing the trace of the server's span for the trip through the
+// tunnel
+func startSpan(httpReq protocol.HTTPRequest) (context.Context, trace.Span) {
+	ctx := tracing.Extract(context.Background(), httpReq.Headers)
+	attrs := tracing.RequestAttributes(httpReq.Method, httpReq.Path)
+	if httpReq.Tunnel != "" {
+		attrs = append(attrs, tracing.Tunnel.String(httpReq.Tunnel))
+	}
+	return tracing.Start(ctx, "agent "+httpReq.Method, trace.SpanKindServer, attrs...)
+}
+
+// startLocalSpan starts the span of the call to the local service and
+// passes it on to the service in req's traceparent header
+func startLocalSpan(req *http.Request) (*http.Request, trace.Span) {
+	ctx, span := tracing.Start(req.Context(), "local "+req.Method, trace.SpanKindClient, tracing.RequestAttributes(req.Method, req.URL.Path)...)
+	tracing.Inject(ctx, req.Header)
+	return req.WithContext(ctx), span
+}
+
+// endLocalSpan ends the span of a call to the local service once its
+// response head arrived or the call failed
+func endLocalSpan(span trace.Span, resp *http.Response, err error) {
+	if err != nil {
+		tracing.End(span, 0, err)
+		return
+	}
+	tracing.End(span, resp.StatusCode, nil)
+}
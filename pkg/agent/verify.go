@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"minitunnel/internal/config"
+	"minitunnel/internal/protocol"
+)
+
+// errPinMismatch is returned when no pin matches the server's certificate
+var errPinMismatch = errors.New("server certificate does not match any -pin-sha256")
+
+// tlsConfig returns the TLS configuration for connecting to the server at
+// host. The server certificate is verified against the system roots, or
+// the CAs of -ca. With -pin-sha256 the certificate's public key has to
+// match a pin instead, so a self-signed server needs no CA at all
+func (a *Agent) tlsConfig(host string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: a.config.Insecure,
+		NextProtos:         []string{protocol.ALPN},
+		ServerName:         host,
+	}
+	if a.config.ServerName != "" {
+		tlsConfig.ServerName = a.config.ServerName
+	}
+	a.config.TLS.Apply(tlsConfig)
+	tlsConfig.ClientSessionCache = a.sessionCacheFor()
+
+	if a.config.CAFile != "" {
+		pem, err := os.ReadFile(a.config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", a.config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(a.config.PinSHA256) > 0 {
+		pins := make([][]byte, 0, len(a.config.PinSHA256))
+		for _, pin := range a.config.PinSHA256 {
+			digest, err := config.ParsePin(pin)
+			if err != nil {
+				return nil, err
+			}
+			pins = append(pins, digest)
+		}
+		// Pins take the place of chain verification, which would reject
+		// the self-signed certificates they are mostly used for
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPin(rawCerts, pins)
+		}
+	}
+
+	if a.config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(a.config.CertFile, a.config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// verifyPin checks the public key of the server's leaf certificate against
+// the pins
+func verifyPin(rawCerts [][]byte, pins [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errPinMismatch
+	}
+	leaf, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse server certificate: %w", err)
+	}
+	sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if bytes.Equal(sum[:], pin) {
+			return nil
+		}
+	}
+	return errPinMismatch
+}
+
+// verifyHint explains how to fix a failed verification of the server's
+// certificate, or returns "" if err is something else
+func verifyHint(err error) string {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return "the server certificate is not signed by a trusted CA: pass it with -ca, or its pin with -pin-sha256 (both printed by mt_server)"
+	case errors.As(err, &hostname):
+		return "the server certificate is not valid for this name: use -server-name to verify another one"
+	case errors.Is(err, errPinMismatch):
+		return "check -pin-sha256 against the pin mt_server prints at startup"
+	}
+	return ""
+}
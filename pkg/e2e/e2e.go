@@ -0,0 +1,223 @@
+// Package e2e encrypts response bodies between an agent and the visitors'
+// clients, so the operator of the server they go through can't read them.
+// An agent started with -e2e-key seals every body its local service
+// returns with AES-256-GCM, and clients holding the same key open them
+// again:
+//
+//	key, err := e2e.ParseKey(os.Getenv("MINITUNNEL_E2E_KEY"))
+//	client := &http.Client{Transport: &e2e.Transport{Key: key}}
+//	resp, err := client.Get("https://tunnel.example.com/shop/")
+//
+// A sealed body is sent with Encoding as its Content-Encoding, so the
+// server and proxies on the way pass it on untouched, and carries the
+// response's Content-Type and Content-Encoding inside. Only these are
+// sealed: the status, other headers and request, including its body, stay
+// readable to the server, which can also withhold responses or serve one
+// in place of another
+package e2e
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Encoding is the Content-Encoding of sealed bodies
+const Encoding = "x-minitunnel-e2e"
+
+// KeySize is the size of a key in bytes
+const KeySize = 32
+
+// version is the first byte of a sealed body, followed by the GCM nonce
+// and the ciphertext
+const version = 1
+
+// ErrOpen is returned for a body that isn't sealed with the key, or was
+// altered on the way
+var ErrOpen = errors.New("failed to open end-to-end encrypted body")
+
+// GenerateKey returns a new random key, encoded as ParseKey expects
+func GenerateKey() (string, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate key: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+// ParseKey decodes a key made by GenerateKey: KeySize bytes in unpadded
+// URL-safe base64
+func ParseKey(s string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid end-to-end key: %w", err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("invalid end-to-end key: %d bytes, want %d", len(key), KeySize)
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid end-to-end key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts body with key
+func Seal(key, body []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 1+aead.NonceSize(), 1+aead.NonceSize()+len(body)+aead.Overhead())
+	out[0] = version
+	if _, err := rand.Read(out[1:]); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(out, out[1:], body, nil), nil
+}
+
+// Open decrypts a body sealed with key
+func Open(key, sealed []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < 1+aead.NonceSize()+aead.Overhead() || sealed[0] != version {
+		return nil, ErrOpen
+	}
+	nonce, ciphertext := sealed[1:1+aead.NonceSize()], sealed[1+aead.NonceSize():]
+	body, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, ErrOpen
+	}
+	return body, nil
+}
+
+// sealedHeaders are the response headers sealed with the body, in the
+// order they are stored: each as a 2-byte big-endian length and the value
+var sealedHeaders = []string{"Content-Type", "Content-Encoding"}
+
+// Sealed reports whether h marks a sealed body
+func Sealed(h http.Header) bool {
+	return strings.EqualFold(strings.TrimSpace(h.Get("Content-Encoding")), Encoding)
+}
+
+// SealResponse seals a response body and its sealedHeaders, updating h to
+// describe the sealed body. Bodies that are empty or already sealed are
+// left alone
+func SealResponse(key []byte, h http.Header, body []byte) ([]byte, error) {
+	if len(body) == 0 || Sealed(h) {
+		return body, nil
+	}
+	var plain []byte
+	for _, name := range sealedHeaders {
+		v := h.Get(name)
+		if len(v) > 0xffff {
+			return nil, fmt.Errorf("%s header too long to seal", name)
+		}
+		plain = binary.BigEndian.AppendUint16(plain, uint16(len(v)))
+		plain = append(plain, v...)
+	}
+	sealed, err := Seal(key, append(plain, body...))
+	if err != nil {
+		return nil, err
+	}
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Content-Encoding", Encoding)
+	h.Del("Content-Length")
+	return sealed, nil
+}
+
+// OpenResponse reverses SealResponse, leaving bodies that aren't sealed
+// as they are
+func OpenResponse(key []byte, h http.Header, body []byte) ([]byte, error) {
+	if !Sealed(h) {
+		return body, nil
+	}
+	plain, err := Open(key, body)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, len(sealedHeaders))
+	for i := range sealedHeaders {
+		if len(plain) < 2 || len(plain) < 2+int(binary.BigEndian.Uint16(plain)) {
+			return nil, ErrOpen
+		}
+		n := int(binary.BigEndian.Uint16(plain))
+		values[i], plain = string(plain[2:2+n]), plain[2+n:]
+	}
+	for i, name := range sealedHeaders {
+		if values[i] == "" {
+			h.Del(name)
+		} else {
+			h.Set(name, values[i])
+		}
+	}
+	h.Set("Content-Length", strconv.Itoa(len(plain)))
+	return plain, nil
+}
+
+// Transport is an http.RoundTripper opening sealed response bodies. A body
+// that fails to open fails the request with ErrOpen. Bodies that aren't
+// sealed, such as the server's own error pages, are passed on as they are
+type Transport struct {
+	Key  []byte
+	Base http.RoundTripper // http.DefaultTransport if nil
+}
+
+// MaxBodySize bounds the sealed bodies Transport reads, matching the
+// server's default -max-response-body
+var MaxBodySize int64 = 50 << 20
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil || !Sealed(resp.Header) {
+		return resp, err
+	}
+	defer resp.Body.Close()
+	sealed, err := io.ReadAll(io.LimitReader(resp.Body, MaxBodySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if int64(len(sealed)) > MaxBodySize {
+		return nil, fmt.Errorf("%w: larger than %d bytes", ErrOpen, MaxBodySize)
+	}
+	body, err := OpenResponse(t.Key, resp.Header, sealed)
+	if err != nil {
+		return nil, err
+	}
+	// Like net/http, decompress gzip the transport asked for on its own
+	if req.Header.Get("Accept-Encoding") == "" && strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gzip body: %w", err)
+		}
+		if body, err = io.ReadAll(io.LimitReader(zr, MaxBodySize+1)); err != nil {
+			return nil, fmt.Errorf("failed to read gzip body: %w", err)
+		}
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.Uncompressed = true
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	return resp, nil
+}
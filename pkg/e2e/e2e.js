@@ -0,0 +1,82 @@
+// Opens response bodies sealed by an agent started with -e2e-key, for
+// browser extensions and pages using fetch. It mirrors OpenResponse in
+// e2e.go:
+//
+//   import { fetchSealed } from './e2e.js';
+//   const res = await fetchSealed('https://tunnel.example.com/shop/', key);
+//   console.log(await res.text());
+
+export const ENCODING = 'x-minitunnel-e2e';
+const VERSION = 1;
+const NONCE_SIZE = 12;
+const SEALED_HEADERS = ['Content-Type', 'Content-Encoding'];
+
+// importKey turns a key printed by `mt_agent e2e-key` into a CryptoKey
+export async function importKey(key) {
+  const b64 = key.trim().replace(/-/g, '+').replace(/_/g, '/');
+  const raw = Uint8Array.from(atob(b64), (c) => c.charCodeAt(0));
+  if (raw.length !== 32) {
+    throw new Error(`invalid end-to-end key: ${raw.length} bytes, want 32`);
+  }
+  return crypto.subtle.importKey('raw', raw, 'AES-GCM', false, ['decrypt']);
+}
+
+// sealed reports whether a response carries a sealed body
+export function sealed(response) {
+  return (response.headers.get('Content-Encoding') || '').trim().toLowerCase() === ENCODING;
+}
+
+// openResponse returns a response with the body of a sealed one decrypted,
+// and other responses as they are. It rejects bodies that were altered
+export async function openResponse(response, key) {
+  if (!sealed(response)) {
+    return response;
+  }
+  if (!(key instanceof CryptoKey)) {
+    key = await importKey(key);
+  }
+  const body = new Uint8Array(await response.arrayBuffer());
+  if (body.length < 1 + NONCE_SIZE + 16 || body[0] !== VERSION) {
+    throw new Error('failed to open end-to-end encrypted body');
+  }
+  let plain;
+  try {
+    plain = new Uint8Array(await crypto.subtle.decrypt(
+      { name: 'AES-GCM', iv: body.subarray(1, 1 + NONCE_SIZE) },
+      key,
+      body.subarray(1 + NONCE_SIZE),
+    ));
+  } catch {
+    throw new Error('failed to open end-to-end encrypted body');
+  }
+
+  const headers = new Headers(response.headers);
+  for (const name of SEALED_HEADERS) {
+    const n = plain.length >= 2 ? (plain[0] << 8) | plain[1] : -1;
+    if (n < 0 || plain.length < 2 + n) {
+      throw new Error('failed to open end-to-end encrypted body');
+    }
+    const value = new TextDecoder().decode(plain.subarray(2, 2 + n));
+    plain = plain.subarray(2 + n);
+    if (value) {
+      headers.set(name, value);
+    } else {
+      headers.delete(name);
+    }
+  }
+
+  // fetch has already undone the outer encoding, undo the local service's
+  let stream = new Blob([plain]).stream();
+  const encoding = (headers.get('Content-Encoding') || '').trim().toLowerCase();
+  if (encoding) {
+    stream = stream.pipeThrough(new DecompressionStream(encoding === 'x-gzip' ? 'gzip' : encoding));
+    headers.delete('Content-Encoding');
+  }
+  headers.delete('Content-Length');
+  return new Response(stream, { status: response.status, statusText: response.statusText, headers });
+}
+
+// fetchSealed is fetch for URLs served with -e2e-key
+export async function fetchSealed(input, key, init) {
+  return openResponse(await fetch(input, init), key);
+}
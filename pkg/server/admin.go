@@ -0,0 +1,293 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"minitunnel/internal/protocol"
+
+	"github.com/quic-go/quic-go"
+)
+
+// TunnelInfo describes a connected agent in admin API responses
+type TunnelInfo struct {
+	ID            string                `json:"id"`
+	TunnelURL     string                `json:"tunnel_url"`
+	RemoteAddr    string                `json:"remote_addr"`
+	ConnectedAt   time.Time             `json:"connected_at"`
+	LastHeartbeat time.Time             `json:"last_heartbeat"`
+	Draining      bool                  `json:"draining"`
+	LocalDown     string                `json:"local_down,omitempty"` // Why the local service fails its health check
+	Standby       bool                  `json:"standby"`
+	Identity      string                `json:"identity,omitempty"` // Client certificate name, see -client-ca
+	BasicAuth     bool                  `json:"basic_auth"`         // Visitors must log in
+	Limit         *LimitSnapshot        `json:"limit,omitempty"`    // Concurrency limit, omitted for unlimited tunnels
+	Pool          int                   `json:"pool,omitempty"`     // Agents sharing the tunnel name, see -balance
+	Agent         protocol.HelloPayload `json:"agent"`
+	Stats         StatsSnapshot         `json:"stats"`
+}
+
+func (s *Server) startAdminServer(ln net.Listener) {
+	if s.config.AdminToken == "" {
+		s.config.AdminToken = generateToken()
+		log.Printf("Admin API token (set -admin-token to choose your own): %s", s.config.AdminToken)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/tunnels", s.handleListTunnels)
+	mux.HandleFunc("POST /api/tunnels/bulk", s.handleBulk)
+	mux.HandleFunc("GET /api/tunnels/{id}", s.handleGetTunnel)
+	mux.HandleFunc("DELETE /api/tunnels/{id}", s.handleEvictTunnel)
+	mux.HandleFunc("GET /api/tunnels/{id}/stats", s.handleTunnelStats)
+	mux.HandleFunc("GET /api/tunnels/{id}/paths", s.handleTunnelPaths)
+	mux.HandleFunc("GET /api/tunnels/{id}/requests", s.handleInspectedRequests)
+	mux.HandleFunc("GET /api/tunnels/{id}/requests/{request}", s.handleInspectedRequest)
+	mux.HandleFunc("DELETE /api/tunnels/{id}/requests", s.handleClearInspectedRequests)
+	mux.HandleFunc("GET /api/requests", s.handleRecentRequests)
+	mux.HandleFunc("GET /api/inboxes", s.handleListInboxes)
+	mux.HandleFunc("GET /api/reservations", s.handleListReservations)
+	mux.HandleFunc("POST /api/reservations", s.handleAddReservation)
+	mux.HandleFunc("DELETE /api/reservations/{name}", s.handleDeleteReservation)
+	mux.HandleFunc("PUT /api/reservations/{name}/quota", s.handleSetQuota)
+	mux.HandleFunc("GET /api/usage", s.handleUsage)
+	mux.HandleFunc("GET /api/usage/tokens", s.handleTokenUsage)
+	mux.HandleFunc("GET "+protocol.OpenAPIPath, s.handleOpenAPI)
+	mux.HandleFunc("GET /{$}", s.handleDashboard)
+	if s.config.DebugEndpoints {
+		s.addDebugEndpoints(mux)
+	}
+
+	log.Printf("Admin server listening on %s", s.config.AdminAddr)
+
+	// Health checks come from load balancers and orchestrators, which
+	// don't have the token
+	root := http.NewServeMux()
+	root.HandleFunc("GET /healthz", s.handleHealthz)
+	root.HandleFunc("GET /readyz", s.handleReadyz)
+	if s.config.ClusterSecret != "" {
+		root.Handle("/cluster/", s.clusterHandler())
+	}
+	root.Handle("/", s.auditAdmin(s.requireAdmin(mux)))
+
+	server := &http.Server{Handler: root}
+	s.servers = append(s.servers, server)
+	s.serve("Admin", func() error { return server.Serve(ln) })
+}
+
+// requireAdmin rejects requests that don't carry the admin token, either as
+// a bearer token or as the password of HTTP Basic auth (for browsers)
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			_, token, ok = r.BasicAuth()
+		}
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="minitunnel admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleListTunnels(w http.ResponseWriter, r *http.Request) {
+	selectors, err := parseLabelSelectors(r.URL.Query()["label"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.listTunnels(selectors))
+}
+
+// listTunnels returns the connected tunnels matching all selectors, oldest
+// first
+func (s *Server) listTunnels(selectors []labelSelector) []TunnelInfo {
+	tunnels := []TunnelInfo{}
+	add := func(id string, clientInfo *ClientInfo) {
+		if matchLabels(clientInfo.currentLabels(), selectors) {
+			tunnels = append(tunnels, clientInfo.info(id))
+		}
+	}
+	collect := func(key, value interface{}) bool {
+		clientInfo := value.(*ClientInfo)
+		if clientInfo.pool == nil {
+			add(key.(string), clientInfo)
+			return true
+		}
+		// Every agent sharing the name is listed under it
+		for _, member := range clientInfo.pool.snapshot() {
+			add(key.(string), member)
+		}
+		return true
+	}
+	s.clients.Range(collect)
+	s.standbys.Range(collect)
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].ConnectedAt.Before(tunnels[j].ConnectedAt)
+	})
+	return tunnels
+}
+
+// labelSelector matches a label by key and, if hasValue is set, by value
+type labelSelector struct {
+	key      string
+	value    string
+	hasValue bool
+}
+
+// parseLabelSelectors parses ?label= query values of the form key=value or
+// key (label present with any value)
+func parseLabelSelectors(values []string) ([]labelSelector, error) {
+	selectors := make([]labelSelector, 0, len(values))
+	for _, v := range values {
+		key, value, hasValue := strings.Cut(v, "=")
+		if key == "" {
+			return nil, fmt.Errorf("invalid label selector %q: expected key or key=value", v)
+		}
+		selectors = append(selectors, labelSelector{key: key, value: value, hasValue: hasValue})
+	}
+	return selectors, nil
+}
+
+// matchLabels reports whether labels satisfy every selector
+func matchLabels(labels map[string]string, selectors []labelSelector) bool {
+	for _, sel := range selectors {
+		value, ok := labels[sel.key]
+		if !ok || (sel.hasValue && value != sel.value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) handleGetTunnel(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	val, ok := s.clients.Load(id)
+	if !ok {
+		http.Error(w, "Tunnel not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, val.(*ClientInfo).info(id))
+}
+
+func (s *Server) handleEvictTunnel(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	val, ok := s.clients.Load(id)
+	if !ok {
+		http.Error(w, "Tunnel not found", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("Evicting agent %s (admin request from %s)", id, r.RemoteAddr)
+	val.(*ClientInfo).conn.CloseWithError(quic.ApplicationErrorCode(protocol.ErrCodeEvicted), "evicted by administrator")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleTunnelStats(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	val, ok := s.clients.Load(id)
+	if !ok {
+		http.Error(w, "Tunnel not found", http.StatusNotFound)
+		return
+	}
+
+	clientInfo := val.(*ClientInfo)
+	writeJSON(w, http.StatusOK, clientInfo.stats.snapshot(id, clientInfo.connectedAt))
+}
+
+// handleTunnelPaths lists the tunnel's busiest paths, ordered by ?by=
+// requests (default), bytes or error_rate, at most ?limit= of them
+func (s *Server) handleTunnelPaths(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	val, ok := s.clients.Load(id)
+	if !ok {
+		http.Error(w, "Tunnel not found", http.StatusNotFound)
+		return
+	}
+
+	by := r.URL.Query().Get("by")
+	if by == "" {
+		by = pathsByRequests
+	}
+	if !validPathOrder(by) {
+		http.Error(w, "by must be requests, bytes or error_rate", http.StatusBadRequest)
+		return
+	}
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	writeJSON(w, http.StatusOK, val.(*ClientInfo).stats.paths.top(by, limit))
+}
+
+func (s *Server) handleRecentRequests(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.recent.recent())
+}
+
+// info builds the admin API view of a client
+func (c *ClientInfo) info(id string) TunnelInfo {
+	// Operators see that a tunnel is protected, not its password
+	agent := c.hello
+	agent.BasicAuth = nil
+	agent.Labels = c.currentLabels()
+	return TunnelInfo{
+		ID:            id,
+		TunnelURL:     c.tunnelURL,
+		RemoteAddr:    c.remoteAddr,
+		ConnectedAt:   c.connectedAt,
+		LastHeartbeat: c.lastHeartbeat(),
+		Draining:      c.draining.Load(),
+		LocalDown:     c.localDown(),
+		Standby:       c.standby.Load(),
+		Identity:      c.identity,
+		BasicAuth:     c.hello.BasicAuth != nil,
+		Limit:         c.limit.snapshot(),
+		Pool:          c.poolSize(),
+		Agent:         agent,
+		Stats:         c.stats.snapshot(id, c.connectedAt),
+	}
+}
+
+// handleOpenAPI serves the admin API's OpenAPI document, for generating
+// clients
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(protocol.AdminOpenAPI())
+}
+
+// generateToken returns a random hex token
+func generateToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Failed to generate token: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// writeJSON writes v as an indented JSON response
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net/http"
+
+	"minitunnel/internal/auditlog"
+)
+
+// auditAgent records an agent event for the tunnel clientID
+func (s *Server) auditAgent(eventType, clientID string, c *ClientInfo) {
+	s.audit.Log(auditlog.Event{
+		Type:       eventType,
+		Tunnel:     clientID,
+		RemoteAddr: c.remoteAddr,
+		Identity:   c.identity,
+	})
+}
+
+// auditVisitor records an event about the visitor of r
+func (s *Server) auditVisitor(eventType string, r *http.Request, tunnel, identity, reason string) {
+	if s.audit == nil {
+		return
+	}
+	remoteAddr := r.RemoteAddr
+	if addr, ok := s.visitorAddr(r); ok {
+		remoteAddr = addr.String()
+	}
+	s.audit.Log(auditlog.Event{
+		Type:       eventType,
+		Tunnel:     tunnel,
+		RemoteAddr: remoteAddr,
+		Identity:   identity,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Reason:     reason,
+	})
+}
+
+// denyVisitor answers 403 to a visitor kept out by IP rules, the server's
+// when tunnel is empty
+func (s *Server) denyVisitor(w http.ResponseWriter, r *http.Request, tunnel string) {
+	s.auditVisitor(auditlog.AccessDenied, r, tunnel, "", "IP address not allowed")
+	http.Error(w, "Forbidden", http.StatusForbidden)
+}
+
+// challengeVisitor asks the browser for the tunnel's credentials, recording
+// a failed login if it sent wrong ones
+func (s *Server) challengeVisitor(w http.ResponseWriter, r *http.Request, tunnel string) {
+	if user, _, ok := r.BasicAuth(); ok {
+		s.auditVisitor(auditlog.VisitorAuthFailed, r, tunnel, user, "wrong credentials")
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="minitunnel", charset="UTF-8"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// auditAdmin records failed logins to the admin API and the changes made
+// through it. Reads aren't recorded
+func (s *Server) auditAdmin(next http.Handler) http.Handler {
+	if s.audit == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := newStatusRecorder(w)
+		next.ServeHTTP(rec, r)
+		e := auditlog.Event{RemoteAddr: r.RemoteAddr, Method: r.Method, Path: r.URL.Path, Status: rec.status}
+		switch {
+		case rec.status == http.StatusUnauthorized:
+			e.Type = auditlog.AdminAuthFailed
+		case r.Method != http.MethodGet && r.Method != http.MethodHead:
+			e.Type = auditlog.AdminAction
+			// Set by the mux on r for routes naming a tunnel
+			e.Tunnel = r.PathValue("id")
+			if e.Tunnel == "" {
+				e.Tunnel = r.PathValue("name")
+			}
+		default:
+			return
+		}
+		s.audit.Log(e)
+	})
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net/http"
+	"net/netip"
+
+	"minitunnel/internal/auditlog"
+)
+
+// Authorizer decides whether a visitor's request may reach a tunnel. It is
+// asked after the built-in access options (-allow-ip, -basic-auth, -oauth)
+// let the request through, so programs embedding the server can add their
+// own rules. Authorize is called concurrently and should not block for long
+type Authorizer interface {
+	Authorize(req AuthRequest) AuthVerdict
+}
+
+// AuthorizerFunc adapts a function to the Authorizer interface
+type AuthorizerFunc func(req AuthRequest) AuthVerdict
+
+// Authorize calls f(req)
+func (f AuthorizerFunc) Authorize(req AuthRequest) AuthVerdict {
+	return f(req)
+}
+
+// AuthRequest describes a public request for an Authorizer
+type AuthRequest struct {
+	TunnelID  string
+	VisitorIP netip.Addr // Invalid if it can't be told; see -trust-forwarded
+	Method    string
+	Path      string // Path within the tunnel, with the query string
+	Header    http.Header
+}
+
+// AuthVerdict is an Authorizer's decision. The zero value allows the
+// request
+type AuthVerdict struct {
+	Status   int    // Deny with this status, e.g. 403, unless zero
+	Message  string // Response body of a denial, the status text if empty
+	Redirect string // Send the visitor to this URL with 302 instead
+}
+
+// Allow lets the request through
+func Allow() AuthVerdict {
+	return AuthVerdict{}
+}
+
+// Deny answers the request with status and message
+func Deny(status int, message string) AuthVerdict {
+	return AuthVerdict{Status: status, Message: message}
+}
+
+// Redirect sends the visitor to url, for example a login page
+func Redirect(url string) AuthVerdict {
+	return AuthVerdict{Status: http.StatusFound, Redirect: url}
+}
+
+// SetAuthorizer installs an Authorizer asked about every public request.
+// Call it before Start
+func (s *Server) SetAuthorizer(a Authorizer) {
+	s.authorizer = a
+}
+
+// checkAuthorizer asks the embedder's Authorizer, if any, about r and
+// answers the visitor if it wasn't allowed. It reports whether the request
+// may go on
+func (s *Server) checkAuthorizer(w http.ResponseWriter, r *http.Request, tunnelID, requestPath string) bool {
+	if s.authorizer == nil {
+		return true
+	}
+	addr, _ := s.visitorAddr(r)
+	verdict := s.authorizer.Authorize(AuthRequest{
+		TunnelID:  tunnelID,
+		VisitorIP: addr,
+		Method:    r.Method,
+		Path:      requestPath,
+		Header:    r.Header.Clone(),
+	})
+	switch {
+	case verdict.Redirect != "":
+		status := verdict.Status
+		if status < 300 || status > 399 {
+			status = http.StatusFound
+		}
+		http.Redirect(w, r, verdict.Redirect, status)
+		return false
+	case verdict.Status != 0:
+		message := verdict.Message
+		if message == "" {
+			message = http.StatusText(verdict.Status)
+		}
+		s.auditVisitor(auditlog.AccessDenied, r, tunnelID, "", message)
+		http.Error(w, message, verdict.Status)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"minitunnel/internal/protocol"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Actions of a bulk request
+const (
+	bulkDisconnect = "disconnect" // Close the agents' connections now
+	bulkDrain      = "drain"      // Stop sending requests, disconnect once in-flight ones finished
+	bulkRelabel    = "relabel"    // Change the labels operators see and select by
+)
+
+// defaultDrainTimeout bounds how long a bulk drain waits for requests in
+// flight before disconnecting anyway
+const defaultDrainTimeout = 30 * time.Second
+
+// BulkRequest is the body of POST /api/tunnels/bulk. The filters combine;
+// a request without any must set All to act on every tunnel. Unknown fields
+// are rejected, so that a misspelt filter can't widen the request
+type BulkRequest struct {
+	Action string `json:"action"`
+	DryRun bool   `json:"dry_run"` // Only list the tunnels that would be affected
+
+	Labels   []string `json:"labels"`   // Selectors as in ?label=, key or key=value
+	Idle     string   `json:"idle"`     // Only tunnels without requests for this long, e.g. "30m"
+	Identity string   `json:"identity"` // Only agents with this client certificate identity
+	Token    string   `json:"token"`    // Only agents that connected with this reservation token
+	All      bool     `json:"all"`      // Confirms acting on every tunnel when there are no filters
+
+	SetLabels    map[string]string `json:"set_labels"`    // For relabel: labels to add or change
+	RemoveLabels []string          `json:"remove_labels"` // For relabel: labels to remove
+	Timeout      string            `json:"timeout"`       // For drain: how long to wait, 30s by default
+}
+
+// BulkResult lists the tunnels a bulk request acted on, or would have
+type BulkResult struct {
+	Action  string   `json:"action"`
+	DryRun  bool     `json:"dry_run"`
+	Matched int      `json:"matched"`
+	Tunnels []string `json:"tunnels"`
+}
+
+// bulkTarget is a connected agent picked by a bulk request
+type bulkTarget struct {
+	id     string
+	client *ClientInfo
+}
+
+func (s *Server) handleBulk(w http.ResponseWriter, r *http.Request) {
+	var req BulkRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	selectors, err := parseLabelSelectors(req.Labels)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var idle, timeout time.Duration
+	if req.Idle != "" {
+		if idle, err = time.ParseDuration(req.Idle); err != nil || idle <= 0 {
+			http.Error(w, fmt.Sprintf("invalid idle %q: use a duration like 30m", req.Idle), http.StatusBadRequest)
+			return
+		}
+	}
+	switch req.Action {
+	case bulkDisconnect:
+	case bulkDrain:
+		timeout = defaultDrainTimeout
+		if req.Timeout != "" {
+			if timeout, err = time.ParseDuration(req.Timeout); err != nil || timeout <= 0 {
+				http.Error(w, fmt.Sprintf("invalid timeout %q: use a duration like 30s", req.Timeout), http.StatusBadRequest)
+				return
+			}
+		}
+	case bulkRelabel:
+		if len(req.SetLabels) == 0 && len(req.RemoveLabels) == 0 {
+			http.Error(w, "relabel needs set_labels or remove_labels", http.StatusBadRequest)
+			return
+		}
+		for key := range req.SetLabels {
+			if key == "" || strings.Contains(key, "=") {
+				http.Error(w, fmt.Sprintf("invalid label key %q", key), http.StatusBadRequest)
+				return
+			}
+		}
+	default:
+		http.Error(w, "action must be disconnect, drain or relabel", http.StatusBadRequest)
+		return
+	}
+	if len(selectors) == 0 && idle == 0 && req.Identity == "" && req.Token == "" && !req.All {
+		http.Error(w, "no filter given: set labels, idle, identity or token, or all to act on every tunnel", http.StatusBadRequest)
+		return
+	}
+	var digest string
+	if req.Token != "" {
+		digest = tokenDigest(req.Token)
+	}
+
+	targets := s.bulkTargets(selectors, idle, req.Identity, digest)
+	result := BulkResult{Action: req.Action, DryRun: req.DryRun, Matched: len(targets), Tunnels: []string{}}
+	for _, t := range targets {
+		result.Tunnels = append(result.Tunnels, t.id)
+	}
+	if !req.DryRun {
+		log.Printf("Bulk %s of %d tunnels (admin request from %s)", req.Action, len(targets), r.RemoteAddr)
+		for _, t := range targets {
+			switch req.Action {
+			case bulkDisconnect:
+				t.client.conn.CloseWithError(quic.ApplicationErrorCode(protocol.ErrCodeEvicted), "disconnected by administrator")
+			case bulkDrain:
+				go t.client.drain(t.id, timeout, protocol.ErrCodeEvicted, "drained by administrator")
+			case bulkRelabel:
+				t.client.relabel(req.SetLabels, req.RemoveLabels)
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// bulkTargets returns the connected agents, standbys included, matching all
+// filters, ordered by tunnel ID. digest is that of the agents' token. Zero
+// values don't filter
+func (s *Server) bulkTargets(selectors []labelSelector, idle time.Duration, identity, digest string) []bulkTarget {
+	var targets []bulkTarget
+	seen := make(map[*ClientInfo]bool)
+	consider := func(id string, c *ClientInfo) {
+		// Agents serving several names are listed under their main one
+		if seen[c] || slices.Contains(c.extraTunnels, id) {
+			return
+		}
+		seen[c] = true
+		if !matchLabels(c.currentLabels(), selectors) ||
+			(idle > 0 && c.idleFor() < idle) ||
+			(identity != "" && c.identity != identity) ||
+			(digest != "" && subtle.ConstantTimeCompare([]byte(c.tokenDigest), []byte(digest)) != 1) {
+			return
+		}
+		targets = append(targets, bulkTarget{id: id, client: c})
+	}
+	collect := func(key, value any) bool {
+		c := value.(*ClientInfo)
+		if c.pool == nil {
+			consider(key.(string), c)
+			return true
+		}
+		for _, member := range c.pool.snapshot() {
+			consider(key.(string), member)
+		}
+		return true
+	}
+	s.clients.Range(collect)
+	s.standbys.Range(collect)
+	sort.SliceStable(targets, func(i, j int) bool { return targets[i].id < targets[j].id })
+	return targets
+}
+
+// idleFor returns how long the agent has had no requests, counting from
+// when it connected
+func (c *ClientInfo) idleFor() time.Duration {
+	last := c.connectedAt
+	if t := c.lastRequest.Load(); t > 0 {
+		last = time.Unix(0, t)
+	}
+	return time.Since(last)
+}
+
+// drain stops sending the agent requests and disconnects it with code once
+// those in flight are answered, or after timeout
+func (c *ClientInfo) drain(id string, timeout time.Duration, code protocol.ErrorCode, reason string) {
+	c.draining.Store(true)
+	deadline := time.Now().Add(timeout)
+	for c.active.Load() > 0 && time.Now().Before(deadline) {
+		select {
+		case <-c.conn.Context().Done():
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	log.Printf("Drained %s, disconnecting", id)
+	c.conn.CloseWithError(quic.ApplicationErrorCode(code), reason)
+}
+
+// currentLabels returns the agent's labels, as changed by bulk relabels.
+// The map must not be modified
+func (c *ClientInfo) currentLabels() map[string]string {
+	if labels := c.labels.Load(); labels != nil {
+		return *labels
+	}
+	return c.hello.Labels
+}
+
+// relabel sets and removes labels. The map is replaced rather than changed
+// so that readers need no lock
+func (c *ClientInfo) relabel(set map[string]string, remove []string) {
+	for {
+		old := c.labels.Load()
+		labels := maps.Clone(c.currentLabels())
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		maps.Copy(labels, set)
+		for _, key := range remove {
+			delete(labels, key)
+		}
+		if c.labels.CompareAndSwap(old, &labels) {
+			return
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"minitunnel/internal/protocol"
+)
+
+// bulkServer returns a server with agents connected as web, api and old,
+// of which old had no requests for an hour
+func bulkServer() *Server {
+	s := &Server{}
+	s.clients.Store("web", &ClientInfo{
+		hello:       protocol.HelloPayload{Labels: map[string]string{"env": "prod", "team": "a"}},
+		identity:    "web.example.com",
+		tokenDigest: tokenDigest("secret-web"),
+		connectedAt: time.Now(),
+	})
+	s.clients.Store("api", &ClientInfo{
+		hello:       protocol.HelloPayload{Labels: map[string]string{"env": "staging", "team": "a"}},
+		connectedAt: time.Now(),
+	})
+	s.standbys.Store("old", &ClientInfo{
+		hello:       protocol.HelloPayload{Labels: map[string]string{"env": "staging"}},
+		tokenDigest: tokenDigest("secret-old"),
+		connectedAt: time.Now().Add(-time.Hour),
+	})
+	return s
+}
+
+func TestHandleBulk(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		status  int
+		tunnels []string // Matched tunnels for a 200
+	}{
+		{"labels", `{"action":"drain","labels":["team=a"]}`, http.StatusOK, []string{"api", "web"}},
+		{"labels and idle", `{"action":"drain","labels":["env=staging"],"idle":"30m"}`, http.StatusOK, []string{"old"}},
+		{"identity", `{"action":"disconnect","identity":"web.example.com"}`, http.StatusOK, []string{"web"}},
+		{"token", `{"action":"disconnect","token":"secret-old"}`, http.StatusOK, []string{"old"}},
+		{"unknown token", `{"action":"disconnect","token":"secret"}`, http.StatusOK, []string{}},
+		{"all", `{"action":"relabel","all":true,"set_labels":{"x":"y"}}`, http.StatusOK, []string{"api", "old", "web"}},
+		{"no filter", `{"action":"disconnect"}`, http.StatusBadRequest, nil},
+		{"unknown field", `{"action":"disconnect","lables":["team=a"],"all":true}`, http.StatusBadRequest, nil},
+		{"bad idle", `{"action":"disconnect","idle":"soon"}`, http.StatusBadRequest, nil},
+		{"bad action", `{"action":"restart","all":true}`, http.StatusBadRequest, nil},
+		{"relabel without labels", `{"action":"relabel","all":true}`, http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := strings.Replace(tt.body, "{", `{"dry_run":true,`, 1)
+			rec := httptest.NewRecorder()
+			bulkServer().handleBulk(rec, httptest.NewRequest(http.MethodPost, "/api/tunnels/bulk", strings.NewReader(body)))
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var result BulkResult
+			if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(result.Tunnels, tt.tunnels) || result.Matched != len(tt.tunnels) {
+				t.Errorf("matched %d: %q, want %q", result.Matched, result.Tunnels, tt.tunnels)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"minitunnel/internal/certs"
+)
+
+// certCheckInterval is how often the certificate files are checked for
+// changes
+const certCheckInterval = 10 * time.Second
+
+// certLoader holds the server's certificate, reloading it when its files
+// change so that renewed certificates are used without a restart, which
+// would disconnect every agent
+type certLoader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time // Latest modification time of the files loaded
+}
+
+// newCertLoader loads the certificate and key
+func newCertLoader(certFile, keyFile string) (*certLoader, error) {
+	l := &certLoader{certFile: certFile, keyFile: keyFile}
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config
+func (l *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.cert, nil
+}
+
+// Leaf returns the parsed current certificate
+func (l *certLoader) Leaf() *x509.Certificate {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.cert.Leaf
+}
+
+// reload loads the files again. The current certificate is kept if they
+// can't be loaded, e.g. while only one of them has been replaced
+func (l *certLoader) reload() error {
+	modTime, err := l.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificates: %w", err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cert = &cert
+	l.modTime = modTime
+	return nil
+}
+
+// filesModTime returns the latest modification time of the files
+func (l *certLoader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{l.certFile, l.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to load TLS certificates: %w", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// watch reloads the certificate whenever its files change, until ctx is
+// cancelled. Files that fail to load are tried again once they change
+func (l *certLoader) watch(ctx context.Context) {
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+
+	l.mu.RLock()
+	seen := l.modTime
+	l.mu.RUnlock()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		modTime, err := l.filesModTime()
+		if err == nil && !modTime.Equal(seen) {
+			seen = modTime
+			l.logReload()
+		}
+	}
+}
+
+// logReload reloads the certificate and logs the outcome
+func (l *certLoader) logReload() {
+	if err := l.reload(); err != nil {
+		log.Printf("Error reloading certificate, keeping the current one: %v", err)
+		return
+	}
+	leaf := l.Leaf()
+	log.Printf("✓ Reloaded certificate %s (expires %s, pin %s)", l.certFile, leaf.NotAfter.Format(time.DateOnly), certs.PinSHA256(leaf))
+}
+
+// ReloadCertificate loads the certificate and key files again, for
+// example on SIGHUP after they were renewed. Changed files are also picked
+// up on their own within certCheckInterval
+func (s *Server) ReloadCertificate() {
+	if s.certs != nil {
+		s.certs.logReload()
+	}
+}
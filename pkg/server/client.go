@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"time"
+
+	"minitunnel/internal/protocol"
+
+	"github.com/quic-go/quic-go"
+)
+
+// send writes a message to the agent, serializing concurrent writers
+func (c *ClientInfo) send(msg protocol.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.out.Write(c.stream, msg)
+}
+
+// sendWelcome writes the welcome message and switches the connection to
+// the negotiated framing and limits for everything sent after it
+func (c *ClientInfo) sendWelcome(msg protocol.Message, out protocol.WriteOptions) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := protocol.WriteMessage(c.stream, msg); err != nil {
+		return err
+	}
+	c.out = out
+	return nil
+}
+
+// roundTrip sends a request to the agent and waits for the matching
+// response. It fails when the agent disconnects or ctx ends first; the
+// time left on ctx is passed to the agent as the request's deadline
+func (c *ClientInfo) roundTrip(ctx context.Context, req protocol.HTTPRequest) (protocol.HTTPResponse, error) {
+	if !c.caps.Has(protocol.CapConcurrentRequests) {
+		// Older agents answer one request at a time
+		c.serial.Lock()
+		defer c.serial.Unlock()
+	}
+	c.active.Add(1)
+	defer c.active.Add(-1)
+	c.lastRequest.Store(time.Now().UnixNano())
+	req.ID = c.nextRequestID.Add(1)
+	req.CompressBody(c.compression)
+	if deadline, ok := ctx.Deadline(); ok {
+		req.TimeoutMs = max(time.Until(deadline).Milliseconds(), 1)
+	}
+	respCh := make(chan protocol.HTTPResponse, 1)
+	c.pending.Store(req.ID, respCh)
+	defer c.pending.Delete(req.ID)
+
+	reqMsg, err := protocol.NewRequestMessage(req)
+	if err != nil {
+		return protocol.HTTPResponse{}, err
+	}
+	if err := c.send(reqMsg); err != nil {
+		return protocol.HTTPResponse{}, err
+	}
+
+	select {
+	case resp := <-respCh:
+		return resp, nil
+	case <-c.conn.Context().Done():
+		return protocol.HTTPResponse{}, errAgentDisconnected
+	case <-ctx.Done():
+		return protocol.HTTPResponse{}, ctx.Err()
+	}
+}
+
+var errAgentDisconnected = errors.New("agent disconnected")
+
+// readLoop reads messages from the agent until the stream fails, answering
+// heartbeats and dispatching responses to waiting requests
+func (c *ClientInfo) readLoop(clientID string, reader *protocol.Reader) {
+	for {
+		msg, err := reader.ReadMessage()
+		if errors.Is(err, protocol.ErrMessageTooLarge) {
+			log.Printf("Disconnecting agent %s: %v", clientID, err)
+			c.protocolError(protocol.ProtocolErrMessageTooLarge, err.Error())
+			return
+		}
+		if errors.Is(err, protocol.ErrBadSignature) {
+			log.Printf("Disconnecting agent %s: %v", clientID, err)
+			c.protocolError(protocol.ProtocolErrBadSignature, err.Error())
+			return
+		}
+		if err != nil {
+			// Connections we closed ourselves and agents that announced
+			// their shutdown have already been logged
+			var appErr *quic.ApplicationError
+			expected := err == io.EOF || c.draining.Load()
+			if errors.As(err, &appErr) {
+				expected = expected || !appErr.Remote || appErr.ErrorCode == quic.ApplicationErrorCode(protocol.ErrCodeShutdown)
+			}
+			if !expected {
+				log.Printf("Error reading from agent %s: %v", clientID, err)
+			}
+			c.conn.CloseWithError(0, "")
+			return
+		}
+		c.lastSeen.Store(time.Now().UnixNano())
+
+		switch msg.Type {
+		case protocol.MsgTypeHeartbeat:
+			var hb protocol.HeartbeatPayload
+			if err := json.Unmarshal(msg.Payload, &hb); err != nil {
+				log.Printf("Error parsing heartbeat from %s: %v", clientID, err)
+				continue
+			}
+			pong, err := protocol.NewPongMessage(protocol.PongPayload{
+				SentAt:     hb.SentAt,
+				ServerTime: time.Now(),
+			})
+			if err != nil {
+				log.Printf("Error creating pong message: %v", err)
+				continue
+			}
+			if err := c.send(pong); err != nil {
+				log.Printf("Error sending pong to %s: %v", clientID, err)
+			}
+
+		case protocol.MsgTypeDisconnect:
+			var disconnect protocol.DisconnectPayload
+			json.Unmarshal(msg.Payload, &disconnect)
+			log.Printf("Agent %s is disconnecting (%s), draining", clientID, disconnect.Reason)
+			c.draining.Store(true)
+
+		case protocol.MsgTypeHealth:
+			var health protocol.HealthPayload
+			if err := json.Unmarshal(msg.Payload, &health); err != nil {
+				log.Printf("Error parsing health report from %s: %v", clientID, err)
+				continue
+			}
+			if health.Healthy {
+				log.Printf("Local service of %s is healthy again", clientID)
+				c.downReason.Store(nil)
+			} else {
+				log.Printf("Local service of %s is down: %s", clientID, health.Reason)
+				c.downReason.Store(&health.Reason)
+			}
+
+		case protocol.MsgTypeError:
+			var perr protocol.ErrorPayload
+			json.Unmarshal(msg.Payload, &perr)
+			log.Printf("Agent %s reported a protocol error: %s (%s)", clientID, perr.Message, perr.Code)
+			c.conn.CloseWithError(quic.ApplicationErrorCode(protocol.ErrCodeProtocol), perr.Code)
+			return
+
+		case protocol.MsgTypeResponse:
+			resp, err := msg.DecodeResponse()
+			if err != nil {
+				log.Printf("Error parsing response from %s: %v", clientID, err)
+				continue
+			}
+			if ch, ok := c.pending.Load(resp.ID); ok {
+				ch.(chan protocol.HTTPResponse) <- resp
+			} else {
+				log.Printf("Dropping response %d from %s: request is gone", resp.ID, clientID)
+			}
+
+		default:
+			log.Printf("Unexpected message type from %s: %s", clientID, msg.Type)
+		}
+	}
+}
+
+// protocolError tells the agent why it is being disconnected and closes
+// the connection once the agent hung up or had time to read the reason
+func (c *ClientInfo) protocolError(code, message string) {
+	msg, err := protocol.NewErrorMessage(protocol.ErrorPayload{Code: code, Message: message})
+	if err == nil {
+		err = c.send(msg)
+	}
+	if err != nil {
+		log.Printf("Error sending protocol error: %v", err)
+	} else {
+		select {
+		case <-c.conn.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+	c.conn.CloseWithError(quic.ApplicationErrorCode(protocol.ErrCodeProtocol), code)
+}
+
+// watchHeartbeats disconnects the agent once it has been silent for longer
+// than timeout. It returns when the connection closes
+func (c *ClientInfo) watchHeartbeats(clientID string, timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.conn.Context().Done():
+			return
+		case <-ticker.C:
+			if silent := time.Since(c.lastHeartbeat()); silent > timeout {
+				log.Printf("Agent %s sent no heartbeat for %s, disconnecting", clientID, silent.Round(time.Second))
+				c.conn.CloseWithError(quic.ApplicationErrorCode(protocol.ErrCodeTimeout), "heartbeat timeout")
+				return
+			}
+		}
+	}
+}
+
+// lastHeartbeat returns when the agent was last heard from
+func (c *ClientInfo) lastHeartbeat() time.Time {
+	return time.Unix(0, c.lastSeen.Load())
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"minitunnel/internal/auditlog"
+	"minitunnel/internal/protocol"
+	"minitunnel/internal/tracing"
+)
+
+// Servers of a cluster talk over their admin listeners, authenticated by
+// -cluster-secret instead of the admin token
+const (
+	clusterSecretHeader  = "X-Cluster-Secret"
+	clusterVisitorHeader = "X-Cluster-Visitor" // Address of the visitor, as the first server saw it
+	clusterMissHeader    = "X-Cluster-Miss"    // Set by a peer that doesn't hold the tunnel after all
+	clusterTunnelsPath   = "/cluster/tunnels/"
+	clusterVisitPath     = "/cluster/visit"
+)
+
+const (
+	ownerCacheTTL     = 10 * time.Second // How long a peer is known to hold a tunnel
+	missCacheTTL      = 2 * time.Second  // How long no peer is known to hold it
+	peerLookupTimeout = 2 * time.Second
+	maxCachedOwners   = 10000 // Beyond this, answers that no peer holds a tunnel aren't cached
+)
+
+// cluster proxies visitors of tunnels whose agents are connected to another
+// server of the cluster to that server
+type cluster struct {
+	peers  []*url.URL
+	secret string
+	client *http.Client
+	proxy  *httputil.ReverseProxy
+
+	mu     sync.Mutex
+	owners map[string]clusterOwner // By tunnel name, nil peer for none
+}
+
+type clusterOwner struct {
+	peer    *url.URL
+	expires time.Time
+}
+
+// newCluster sets up the peering with the servers at the admin URLs peers
+func (s *Server) newCluster(peers []string, secret string) *cluster {
+	c := &cluster{
+		secret: secret,
+		client: &http.Client{Timeout: peerLookupTimeout},
+		owners: map[string]clusterOwner{},
+	}
+	for _, peer := range peers {
+		u, _ := url.Parse(peer) // Checked by Validate
+		c.peers = append(c.peers, u)
+	}
+	c.proxy = &httputil.ReverseProxy{
+		Rewrite:       c.rewrite,
+		FlushInterval: -1, // Streamed responses, such as gRPC, go out as they come
+		ModifyResponse: func(resp *http.Response) error {
+			if resp.Header.Get(clusterMissHeader) != "" {
+				resp.Header.Del(clusterMissHeader)
+				c.forget(resp.Request.Context().Value(peerNameKey{}).(string))
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			name := r.Context().Value(peerNameKey{}).(string)
+			log.Printf("Error proxying %s %s to the cluster peer holding %s: %v", r.Method, r.URL.Path, name, err)
+			c.forget(name)
+			s.tunnelError(w, r, name, http.StatusBadGateway, "Cluster peer unreachable")
+		},
+	}
+	return c
+}
+
+// Context keys of cluster requests. peerKey and peerNameKey carry the peer
+// and tunnel a visitor is proxied for through the ReverseProxy,
+// peerVisitKey marks visitors proxied here by another server, which are
+// never proxied on
+type (
+	peerKey      struct{}
+	peerNameKey  struct{}
+	peerVisitKey struct{}
+)
+
+// rewrite sends a visitor's request to the peer's visit endpoint
+func (c *cluster) rewrite(pr *httputil.ProxyRequest) {
+	peer := pr.In.Context().Value(peerKey{}).(*url.URL)
+	pr.Out.URL.Scheme = peer.Scheme
+	pr.Out.URL.Host = peer.Host
+	pr.Out.URL.Path = strings.TrimSuffix(peer.Path, "/") + clusterVisitPath + pr.In.URL.Path
+	pr.Out.URL.RawPath = ""
+	pr.Out.Host = pr.In.Host
+	pr.Out.Header.Set(clusterSecretHeader, c.secret)
+	pr.Out.Header.Set(clusterVisitorHeader, pr.In.RemoteAddr)
+	tracing.Inject(pr.In.Context(), pr.Out.Header)
+}
+
+// owner returns the admin URL of the peer holding the named tunnel, or nil
+// if none does. Answers are cached for ownerCacheTTL, or missCacheTTL for
+// none while fewer than maxCachedOwners are
+func (c *cluster) owner(ctx context.Context, name string) *url.URL {
+	c.mu.Lock()
+	cached, ok := c.owners[name]
+	c.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.peer
+	}
+
+	// Ask every peer at once, the first to hold it wins
+	ctx, cancel := context.WithTimeout(ctx, peerLookupTimeout)
+	defer cancel()
+	found := make(chan *url.URL, len(c.peers))
+	for _, peer := range c.peers {
+		go func() {
+			if c.holds(ctx, peer, name) {
+				found <- peer
+			} else {
+				found <- nil
+			}
+		}()
+	}
+	var owner *url.URL
+	for range c.peers {
+		if owner = <-found; owner != nil {
+			break
+		}
+	}
+
+	ttl := ownerCacheTTL
+	if owner == nil {
+		ttl = missCacheTTL
+	}
+	now := time.Now()
+	c.mu.Lock()
+	if len(c.owners) >= maxCachedOwners {
+		for cachedName, cached := range c.owners {
+			if now.After(cached.expires) {
+				delete(c.owners, cachedName)
+			}
+		}
+	}
+	// Tunnels held by a peer are few, names looked up in vain are as many
+	// as visitors care to make up
+	if owner != nil || len(c.owners) < maxCachedOwners {
+		c.owners[name] = clusterOwner{peer: owner, expires: now.Add(ttl)}
+	}
+	c.mu.Unlock()
+	return owner
+}
+
+// holds asks peer whether an agent for the named tunnel is connected to it
+func (c *cluster) holds(ctx context.Context, peer *url.URL, name string) bool {
+	u := *peer
+	u.Path = strings.TrimSuffix(u.Path, "/") + clusterTunnelsPath + name
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set(clusterSecretHeader, c.secret)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Error asking cluster peer %s for %s: %v", peer.Host, name, err)
+		}
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusNoContent
+}
+
+// forget drops what is known about the holder of a tunnel
+func (c *cluster) forget(name string) {
+	c.mu.Lock()
+	delete(c.owners, name)
+	c.mu.Unlock()
+}
+
+// clusterPeer returns the peer to proxy a visitor of the named tunnel to,
+// or nil to handle the visitor here
+func (s *Server) clusterPeer(r *http.Request, name string) *url.URL {
+	if s.cluster == nil || fromPeer(r) || !protocol.ValidName(name) {
+		return nil
+	}
+	return s.cluster.owner(r.Context(), name)
+}
+
+// peerTunnel reports whether the first segment of a visitor's path names a
+// tunnel held by a cluster peer. Peers aren't asked while a single agent is
+// connected here, as that agent serves paths not naming a tunnel: asking
+// about each would let visitors multiply requests to the peers
+func (s *Server) peerTunnel(r *http.Request, name string) bool {
+	if s.cluster == nil {
+		return false
+	}
+	if _, agents := s.soleAgent(); agents == 1 {
+		return false
+	}
+	return s.clusterPeer(r, name) != nil
+}
+
+// soleAgent returns the ID of the only connected agent, along with how many
+// are connected, counting no further than two
+func (s *Server) soleAgent() (id string, count int) {
+	s.clients.Range(func(key, _ any) bool {
+		id = key.(string)
+		count++
+		return count < 2
+	})
+	return id, count
+}
+
+// proxyToPeer passes a visitor's request on to the peer holding the tunnel
+func (s *Server) proxyToPeer(w http.ResponseWriter, r *http.Request, name string, peer *url.URL) {
+	ctx := context.WithValue(r.Context(), peerKey{}, peer)
+	ctx = context.WithValue(ctx, peerNameKey{}, name)
+	s.cluster.proxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// fromPeer reports whether r was proxied here by another server
+func fromPeer(r *http.Request) bool {
+	return r.Context().Value(peerVisitKey{}) != nil
+}
+
+// clusterHandler serves the other servers of the cluster: whether a tunnel
+// is held here, and the visitors they proxy here
+func (s *Server) clusterHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+clusterTunnelsPath+"{name}", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := s.clients.Load(r.PathValue("name")); !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	public := s.publicHandler()
+	mux.HandleFunc(clusterVisitPath+"/", func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), peerVisitKey{}, true))
+		r.URL.Path = strings.TrimPrefix(r.URL.Path, clusterVisitPath)
+		r.URL.RawPath = ""
+		r.RequestURI = r.URL.RequestURI()
+		if visitor := r.Header.Get(clusterVisitorHeader); visitor != "" {
+			r.RemoteAddr = visitor
+		}
+		r.Header.Del(clusterVisitorHeader)
+		public.ServeHTTP(w, r)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := r.Header.Get(clusterSecretHeader)
+		if s.config.ClusterSecret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(s.config.ClusterSecret)) != 1 {
+			s.audit.Log(auditlog.Event{
+				Type:       auditlog.ClusterAuthFailed,
+				RemoteAddr: r.RemoteAddr,
+				Method:     r.Method,
+				Path:       r.URL.Path,
+			})
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		r.Header.Del(clusterSecretHeader)
+		mux.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// clusterPeerServer returns the admin URL of a peer holding the tunnel
+// named held, and the count of lookups it answered
+func clusterPeerServer(t *testing.T, held string) (string, *atomic.Int64) {
+	var lookups atomic.Int64
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		if strings.TrimPrefix(r.URL.Path, clusterTunnelsPath) == held {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(peer.Close)
+	return peer.URL, &lookups
+}
+
+func TestClusterOwnerCache(t *testing.T) {
+	url, lookups := clusterPeerServer(t, "held")
+	expired := clusterOwner{expires: time.Now().Add(-time.Second)}
+	live := clusterOwner{expires: time.Now().Add(time.Minute)}
+	tests := []struct {
+		name    string
+		fill    clusterOwner // Cached for other names up to maxCachedOwners
+		lookup  string
+		cached  bool // The answer is cached
+		evicted bool // The expired answers are dropped
+	}{
+		{"miss", clusterOwner{}, "unknown", true, false},
+		{"owner", clusterOwner{}, "held", true, false},
+		{"miss with full cache", live, "unknown", false, false},
+		{"owner with full cache", live, "held", true, false},
+		{"miss with expired answers", expired, "unknown", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := (&Server{}).newCluster([]string{url}, "secret")
+			if !tt.fill.expires.IsZero() {
+				for i := range maxCachedOwners {
+					c.owners[fmt.Sprintf("name-%d", i)] = tt.fill
+				}
+			}
+			before := lookups.Load()
+			owner := c.owner(context.Background(), tt.lookup)
+			if (owner != nil) != (tt.lookup == "held") {
+				t.Fatalf("owner of %s = %v", tt.lookup, owner)
+			}
+			if _, ok := c.owners[tt.lookup]; ok != tt.cached {
+				t.Errorf("cached = %v, want %v", ok, tt.cached)
+			}
+			if tt.evicted && len(c.owners) != 1 {
+				t.Errorf("%d answers cached, want the expired ones dropped", len(c.owners))
+			}
+			if len(c.owners) > maxCachedOwners+1 {
+				t.Errorf("%d answers cached", len(c.owners))
+			}
+			// A cached answer is used without asking again
+			c.owner(context.Background(), tt.lookup)
+			want := int64(1)
+			if !tt.cached {
+				want = 2
+			}
+			if got := lookups.Load() - before; got != want {
+				t.Errorf("%d lookups, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestPeerTunnel(t *testing.T) {
+	url, lookups := clusterPeerServer(t, "held")
+	tests := []struct {
+		name    string
+		agents  []string
+		path    string
+		want    bool
+		lookups int64
+	}{
+		{"no agents", nil, "held", true, 1},
+		{"single agent serves the path", []string{"app"}, "held", false, 0},
+		{"several agents", []string{"app", "web"}, "held", true, 1},
+		{"unknown name", []string{"app", "web"}, "api", false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{}
+			s.cluster = s.newCluster([]string{url}, "secret")
+			for _, id := range tt.agents {
+				s.clients.Store(id, &ClientInfo{})
+			}
+			before := lookups.Load()
+			r := httptest.NewRequest(http.MethodGet, "/"+tt.path+"/x", nil)
+			if got := s.peerTunnel(r, tt.path); got != tt.want {
+				t.Errorf("peerTunnel = %v, want %v", got, tt.want)
+			}
+			if got := lookups.Load() - before; got != tt.lookups {
+				t.Errorf("%d lookups, want %d", got, tt.lookups)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// cookieSigner signs the values of the cookies the server sets on visitors
+// so that they can't be forged
+type cookieSigner struct {
+	secret []byte
+}
+
+// Purposes of signed values. Each is bound into the HMAC so that a value
+// signed for one, like a login state, can't be passed off as another
+const (
+	signSession  = "session"
+	signLogin    = "login"
+	signAffinity = "affinity"
+)
+
+// newCookieSigner uses secret as the key, or a random one if it is empty,
+// invalidating cookies on restart
+func newCookieSigner(secret string) *cookieSigner {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return &cookieSigner{secret: key}
+}
+
+// sign encodes v as JSON followed by its HMAC for purpose, both base64url
+// encoded
+func (s *cookieSigner) sign(purpose string, v any) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data) + "." + base64.RawURLEncoding.EncodeToString(s.mac(purpose, data))
+}
+
+// verify decodes a value made by sign for purpose into v if its HMAC
+// matches
+func (s *cookieSigner) verify(purpose, signed string, v any) bool {
+	encoded, sig, ok := strings.Cut(signed, ".")
+	if !ok {
+		return false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(got, s.mac(purpose, data)) && json.Unmarshal(data, v) == nil
+}
+
+// mac returns the HMAC of data signed for purpose. The purpose can't
+// contain the NUL separating it from data
+func (s *cookieSigner) mac(purpose string, data []byte) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(purpose))
+	mac.Write([]byte{0})
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// serverCookie reports whether a visitor cookie was set by the server
+// rather than the local service
+func serverCookie(name string) bool {
+	return name == sessionCookie || name == loginStateCookie || strings.HasPrefix(name, affinityCookiePrefix)
+}
+
+// stripServerCookies removes the server's own cookies from the Cookie
+// header sent to the agent, so local services can't replay a visitor's
+// session on other tunnels
+func stripServerCookies(h http.Header, r *http.Request) {
+	if h.Get("Cookie") == "" {
+		return
+	}
+	var kept []string
+	for _, c := range r.Cookies() {
+		if !serverCookie(c.Name) {
+			kept = append(kept, c.Name+"="+c.Value)
+		}
+	}
+	h.Del("Cookie")
+	if len(kept) > 0 {
+		h.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"minitunnel/internal/config"
+)
+
+func TestCookieSignerPurpose(t *testing.T) {
+	s := newCookieSigner("secret")
+	other := newCookieSigner("other")
+	state := s.sign(signLogin, loginState{Nonce: "n", Return: "/", Expires: time.Now().Add(time.Hour).Unix()})
+	tests := []struct {
+		name    string
+		signer  *cookieSigner
+		purpose string
+		value   string
+		ok      bool
+	}{
+		{"same purpose", s, signLogin, state, true},
+		{"login state as session", s, signSession, state, false},
+		{"login state as affinity", s, signAffinity, state, false},
+		{"other key", other, signLogin, state, false},
+		{"tampered", s, signLogin, "e30" + state[3:], false},
+		{"unsigned", s, signLogin, "e30", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v map[string]any
+			if got := tt.signer.verify(tt.purpose, tt.value, &v); got != tt.ok {
+				t.Errorf("verify = %v, want %v", got, tt.ok)
+			}
+		})
+	}
+}
+
+func TestOAuthSession(t *testing.T) {
+	g := newOAuthGate(&config.ServerConfig{}, newCookieSigner("secret"))
+	expires := time.Now().Add(time.Hour).Unix()
+	tests := []struct {
+		name  string
+		value string
+		user  string // Empty when the session is refused
+	}{
+		{"valid", g.sign(signSession, session{User: "dev@example.com", Expires: expires}), "dev@example.com"},
+		{"expired", g.sign(signSession, session{User: "dev@example.com", Expires: time.Now().Add(-time.Minute).Unix()}), ""},
+		{"no user", g.sign(signSession, session{Expires: expires}), ""},
+		{"login state", g.sign(signLogin, loginState{Nonce: "n", Return: "/", Expires: expires}), ""},
+		{"affinity", g.sign(signAffinity, affinity{Tunnel: "app", Agent: "a"}), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: tt.value})
+			user, ok := g.session(r)
+			if ok != (tt.user != "") || user != tt.user {
+				t.Errorf("session = %q, %v, want %q", user, ok, tt.user)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"minitunnel/internal/protocol"
+)
+
+// corsMaxAge is how long browsers may cache a preflight answer, in seconds
+const corsMaxAge = "600"
+
+// handleCORS handles CORS for a tunnel whose agent asked the server to, see
+// protocol.CORSPolicy. It sets the CORS headers of the response to a
+// request from an allowed origin, and answers preflights itself, reporting
+// whether it did
+func handleCORS(w http.ResponseWriter, r *http.Request, policy *protocol.CORSPolicy) bool {
+	origin := r.Header.Get("Origin")
+	if policy == nil || origin == "" {
+		return false
+	}
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	allowed := len(policy.Origins) == 0 || slices.Contains(policy.Origins, origin)
+	if !allowed {
+		if preflight {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+		}
+		return preflight
+	}
+
+	if len(policy.Origins) == 0 && !policy.Credentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if policy.Credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		if !policy.Credentials {
+			// Browsers take the wildcard only for requests without
+			// credentials, see fitCORSHeaders for the others
+			h.Set("Access-Control-Expose-Headers", "*")
+		}
+		return false
+	}
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	h.Set("Access-Control-Allow-Methods", r.Header.Get("Access-Control-Request-Method"))
+	if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+		h.Set("Access-Control-Allow-Headers", headers)
+	}
+	h.Set("Access-Control-Max-Age", corsMaxAge)
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// fitCORSHeaders removes the CORS headers of the local service's response,
+// since handleCORS set the server's. With credentials, the response's
+// headers are exposed to the page by name
+func fitCORSHeaders(headers http.Header, policy *protocol.CORSPolicy) {
+	for name := range headers {
+		if strings.HasPrefix(name, "Access-Control-") {
+			delete(headers, name)
+		}
+	}
+	if policy.Credentials && len(headers) > 0 {
+		headers.Set("Access-Control-Expose-Headers", strings.Join(slices.Sorted(maps.Keys(headers)), ", "))
+	}
+}
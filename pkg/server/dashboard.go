@@ -0,0 +1,70 @@
+package server
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+)
+
+//go:embed web/*.html
+var webFS embed.FS
+
+var dashboardTemplate = template.Must(template.New("dashboard.html").Funcs(template.FuncMap{
+	"bytes":    formatBytes,
+	"duration": formatDuration,
+	"percent":  func(f float64) string { return fmt.Sprintf("%.1f%%", f*100) },
+}).ParseFS(webFS, "web/dashboard.html"))
+
+// dashboardData is rendered by the dashboard template
+type dashboardData struct {
+	Now      time.Time
+	Tunnels  []TunnelInfo
+	Requests []RequestRecord
+}
+
+func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	selectors, err := parseLabelSelectors(r.URL.Query()["label"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data := dashboardData{
+		Now:      time.Now(),
+		Tunnels:  s.listTunnels(selectors),
+		Requests: s.recent.recent(),
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		log.Printf("Error rendering dashboard: %v", err)
+	}
+}
+
+// formatBytes renders a byte count with a binary unit suffix
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// formatDuration rounds a duration for display
+func formatDuration(d time.Duration) string {
+	switch {
+	case d < time.Millisecond:
+		return d.Round(time.Microsecond).String()
+	case d < time.Second:
+		return d.Round(time.Millisecond).String()
+	default:
+		return d.Round(time.Second).String()
+	}
+}
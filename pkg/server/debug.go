@@ -0,0 +1,22 @@
+package server
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"net/http/pprof"
+)
+
+// addDebugEndpoints adds Go's runtime debug endpoints to the admin API: pprof
+// profiles under /debug/pprof/ and expvar variables at /debug/vars. They
+// sit behind the admin token like the rest of the API
+func (s *Server) addDebugEndpoints(mux *http.ServeMux) {
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	log.Printf("⚠ Debug endpoints enabled on the admin listener: /debug/pprof/ and /debug/vars")
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fallbackErrorPage is the template of -error-pages used for statuses
+// without a page of their own
+const fallbackErrorPage = "error.html"
+
+// errorPages holds the templates of -error-pages by status, 0 for the
+// fallback
+type errorPages map[int]*template.Template
+
+// errorPageData is what error page templates are executed with
+type errorPageData struct {
+	Tunnel     string // Empty when the request named no tunnel
+	Status     int
+	StatusText string
+	Reason     string // The message other clients get as text
+	RetryAfter int    // Seconds until the visitor should retry, 0 if unknown
+	Now        time.Time
+}
+
+// loadErrorPages parses the templates in dir, named after their status
+// (502.html) or error.html for any status. Other files are ignored
+func loadErrorPages(dir string) (errorPages, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read error pages: %w", err)
+	}
+	pages := errorPages{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != ".html" {
+			continue
+		}
+		status := 0
+		if name != fallbackErrorPage {
+			status, err = strconv.Atoi(strings.TrimSuffix(name, ".html"))
+			if err != nil || status < 400 || status > 599 {
+				continue
+			}
+		}
+		tmpl, err := template.ParseFiles(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse error page: %w", err)
+		}
+		pages[status] = tmpl
+	}
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("no error pages in %s: name them after the status, like 502.html, or error.html", dir)
+	}
+	return pages, nil
+}
+
+// lookup returns the template for status, or nil if there is none
+func (p errorPages) lookup(status int) *template.Template {
+	if tmpl, ok := p[status]; ok {
+		return tmpl
+	}
+	return p[0]
+}
+
+// tunnelError answers a visitor with status. Browsers get the operator's
+// page from -error-pages when there is one, everyone else reason as text.
+// A Retry-After header already set is passed on to the template
+func (s *Server) tunnelError(w http.ResponseWriter, r *http.Request, tunnel string, status int, reason string) {
+	tmpl := s.errorPages.lookup(status)
+	if tmpl == nil || !wantsHTML(r) {
+		http.Error(w, reason, status)
+		return
+	}
+	retry, _ := strconv.Atoi(w.Header().Get("Retry-After"))
+	data := errorPageData{
+		Tunnel:     tunnel,
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Reason:     reason,
+		RetryAfter: retry,
+		Now:        time.Now(),
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Printf("Error rendering error page for %d: %v", status, err)
+	}
+}
+
+// wantsHTML reports whether the visitor is a browser
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// storeOfflinePage keeps the offline page of an agent's named tunnels for
+// when it disconnects, or forgets the previous one if it sent none
+func (s *Server) storeOfflinePage(names []string, page string) {
+	for _, name := range names {
+		if page == "" {
+			s.offline.Delete(name)
+		} else {
+			s.offline.Store(name, page)
+		}
+	}
+}
+
+// handleOffline answers a visitor of a named tunnel whose agent is
+// disconnected but left an offline page. It returns false if it didn't
+func (s *Server) handleOffline(w http.ResponseWriter, r *http.Request, name string) bool {
+	val, ok := s.offline.Load(name)
+	if !ok {
+		return false
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(int(localDownRetry.Seconds())))
+	if !wantsHTML(r) {
+		http.Error(w, "Tunnel is offline", http.StatusServiceUnavailable)
+		return true
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(val.(string)))
+	return true
+}
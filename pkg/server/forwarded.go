@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"minitunnel/internal/httpheader"
+)
+
+// forwardHeaders returns the headers of r to send to the agent of the
+// tunnel name. basicAuth tells whether the tunnel asked for visitor
+// credentials, visitor is the user who logged in through the OAuth gate,
+// if any
+func (s *Server) forwardHeaders(r *http.Request, name string, basicAuth bool, visitor string) http.Header {
+	// Connection-level headers stay on this hop
+	headers := r.Header.Clone()
+	httpheader.RemoveHopByHop(headers)
+	httpheader.AddVia(headers, r.ProtoMajor, r.ProtoMinor)
+	s.setForwardedHeaders(headers, r)
+	if basicAuth {
+		// The credentials were for the tunnel, not the local service
+		headers.Del("Authorization")
+	}
+	stripServerCookies(headers, r)
+	headers.Del(tunnelUserHeader)
+	if visitor != "" {
+		headers.Set(tunnelUserHeader, visitor)
+	}
+	s.config.RequestHeaders.Apply(headers, name)
+	return headers
+}
+
+// setForwardedHeaders sets X-Forwarded-For, X-Forwarded-Proto,
+// X-Forwarded-Host and X-Real-IP on the headers sent to the agent so the
+// local service can tell who the visitor is. Values sent by the visitor are
+// dropped unless the server sits behind a trusted proxy, in which case the
+// address chain is extended and the original proto and host are kept
+func (s *Server) setForwardedHeaders(h http.Header, r *http.Request) {
+	visitor := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(visitor); err == nil {
+		visitor = host
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	if !s.config.TrustForwarded {
+		for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Real-Ip", "Forwarded"} {
+			h.Del(name)
+		}
+	}
+
+	chain := visitor
+	if prior := h.Get("X-Forwarded-For"); prior != "" {
+		chain = prior + ", " + visitor
+	}
+	h.Set("X-Forwarded-For", chain)
+	if h.Get("X-Real-Ip") == "" {
+		// The original client is the first hop in the chain
+		first, _, _ := strings.Cut(chain, ",")
+		h.Set("X-Real-Ip", strings.TrimSpace(first))
+	}
+	if h.Get("X-Forwarded-Proto") == "" {
+		h.Set("X-Forwarded-Proto", proto)
+	}
+	if h.Get("X-Forwarded-Host") == "" {
+		h.Set("X-Forwarded-Host", r.Host)
+	}
+}
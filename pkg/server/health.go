@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// certExpiryWarning is how close to its expiry the certificate is reported
+// as expiring soon
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// Health is the state of the server as /healthz and /readyz report it
+type Health struct {
+	Status              string    `json:"status"`        // "ok", or "unavailable" with the reasons in Problems
+	QUICListener        string    `json:"quic_listener"` // "listening" or "closed"
+	Agents              int       `json:"agents"`        // Agent connections, including those still saying hello
+	Tunnels             int       `json:"tunnels"`       // Registered tunnels, including standbys
+	CertificateExpires  time.Time `json:"certificate_expires"`
+	CertificateDaysLeft int       `json:"certificate_days_left"`
+	Problems            []string  `json:"problems,omitempty"` // Why the server isn't ready
+	Warnings            []string  `json:"warnings,omitempty"` // What needs attention soon
+}
+
+// Health reports whether the server is ready for agents and visitors: its
+// QUIC listener has to accept agents and its certificate must not have
+// expired
+func (s *Server) Health() Health {
+	h := Health{Status: "ok", QUICListener: "closed"}
+	if s.accepting.Load() {
+		h.QUICListener = "listening"
+	} else {
+		h.Problems = append(h.Problems, "QUIC listener is not accepting agents")
+	}
+	s.conns.Range(func(_, _ any) bool {
+		h.Agents++
+		return true
+	})
+	h.Tunnels = len(s.listTunnels(nil))
+
+	if s.certs != nil {
+		h.CertificateExpires = s.certs.Leaf().NotAfter
+		left := time.Until(h.CertificateExpires)
+		h.CertificateDaysLeft = int(left.Hours() / 24)
+		switch {
+		case left <= 0:
+			h.Problems = append(h.Problems, "certificate has expired")
+		case left < certExpiryWarning:
+			h.Warnings = append(h.Warnings, fmt.Sprintf("certificate expires in %d days", h.CertificateDaysLeft))
+		}
+	}
+	if len(h.Problems) > 0 {
+		h.Status = "unavailable"
+	}
+	return h
+}
+
+// handleHealthz answers liveness checks: the server is up if it answers
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Health())
+}
+
+// handleReadyz answers readiness checks, with 503 while the server can't
+// take agents or visitors
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	h := s.Health()
+	status := http.StatusOK
+	if len(h.Problems) > 0 {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, h)
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+
+	"minitunnel/internal/protocol"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newHTTP3Server creates the server for visitors over HTTP/3. It presents
+// the server's certificate, which must then be valid for the public host
+func (s *Server) newHTTP3Server(handler http.Handler) *http3.Server {
+	tlsConfig := &tls.Config{GetCertificate: s.certs.GetCertificate}
+	s.config.TLS.Apply(tlsConfig)
+	return &http3.Server{
+		Handler:        handler,
+		TLSConfig:      tlsConfig,
+		MaxHeaderBytes: s.config.MaxHeaderBytes,
+	}
+}
+
+func (s *Server) serveHTTP3(conn net.PacketConn) error {
+	log.Printf("HTTP/3 server listening on %s", s.config.HTTP3Addr)
+	return s.h3.Serve(conn)
+}
+
+// sharedTLSConfig returns the TLS configuration of a QUIC listener shared
+// by agents and HTTP/3 visitors, picking agents by their ALPN protocol.
+// Visitors are never asked for client certificates
+func (s *Server) sharedTLSConfig(agents, visitors *tls.Config) *tls.Config {
+	visitors = visitors.Clone()
+	visitors.NextProtos = []string{http3.NextProtoH3}
+	return &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if slices.Contains(hello.SupportedProtos, protocol.ALPN) {
+				return agents, nil
+			}
+			return visitors, nil
+		},
+	}
+}
+
+// advertiseHTTP3 adds an Alt-Svc header to responses from the TCP listener,
+// telling browsers they may switch to HTTP/3 for later requests
+func (s *Server) advertiseHTTP3(next http.Handler) http.Handler {
+	addr := s.config.HTTP3Addr
+	if s.config.SinglePort {
+		addr = s.config.ControlAddr
+	}
+	_, port, _ := net.SplitHostPort(addr)
+	altSvc := fmt.Sprintf(`%s=":%s"; ma=2592000`, http3.NextProtoH3, port)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Alt-Svc", altSvc)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"minitunnel/internal/protocol"
+
+	"github.com/quic-go/quic-go"
+)
+
+// loadClientCAs reads the PEM bundle of CAs that sign agent certificates
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// connIdentity returns who the agent's verified client certificate names:
+// its common name, or its first DNS name if the CN is empty. It is empty
+// for agents without a certificate
+func connIdentity(conn quic.Connection) string {
+	certs := conn.ConnectionState().TLS.PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	if cn := certs[0].Subject.CommonName; cn != "" {
+		return cn
+	}
+	if len(certs[0].DNSNames) > 0 {
+		return certs[0].DNSNames[0]
+	}
+	return ""
+}
+
+// identityName turns a certificate identity into a tunnel name, e.g.
+// "Build.Example.com" becomes "build-example-com"
+func identityName(identity string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return '-'
+	}, identity)
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	return strings.Trim(name, "-")
+}
+
+// checkIdentityNames rejects hellos from certificate holders that ask for
+// names outside their own: the identity's name or names starting with it
+// and a hyphen
+func checkIdentityNames(identity string, hello protocol.HelloPayload) *protocol.RejectPayload {
+	own := identityName(identity)
+	var errs []protocol.NameError
+	for _, name := range append([]string{hello.Name}, hello.Tunnels...) {
+		if name != own && !strings.HasPrefix(name, own+"-") {
+			errs = append(errs, protocol.NameError{
+				Name:    name,
+				Code:    protocol.NameErrNotAllowed,
+				Message: fmt.Sprintf("certificate %q may only use %s or %s-*", identity, own, own),
+			})
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return &protocol.RejectPayload{
+		Message: fmt.Sprintf("names not allowed for certificate %q", identity),
+		Names:   errs,
+	}
+}
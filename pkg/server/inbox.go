@@ -0,0 +1,288 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"minitunnel/internal/ipfilter"
+	"minitunnel/internal/protocol"
+)
+
+// bufferedAtHeader tells the local service when a delivered webhook was
+// received by the server
+const bufferedAtHeader = "X-Tunnel-Buffered-At"
+
+// inbox buffers webhooks for a named tunnel while its agent is offline and
+// delivers them in order once it is back
+type inbox struct {
+	mu        sync.Mutex
+	paths     []string            // Path prefixes whose POSTs are buffered
+	basicAuth *protocol.BasicAuth // Access rules of the agent that opened the inbox
+	ipRules   ipfilter.Rules
+	queue     []bufferedRequest // Oldest first
+	bytes     int64
+	agent     *ClientInfo // Connection serving the tunnel, nil while offline
+	left      time.Time   // When the agent last disconnected
+	deliverer *ClientInfo // Connection delivering the queue, nil if none
+}
+
+type bufferedRequest struct {
+	req      protocol.HTTPRequest
+	received time.Time
+}
+
+// InboxInfo describes a tunnel's inbox in admin API responses
+type InboxInfo struct {
+	Name      string     `json:"name"`
+	Paths     []string   `json:"paths"`
+	Online    bool       `json:"online"`
+	Queued    int        `json:"queued"`
+	Bytes     int64      `json:"bytes"`
+	OldestAt  *time.Time `json:"oldest_at,omitempty"`
+	OfflineAt *time.Time `json:"offline_at,omitempty"`
+}
+
+// matches reports whether r is a webhook the inbox buffers
+func (b *inbox) matches(r *http.Request, requestPath string) bool {
+	if r.Method != http.MethodPost {
+		return false
+	}
+	path, _, _ := strings.Cut(requestPath, "?")
+	return slices.ContainsFunc(b.paths, func(prefix string) bool {
+		return path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+	})
+}
+
+// dropExpired forgets requests older than ttl. Callers hold b.mu
+func (b *inbox) dropExpired(name string, ttl time.Duration) {
+	n := 0
+	for n < len(b.queue) && time.Since(b.queue[n].received) > ttl {
+		b.bytes -= int64(len(b.queue[n].req.Body))
+		n++
+	}
+	if n > 0 {
+		log.Printf("Dropped %d buffered webhooks for %s after %s", n, name, ttl)
+		b.queue = b.queue[n:]
+	}
+}
+
+// wantsInbox reports whether an agent's inbox is honored
+func (s *Server) wantsInbox(hello protocol.HelloPayload) bool {
+	return len(hello.Inbox) > 0 && s.config.InboxMaxRequests > 0 && hello.OAuth == nil
+}
+
+// openInbox sets up or updates the inbox of a named tunnel whose agent
+// just connected, and starts delivering what was buffered
+func (s *Server) openInbox(name string, c *ClientInfo) {
+	val, _ := s.inboxes.LoadOrStore(name, &inbox{})
+	b := val.(*inbox)
+	b.mu.Lock()
+	b.paths = c.hello.Inbox
+	b.basicAuth = c.hello.BasicAuth
+	b.ipRules = c.ipRules
+	b.agent = c
+	if len(b.queue) > 0 {
+		log.Printf("Delivering %d buffered webhooks to %s", len(b.queue), name)
+		s.startDelivery(name, b, c)
+	}
+	b.mu.Unlock()
+}
+
+// startDelivery makes c deliver the queue unless it already does. Callers
+// hold b.mu
+func (s *Server) startDelivery(name string, b *inbox, c *ClientInfo) {
+	if b.deliverer == c {
+		return
+	}
+	b.deliverer = c
+	go s.deliverInbox(name, b, c)
+}
+
+// closeInbox notes that the agent serving a tunnel with an inbox went away.
+// The inbox keeps buffering for -inbox-ttl
+func (s *Server) closeInbox(name string, c *ClientInfo) {
+	val, ok := s.inboxes.Load(name)
+	if !ok {
+		return
+	}
+	b := val.(*inbox)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.agent != c {
+		return
+	}
+	b.agent = nil
+	b.left = time.Now()
+	if b.deliverer == c {
+		b.deliverer = nil
+	}
+}
+
+// bufferWebhook stores a webhook for a tunnel with an inbox and answers
+// 202. It is used while the agent is offline (c is nil), and while older
+// webhooks are still being delivered to c so that order is kept. It
+// returns false if the request isn't for an inbox, leaving it to the caller
+func (s *Server) bufferWebhook(w http.ResponseWriter, r *http.Request, name, requestPath string, c *ClientInfo) bool {
+	online := c != nil
+	val, ok := s.inboxes.Load(name)
+	if !ok {
+		return false
+	}
+	b := val.(*inbox)
+	b.mu.Lock()
+	if b.agent == nil && time.Since(b.left) > s.config.InboxTTL {
+		b.mu.Unlock()
+		s.inboxes.CompareAndDelete(name, b)
+		log.Printf("Closed the inbox of %s, offline for more than %s", name, s.config.InboxTTL)
+		return false
+	}
+	b.dropExpired(name, s.config.InboxTTL)
+	if !b.matches(r, requestPath) || (online && len(b.queue) == 0) {
+		b.mu.Unlock()
+		return false
+	}
+	basicAuth, ipRules := b.basicAuth, b.ipRules
+	b.mu.Unlock()
+
+	// Webhooks must pass the tunnel's own rules even while it is offline
+	if !s.visitorAllowed(ipRules, r) {
+		s.denyVisitor(w, r, name)
+		return true
+	}
+	if !checkBasicAuth(basicAuth, r) {
+		s.challengeVisitor(w, r, name)
+		return true
+	}
+	if !s.checkAuthorizer(w, r, name, requestPath) {
+		return true
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.config.MaxRequestBody))
+	if err != nil {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return true
+	}
+	req := protocol.HTTPRequest{
+		Method:  r.Method,
+		Path:    requestPath,
+		Tunnel:  name,
+		Headers: s.forwardHeaders(r, name, basicAuth != nil, ""),
+		Body:    body,
+	}
+	now := time.Now()
+	req.Headers[bufferedAtHeader] = []string{now.UTC().Format(time.RFC3339)}
+
+	b.mu.Lock()
+	if len(b.queue) >= s.config.InboxMaxRequests || b.bytes+int64(len(body)) > s.config.InboxMaxBytes {
+		b.mu.Unlock()
+		log.Printf("Inbox of %s is full, refusing %s %s", name, r.Method, requestPath)
+		// Webhook providers retry on 503
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Tunnel is offline and its inbox is full", http.StatusServiceUnavailable)
+		return true
+	}
+	b.queue = append(b.queue, bufferedRequest{req: req, received: now})
+	b.bytes += int64(len(body))
+	queued := len(b.queue)
+	if online {
+		// Delivery may have finished since the queue was checked
+		s.startDelivery(name, b, c)
+	}
+	b.mu.Unlock()
+
+	log.Printf("Buffered %s %s for %s (%d waiting)", r.Method, requestPath, name, queued)
+	w.WriteHeader(http.StatusAccepted)
+	io.WriteString(w, "Accepted, will be delivered when the tunnel is back online\n")
+	return true
+}
+
+// deliverInbox sends buffered webhooks to the agent one at a time, oldest
+// first. A webhook stays queued until the agent answered it; failed
+// deliveries are retried while the connection lasts. It returns when the
+// queue is empty, the connection closes or a newer connection takes over
+func (s *Server) deliverInbox(name string, b *inbox, c *ClientInfo) {
+	for {
+		b.mu.Lock()
+		b.dropExpired(name, s.config.InboxTTL)
+		if b.deliverer != c || len(b.queue) == 0 {
+			if b.deliverer == c {
+				b.deliverer = nil
+			}
+			b.mu.Unlock()
+			return
+		}
+		next := b.queue[0]
+		b.mu.Unlock()
+
+		resp, err := s.deliverBuffered(c, next.req)
+		if err != nil {
+			log.Printf("Error delivering buffered webhook %s to %s: %v", next.req.Path, name, err)
+			select {
+			case <-c.conn.Context().Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+		log.Printf("Delivered buffered %s %s to %s: %d, waited %s", next.req.Method, next.req.Path, name, resp.StatusCode, time.Since(next.received).Round(time.Second))
+
+		b.mu.Lock()
+		if len(b.queue) > 0 && b.queue[0].received.Equal(next.received) {
+			b.bytes -= int64(len(next.req.Body))
+			b.queue = b.queue[1:]
+		}
+		b.mu.Unlock()
+	}
+}
+
+func (s *Server) deliverBuffered(c *ClientInfo, req protocol.HTTPRequest) (protocol.HTTPResponse, error) {
+	ctx := c.conn.Context()
+	if s.config.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config.RequestTimeout)
+		defer cancel()
+	}
+	if err := c.limit.acquire(ctx); err != nil {
+		return protocol.HTTPResponse{}, err
+	}
+	defer c.limit.release()
+	return c.roundTrip(ctx, req)
+}
+
+// listInboxes describes the inboxes of all tunnels, sorted by name
+func (s *Server) listInboxes() []InboxInfo {
+	inboxes := []InboxInfo{}
+	s.inboxes.Range(func(key, value any) bool {
+		b := value.(*inbox)
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		info := InboxInfo{
+			Name:   key.(string),
+			Paths:  b.paths,
+			Online: b.agent != nil,
+			Queued: len(b.queue),
+			Bytes:  b.bytes,
+		}
+		if len(b.queue) > 0 {
+			oldest := b.queue[0].received
+			info.OldestAt = &oldest
+		}
+		if b.agent == nil {
+			left := b.left
+			info.OfflineAt = &left
+		}
+		inboxes = append(inboxes, info)
+		return true
+	})
+	slices.SortFunc(inboxes, func(a, b InboxInfo) int { return strings.Compare(a.Name, b.Name) })
+	return inboxes
+}
+
+func (s *Server) handleListInboxes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.listInboxes())
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redactedHeaders carry credentials, their values are hidden from
+// inspection
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// InspectedRequest is a request through a tunnel as kept for operators, see
+// -inspect-requests
+type InspectedRequest struct {
+	ID              uint64        `json:"id"`
+	Time            time.Time     `json:"time"`
+	Duration        time.Duration `json:"duration_ns"`
+	Method          string        `json:"method"`
+	Path            string        `json:"path"`
+	RemoteAddr      string        `json:"remote_addr"`
+	RequestHeaders  http.Header   `json:"request_headers"`
+	RequestBody     []byte        `json:"request_body,omitempty"` // The first -inspect-body-bytes
+	RequestBytes    int64         `json:"request_bytes"`
+	Status          int           `json:"status"`
+	ResponseHeaders http.Header   `json:"response_headers"`
+	ResponseBody    []byte        `json:"response_body,omitempty"` // The first -inspect-body-bytes
+	ResponseBytes   int64         `json:"response_bytes"`
+}
+
+// inspectLog keeps the most recent requests of a tunnel. A nil log keeps
+// nothing
+type inspectLog struct {
+	mu        sync.Mutex
+	records   []*InspectedRequest
+	next      int
+	full      bool
+	nextID    uint64
+	bodyLimit int
+}
+
+// newInspectLog returns a log of size requests keeping bodyLimit bytes of
+// each body, or nil if size is 0
+func newInspectLog(size, bodyLimit int) *inspectLog {
+	if size <= 0 {
+		return nil
+	}
+	return &inspectLog{records: make([]*InspectedRequest, size), bodyLimit: bodyLimit}
+}
+
+// inspection is a request being captured for an inspectLog
+type inspection struct {
+	InspectedRequest
+	start    time.Time
+	reqBody  *bodyCapture
+	respBody *bodyCapture
+}
+
+// begin starts capturing a request. When bodies are kept, it wraps w and
+// r.Body to copy the start of them. It returns nil and w for a nil log
+func (l *inspectLog) begin(w http.ResponseWriter, r *http.Request, path string) (*inspection, http.ResponseWriter) {
+	if l == nil {
+		return nil, w
+	}
+	in := &inspection{start: time.Now()}
+	in.Time = in.start
+	in.Method = r.Method
+	in.Path = path
+	in.RemoteAddr = r.RemoteAddr
+	in.RequestHeaders = redactHeaders(r.Header)
+	if l.bodyLimit > 0 {
+		in.reqBody = &bodyCapture{limit: l.bodyLimit}
+		in.respBody = &bodyCapture{limit: l.bodyLimit}
+		r.Body = &capturingBody{ReadCloser: r.Body, capture: in.reqBody}
+		w = &capturingWriter{ResponseWriter: w, capture: in.respBody}
+	}
+	return in, w
+}
+
+// finish adds a captured request to the log, with the response rec
+// recorded and the request body bytes forwarded
+func (l *inspectLog) finish(in *inspection, rec *statusRecorder, bytesIn int64) {
+	if l == nil || in == nil {
+		return
+	}
+	in.Duration = time.Since(in.start)
+	in.RequestBytes = bytesIn
+	in.Status = rec.status
+	in.ResponseHeaders = redactHeaders(rec.Header())
+	in.ResponseBytes = rec.bytes
+	if in.reqBody != nil {
+		in.RequestBody, in.ResponseBody = in.reqBody.buf, in.respBody.buf
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.nextID++
+	in.ID = l.nextID
+	l.records[l.next] = &in.InspectedRequest
+	l.next = (l.next + 1) % len(l.records)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// recent returns the kept requests, newest first
+func (l *inspectLog) recent() []*InspectedRequest {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.next
+	if l.full {
+		n = len(l.records)
+	}
+	out := make([]*InspectedRequest, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, l.records[(l.next-i+len(l.records))%len(l.records)])
+	}
+	return out
+}
+
+// clear forgets the kept requests
+func (l *inspectLog) clear() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	clear(l.records)
+	l.next, l.full = 0, false
+}
+
+// redactHeaders copies h, hiding the values of redactedHeaders
+func redactHeaders(h http.Header) http.Header {
+	out := h.Clone()
+	if out == nil {
+		out = http.Header{}
+	}
+	for _, name := range redactedHeaders {
+		if values, ok := out[name]; ok {
+			out[name] = make([]string, len(values))
+			for i := range values {
+				out[name][i] = "[redacted]"
+			}
+		}
+	}
+	return out
+}
+
+// bodyCapture keeps the first limit bytes written to it
+type bodyCapture struct {
+	buf   []byte
+	limit int
+}
+
+func (c *bodyCapture) write(p []byte) {
+	if room := c.limit - len(c.buf); room > 0 {
+		c.buf = append(c.buf, p[:min(room, len(p))]...)
+	}
+}
+
+// capturingBody copies the start of a request body as it is read
+type capturingBody struct {
+	io.ReadCloser
+	capture *bodyCapture
+}
+
+func (b *capturingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.capture.write(p[:n])
+	return n, err
+}
+
+// capturingWriter copies the start of a response body as it is written
+type capturingWriter struct {
+	http.ResponseWriter
+	capture *bodyCapture
+}
+
+func (w *capturingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.capture.write(p[:n])
+	return n, err
+}
+
+// Unwrap lets http.ResponseController flush streamed responses
+func (w *capturingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// inspectLogOf returns the inspection log of the tunnel named in the
+// request path, answering the request itself if there is none
+func (s *Server) inspectLogOf(w http.ResponseWriter, r *http.Request) *inspectLog {
+	val, ok := s.clients.Load(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Tunnel not found", http.StatusNotFound)
+		return nil
+	}
+	l := val.(*ClientInfo).inspect
+	if l == nil {
+		http.Error(w, "Request inspection is off, start the server with -inspect-requests", http.StatusNotFound)
+	}
+	return l
+}
+
+func (s *Server) handleInspectedRequests(w http.ResponseWriter, r *http.Request) {
+	if l := s.inspectLogOf(w, r); l != nil {
+		writeJSON(w, http.StatusOK, l.recent())
+	}
+}
+
+func (s *Server) handleInspectedRequest(w http.ResponseWriter, r *http.Request) {
+	l := s.inspectLogOf(w, r)
+	if l == nil {
+		return
+	}
+	id, err := strconv.ParseUint(r.PathValue("request"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid request ID", http.StatusBadRequest)
+		return
+	}
+	for _, req := range l.recent() {
+		if req.ID == id {
+			writeJSON(w, http.StatusOK, req)
+			return
+		}
+	}
+	http.Error(w, "Request not found", http.StatusNotFound)
+}
+
+func (s *Server) handleClearInspectedRequests(w http.ResponseWriter, r *http.Request) {
+	if l := s.inspectLogOf(w, r); l != nil {
+		l.clear()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"minitunnel/internal/ipfilter"
+)
+
+// filterVisitors answers 403 to visitors outside the server's -allow-ip and
+// -deny-ip rules before any tunnel sees them
+func (s *Server) filterVisitors(next http.Handler) http.Handler {
+	if s.ipRules.Empty() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.visitorAllowed(s.ipRules, r) {
+			s.denyVisitor(w, r, "")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// visitorAllowed checks the visitor of r against rules. Visitors whose
+// address can't be told are only let in when there are no rules
+func (s *Server) visitorAllowed(rules ipfilter.Rules, r *http.Request) bool {
+	if rules.Empty() {
+		return true
+	}
+	addr, ok := s.visitorAddr(r)
+	return ok && rules.Allows(addr)
+}
+
+// visitorAddr returns the visitor's IP address: the peer's, or with
+// -trust-forwarded the one the proxy in front of the server saw, which it
+// appended last to X-Forwarded-For. Earlier entries come from the visitor
+// and can't be trusted
+func (s *Server) visitorAddr(r *http.Request) (netip.Addr, bool) {
+	host := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if s.config.TrustForwarded {
+		if chain := r.Header.Values("X-Forwarded-For"); len(chain) > 0 {
+			hops := strings.Split(chain[len(chain)-1], ",")
+			host = strings.TrimSpace(hops[len(hops)-1])
+		}
+	}
+	addr, err := netip.ParseAddr(host)
+	return addr, err == nil
+}
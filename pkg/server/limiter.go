@@ -0,0 +1,117 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	errQueueFull    = errors.New("request queue is full")
+	errQueueTimeout = errors.New("timed out waiting in the request queue")
+)
+
+// limiter caps the requests a tunnel has in flight. Requests over the
+// limit wait in a bounded queue, first come first served: a released slot
+// goes to the request that has waited longest
+type limiter struct {
+	max       int
+	queueSize int
+	timeout   time.Duration
+
+	mu       sync.Mutex
+	inFlight int
+	waiters  list.List // Of chan struct{}, closed when handed a slot, oldest first
+}
+
+// newLimiter returns a limiter for max concurrent requests, or nil if max
+// is zero, which means no limit
+func newLimiter(max, queueSize int, timeout time.Duration) *limiter {
+	if max <= 0 {
+		return nil
+	}
+	return &limiter{max: max, queueSize: queueSize, timeout: timeout}
+}
+
+// acquire waits for a free slot. It fails at once when the queue is full,
+// and after the queue timeout or when ctx ends. Call release after a
+// successful acquire
+func (l *limiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	if l.inFlight < l.max && l.waiters.Len() == 0 {
+		l.inFlight++
+		l.mu.Unlock()
+		return nil
+	}
+	if l.waiters.Len() >= l.queueSize {
+		l.mu.Unlock()
+		return errQueueFull
+	}
+	ready := make(chan struct{})
+	elem := l.waiters.PushBack(ready)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	select {
+	case <-ready:
+		// Handed a slot while giving up, pass it on
+		l.mu.Unlock()
+		l.release()
+	default:
+		l.waiters.Remove(elem)
+		l.mu.Unlock()
+	}
+	return err
+}
+
+// release frees a slot, handing it to the oldest waiting request if any
+func (l *limiter) release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if front := l.waiters.Front(); front != nil {
+		close(l.waiters.Remove(front).(chan struct{}))
+		return
+	}
+	l.inFlight--
+}
+
+// LimitSnapshot is the state of a tunnel's concurrency limit
+type LimitSnapshot struct {
+	MaxConcurrent int   `json:"max_concurrent"`
+	InFlight      int   `json:"in_flight"`
+	Queued        int64 `json:"queued"`
+}
+
+// snapshot returns the limiter's state, nil for unlimited tunnels
+func (l *limiter) snapshot() *LimitSnapshot {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return &LimitSnapshot{
+		MaxConcurrent: l.max,
+		InFlight:      l.inFlight,
+		Queued:        int64(l.waiters.Len()),
+	}
+}
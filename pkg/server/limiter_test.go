@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitQueued waits until l has n requests queued
+func waitQueued(t *testing.T, l *limiter, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for l.snapshot().Queued != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("queued = %d, want %d", l.snapshot().Queued, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLimiterAcquire(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name      string
+		max       int
+		queueSize int
+		timeout   time.Duration
+		held      int // Slots taken before the acquire under test
+		queued    int // Requests waiting before it
+		ctx       context.Context
+		want      error
+	}{
+		{"free slot", 2, 1, time.Second, 1, 0, context.Background(), nil},
+		{"queue full", 1, 1, time.Second, 1, 1, context.Background(), errQueueFull},
+		{"no queue", 1, 0, time.Second, 1, 0, context.Background(), errQueueFull},
+		{"queue timeout", 1, 1, 10 * time.Millisecond, 1, 0, context.Background(), errQueueTimeout},
+		{"cancelled", 1, 1, time.Second, 1, 0, cancelled, context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLimiter(tt.max, tt.queueSize, tt.timeout)
+			for range tt.held {
+				if err := l.acquire(context.Background()); err != nil {
+					t.Fatalf("taking a slot: %v", err)
+				}
+			}
+			ctx, stop := context.WithCancel(context.Background())
+			defer stop()
+			for i := range tt.queued {
+				go l.acquire(ctx)
+				waitQueued(t, l, int64(i+1))
+			}
+			if err := l.acquire(tt.ctx); !errors.Is(err, tt.want) {
+				t.Errorf("acquire = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimiterFIFO(t *testing.T) {
+	l := newLimiter(1, 10, time.Second)
+	if err := l.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	const waiters = 5
+	order := make(chan int, waiters)
+	for i := range waiters {
+		go func() {
+			if err := l.acquire(context.Background()); err != nil {
+				t.Errorf("waiter %d: %v", i, err)
+				return
+			}
+			order <- i
+		}()
+		waitQueued(t, l, int64(i+1))
+	}
+	for want := range waiters {
+		l.release()
+		if got := <-order; got != want {
+			t.Fatalf("slot went to waiter %d, want %d", got, want)
+		}
+	}
+	l.release()
+	if s := l.snapshot(); s.InFlight != 0 || s.Queued != 0 {
+		t.Errorf("after releasing all, snapshot = %+v", s)
+	}
+}
+
+func TestLimiterGiveUpKeepsSlots(t *testing.T) {
+	l := newLimiter(1, 2, time.Second)
+	if err := l.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	gaveUp := make(chan error)
+	go func() { gaveUp <- l.acquire(ctx) }()
+	waitQueued(t, l, 1)
+	cancel()
+	if err := <-gaveUp; !errors.Is(err, context.Canceled) {
+		t.Fatalf("acquire = %v, want context.Canceled", err)
+	}
+	l.release()
+	if s := l.snapshot(); s.InFlight != 0 || s.Queued != 0 {
+		t.Errorf("snapshot = %+v, want no slots taken", s)
+	}
+	if err := l.acquire(context.Background()); err != nil {
+		t.Errorf("acquire after release = %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// localDownRetry is how soon visitors are told to try again while a local
+// service is down, the agent's default -health-interval
+const localDownRetry = 10 * time.Second
+
+var downTemplate = template.Must(template.ParseFS(webFS, "web/down.html"))
+
+// localDown returns why the agent's local service fails its health check,
+// or "" while it passes or isn't checked
+func (c *ClientInfo) localDown() string {
+	if reason := c.downReason.Load(); reason != nil {
+		return *reason
+	}
+	return ""
+}
+
+// available reports whether the agent takes new requests: it isn't
+// shutting down and its local service hasn't been reported down
+func (c *ClientInfo) available() bool {
+	return !c.draining.Load() && c.downReason.Load() == nil
+}
+
+// handleLocalDown answers a visitor with 503 on behalf of an agent whose
+// local service is down, instead of trying it and failing. Browsers get a
+// page that reloads itself, other clients plain text. The reason stays in
+// the logs and admin API, since it may name internal addresses
+func (s *Server) handleLocalDown(w http.ResponseWriter, r *http.Request, name string) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(int(localDownRetry.Seconds())))
+	if !wantsHTML(r) || s.errorPages.lookup(http.StatusServiceUnavailable) != nil {
+		s.tunnelError(w, r, name, http.StatusServiceUnavailable, "Service unavailable: the app behind this tunnel is down")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	data := struct {
+		Name string
+		Now  time.Time
+	}{name, time.Now()}
+	if err := downTemplate.Execute(w, data); err != nil {
+		log.Printf("Error rendering backend down page: %v", err)
+	}
+}
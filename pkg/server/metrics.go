@@ -0,0 +1,113 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// startMetricsServer serves tunnel counters in the Prometheus text format
+// and the health checks on a listener of its own, so scrapers don't need
+// the admin token
+func (s *Server) startMetricsServer(ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", s.handleMetrics)
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+
+	log.Printf("Metrics server listening on %s", s.config.MetricsAddr)
+
+	server := &http.Server{Handler: mux}
+	s.servers = append(s.servers, server)
+	s.serve("Metrics", func() error { return server.Serve(ln) })
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	tunnels := s.listTunnels(nil)
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].ID < tunnels[j].ID })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP minitunnel_tunnels Connected tunnels, including standbys")
+	fmt.Fprintln(w, "# TYPE minitunnel_tunnels gauge")
+	fmt.Fprintf(w, "minitunnel_tunnels %d\n", len(tunnels))
+
+	counters := []struct {
+		name, help string
+		value      func(StatsSnapshot) int64
+	}{
+		{"minitunnel_requests_total", "Requests proxied to the tunnel", func(st StatsSnapshot) int64 { return st.Requests }},
+		{"minitunnel_request_errors_total", "Proxy failures and 5xx responses", func(st StatsSnapshot) int64 { return st.Errors }},
+		{"minitunnel_received_bytes_total", "Request body bytes received from visitors", func(st StatsSnapshot) int64 { return st.BytesIn }},
+		{"minitunnel_sent_bytes_total", "Response body bytes sent to visitors", func(st StatsSnapshot) int64 { return st.BytesOut }},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+		fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+		for _, t := range tunnels {
+			fmt.Fprintf(w, "%s{tunnel=%q} %d\n", c.name, t.ID, c.value(t.Stats))
+		}
+	}
+
+	// Only tunnels with a concurrency limit have a queue
+	gauges := []struct {
+		name, help string
+		value      func(*LimitSnapshot) int64
+	}{
+		{"minitunnel_in_flight_requests", "Requests in flight to the agent of tunnels with -max-concurrent", func(l *LimitSnapshot) int64 { return int64(l.InFlight) }},
+		{"minitunnel_queued_requests", "Requests waiting for a slot under -max-concurrent", func(l *LimitSnapshot) int64 { return l.Queued }},
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n", g.name, g.help)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", g.name)
+		for _, t := range tunnels {
+			if t.Limit != nil {
+				fmt.Fprintf(w, "%s{tunnel=%q} %d\n", g.name, t.ID, g.value(t.Limit))
+			}
+		}
+	}
+
+	histograms := []struct {
+		name, help string
+		value      func(StatsSnapshot) HistogramSnapshot
+	}{
+		{"minitunnel_request_size_bytes", "Request body sizes received from visitors", func(st StatsSnapshot) HistogramSnapshot { return st.RequestSizes }},
+		{"minitunnel_response_size_bytes", "Response body sizes sent to visitors", func(st StatsSnapshot) HistogramSnapshot { return st.ResponseSizes }},
+	}
+	for _, h := range histograms {
+		fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+		fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+		for _, t := range tunnels {
+			hist := h.value(t.Stats)
+			for _, b := range hist.Buckets {
+				fmt.Fprintf(w, "%s_bucket{tunnel=%q,le=\"%d\"} %d\n", h.name, t.ID, b.LE, b.Count)
+			}
+			fmt.Fprintf(w, "%s_bucket{tunnel=%q,le=\"+Inf\"} %d\n", h.name, t.ID, hist.Count)
+			fmt.Fprintf(w, "%s_sum{tunnel=%q} %d\n", h.name, t.ID, hist.Sum)
+			fmt.Fprintf(w, "%s_count{tunnel=%q} %d\n", h.name, t.ID, hist.Count)
+		}
+	}
+
+	// Only the busiest paths, to keep the number of series bounded
+	fmt.Fprintln(w, "# HELP minitunnel_top_path_bytes Body bytes of the tunnel's busiest paths over the last 10-20 minutes")
+	fmt.Fprintln(w, "# TYPE minitunnel_top_path_bytes gauge")
+	for _, t := range tunnels {
+		val, ok := s.clients.Load(t.ID)
+		if !ok {
+			continue
+		}
+		for _, p := range val.(*ClientInfo).stats.paths.top(pathsByBytes, topPathsInMetrics) {
+			fmt.Fprintf(w, "minitunnel_top_path_bytes{tunnel=%q,path=\"%s\"} %d\n", t.ID, labelEscaper.Replace(p.Path), p.Bytes)
+		}
+	}
+}
+
+// labelEscaper escapes label values the way the text format expects; %q
+// would also escape non-ASCII characters, which Prometheus rejects
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// topPathsInMetrics is how many paths per tunnel are exported as metrics
+const topPathsInMetrics = 10
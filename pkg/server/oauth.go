@@ -0,0 +1,288 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"minitunnel/internal/config"
+)
+
+// Visitors who logged in through the OAuth gate are named in this header
+// on the requests forwarded to the agent
+const tunnelUserHeader = "X-Tunnel-User"
+
+const (
+	sessionCookie    = "minitunnel_session"
+	loginStateCookie = "minitunnel_login"
+	sessionLifetime  = 24 * time.Hour
+	loginLifetime    = 10 * time.Minute
+)
+
+// oauthEndpoints are the issuer URLs used in the login flow
+type oauthEndpoints struct {
+	Authorization string `json:"authorization_endpoint"`
+	Token         string `json:"token_endpoint"`
+	UserInfo      string `json:"userinfo_endpoint"`
+}
+
+// githubEndpoints are used for -oauth-issuer github, which speaks OAuth 2
+// but not OpenID Connect
+var githubEndpoints = oauthEndpoints{
+	Authorization: "https://github.com/login/oauth/authorize",
+	Token:         "https://github.com/login/oauth/access_token",
+	UserInfo:      "https://api.github.com/user",
+}
+
+// oauthGate sends visitors of protected tunnels through the issuer's login
+// and remembers them in a signed session cookie
+type oauthGate struct {
+	*cookieSigner
+	cfg    *config.ServerConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	endpoints *oauthEndpoints // Discovered on first use
+}
+
+func newOAuthGate(cfg *config.ServerConfig, signer *cookieSigner) *oauthGate {
+	return &oauthGate{
+		cookieSigner: signer,
+		cfg:          cfg,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// authorize returns the logged in visitor allowed by policy. Otherwise it
+// answers the request itself, sending the visitor to the login or
+// refusing them, and returns false, with the visitor if they were logged
+// in but not allowed
+func (g *oauthGate) authorize(w http.ResponseWriter, r *http.Request, allow []string, returnURL string) (string, bool) {
+	if user, ok := g.session(r); ok {
+		if !oauthAllowed(user, allow) {
+			http.Error(w, fmt.Sprintf("%s may not visit this tunnel", user), http.StatusForbidden)
+			return user, false
+		}
+		return user, true
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Log in to visit this tunnel", http.StatusUnauthorized)
+		return "", false
+	}
+
+	endpoints, err := g.discover(r.Context())
+	if err != nil {
+		log.Printf("Error discovering OAuth endpoints: %v", err)
+		http.Error(w, "Login is unavailable", http.StatusBadGateway)
+		return "", false
+	}
+
+	// The state carries where to go back to, and is tied to this browser
+	// by a cookie so a login can't be started for someone else
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	state := g.sign(signLogin, loginState{Nonce: hex.EncodeToString(nonce), Return: returnURL, Expires: time.Now().Add(loginLifetime).Unix()})
+	http.SetCookie(w, g.cookie(loginStateCookie, hex.EncodeToString(nonce), loginLifetime))
+
+	scope := "openid email"
+	if g.cfg.OAuthIssuer == "github" {
+		scope = "read:user user:email"
+	}
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {g.cfg.OAuthClientID},
+		"redirect_uri":  {g.cfg.OAuthRedirectURL},
+		"scope":         {scope},
+		"state":         {state},
+	}
+	http.Redirect(w, r, endpoints.Authorization+"?"+q.Encode(), http.StatusFound)
+	return "", false
+}
+
+// handleCallback finishes a login: it trades the code for the visitor's
+// identity, starts a session and sends the visitor back to the tunnel
+func (g *oauthGate) handleCallback(w http.ResponseWriter, r *http.Request) {
+	var state loginState
+	if !g.verify(signLogin, r.URL.Query().Get("state"), &state) || time.Now().Unix() > state.Expires {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	nonce, err := r.Cookie(loginStateCookie)
+	if err != nil || !hmac.Equal([]byte(nonce.Value), []byte(state.Nonce)) {
+		http.Error(w, "Login was started in another browser", http.StatusBadRequest)
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		http.Error(w, "Login failed: "+e, http.StatusForbidden)
+		return
+	}
+
+	user, err := g.exchange(r.Context(), r.URL.Query().Get("code"))
+	if err != nil {
+		log.Printf("Error completing OAuth login: %v", err)
+		http.Error(w, "Login failed", http.StatusBadGateway)
+		return
+	}
+
+	http.SetCookie(w, g.cookie(loginStateCookie, "", -1))
+	http.SetCookie(w, g.cookie(sessionCookie, g.sign(signSession, session{User: user, Expires: time.Now().Add(sessionLifetime).Unix()}), sessionLifetime))
+	http.Redirect(w, r, state.Return, http.StatusFound)
+}
+
+// exchange redeems an authorization code and asks the issuer who logged in
+func (g *oauthGate) exchange(ctx context.Context, code string) (string, error) {
+	endpoints, err := g.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {g.cfg.OAuthRedirectURL},
+		"client_id":     {g.cfg.OAuthClientID},
+		"client_secret": {g.cfg.OAuthClientSecret},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoints.Token, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var token struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := g.getJSON(req, &token); err != nil {
+		return "", fmt.Errorf("failed to redeem code: %w", err)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("no access token: %s", token.Error)
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, endpoints.UserInfo, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	var info struct {
+		Email         string `json:"email"`
+		EmailVerified *bool  `json:"email_verified"`
+		Login         string `json:"login"` // GitHub
+	}
+	if err := g.getJSON(req, &info); err != nil {
+		return "", fmt.Errorf("failed to fetch user info: %w", err)
+	}
+	if info.Login != "" {
+		return info.Login, nil
+	}
+	if info.Email == "" || info.EmailVerified != nil && !*info.EmailVerified {
+		return "", errors.New("issuer returned no verified email")
+	}
+	return info.Email, nil
+}
+
+// discover looks up the issuer's endpoints, caching them once found
+func (g *oauthGate) discover(ctx context.Context) (*oauthEndpoints, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.endpoints != nil {
+		return g.endpoints, nil
+	}
+	if g.cfg.OAuthIssuer == "github" {
+		g.endpoints = &githubEndpoints
+		return g.endpoints, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(g.cfg.OAuthIssuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints oauthEndpoints
+	if err := g.getJSON(req, &endpoints); err != nil {
+		return nil, err
+	}
+	if endpoints.Authorization == "" || endpoints.Token == "" || endpoints.UserInfo == "" {
+		return nil, fmt.Errorf("issuer %s lacks authorization, token or userinfo endpoint", g.cfg.OAuthIssuer)
+	}
+	g.endpoints = &endpoints
+	return g.endpoints, nil
+}
+
+func (g *oauthGate) getJSON(req *http.Request, v any) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", req.URL.Host, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// session is the content of the session cookie
+type session struct {
+	User    string `json:"u"`
+	Expires int64  `json:"e"`
+}
+
+// loginState is the signed state passed through the issuer
+type loginState struct {
+	Nonce   string `json:"n"`
+	Return  string `json:"r"`
+	Expires int64  `json:"e"`
+}
+
+// session returns the visitor named in a valid session cookie. Sessions
+// without a user are refused, as the allow list can't be checked for them
+func (g *oauthGate) session(r *http.Request) (string, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", false
+	}
+	var sess session
+	if !g.verify(signSession, c.Value, &sess) || sess.User == "" || time.Now().Unix() > sess.Expires {
+		return "", false
+	}
+	return sess.User, true
+}
+
+func (g *oauthGate) cookie(name, value string, lifetime time.Duration) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(lifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(g.cfg.OAuthRedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// oauthAllowed reports whether user matches the allow list: an exact email
+// or login (case-insensitive) or an @domain. An empty list allows anyone
+func oauthAllowed(user string, allow []string) bool {
+	if len(allow) == 0 {
+		return true
+	}
+	user = strings.ToLower(user)
+	return slices.ContainsFunc(allow, func(a string) bool {
+		a = strings.ToLower(a)
+		if strings.HasPrefix(a, "@") {
+			return strings.HasSuffix(user, a)
+		}
+		return user == a
+	})
+}
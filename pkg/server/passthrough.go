@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"minitunnel/internal/auditlog"
+	"minitunnel/internal/ipfilter"
+	"minitunnel/internal/protocol"
+
+	"github.com/quic-go/quic-go"
+)
+
+// passthroughHelloTimeout bounds how long a visitor may take to send its
+// ClientHello, and the agent to take the stream for it
+const passthroughHelloTimeout = 10 * time.Second
+
+// errHelloRead stops the handshake readClientHello runs once it has the
+// ClientHello
+var errHelloRead = errors.New("client hello read")
+
+// servePassthrough accepts TLS connections on the -tls-passthrough-addr
+// listener until it is closed, see protocol.CapPassthrough
+func (s *Server) servePassthrough(ln net.Listener) error {
+	log.Printf("Passing TLS connections for *.%s on %s through to agents", s.passthroughDomain(), s.config.PassthroughAddr)
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go s.handlePassthrough(conn)
+	}
+}
+
+// passthroughDomain returns -tls-passthrough-domain without dots around it
+func (s *Server) passthroughDomain() string {
+	return strings.ToLower(strings.Trim(s.config.PassthroughDomain, "."))
+}
+
+// passthroughHost returns the host:port visitors of a passed-through
+// tunnel connect to
+func (s *Server) passthroughHost(name string) string {
+	_, port, _ := net.SplitHostPort(s.config.PassthroughAddr)
+	return net.JoinHostPort(name+"."+s.passthroughDomain(), port)
+}
+
+// handlePassthrough passes a visitor's TLS connection through to the agent
+// of the tunnel named by its SNI, unopened
+func (s *Server) handlePassthrough(conn net.Conn) {
+	defer conn.Close()
+	remoteAddr := conn.RemoteAddr().String()
+
+	conn.SetReadDeadline(time.Now().Add(passthroughHelloTimeout))
+	serverName, hello, err := readClientHello(conn)
+	if err != nil {
+		log.Printf("Error reading TLS ClientHello from %s: %v", remoteAddr, err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	name, ok := strings.CutSuffix(serverName, "."+s.passthroughDomain())
+	if !ok || !protocol.ValidName(name) {
+		log.Printf("TLS connection from %s for unknown host %q", remoteAddr, serverName)
+		return
+	}
+	c, reason := s.passthroughAgent(name, conn.RemoteAddr())
+	if c == nil {
+		log.Printf("TLS connection from %s for %s refused: %s", remoteAddr, name, reason)
+		return
+	}
+	if status, reason, _ := s.quotaExceeded(name, c); status != 0 {
+		log.Printf("TLS connection from %s for %s refused: %s", remoteAddr, name, reason)
+		return
+	}
+
+	c.active.Add(1)
+	defer c.active.Add(-1)
+	c.lastRequest.Store(time.Now().UnixNano())
+	c.stats.requests.Add(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), passthroughHelloTimeout)
+	stream, err := c.conn.OpenStreamSync(ctx)
+	cancel()
+	if err != nil {
+		c.stats.failures.Add(1)
+		log.Printf("Error opening passthrough stream to %s: %v", name, err)
+		return
+	}
+	head, err := protocol.NewConnectMessage(protocol.ConnectPayload{Tunnel: name, ServerName: serverName, RemoteAddr: remoteAddr})
+	if err == nil {
+		err = protocol.WriteBinaryMessage(stream, head)
+	}
+	if err != nil {
+		c.stats.failures.Add(1)
+		log.Printf("Error opening passthrough stream to %s: %v", name, err)
+		stream.CancelWrite(protocol.CallErrCanceled)
+		stream.CancelRead(protocol.CallErrCanceled)
+		return
+	}
+	log.Printf("TLS connection from %s passed through to %s", remoteAddr, name)
+
+	bytesIn, bytesOut := pipePassthrough(conn, stream, hello)
+	c.stats.bytesIn.Add(bytesIn)
+	c.stats.bytesOut.Add(bytesOut)
+	s.recordUsage(name, c, 0, bytesIn, bytesOut)
+}
+
+// passthroughAgent returns the agent a TLS connection for the tunnel name
+// from addr goes to, or nil and why there is none
+func (s *Server) passthroughAgent(name string, addr net.Addr) (*ClientInfo, string) {
+	val, ok := s.clients.Load(name)
+	if !ok {
+		return nil, "tunnel not found"
+	}
+	c := val.(*ClientInfo)
+	if c.pool != nil {
+		if c = c.pool.pick(s.config.Balance); c == nil {
+			return nil, "no agent available"
+		}
+	}
+	if !c.hello.TLSPassthrough || !c.caps.Has(protocol.CapPassthrough) || slices.Contains(c.extraTunnels, name) {
+		return nil, "tunnel doesn't take TLS connections"
+	}
+	if c.draining.Load() {
+		return nil, "agent is shutting down"
+	}
+	visitor, _ := netip.ParseAddrPort(addr.String())
+	allowed := func(rules ipfilter.Rules) bool {
+		return rules.Empty() || rules.Allows(visitor.Addr().Unmap())
+	}
+	if !allowed(s.ipRules) || !allowed(c.ipRules) {
+		s.audit.Log(auditlog.Event{Type: auditlog.AccessDenied, Tunnel: name, RemoteAddr: addr.String(), Reason: "IP address not allowed"})
+		return nil, "IP address not allowed"
+	}
+	return c, ""
+}
+
+// pipePassthrough copies the visitor's connection, starting with the
+// ClientHello already read from it, to the stream and back until both
+// sides are done. It returns the bytes copied each way
+func pipePassthrough(conn net.Conn, stream quic.Stream, hello []byte) (int64, int64) {
+	done := make(chan int64)
+	go func() {
+		n, err := io.Copy(stream, io.MultiReader(bytes.NewReader(hello), conn))
+		if err != nil {
+			stream.CancelWrite(protocol.CallErrCanceled)
+		} else {
+			stream.Close()
+		}
+		done <- n
+	}()
+	bytesOut, err := io.Copy(conn, stream)
+	if err != nil {
+		stream.CancelRead(protocol.CallErrCanceled)
+		conn.Close()
+	} else if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+	return <-done, bytesOut
+}
+
+// readClientHello reads the ClientHello a TLS connection starts with,
+// returning the server name it asks for and the bytes read
+func readClientHello(conn net.Conn) (string, []byte, error) {
+	var buf bytes.Buffer
+	var serverName string
+	err := tls.Server(readOnlyConn{conn, io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = strings.ToLower(hello.ServerName)
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if !errors.Is(err, errHelloRead) {
+		return "", nil, fmt.Errorf("not a TLS connection: %w", err)
+	}
+	if serverName == "" {
+		return "", nil, fmt.Errorf("no server name (SNI) in ClientHello")
+	}
+	return serverName, buf.Bytes(), nil
+}
+
+// readOnlyConn lets crypto/tls read a ClientHello without answering it
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
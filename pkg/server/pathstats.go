@@ -0,0 +1,138 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Path statistics cover the current window and the one before it, so a
+// report always spans between one and two windows of traffic
+const (
+	pathStatsWindow = 10 * time.Minute
+	maxTrackedPaths = 1000      // Per window, further paths are counted under otherPaths
+	otherPaths      = "(other)" // Paths that didn't fit in the window
+)
+
+// PathStat is the JSON representation of a path's recent traffic
+type PathStat struct {
+	Path      string  `json:"path"`
+	Requests  int64   `json:"requests"`
+	Errors    int64   `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	Bytes     int64   `json:"bytes"` // Request and response bodies
+}
+
+// pathStats counts requests per path over a rolling window, answering
+// which paths account for a tunnel's traffic without keeping the requests
+type pathStats struct {
+	mu       sync.Mutex
+	started  time.Time
+	current  map[string]*PathStat
+	previous map[string]*PathStat
+}
+
+func (p *pathStats) record(path string, status int, bytes int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rotate(time.Now())
+
+	stat, ok := p.current[path]
+	if !ok {
+		if len(p.current) >= maxTrackedPaths {
+			path = otherPaths
+		}
+		if stat, ok = p.current[path]; !ok {
+			stat = &PathStat{Path: path}
+			p.current[path] = stat
+		}
+	}
+	stat.Requests++
+	if status >= 500 {
+		stat.Errors++
+	}
+	stat.Bytes += bytes
+}
+
+// totals sums the requests and errors of all paths over the last one to two
+// windows
+func (p *pathStats) totals() (requests, errors int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rotate(time.Now())
+	for _, window := range []map[string]*PathStat{p.current, p.previous} {
+		for _, stat := range window {
+			requests += stat.Requests
+			errors += stat.Errors
+		}
+	}
+	return requests, errors
+}
+
+// rotate starts a new window once the current one is over. p.mu is held
+func (p *pathStats) rotate(now time.Time) {
+	switch elapsed := now.Sub(p.started); {
+	case p.current == nil || elapsed >= 2*pathStatsWindow:
+		p.previous = nil
+	case elapsed >= pathStatsWindow:
+		p.previous = p.current
+	default:
+		return
+	}
+	p.current = make(map[string]*PathStat)
+	p.started = now
+}
+
+// Orders accepted by top, see validPathOrder
+const (
+	pathsByRequests  = "requests"
+	pathsByBytes     = "bytes"
+	pathsByErrorRate = "error_rate"
+)
+
+func validPathOrder(by string) bool {
+	return by == pathsByRequests || by == pathsByBytes || by == pathsByErrorRate
+}
+
+// top returns the n paths with the most requests, bytes or the highest
+// error rate over the last one to two windows
+func (p *pathStats) top(by string, n int) []PathStat {
+	p.mu.Lock()
+	p.rotate(time.Now())
+	merged := make(map[string]*PathStat, len(p.current)+len(p.previous))
+	for _, window := range []map[string]*PathStat{p.previous, p.current} {
+		for path, stat := range window {
+			m, ok := merged[path]
+			if !ok {
+				m = &PathStat{Path: path}
+				merged[path] = m
+			}
+			m.Requests += stat.Requests
+			m.Errors += stat.Errors
+			m.Bytes += stat.Bytes
+		}
+	}
+	p.mu.Unlock()
+
+	stats := make([]PathStat, 0, len(merged))
+	for _, m := range merged {
+		m.ErrorRate = float64(m.Errors) / float64(m.Requests)
+		stats = append(stats, *m)
+	}
+	less := map[string]func(a, b PathStat) bool{
+		pathsByRequests: func(a, b PathStat) bool { return a.Requests > b.Requests },
+		pathsByBytes:    func(a, b PathStat) bool { return a.Bytes > b.Bytes },
+		pathsByErrorRate: func(a, b PathStat) bool {
+			if a.ErrorRate != b.ErrorRate {
+				return a.ErrorRate > b.ErrorRate
+			}
+			return a.Errors > b.Errors
+		},
+	}[by]
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Path < stats[j].Path })
+	sort.SliceStable(stats, func(i, j int) bool { return less(stats[i], stats[j]) })
+	if len(stats) > n {
+		stats = stats[:n]
+	}
+	return stats
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"minitunnel/internal/protocol"
+)
+
+// Request and Response are the requests forwarded to agents and the
+// responses they send back, as plugins see them. Request.Tunnel names the
+// tunnel, and the X-Real-Ip header the visitor
+type (
+	Request  = protocol.HTTPRequest
+	Response = protocol.HTTPResponse
+)
+
+// AgentInfo describes an agent asking for a tunnel
+type AgentInfo struct {
+	Name       string   // Tunnel name asked for, empty for a random one
+	Tunnels    []string // Further names asked for, see mt_agent -tunnel
+	Identity   string   // From the client certificate, empty without one
+	RemoteAddr string
+	Hostname   string
+	Version    string
+	Labels     map[string]string
+}
+
+// Plugin hooks into the server's handling of agents and requests, so
+// programs embedding it can add auth, logging or rewriting of their own.
+// Plugins are called in the order they were added with Use, responses in
+// reverse order. Streamed calls such as gRPC have no Body in either
+// direction, only their heads can be changed. Hooks are called
+// concurrently; embed NopPlugin to implement only some of them
+type Plugin interface {
+	// OnAgentConnect is called when an agent asks for a tunnel, before it
+	// is registered. Returning an error turns the agent away with it
+	OnAgentConnect(agent AgentInfo) error
+
+	// OnRequest is called before a request is sent to the agent and may
+	// change it. Returning a response answers the visitor with it instead,
+	// skipping the agent and later plugins
+	OnRequest(req *Request) (*Response, error)
+
+	// OnResponse is called with the agent's response before it is written
+	// to the visitor and may change it
+	OnResponse(req *Request, resp *Response) error
+}
+
+// NopPlugin implements every Plugin hook as a no-op
+type NopPlugin struct{}
+
+// OnAgentConnect accepts the agent
+func (NopPlugin) OnAgentConnect(AgentInfo) error { return nil }
+
+// OnRequest passes the request on
+func (NopPlugin) OnRequest(*Request) (*Response, error) { return nil, nil }
+
+// OnResponse passes the response on
+func (NopPlugin) OnResponse(*Request, *Response) error { return nil }
+
+// Use appends plugins to the server's chain. Returning an error from a
+// request or response hook fails the request with a 502. Call it before
+// Start
+func (s *Server) Use(plugins ...Plugin) {
+	s.plugins = append(s.plugins, plugins...)
+}
+
+// agentAllowed asks the plugins whether an agent may connect, returning
+// the first plugin's refusal
+func (s *Server) agentAllowed(info AgentInfo) error {
+	for _, p := range s.plugins {
+		if err := p.OnAgentConnect(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pluginRequest runs a request through the plugins, answering the visitor
+// if one of them did or failed. It reports whether the request may go on
+func (s *Server) pluginRequest(w http.ResponseWriter, req *Request) bool {
+	for _, p := range s.plugins {
+		resp, err := p.OnRequest(req)
+		if err != nil {
+			log.Printf("Plugin failed on %s %s for %s: %v", req.Method, req.Path, req.Tunnel, err)
+			http.Error(w, "Error processing request", http.StatusBadGateway)
+			return false
+		}
+		if resp != nil {
+			writeResponse(w, *resp)
+			return false
+		}
+	}
+	return true
+}
+
+// pluginResponse runs a response through the plugins in reverse order
+func (s *Server) pluginResponse(req *Request, resp *Response) error {
+	for i := len(s.plugins) - 1; i >= 0; i-- {
+		if err := s.plugins[i].OnResponse(req, resp); err != nil {
+			return fmt.Errorf("plugin failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// writeResponse writes a complete response to the visitor
+func writeResponse(w http.ResponseWriter, resp Response) {
+	for key, values := range resp.Headers {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	status := resp.StatusCode
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	w.Write(resp.Body)
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"minitunnel/internal/config"
+	"minitunnel/internal/protocol"
+)
+
+// pool is a set of agents sharing one tunnel name, see
+// HelloPayload.Balance. The oldest member is stored in s.clients and stands
+// for the tunnel; requests are spread over all members
+type pool struct {
+	mu      sync.Mutex
+	members []*ClientInfo // Oldest first
+	next    int           // Where the next pick starts looking
+}
+
+// joinPool adds a client to the pool of the tunnel called name, creating
+// it if the name is free. It returns false if the name is invalid or held
+// by an agent that doesn't share, in which case the client registers
+// normally
+func (s *Server) joinPool(name string, clientInfo *ClientInfo) bool {
+	if !protocol.ValidName(name) {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, ok := s.clients.Load(name)
+	clientInfo.memberID = generateToken()[:16]
+	if !ok {
+		clientInfo.pool = &pool{members: []*ClientInfo{clientInfo}}
+		s.clients.Store(name, clientInfo)
+		return true
+	}
+	p := val.(*ClientInfo).pool
+	if p == nil {
+		return false
+	}
+	clientInfo.pool = p
+	p.mu.Lock()
+	p.members = append(p.members, clientInfo)
+	size := len(p.members)
+	p.mu.Unlock()
+	log.Printf("Agent joined %s, %d agents share the tunnel", name, size)
+	return true
+}
+
+// leavePool removes a disconnected client from its pool. If it stood for
+// the tunnel, the next oldest member takes its place. Callers hold s.mu
+func (s *Server) leavePool(name string, clientInfo *ClientInfo) {
+	p := clientInfo.pool
+	p.mu.Lock()
+	p.members = slices.DeleteFunc(p.members, func(c *ClientInfo) bool { return c == clientInfo })
+	var next *ClientInfo
+	if len(p.members) > 0 {
+		next = p.members[0]
+	}
+	size := len(p.members)
+	p.mu.Unlock()
+
+	if next == nil {
+		s.clients.CompareAndDelete(name, clientInfo)
+		return
+	}
+	log.Printf("Agent left %s, %d remaining", name, size)
+	s.clients.CompareAndSwap(name, clientInfo, next)
+	// The inbox may have belonged to the agent that left
+	if s.wantsInbox(next.hello) {
+		s.openInbox(name, next)
+	}
+}
+
+// pick chooses the member that serves the next request, skipping members
+// that are shutting down or whose local service is down. It returns nil if
+// all of them are
+func (p *pool) pick(strategy string) *ClientInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := len(p.members)
+	if n == 0 {
+		return nil
+	}
+	var best *ClientInfo
+	for i := range n {
+		c := p.members[(p.next+i)%n]
+		if !c.available() {
+			continue
+		}
+		if strategy == config.BalanceRoundRobin {
+			p.next = (p.next + i + 1) % n
+			return c
+		}
+		if best == nil || c.active.Load() < best.active.Load() {
+			best = c
+		}
+	}
+	// Rotate the start so that ties don't always go to the same member
+	p.next = (p.next + 1) % n
+	return best
+}
+
+// member returns the agent with the given member ID unless it is gone,
+// shutting down or its local service is down
+func (p *pool) member(id string) *ClientInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.members {
+		if c.memberID == id && c.available() {
+			return c
+		}
+	}
+	return nil
+}
+
+// Visitors of a shared tunnel are tied to an agent by a cookie named after
+// the tunnel, see -sticky-sessions
+const affinityCookiePrefix = "minitunnel_affinity_"
+
+// affinity is the signed value of an affinity cookie
+type affinity struct {
+	Tunnel string `json:"t"`
+	Agent  string `json:"a"` // ClientInfo.memberID
+}
+
+// pickMember chooses the agent of a shared tunnel that serves r, or nil if
+// none of them is available. With -sticky-sessions a visitor stays with
+// the agent named in their affinity cookie while it is connected, and gets
+// such a cookie otherwise
+func (s *Server) pickMember(w http.ResponseWriter, r *http.Request, name string, p *pool) *ClientInfo {
+	if !s.config.StickySessions {
+		return p.pick(s.config.Balance)
+	}
+	if c, err := r.Cookie(affinityCookiePrefix + name); err == nil {
+		var a affinity
+		if s.cookies.verify(signAffinity, c.Value, &a) && a.Tunnel == name {
+			if member := p.member(a.Agent); member != nil {
+				return member
+			}
+		}
+	}
+	member := p.pick(s.config.Balance)
+	if member != nil {
+		// A session cookie: the agent is gone by the next browser session
+		// more often than not
+		http.SetCookie(w, &http.Cookie{
+			Name:     affinityCookiePrefix + name,
+			Value:    s.cookies.sign(signAffinity, affinity{Tunnel: name, Agent: member.memberID}),
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   strings.HasPrefix(s.config.TunnelURL(name), "https://"),
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return member
+}
+
+// poolSize returns the number of agents sharing the client's tunnel name,
+// 0 if it doesn't share
+func (c *ClientInfo) poolSize() int {
+	if c.pool == nil {
+		return 0
+	}
+	c.pool.mu.Lock()
+	defer c.pool.mu.Unlock()
+	return len(c.pool.members)
+}
+
+// snapshot returns the members, oldest first
+func (p *pool) snapshot() []*ClientInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.members)
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// Port describes a port the server opens and who needs to reach it
+type Port struct {
+	Role     string // control, data, http3, passthrough, admin or metrics
+	Flag     string // Option setting the address, e.g. http-addr
+	Addr     string
+	Proto    string // tcp or udp
+	Audience string
+	Public   bool // Must be reachable from the internet
+}
+
+// Ports returns the ports the server opens with the given options,
+// skipping disabled listeners
+func Ports(cfg *Options) []Port {
+	ls := []Port{
+		{"control", "control-addr", cfg.ControlAddr, "udp", "agents (QUIC)", true},
+		{"data", "http-addr", cfg.HTTPAddr, "tcp", "visitors (HTTP)", true},
+		{"admin", "admin-addr", cfg.AdminAddr, "tcp", "operators only", false},
+	}
+	if cfg.SinglePort {
+		ls[0].Audience = "agents (QUIC), visitors (HTTP/3)"
+		ls[1].Audience = "visitors (HTTPS)"
+	}
+	if cfg.HTTP3Addr != "" {
+		ls = append(ls, Port{"http3", "http3-addr", cfg.HTTP3Addr, "udp", "visitors (HTTP/3)", true})
+	}
+	if cfg.PassthroughAddr != "" {
+		ls = append(ls, Port{"passthrough", "tls-passthrough-addr", cfg.PassthroughAddr, "tcp", "visitors (TLS passthrough)", true})
+	}
+	if cfg.MetricsAddr != "" {
+		ls = append(ls, Port{"metrics", "metrics-addr", cfg.MetricsAddr, "tcp", "monitoring only", false})
+	}
+	return ls
+}
+
+// boundListeners holds the server's sockets. They are all opened before
+// anything starts serving, so a port problem stops the server right away
+type boundListeners struct {
+	control net.PacketConn
+	data    net.Listener
+	http3   net.PacketConn // nil if disabled
+	tls     net.Listener   // Passthrough, nil if disabled
+	admin   net.Listener
+	metrics net.Listener // nil if disabled
+}
+
+// CheckPorts reports whether every port of the options can be opened,
+// returning the error Start would fail with otherwise
+func CheckPorts(cfg *Options) error {
+	bound, err := bindListeners(cfg)
+	if err != nil {
+		return err
+	}
+	bound.Close()
+	return nil
+}
+
+// bindListeners opens every listener of the configuration, explaining what
+// to do about the first one that can't be opened
+func bindListeners(cfg *Options) (*boundListeners, error) {
+	b := &boundListeners{}
+	var opened []Port
+	for _, l := range Ports(cfg) {
+		var err error
+		switch l.Role {
+		case "control":
+			b.control, err = net.ListenPacket("udp", l.Addr)
+		case "data":
+			b.data, err = net.Listen("tcp", l.Addr)
+		case "http3":
+			b.http3, err = net.ListenPacket("udp", l.Addr)
+		case "passthrough":
+			b.tls, err = net.Listen("tcp", l.Addr)
+		case "admin":
+			b.admin, err = net.Listen("tcp", l.Addr)
+		case "metrics":
+			b.metrics, err = net.Listen("tcp", l.Addr)
+		}
+		if err != nil {
+			b.Close()
+			return nil, bindError(l, opened, err)
+		}
+		opened = append(opened, l)
+	}
+	return b, nil
+}
+
+// Close closes all opened listeners
+func (b *boundListeners) Close() {
+	for _, conn := range []net.PacketConn{b.control, b.http3} {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	for _, ln := range []net.Listener{b.data, b.tls, b.admin, b.metrics} {
+		if ln != nil {
+			ln.Close()
+		}
+	}
+}
+
+// bindError turns a failed bind of l into advice on how to fix it. opened
+// are the server's own listeners that were bound before l
+func bindError(l Port, opened []Port, err error) error {
+	_, port, _ := net.SplitHostPort(l.Addr)
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		for _, o := range opened {
+			if _, p, _ := net.SplitHostPort(o.Addr); o.Proto == l.Proto && p == port {
+				return fmt.Errorf("-%s %s overlaps -%s %s: give the %s and %s listeners different ports", l.Flag, l.Addr, o.Flag, o.Addr, o.Role, l.Role)
+			}
+		}
+		find := fmt.Sprintf("ss -lnp%s 'sport = :%s'", l.Proto[:1], port)
+		if runtime.GOOS != "linux" {
+			find = fmt.Sprintf("lsof -nP -i %s:%s", l.Proto, port)
+		}
+		return fmt.Errorf("port %s/%s for the %s listener is already in use by another process (find it with: %s); stop it or choose another port with -%s", port, l.Proto, l.Role, find, l.Flag)
+	case errors.Is(err, syscall.EACCES):
+		return fmt.Errorf("not allowed to listen on port %s/%s for the %s listener: ports below 1024 need root or CAP_NET_BIND_SERVICE (sudo setcap cap_net_bind_service=+ep %s); or choose a port above 1023 with -%s", port, l.Proto, l.Role, os.Args[0], l.Flag)
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		return fmt.Errorf("cannot listen on %s for the %s listener: the host is not an address of this machine; use one of its addresses in -%s, or leave the host empty to listen on all", l.Addr, l.Role, l.Flag)
+	}
+	return fmt.Errorf("failed to open the %s listener on %s (-%s): %w", l.Role, l.Addr, l.Flag, err)
+}
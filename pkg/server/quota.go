@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"minitunnel/internal/store"
+)
+
+// Quota caps what the agents of a reservation's token may serve per day and
+// month
+type Quota = store.Quota
+
+// TokenUsage is the usage of a reservation's token, listed by
+// GET /api/usage/tokens
+type TokenUsage struct {
+	Names []string `json:"names"`
+	Note  string   `json:"note,omitempty"`
+	Quota *Quota   `json:"quota,omitempty"`
+	store.TokenUsage
+}
+
+// validateQuota checks the caps of a quota, nil for none
+func validateQuota(q *Quota) error {
+	if q == nil {
+		return nil
+	}
+	if q.Daily.Requests < 0 || q.Daily.Bytes < 0 || q.Monthly.Requests < 0 || q.Monthly.Bytes < 0 {
+		return fmt.Errorf("quota caps must not be negative")
+	}
+	return nil
+}
+
+// quotaOf returns the quota of the reservation of a token digest, or nil
+func (s *Server) quotaOf(digest string) *Quota {
+	for _, res := range s.reservations() {
+		if res.TokenSHA256 == digest {
+			return res.Quota
+		}
+	}
+	return nil
+}
+
+// checkQuota answers visitors of an agent whose token used up its quota:
+// 429 for the day's, 402 for the month's, until the period ends. It reports
+// whether the request may go on
+func (s *Server) checkQuota(w http.ResponseWriter, r *http.Request, clientID string, c *ClientInfo) bool {
+	status, reason, reset := s.quotaExceeded(clientID, c)
+	if status == 0 {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+	s.tunnelError(w, r, clientID, status, reason)
+	return false
+}
+
+// quotaExceeded returns the status visitors of an agent whose token used up
+// its quota get, why, and when the quota is renewed. The status is 0 while
+// there is quota left
+func (s *Server) quotaExceeded(clientID string, c *ClientInfo) (int, string, time.Time) {
+	if c.tokenDigest == "" {
+		return 0, "", time.Time{}
+	}
+	quota := s.quotaOf(c.tokenDigest)
+	if quota == nil {
+		return 0, "", time.Time{}
+	}
+	now := time.Now().UTC()
+	usage, err := s.store.TokenUsage(c.tokenDigest, now)
+	if err != nil {
+		log.Printf("Error loading token usage of %s: %v", clientID, err)
+		return 0, "", time.Time{}
+	}
+	switch {
+	case quota.Monthly.Reached(usage.Monthly):
+		return http.StatusPaymentRequired, "Monthly quota of the tunnel used up", time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	case quota.Daily.Reached(usage.Daily):
+		return http.StatusTooManyRequests, "Daily quota of the tunnel used up", time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	}
+	return 0, "", time.Time{}
+}
+
+// handleSetQuota replaces the quota of the reservation holding a name, a
+// null body removing it
+func (s *Server) handleSetQuota(w http.ResponseWriter, r *http.Request) {
+	var quota *Quota
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&quota); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := validateQuota(quota); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := s.store.SetQuota(r.PathValue("name"), quota)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Name not reserved", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error saving reservations: %v", err)
+		http.Error(w, "Failed to save the quota", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Set the quota of %v", res.Names)
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) handleTokenUsage(w http.ResponseWriter, r *http.Request) {
+	list, err := s.store.Reservations()
+	if err != nil {
+		log.Printf("Error loading reservations: %v", err)
+		http.Error(w, "Failed to load the reservations", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	usage := make([]TokenUsage, 0, len(list))
+	for _, res := range list {
+		u, err := s.store.TokenUsage(res.TokenSHA256, now)
+		if err != nil {
+			log.Printf("Error loading token usage: %v", err)
+			http.Error(w, "Failed to load usage", http.StatusInternalServerError)
+			return
+		}
+		usage = append(usage, TokenUsage{Names: res.Names, Note: res.Note, Quota: res.Quota, TokenUsage: u})
+	}
+	writeJSON(w, http.StatusOK, usage)
+}
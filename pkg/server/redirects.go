@@ -0,0 +1,183 @@
+package server
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"minitunnel/internal/config"
+	"minitunnel/internal/protocol"
+	"minitunnel/internal/rewrite"
+)
+
+// urlRewriter points URLs a local service builds for itself at the tunnel's
+// public URL. Local services see their own address in the Host header and
+// believe they are served from the root of the site, so their redirects
+// name e.g. http://localhost:3000/login or /login
+type urlRewriter struct {
+	origin     string   // Scheme and host visitors use, e.g. https://api.example.com
+	publicHost string   // Host name in origin
+	basePath   string   // Path of the tunnel under origin, with a trailing slash
+	localHosts []string // Host names that stand for the local service
+}
+
+// newURLRewriter builds the rewriter for a request to the named tunnel.
+// The origin comes from -url-template if it is set, otherwise from the
+// X-Forwarded-Proto and X-Forwarded-Host headers sent to the agent, which
+// name the origin the visitor used
+func (s *Server) newURLRewriter(name string, headers map[string][]string, localHosts []string) *urlRewriter {
+	scheme, host := http.Header(headers).Get("X-Forwarded-Proto"), http.Header(headers).Get("X-Forwarded-Host")
+	if s.config.URLTemplate != config.DefaultURLTemplate {
+		if u, err := url.Parse(s.config.TunnelURL(name)); err == nil && u.Host != "" {
+			scheme, host = u.Scheme, u.Host
+		}
+	}
+	publicHost := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		publicHost = h
+	}
+	return &urlRewriter{
+		origin:     scheme + "://" + host,
+		publicHost: strings.Trim(publicHost, "[]"),
+		basePath:   s.config.TunnelBasePath(name),
+		localHosts: append(slices.Clip(localHosts), strings.Trim(publicHost, "[]")),
+	}
+}
+
+// rewriteHeaders rewrites the Location, Content-Location and Refresh
+// headers of a response
+func (rw *urlRewriter) rewriteHeaders(h map[string][]string) {
+	for _, key := range []string{"Location", "Content-Location"} {
+		for i, v := range h[key] {
+			h[key][i] = rw.rewrite(v)
+		}
+	}
+	// Refresh: 5; url=http://localhost:3000/
+	for i, v := range h["Refresh"] {
+		h["Refresh"][i] = rw.page().Refresh(v)
+	}
+}
+
+// page returns a rewriter for the URLs in page bodies
+func (rw *urlRewriter) page() *rewrite.Rewriter {
+	return &rewrite.Rewriter{URL: rw.rewrite}
+}
+
+// rewritePage fixes the links of an HTML page, and the Content Security
+// Policy allowing them. Pages in an encoding that can't be decoded are
+// passed on as they are
+func (s *Server) rewritePage(resp *protocol.HTTPResponse, rw *urlRewriter) {
+	h := http.Header(resp.Headers)
+	if !strings.Contains(h.Get("Content-Type"), "text/html") {
+		return
+	}
+	encoding := h.Get("Content-Encoding")
+	if !rewrite.Supported(encoding) {
+		return
+	}
+	body, err := rw.page().Body(resp.Body, encoding, s.config.MaxResponseBody)
+	if err != nil {
+		log.Printf("Error rewriting page: %v", err)
+		return
+	}
+	resp.Body = body
+	for _, key := range []string{"Content-Security-Policy", "Content-Security-Policy-Report-Only"} {
+		for i, v := range resp.Headers[key] {
+			resp.Headers[key][i] = rw.page().CSP(v)
+		}
+	}
+}
+
+// rewriteCookies fits the Set-Cookie headers of a response to the public
+// URL: cookies for a local host become cookies of the public host, and
+// their paths are put under the tunnel's base path
+func (rw *urlRewriter) rewriteCookies(h map[string][]string) {
+	for i, v := range h["Set-Cookie"] {
+		h["Set-Cookie"][i] = rw.rewriteCookie(v)
+	}
+}
+
+// rewriteCookie rewrites a single Set-Cookie value, keeping its other
+// attributes as they are
+func (rw *urlRewriter) rewriteCookie(v string) string {
+	parts := strings.Split(v, ";")
+	kept := parts[:1]
+	for _, part := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch strings.ToLower(name) {
+		case "domain":
+			// Without a Domain the cookie belongs to the host that set it
+			domain := strings.TrimPrefix(value, ".")
+			if rw.isLocal(domain) && !strings.EqualFold(domain, rw.publicHost) {
+				continue
+			}
+		case "path":
+			if strings.HasPrefix(value, "/") {
+				part = " Path=" + rw.withBase(value)
+			}
+		}
+		kept = append(kept, part)
+	}
+	return strings.Join(kept, ";")
+}
+
+// rewrite returns the public form of raw. URLs on other hosts and paths
+// relative to the current one are returned as they are
+func (rw *urlRewriter) rewrite(raw string) string {
+	rest, ok := strings.CutPrefix(raw, "//")
+	if !ok {
+		if scheme, after, found := strings.Cut(raw, "://"); found && (strings.EqualFold(scheme, "http") || strings.EqualFold(scheme, "https")) {
+			rest, ok = after, true
+		}
+	}
+	if !ok {
+		if strings.HasPrefix(raw, "/") {
+			return rw.withBase(raw)
+		}
+		return raw
+	}
+
+	authority, path := rest, "/"
+	if i := strings.IndexAny(rest, "/?#"); i >= 0 {
+		authority, path = rest[:i], rest[i:]
+		if path[0] != '/' {
+			path = "/" + path
+		}
+	}
+	if !rw.isLocal(authority) {
+		return raw
+	}
+	return rw.origin + rw.withBase(path)
+}
+
+// withBase puts a root-relative path under the tunnel's base path, unless
+// it already is
+func (rw *urlRewriter) withBase(path string) string {
+	if rw.basePath == "/" || strings.HasPrefix(path, rw.basePath) || path == strings.TrimSuffix(rw.basePath, "/") {
+		return path
+	}
+	return strings.TrimSuffix(rw.basePath, "/") + path
+}
+
+// isLocal reports whether a URL authority names the local service or the
+// tunnel itself
+func (rw *urlRewriter) isLocal(authority string) bool {
+	if _, host, ok := strings.Cut(authority, "@"); ok {
+		authority = host
+	}
+	host := authority
+	if h, _, err := net.SplitHostPort(authority); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if host == "localhost" {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil && (ip.IsLoopback() || ip.IsUnspecified()) {
+		return true
+	}
+	return slices.ContainsFunc(rw.localHosts, func(h string) bool { return strings.EqualFold(h, host) })
+}
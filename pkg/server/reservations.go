@@ -0,0 +1,186 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"minitunnel/internal/protocol"
+	"minitunnel/internal/store"
+)
+
+// Reservation gives the agents presenting a token its tunnel names, which
+// no other agent may use
+type Reservation = store.Reservation
+
+// reservationRequest is the body of POST /api/reservations
+type reservationRequest struct {
+	Names []string `json:"names"`
+	Note  string   `json:"note"`
+	Quota *Quota   `json:"quota"`
+}
+
+// newReservation is the answer to POST /api/reservations, the only time
+// the token is shown
+type newReservation struct {
+	Reservation
+	Token string `json:"token"`
+}
+
+// tokenDigest returns the hex SHA-256 of a token as kept in reservations
+func tokenDigest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// reservationOf returns the reservation of the token with digest, or nil
+func reservationOf(list []Reservation, digest string) *Reservation {
+	if digest == "" {
+		return nil
+	}
+	for i := range list {
+		if subtle.ConstantTimeCompare([]byte(list[i].TokenSHA256), []byte(digest)) == 1 {
+			return &list[i]
+		}
+	}
+	return nil
+}
+
+// reservations returns the reservations of the store. Agents are let in
+// without the checks if it fails, which only a broken store does
+func (s *Server) reservations() []Reservation {
+	list, err := s.store.Reservations()
+	if err != nil {
+		log.Printf("Error loading reservations: %v", err)
+	}
+	return list
+}
+
+// helloToken returns the digest of the token an agent presented: in its
+// hello, or by protocol.TokenID when it signs. It is "" for agents without
+// one, and ok is false for a token the server doesn't know
+func (s *Server) helloToken(hello protocol.HelloPayload) (digest string, ok bool) {
+	if hello.Token != "" {
+		digest = tokenDigest(hello.Token)
+		return digest, reservationOf(s.reservations(), digest) != nil
+	}
+	if hello.Signing == nil {
+		return "", true
+	}
+	for _, res := range s.reservations() {
+		raw, err := hex.DecodeString(res.TokenSHA256)
+		if err == nil && protocol.TokenID(raw) == hello.Signing.TokenID {
+			return res.TokenSHA256, true
+		}
+	}
+	return "", false
+}
+
+// defaultName returns the first name reserved for the token with digest,
+// for agents that don't ask for one, or "" if there is none
+func (s *Server) defaultName(digest string) string {
+	if res := reservationOf(s.reservations(), digest); res != nil {
+		return res.Names[0]
+	}
+	return ""
+}
+
+// checkReservations refuses agents asking for names reserved for another
+// token than the one with digest
+func (s *Server) checkReservations(digest string, hello protocol.HelloPayload) *protocol.RejectPayload {
+	list := s.reservations()
+	own := reservationOf(list, digest)
+	var errs []protocol.NameError
+	for _, name := range append([]string{hello.Name}, hello.Tunnels...) {
+		i := slices.IndexFunc(list, func(res Reservation) bool { return slices.Contains(res.Names, name) })
+		if i >= 0 && &list[i] != own {
+			errs = append(errs, protocol.NameError{
+				Name:    name,
+				Code:    protocol.NameErrReserved,
+				Message: "reserved, start the agent with the -token it is reserved for",
+			})
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return &protocol.RejectPayload{Message: "names reserved for another token", Names: errs}
+}
+
+// validate checks the names of a reservation request
+func (req reservationRequest) validate() error {
+	if len(req.Names) == 0 {
+		return fmt.Errorf("names are required")
+	}
+	for i, name := range req.Names {
+		if !protocol.ValidName(name) {
+			return fmt.Errorf("invalid name %q: use 1-63 lowercase letters, digits and hyphens", name)
+		}
+		if slices.Contains(req.Names[:i], name) {
+			return fmt.Errorf("name %q given more than once", name)
+		}
+	}
+	return validateQuota(req.Quota)
+}
+
+func (s *Server) handleListReservations(w http.ResponseWriter, r *http.Request) {
+	list, err := s.store.Reservations()
+	if err != nil {
+		log.Printf("Error loading reservations: %v", err)
+		http.Error(w, "Failed to load the reservations", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) handleAddReservation(w http.ResponseWriter, r *http.Request) {
+	var req reservationRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	token := generateToken()
+	res := Reservation{
+		Names:       req.Names,
+		Note:        req.Note,
+		TokenSHA256: tokenDigest(token),
+		Quota:       req.Quota,
+		CreatedAt:   time.Now().UTC(),
+	}
+	err := s.store.AddReservation(res)
+	if errors.Is(err, store.ErrReserved) {
+		http.Error(w, "A name is already reserved", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Error saving reservations: %v", err)
+		http.Error(w, "Failed to save the reservation", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Reserved %v for a new token", res.Names)
+	writeJSON(w, http.StatusCreated, newReservation{Reservation: res, Token: token})
+}
+
+func (s *Server) handleDeleteReservation(w http.ResponseWriter, r *http.Request) {
+	res, err := s.store.DeleteReservation(r.PathValue("name"))
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Name not reserved", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error saving reservations: %v", err)
+		http.Error(w, "Failed to save the reservations", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Released the reservation of %v", res.Names)
+	w.WriteHeader(http.StatusNoContent)
+}
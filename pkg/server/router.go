@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Router picks the tunnel for a public request, so programs embedding the
+// server can route by host name, header or anything else besides the
+// tunnel name at the start of the path. Route returns the tunnel name and
+// the path to send to it, or false to route the request by its path as
+// usual. Route is called concurrently and should not block for long
+type Router interface {
+	Route(r *http.Request) (tunnel, path string, ok bool)
+}
+
+// RouterFunc adapts a function to the Router interface
+type RouterFunc func(r *http.Request) (tunnel, path string, ok bool)
+
+// Route calls f(r)
+func (f RouterFunc) Route(r *http.Request) (string, string, bool) {
+	return f(r)
+}
+
+// HostRouter routes requests for each host name, without a port, to the
+// tunnel of the same name under a domain, e.g. api.tunnels.example.com to
+// api with HostRouter("tunnels.example.com")
+func HostRouter(domain string) Router {
+	suffix := "." + strings.TrimPrefix(domain, ".")
+	return RouterFunc(func(r *http.Request) (string, string, bool) {
+		host := r.Host
+		if i := strings.LastIndexByte(host, ':'); i > strings.LastIndexByte(host, ']') {
+			host = host[:i]
+		}
+		name, ok := strings.CutSuffix(strings.ToLower(host), suffix)
+		if !ok || name == "" || strings.Contains(name, ".") {
+			return "", "", false
+		}
+		return name, r.URL.Path, true
+	})
+}
+
+// SetRouter installs a Router asked about every public request. Call it
+// before Start
+func (s *Server) SetRouter(r Router) {
+	s.router = r
+}
+
+// route asks the embedder's Router, if any, which tunnel r is for. The path
+// is made absolute
+func (s *Server) route(r *http.Request) (string, string, bool) {
+	if s.router == nil {
+		return "", "", false
+	}
+	tunnel, path, ok := s.router.Route(r)
+	if !ok || tunnel == "" {
+		return "", "", false
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return tunnel, path, true
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"minitunnel/internal/certs"
+	"minitunnel/internal/config"
+)
+
+// SelfSignedValidity is how long the certificates the server creates for
+// itself are valid
+const SelfSignedValidity = 365 * 24 * time.Hour
+
+// ensureCertificate creates a self-signed certificate at the default
+// locations on first run, so that the server starts without any setup.
+// Certificates named with -cert and -key must exist
+func (s *Server) ensureCertificate() error {
+	if s.config.CertFile != config.DefaultCertFile || s.config.KeyFile != config.DefaultKeyFile {
+		return nil
+	}
+	_, certErr := os.Stat(s.config.CertFile)
+	_, keyErr := os.Stat(s.config.KeyFile)
+	if !errors.Is(certErr, os.ErrNotExist) || !errors.Is(keyErr, os.ErrNotExist) {
+		return nil
+	}
+
+	hosts := certs.LocalHosts()
+	if _, err := certs.WriteSelfSigned(s.config.CertFile, s.config.KeyFile, hosts, SelfSignedValidity); err != nil {
+		return fmt.Errorf("failed to create a self-signed certificate: %w", err)
+	}
+	log.Printf("Created a self-signed certificate for %s in %s; use mt_server gen-cert -host for other names", strings.Join(hosts, ", "), s.config.CertFile)
+	return nil
+}
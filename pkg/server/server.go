@@ -0,0 +1,1149 @@
+// Package server is the minitunnel server mt_server runs, for programs
+// that embed it in their own control plane:
+//
+//	opts := server.DefaultOptions()
+//	opts.CertFile, opts.KeyFile = "server.crt", "server.key"
+//	s := server.New(opts)
+//	s.SetAuthorizer(myAuthorizer)
+//	if err := s.Start(); err != nil {
+//		log.Fatal(err)
+//	}
+//	defer s.Shutdown(ctx)
+//
+// The server logs what it does with the standard logger, like mt_server
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"minitunnel/internal/accesslog"
+	"minitunnel/internal/auditlog"
+	"minitunnel/internal/certs"
+	"minitunnel/internal/config"
+	"minitunnel/internal/httpheader"
+	"minitunnel/internal/ipfilter"
+	"minitunnel/internal/protocol"
+	"minitunnel/internal/store"
+	"minitunnel/internal/tracing"
+
+	"github.com/google/uuid"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Options configures a server. The fields are the mt_server flags of the
+// same names, see DefaultOptions
+type Options = config.ServerConfig
+
+// DefaultOptions returns the options mt_server runs with when no flags are
+// given
+func DefaultOptions() *Options {
+	opts := &Options{}
+	opts.RegisterFlags(flag.NewFlagSet("server", flag.ContinueOnError))
+	return opts
+}
+
+type Server struct {
+	config      *config.ServerConfig
+	clients     sync.Map // map[clientID]*ClientInfo
+	pollers     sync.Map // map[name]*poller
+	standbys    sync.Map // map[name]*ClientInfo, promoted when the primary goes away
+	inboxes     sync.Map // map[name]*inbox, webhooks buffered for named tunnels
+	offline     sync.Map // map[name]string, offline pages left by disconnected agents
+	waiting     sync.Map // map[name]*waitingRoom, visitors held for -reconnect-grace
+	recent      *requestLog
+	access      *accesslog.Logger           // Nil unless -access-log is set
+	audit       *auditlog.Logger            // Nil unless -audit-log is set
+	stopTracing func(context.Context) error // Flushes spans to -otlp-endpoint, nil without it
+	oauth       *oauthGate                  // Nil unless -oauth-issuer is set
+	errorPages  errorPages                  // From -error-pages, nil without it
+	store       store.Store                 // Reservations and usage, in -state or memory
+	cluster     *cluster                    // From -cluster-peer, nil without it
+	ipRules     ipfilter.Rules              // From -allow-ip and -deny-ip
+	authorizer  Authorizer                  // Set by embedders with SetAuthorizer, nil if none
+	router      Router                      // Set by embedders with SetRouter, nil if none
+	plugins     []Plugin                    // Added by embedders with Use
+	cookies     *cookieSigner               // Signs visitor cookies, keyed by -session-secret
+	h3          *http3.Server               // Serves visitors over HTTP/3, nil unless -http3-addr is set
+	certs       *certLoader                 // The -cert certificate, reloaded when it changes
+	mu          sync.RWMutex                // Serializes standby registration and promotion
+
+	// Set up by Start and torn down by Shutdown
+	bound     *boundListeners
+	servers   []*http.Server // Visitor, admin and metrics servers
+	conns     sync.Map       // map[quic.Connection]struct{}, every agent connection
+	stop      context.CancelFunc
+	failed    chan error  // Receives the first serving error, see Run
+	accepting atomic.Bool // The QUIC listener is accepting agents, see Health
+}
+
+type ClientInfo struct {
+	conn        quic.Connection
+	stream      quic.Stream
+	mu          sync.Mutex // Protects stream writes
+	tunnelURL   string
+	remoteAddr  string
+	hello       protocol.HelloPayload // Agent identification
+	identity    string                // From the client certificate, empty without one
+	takeoverKey []byte                // SHA-256 of HelloPayload.TakeoverSecret, nil without one
+	tokenDigest string                // Of HelloPayload.Token for its reservation's quota, empty without one
+	ipRules     ipfilter.Rules        // Parsed from HelloPayload.IPFilter
+	limit       *limiter              // Caps requests in flight, nil for no limit
+	inspect     *inspectLog           // Recent requests for the admin API, nil unless -inspect-requests
+	connectedAt time.Time
+	stats       TunnelStats
+
+	nextRequestID atomic.Uint64
+	pending       sync.Map               // map[requestID]chan protocol.HTTPResponse
+	lastSeen      atomic.Int64           // Unix nanoseconds of the last message from the agent
+	draining      atomic.Bool            // Agent announced shutdown, don't send new requests
+	downReason    atomic.Pointer[string] // Why the local service fails its health check, nil while it passes
+	standby       atomic.Bool            // Waiting in s.standbys, carries no traffic
+	pool          *pool                  // Agents sharing the tunnel name, nil unless HelloPayload.Balance
+	memberID      string                 // Identifies the agent within its pool in affinity cookies
+	active        atomic.Int64           // Requests sent to the agent and not answered yet
+	lastRequest   atomic.Int64           // Unix nanoseconds of the last request sent to the agent
+	extraTunnels  []string               // Additional names routed to this connection, see HelloPayload.Tunnels
+	caps          protocol.Capabilities  // Negotiated from the hello, see protocol.NegotiateCapabilities
+	serial        sync.Mutex             // Held per request when the agent can't take concurrent ones
+	compression   string                 // Body compression negotiated in the hello, none if empty
+	out           protocol.WriteOptions  // Framing and limits for messages after the welcome, guarded by mu
+
+	labels atomic.Pointer[map[string]string] // Set by bulk relabels, see currentLabels
+}
+
+// New creates a server for the given options, see DefaultOptions. Nothing
+// is opened until Start
+func New(cfg *Options) *Server {
+	cfg.ApplyDefaults()
+	s := &Server{
+		config:  cfg,
+		recent:  newRequestLog(100),
+		cookies: newCookieSigner(cfg.SessionSecret),
+		failed:  make(chan error, 1),
+	}
+	if cfg.OAuthIssuer != "" {
+		s.oauth = newOAuthGate(cfg, s.cookies)
+	}
+	// Already checked by cfg.Validate
+	s.ipRules, _ = ipfilter.Parse(cfg.AllowIP, cfg.DenyIP)
+	return s
+}
+
+// Start opens the server's ports and serves agents, visitors and the admin
+// API in the background until Shutdown
+func (s *Server) Start() (err error) {
+	// Open all ports first, so conflicts are reported before anything runs
+	bound, err := bindListeners(s.config)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			bound.Close()
+		}
+	}()
+
+	// Load TLS certificates
+	if err := s.ensureCertificate(); err != nil {
+		return err
+	}
+	s.certs, err = newCertLoader(s.config.CertFile, s.config.KeyFile)
+	if err != nil {
+		return err
+	}
+	log.Printf("Certificate pin (for the agents' -pin-sha256): %s", certs.PinSHA256(s.certs.Leaf()))
+
+	tlsConfig := &tls.Config{
+		GetCertificate: s.certs.GetCertificate,
+		NextProtos:     []string{protocol.ALPN},
+	}
+	s.config.TLS.Apply(tlsConfig)
+	log.Printf("TLS policy: %s", &s.config.TLS)
+	log.Printf("QUIC: %s", &s.config.QUIC)
+	if s.config.ClientCA != "" {
+		tlsConfig.ClientCAs, err = loadClientCAs(s.config.ClientCA)
+		if err != nil {
+			return err
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		log.Printf("Requiring client certificates signed by %s", s.config.ClientCA)
+	}
+
+	if !s.ipRules.Empty() {
+		log.Printf("Visitor IP rules for all tunnels: %s", s.ipRules)
+	}
+	if s.config.StickySessions {
+		log.Printf("Agents sharing a tunnel name get new visitors by %s, then keep them", s.config.Balance)
+	} else {
+		log.Printf("Agents sharing a tunnel name get requests by %s", s.config.Balance)
+	}
+
+	if s.config.State != "" {
+		state, err := store.OpenFile(s.config.State)
+		if err != nil {
+			return err
+		}
+		s.store = state
+		reservations, _ := state.Reservations()
+		log.Printf("Loaded state from %s: %d reservations", s.config.State, len(reservations))
+	} else {
+		s.store = store.NewMemory()
+	}
+	defer func() {
+		if err != nil {
+			s.store.Close()
+		}
+	}()
+
+	if len(s.config.ClusterPeers) > 0 {
+		s.cluster = s.newCluster(s.config.ClusterPeers, s.config.ClusterSecret)
+		log.Printf("Proxying visitors of tunnels held by cluster peers %s", strings.Join(s.config.ClusterPeers, ", "))
+	}
+
+	if s.config.ErrorPages != "" {
+		s.errorPages, err = loadErrorPages(s.config.ErrorPages)
+		if err != nil {
+			return err
+		}
+		log.Printf("Serving error pages from %s", s.config.ErrorPages)
+	}
+
+	if s.config.AccessLog != "" {
+		s.access, err = accesslog.Open(s.config.AccessLog)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.config.AuditLog != "" {
+		s.audit, err = auditlog.Open(s.config.AuditLog, s.config.AuditLogMaxSize, s.config.AuditLogMaxBackups)
+		if err != nil {
+			s.access.Close()
+			return err
+		}
+		log.Printf("Writing the audit log to %s", s.config.AuditLog)
+	}
+
+	// With -single-port, HTTP/3 visitors arrive on the agents' listener
+	handler := s.publicHandler()
+	listenerTLS := tlsConfig
+	if s.config.SinglePort {
+		s.h3 = s.newHTTP3Server(handler)
+		listenerTLS = s.sharedTLSConfig(tlsConfig, s.h3.TLSConfig)
+	}
+
+	// Start QUIC listener for agent connections
+	quicConfig := s.config.QUIC.Apply(nil)
+	quicConfig.Allow0RTT = s.config.ZeroRTT
+	listener, err := quic.ListenEarly(bound.control, listenerTLS, quicConfig)
+	if err != nil {
+		s.access.Close()
+		s.audit.Close()
+		return fmt.Errorf("failed to start QUIC listener: %w", err)
+	}
+	s.bound = bound
+
+	if s.config.OTLPEndpoint != "" {
+		s.stopTracing, err = tracing.Setup(context.Background(), s.config.OTLPEndpoint, "mt_server", "")
+		if err != nil {
+			log.Printf("⚠ Tracing disabled: %v", err)
+		} else {
+			log.Printf("Exporting traces to %s", s.config.OTLPEndpoint)
+		}
+	}
+
+	log.Printf("Server listening on %s", s.config.ControlAddr)
+	log.Printf("Waiting for agent connections...")
+
+	// Start HTTP servers for incoming requests
+	if bound.http3 != nil {
+		s.h3 = s.newHTTP3Server(handler)
+		s.serve("HTTP/3", func() error { return s.serveHTTP3(bound.http3) })
+	}
+	if bound.tls != nil {
+		s.serve("TLS passthrough", func() error { return s.servePassthrough(bound.tls) })
+	}
+	s.startHTTPServer(bound.data, handler)
+
+	// Start admin API
+	s.startAdminServer(bound.admin)
+
+	if bound.metrics != nil {
+		s.startMetricsServer(bound.metrics)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stop = cancel
+	go s.certs.watch(ctx)
+	s.accepting.Store(true)
+	go s.acceptAgents(ctx, listener)
+	return nil
+}
+
+// acceptAgents accepts QUIC connections until ctx is cancelled: agents, and
+// HTTP/3 visitors with -single-port
+func (s *Server) acceptAgents(ctx context.Context, listener *quic.EarlyListener) {
+	defer listener.Close()
+	defer s.accepting.Store(false)
+	for {
+		conn, err := listener.Accept(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, quic.ErrServerClosed) {
+			log.Printf("QUIC listener closed: %v", err)
+			return
+		}
+		if err != nil {
+			log.Printf("Error accepting connection: %v", err)
+			continue
+		}
+		if conn.ConnectionState().TLS.NegotiatedProtocol == http3.NextProtoH3 {
+			// Requests in 0-RTT could be replayed to the tunnels
+			go func() {
+				select {
+				case <-conn.HandshakeComplete():
+					s.h3.ServeQUICConn(conn)
+				case <-conn.Context().Done():
+				}
+			}()
+			continue
+		}
+		s.conns.Store(conn, struct{}{})
+		context.AfterFunc(conn.Context(), func() { s.conns.Delete(conn) })
+		go s.handleAgentConnection(conn)
+	}
+}
+
+// serve runs a listener's serve loop in the background, reporting how it
+// failed to Run
+func (s *Server) serve(name string, serve func() error) {
+	go func() {
+		err := serve()
+		if err == nil || errors.Is(err, http.ErrServerClosed) {
+			return
+		}
+		log.Printf("%s server error: %v", name, err)
+		select {
+		case s.failed <- fmt.Errorf("%s server failed: %w", name, err):
+		default:
+		}
+	}()
+}
+
+// Shutdown stops the server: it stops accepting agents and visitors, waits
+// for visitor requests in flight until ctx is done, then disconnects the
+// agents and closes the ports
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.stop == nil {
+		return nil
+	}
+	s.stop()
+
+	var errs []error
+	for _, server := range s.servers {
+		if err := server.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if s.h3 != nil {
+		s.h3.Close()
+	}
+	s.conns.Range(func(key, _ any) bool {
+		key.(quic.Connection).CloseWithError(quic.ApplicationErrorCode(protocol.ErrCodeNone), "server shutting down")
+		return true
+	})
+	s.bound.Close()
+	s.access.Close()
+	s.audit.Close()
+	if err := s.store.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if s.stopTracing != nil {
+		if err := s.stopTracing(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to flush traces: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// shutdownTimeout bounds how long Run waits for visitor requests in flight
+const shutdownTimeout = 30 * time.Second
+
+// Run starts the server and serves until ctx is cancelled or a listener
+// fails, then shuts it down, giving visitor requests in flight
+// shutdownTimeout to finish
+func (s *Server) Run(ctx context.Context) error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+	var err error
+	select {
+	case <-ctx.Done():
+		log.Printf("Shutting down...")
+	case err = <-s.failed:
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if serr := s.Shutdown(shutdownCtx); serr != nil && err == nil {
+		err = fmt.Errorf("failed to shut down: %w", serr)
+	}
+	return err
+}
+
+func (s *Server) handleAgentConnection(conn quic.EarlyConnection) {
+	log.Printf("New connection from %s, waiting for stream...", conn.RemoteAddr())
+
+	// Accept stream opened by the agent with timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		log.Printf("Error accepting stream: %v", err)
+		log.Printf("This might be a QUIC handshake issue. Connection state: %v", conn.Context().Err())
+		return
+	}
+	defer stream.Close()
+
+	log.Printf("Stream accepted from %s", conn.RemoteAddr())
+
+	// Read hello message from agent
+	reader := protocol.NewReader(stream)
+	reader.SetMaxSize(protocol.MaxHelloSize)
+	helloMsg, err := reader.ReadMessage()
+	if err != nil {
+		log.Printf("Error reading hello message: %v", err)
+		return
+	}
+
+	// A hello sent with 0-RTT can be replayed by anyone who captured it, so
+	// act on it only once the handshake shows the agent is there
+	select {
+	case <-conn.HandshakeComplete():
+	case <-conn.Context().Done():
+		log.Printf("Error completing handshake with %s: %v", conn.RemoteAddr(), context.Cause(conn.Context()))
+		return
+	case <-ctx.Done():
+		log.Printf("Error completing handshake with %s: timed out", conn.RemoteAddr())
+		return
+	}
+	if conn.ConnectionState().Used0RTT {
+		log.Printf("Hello from %s arrived with 0-RTT", conn.RemoteAddr())
+	}
+
+	if helloMsg.Type == protocol.MsgTypePoll {
+		s.handlePoll(conn, stream, helloMsg)
+		return
+	}
+
+	if helloMsg.Type != protocol.MsgTypeHello {
+		log.Printf("Expected hello message, got %s", helloMsg.Type)
+		return
+	}
+
+	var hello protocol.HelloPayload
+	if err := json.Unmarshal(helloMsg.Payload, &hello); err != nil {
+		log.Printf("Error parsing hello message: %v", err)
+		return
+	}
+
+	log.Printf("Received hello from agent %q on %s", hello.UserAgent, hello.Hostname)
+	reader.SetMaxSize(s.config.MaxMessageSize)
+	reader.SetMaxReassembledSize(s.config.MaxReassembledSize)
+
+	// Agents with a client certificate are named after it unless they ask
+	// for one of their own names
+	identity := connIdentity(conn)
+	if identity != "" {
+		log.Printf("Agent authenticated as %q", identity)
+		if hello.Name == "" {
+			hello.Name = identityName(identity)
+		}
+	}
+
+	// Only a digest of the takeover secret is kept, out of the admin API
+	var takeoverKey []byte
+	if hello.TakeoverSecret != "" {
+		sum := sha256.Sum256([]byte(hello.TakeoverSecret))
+		takeoverKey = sum[:]
+		hello.TakeoverSecret = ""
+	}
+	// Agents with a token get its first reserved name unless they ask for one.
+	// The token is only checked here, and isn't listed with the agent
+	digest, knownToken := s.helloToken(hello)
+	hello.Token = ""
+	if hello.Name == "" {
+		hello.Name = s.defaultName(digest)
+	}
+
+	// The offline page is served from s.offline, not listed with the agent
+	offlinePage := hello.OfflinePage
+	hello.OfflinePage = ""
+
+	// Store client connection under the requested name if it is free,
+	// otherwise under a random ID
+	clientInfo := &ClientInfo{
+		conn:        conn,
+		stream:      stream,
+		remoteAddr:  conn.RemoteAddr().String(),
+		hello:       hello,
+		identity:    identity,
+		takeoverKey: takeoverKey,
+		connectedAt: time.Now(),
+		caps:        protocol.NegotiateCapabilities(hello),
+	}
+	if clientInfo.caps.Has(protocol.CapCompression) {
+		clientInfo.compression = protocol.NegotiateCompression(hello.Compression)
+	}
+	clientInfo.lastSeen.Store(clientInfo.connectedAt.UnixNano())
+	maxConcurrent := s.config.MaxConcurrent
+	if hello.MaxConcurrent > 0 && (maxConcurrent == 0 || hello.MaxConcurrent < maxConcurrent) {
+		maxConcurrent = hello.MaxConcurrent
+	}
+	clientInfo.limit = newLimiter(maxConcurrent, s.config.QueueSize, s.config.QueueTimeout)
+	clientInfo.inspect = newInspectLog(s.config.InspectRequests, s.config.InspectBodyBytes)
+	if filter := hello.IPFilter; filter != nil {
+		rules, err := ipfilter.Parse(filter.Allow, filter.Deny)
+		if err != nil {
+			s.reject(clientInfo, protocol.RejectPayload{Message: fmt.Sprintf("invalid IP filter: %v", err)})
+			return
+		}
+		clientInfo.ipRules = rules
+	}
+	if hello.TLSPassthrough && (hello.BasicAuth != nil || hello.OAuth != nil) {
+		s.reject(clientInfo, protocol.RejectPayload{Message: "TLS passthrough can't be combined with visitor logins, which the server can't ask for on connections it doesn't decrypt"})
+		return
+	}
+	if identity != "" {
+		if rejection := checkIdentityNames(identity, hello); rejection != nil {
+			s.reject(clientInfo, *rejection)
+			return
+		}
+	}
+	if !knownToken {
+		s.reject(clientInfo, protocol.RejectPayload{Message: "unknown token: ask the server's operator for a reservation"})
+		return
+	}
+	if s.config.RequireSigning && !clientInfo.caps.Has(protocol.CapSigning) {
+		s.reject(clientInfo, protocol.RejectPayload{Message: "this server only accepts signed messages: start the agent with -token and -sign"})
+		return
+	}
+	if rejection := s.checkReservations(digest, hello); rejection != nil {
+		s.reject(clientInfo, *rejection)
+		return
+	}
+	clientInfo.tokenDigest = digest
+	err = s.agentAllowed(AgentInfo{
+		Name:       hello.Name,
+		Tunnels:    hello.Tunnels,
+		Identity:   identity,
+		RemoteAddr: clientInfo.remoteAddr,
+		Hostname:   hello.Hostname,
+		Version:    hello.Version,
+		Labels:     hello.Labels,
+	})
+	if err != nil {
+		s.reject(clientInfo, protocol.RejectPayload{Message: err.Error()})
+		return
+	}
+	var clientID string
+	var nameWarning *protocol.Warning
+	var tookOver bool
+	if hello.Takeover {
+		var rejection *protocol.RejectPayload
+		tookOver, rejection = s.takeOver(hello.Name, clientInfo)
+		if rejection != nil {
+			s.reject(clientInfo, *rejection)
+			return
+		}
+	}
+	if tookOver {
+		clientID = hello.Name
+	} else if len(hello.Tunnels) > 0 {
+		var rejection *protocol.RejectPayload
+		clientID, rejection = s.registerTunnels(clientInfo)
+		if rejection != nil {
+			s.reject(clientInfo, *rejection)
+			return
+		}
+	} else if hello.Standby && s.registerStandby(hello.Name, clientInfo) {
+		clientID = hello.Name
+	} else if hello.Balance && s.joinPool(hello.Name, clientInfo) {
+		clientID = hello.Name
+	} else {
+		clientID, nameWarning = s.registerClient(clientInfo)
+	}
+	defer s.unregisterClient(clientID, clientInfo)
+	s.pollers.Delete(clientID)
+	s.releaseVisitors(append([]string{clientID}, clientInfo.extraTunnels...)...)
+	inbox := clientID == hello.Name && s.wantsInbox(hello)
+	if inbox && !clientInfo.standby.Load() {
+		s.openInbox(clientID, clientInfo)
+	}
+	defer s.closeInbox(clientID, clientInfo)
+	if clientID == hello.Name && !clientInfo.standby.Load() {
+		names := append([]string{clientID}, clientInfo.extraTunnels...)
+		s.storeOfflinePage(names, offlinePage)
+		s.tunnelConnected(names)
+	}
+
+	tunnelURL := s.config.TunnelURL(clientID)
+	clientInfo.tunnelURL = tunnelURL
+
+	if clientInfo.standby.Load() {
+		log.Printf("Standby agent connected for %s", clientID)
+	} else {
+		log.Printf("New agent connected: %s", clientID)
+	}
+	s.auditAgent(auditlog.AgentConnected, clientID, clientInfo)
+	log.Printf("Tunnel URL: %s", tunnelURL)
+
+	// Send welcome message
+	welcome := protocol.WelcomePayload{
+		ProtocolVersion: protocol.ProtocolVersion,
+		Capabilities:    clientInfo.caps,
+		ClientID:        clientID,
+		TunnelURL:       tunnelURL,
+		Standby:         clientInfo.standby.Load(),
+		Compression:     clientInfo.compression,
+		BasicAuth:       hello.BasicAuth != nil,
+		OAuth:           hello.OAuth != nil && s.oauth != nil,
+		IPFilter:        hello.IPFilter != nil,
+		CORS:            hello.CORS != nil,
+		MaxConcurrent:   maxConcurrent,
+		Inbox:           inbox,
+		Balance:         clientInfo.pool != nil,
+		Takeover:        tookOver,
+		Features:        []string{protocol.FeatureHTTP, protocol.FeatureStats, protocol.FeatureAdminEvict},
+	}
+	if clientInfo.caps.Has(protocol.CapBinaryFraming) {
+		welcome.Framing = protocol.NegotiateFraming(hello.Framing)
+	}
+	welcome.MaxMessageSize = s.config.MaxMessageSize
+	for _, name := range clientInfo.extraTunnels {
+		url := s.config.TunnelURL(name)
+		log.Printf("Tunnel URL: %s", url)
+		welcome.Tunnels = append(welcome.Tunnels, protocol.TunnelGrant{Name: name, TunnelURL: url})
+	}
+	if lifetime := s.config.MaxTunnelLifetime; lifetime > 0 {
+		expiresAt := clientInfo.connectedAt.Add(lifetime)
+		welcome.ExpiresAt = &expiresAt
+		timer := time.AfterFunc(lifetime, func() {
+			log.Printf("Tunnel %s reached its maximum lifetime", clientID)
+			conn.CloseWithError(quic.ApplicationErrorCode(protocol.ErrCodeExpired), "tunnel expired")
+		})
+		defer timer.Stop()
+	}
+
+	welcome.Warnings = s.welcomeWarnings(welcome)
+	if nameWarning != nil {
+		welcome.Warnings = append(welcome.Warnings, *nameWarning)
+	}
+	if hello.TLSPassthrough && clientInfo.caps.Has(protocol.CapPassthrough) && s.config.PassthroughAddr != "" && !clientInfo.standby.Load() {
+		welcome.TLSPassthrough = s.passthroughHost(clientID)
+	}
+	if clientInfo.caps.Has(protocol.CapSigning) {
+		welcome.SigningNonce = make([]byte, protocol.SigningNonceSize)
+		rand.Read(welcome.SigningNonce)
+	}
+
+	welcomeMsg, err := protocol.NewWelcomeMessage(welcome)
+	if err != nil {
+		log.Printf("Error creating welcome message: %v", err)
+		return
+	}
+
+	// The welcome itself is always JSON; everything after it, both ways,
+	// uses the negotiated framing
+	out := protocol.WriteOptions{
+		Framing:      welcome.Framing,
+		MaxFrameSize: hello.MaxMessageSize,
+		Continuation: welcome.Framing == protocol.FramingBinary && clientInfo.caps.Has(protocol.CapContinuation),
+	}
+	var verifier *protocol.Verifier
+	if clientInfo.caps.Has(protocol.CapSigning) {
+		raw, _ := hex.DecodeString(clientInfo.tokenDigest)
+		agentKey, serverKey := protocol.SigningKeys(raw, helloMsg.Payload, welcomeMsg.Payload)
+		out.Signer = protocol.NewSigner(serverKey)
+		verifier = protocol.NewVerifier(agentKey)
+	}
+	if err := clientInfo.sendWelcome(welcomeMsg, out); err != nil {
+		log.Printf("Error sending welcome message: %v", err)
+		return
+	}
+	reader.SetFraming(welcome.Framing)
+	reader.SetVerifier(verifier)
+
+	log.Printf("Welcome message sent to %s", clientID)
+
+	// Read responses and heartbeats until the agent goes away, and expire it
+	// if it stops sending heartbeats
+	go clientInfo.readLoop(clientID, reader)
+	clientInfo.watchHeartbeats(clientID, s.config.HeartbeatTimeout)
+	log.Printf("Agent disconnected: %s", clientID)
+	s.auditAgent(auditlog.AgentDisconnected, clientID, clientInfo)
+}
+
+// registerClient stores the client under its requested name, falling back
+// to a random ID (with a warning for the agent) when the name is invalid or
+// already in use
+func (s *Server) registerClient(clientInfo *ClientInfo) (string, *protocol.Warning) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := clientInfo.hello.Name
+	if name != "" {
+		if !protocol.ValidName(name) {
+			clientID := uuid.New().String()
+			s.clients.Store(clientID, clientInfo)
+			return clientID, &protocol.Warning{
+				Code:    protocol.WarnNameNotReserved,
+				Message: fmt.Sprintf("name %q is invalid, using a random one", name),
+			}
+		}
+		if _, loaded := s.clients.LoadOrStore(name, clientInfo); !loaded {
+			return name, nil
+		}
+	}
+
+	clientID := uuid.New().String()
+	s.clients.Store(clientID, clientInfo)
+	if name != "" {
+		return clientID, &protocol.Warning{
+			Code:    protocol.WarnNameNotReserved,
+			Message: fmt.Sprintf("name %q is in use, using a random one", name),
+		}
+	}
+	return clientID, nil
+}
+
+// isTunnelID reports whether a path segment addresses a tunnel: a connected
+// or sleeping tunnel name, or anything that looks like a generated UUID
+func (s *Server) isTunnelID(segment string) bool {
+	// Generated IDs are UUIDs (contain hyphens and are ~36 chars)
+	if len(segment) > 30 && strings.Contains(segment, "-") {
+		return true
+	}
+	if _, ok := s.clients.Load(segment); ok {
+		return true
+	}
+	if _, ok := s.inboxes.Load(segment); ok {
+		return true
+	}
+	if _, ok := s.waiting.Load(segment); ok {
+		return true
+	}
+	if _, ok := s.offline.Load(segment); ok {
+		return true
+	}
+	_, ok := s.pollers.Load(segment)
+	return ok
+}
+
+// welcomeWarnings lists the conditions an agent should be told about when
+// it connects
+func (s *Server) welcomeWarnings(welcome protocol.WelcomePayload) []protocol.Warning {
+	var warnings []protocol.Warning
+	if s.config.Notice != "" {
+		warnings = append(warnings, protocol.Warning{
+			Code:    protocol.WarnServerNotice,
+			Message: s.config.Notice,
+		})
+	}
+	if welcome.ExpiresAt != nil {
+		warnings = append(warnings, protocol.Warning{
+			Code:    protocol.WarnTunnelExpires,
+			Message: fmt.Sprintf("tunnel will be disconnected after %s", s.config.MaxTunnelLifetime),
+		})
+	}
+	if q := welcome.Quota; q != nil {
+		if q.RequestsLimit > 0 && q.RequestsUsed*10 >= q.RequestsLimit*9 {
+			warnings = append(warnings, protocol.Warning{
+				Code:    protocol.WarnQuotaLow,
+				Message: fmt.Sprintf("%d of %d requests used", q.RequestsUsed, q.RequestsLimit),
+			})
+		}
+		if q.BytesLimit > 0 && q.BytesUsed*10 >= q.BytesLimit*9 {
+			warnings = append(warnings, protocol.Warning{
+				Code:    protocol.WarnQuotaLow,
+				Message: fmt.Sprintf("%d of %d bytes used", q.BytesUsed, q.BytesLimit),
+			})
+		}
+	}
+	return warnings
+}
+
+// publicHandler returns the handler for visitor traffic, whichever
+// listener it arrives on
+func (s *Server) publicHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleHTTPRequest)
+	if s.oauth != nil {
+		mux.HandleFunc("GET "+config.OAuthCallbackPath, s.oauth.handleCallback)
+	}
+	return s.traceVisitors(s.filterVisitors(mux))
+}
+
+// startHTTPServer serves visitors on the TCP listener: over HTTP, or with
+// -single-port over HTTPS
+func (s *Server) startHTTPServer(ln net.Listener, handler http.Handler) {
+	if s.h3 != nil {
+		handler = s.advertiseHTTP3(handler)
+	}
+
+	// Oversized request headers are answered with 431 before reaching the
+	// handler, so they never have to fit into a protocol message
+	server := &http.Server{
+		Handler:        handler,
+		MaxHeaderBytes: s.config.MaxHeaderBytes,
+	}
+	// Cleartext HTTP/2 (h2c) next to HTTP/1, for gRPC clients
+	server.Protocols = new(http.Protocols)
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
+
+	if s.config.SinglePort {
+		server.Protocols.SetHTTP2(true)
+		server.TLSConfig = &tls.Config{GetCertificate: s.certs.GetCertificate}
+		s.config.TLS.Apply(server.TLSConfig)
+		log.Printf("HTTPS server listening on %s", s.config.HTTPAddr)
+		s.servers = append(s.servers, server)
+		s.serve("HTTPS", func() error { return server.ServeTLS(ln, "", "") })
+		return
+	}
+
+	log.Printf("HTTP server listening on %s", s.config.HTTPAddr)
+
+	s.servers = append(s.servers, server)
+	s.serve("HTTP", func() error { return server.Serve(ln) })
+}
+
+func (s *Server) handleHTTPRequest(w http.ResponseWriter, r *http.Request) {
+	// Extract client ID from path
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	parts := strings.SplitN(path, "/", 2)
+
+	var clientID string
+	var requestPath string
+	named := false // The path starts with the tunnel's name
+
+	// Check if first part names a tunnel. Status pages can be asked for
+	// whether or not the tunnel is known, and so can the tunnels of visitors
+	// proxied here by a cluster peer
+	statusPage := s.config.StatusPage && len(parts) > 1 && "/"+parts[1] == config.StatusPagePath
+	if tunnel, tunnelPath, ok := s.route(r); ok {
+		// The embedder's Router picked the tunnel
+		clientID, requestPath = tunnel, tunnelPath
+		parts, statusPage = nil, false
+	} else if len(parts) > 0 && (s.isTunnelID(parts[0]) || (statusPage || fromPeer(r)) && protocol.ValidName(parts[0]) || s.peerTunnel(r, parts[0])) {
+		// Path has tunnel prefix: /id/path
+		clientID, named = parts[0], true
+		requestPath = "/"
+		if len(parts) > 1 && parts[1] != "" {
+			requestPath = "/" + parts[1]
+		}
+	} else {
+		// No UUID prefix - try to route to the only connected agent
+		// This handles Next.js assets like /_next/static/...
+		foundClientID, count := s.soleAgent()
+		if count == 0 {
+			s.tunnelError(w, r, "", http.StatusServiceUnavailable, "No agents connected")
+			return
+		} else if count > 1 {
+			http.Error(w, "Multiple agents connected - please use full tunnel URL: http://server:port/<client-id>/path", http.StatusBadRequest)
+			return
+		}
+
+		clientID = foundClientID
+		requestPath = r.URL.Path
+	}
+
+	// Relative links only resolve under the tunnel with a trailing slash.
+	// Paths sent to the only agent have no tunnel prefix to add it to
+	if named && len(parts) == 1 && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		if base := s.config.TunnelBasePath(clientID); base != "/" {
+			target := base
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+	}
+
+	// Preserve query string
+	if r.URL.RawQuery != "" {
+		requestPath += "?" + r.URL.RawQuery
+	}
+
+	// Find the agent connection
+	val, ok := s.clients.Load(clientID)
+	if !ok {
+		if peer := s.clusterPeer(r, clientID); peer != nil {
+			s.proxyToPeer(w, r, clientID, peer)
+			return
+		}
+		if fromPeer(r) {
+			// The peer asking has it wrong, it will ask again
+			w.Header().Set(clusterMissHeader, "1")
+		}
+		if statusPage {
+			s.handleStatusPage(w, clientID, nil)
+			return
+		}
+		if s.bufferWebhook(w, r, clientID, requestPath, nil) {
+			return
+		}
+		if s.awaitAgent(r.Context(), clientID) {
+			s.handleHTTPRequest(w, r)
+			return
+		}
+		if !s.wakePoller(w, r, clientID) && !s.handleOffline(w, r, clientID) {
+			s.tunnelError(w, r, clientID, http.StatusNotFound, "Tunnel not found")
+		}
+		return
+	}
+
+	head := val.(*ClientInfo)
+	clientInfo := head
+	if head.pool != nil {
+		if member := s.pickMember(w, r, clientID, head.pool); member != nil {
+			clientInfo = member
+		}
+	}
+	if clientInfo.draining.Load() {
+		if s.bufferWebhook(w, r, clientID, requestPath, nil) {
+			return
+		}
+		s.tunnelError(w, r, clientID, http.StatusServiceUnavailable, "Tunnel is shutting down")
+		return
+	}
+	// Webhooks queue behind older buffered ones so that they arrive in order
+	if s.bufferWebhook(w, r, clientID, requestPath, clientInfo) {
+		return
+	}
+	if !s.visitorAllowed(clientInfo.ipRules, r) {
+		s.denyVisitor(w, r, clientID)
+		return
+	}
+	// Browsers send preflights without credentials, so they are answered
+	// before the visitor is asked to log in
+	if handleCORS(w, r, clientInfo.hello.CORS) {
+		return
+	}
+	if !clientInfo.authorizeVisitor(r) {
+		s.challengeVisitor(w, r, clientID)
+		return
+	}
+	var visitor string
+	if policy := clientInfo.hello.OAuth; policy != nil {
+		if s.oauth == nil {
+			http.Error(w, "Login is not configured on this server", http.StatusServiceUnavailable)
+			return
+		}
+		user, ok := s.oauth.authorize(w, r, policy.Allow, s.config.TunnelURL(clientID)+requestPath)
+		if !ok {
+			if user != "" {
+				s.auditVisitor(auditlog.AccessDenied, r, clientID, user, "login not allowed")
+			}
+			return
+		}
+		visitor = user
+	}
+	if !s.checkAuthorizer(w, r, clientID, requestPath) {
+		return
+	}
+	if statusPage && !head.hello.HideStatus {
+		s.handleStatusPage(w, clientID, head)
+		return
+	}
+	if clientInfo.localDown() != "" {
+		s.handleLocalDown(w, r, clientID)
+		return
+	}
+	if !s.checkQuota(w, r, clientID, clientInfo) {
+		return
+	}
+
+	// Record traffic statistics once the response is written
+	rec := newStatusRecorder(w)
+	inspection, w := clientInfo.inspect.begin(rec, r, requestPath)
+	var bytesIn int64
+	start := time.Now()
+	defer func() {
+		path, _, _ := strings.Cut(requestPath, "?")
+		clientInfo.stats.record(path, rec.status, bytesIn, rec.bytes)
+		clientInfo.inspect.finish(inspection, rec, bytesIn)
+		s.recordUsage(clientID, clientInfo, rec.status, bytesIn, rec.bytes)
+		s.recent.add(RequestRecord{
+			Time:       start,
+			TunnelID:   clientID,
+			Method:     r.Method,
+			Path:       requestPath,
+			Status:     rec.status,
+			Duration:   time.Since(start),
+			BytesIn:    bytesIn,
+			BytesOut:   rec.bytes,
+			RemoteAddr: r.RemoteAddr,
+		})
+		s.access.Log(accesslog.Entry{
+			Time:       start,
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			Path:       requestPath,
+			Proto:      r.Proto,
+			Status:     rec.status,
+			Bytes:      rec.bytes,
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+			TunnelID:   clientID,
+			Duration:   time.Since(start),
+		})
+	}()
+
+	// gRPC calls stream their bodies both ways on a stream of their own,
+	// others are forwarded whole
+	streaming := clientInfo.caps.Has(protocol.CapStreaming) && streamed(r)
+
+	// Read request body
+	var body []byte
+	var err error
+	if !streaming {
+		body, err = io.ReadAll(http.MaxBytesReader(w, r.Body, s.config.MaxRequestBody))
+		bytesIn = int64(len(body))
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			log.Printf("Rejected request to %s: body larger than %d bytes", clientID, tooLarge.Limit)
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		return
+	}
+
+	// Create HTTP request message
+	httpReq := protocol.HTTPRequest{
+		Method:  r.Method,
+		Path:    requestPath,
+		Tunnel:  clientID,
+		Headers: s.forwardHeaders(r, clientID, clientInfo.hello.BasicAuth != nil, visitor),
+		Body:    body,
+	}
+	if !s.pluginRequest(w, &httpReq) {
+		return
+	}
+
+	// Send request to agent and wait for its response
+	ctx := r.Context()
+	if s.config.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config.RequestTimeout)
+		defer cancel()
+	}
+	if err := clientInfo.limit.acquire(ctx); err != nil {
+		if errors.Is(err, context.Canceled) {
+			w.WriteHeader(499)
+			return
+		}
+		log.Printf("Turned away %s %s for %s: %v", r.Method, requestPath, clientID, err)
+		w.Header().Set("Retry-After", "1")
+		s.tunnelError(w, r, clientID, http.StatusServiceUnavailable, "Tunnel is busy, try again later")
+		return
+	}
+	ctx, span := startTunnelSpan(ctx, clientID, &httpReq)
+	if streaming {
+		bytesIn = s.forwardStream(ctx, w, r, clientInfo, clientID, httpReq)
+		clientInfo.limit.release()
+		tracing.End(span, rec.status, nil)
+		return
+	}
+	httpResp, err := clientInfo.roundTrip(ctx, httpReq)
+	clientInfo.limit.release()
+	tracing.End(span, httpResp.StatusCode, err)
+	if err != nil {
+		if errors.Is(err, errAgentDisconnected) {
+			clientInfo.stats.failures.Add(1)
+			s.tunnelError(w, r, clientID, http.StatusBadGateway, "Agent disconnected")
+		} else if errors.Is(err, protocol.ErrMessageTooLarge) {
+			log.Printf("Dropped request to %s for %s %s: %v", clientID, r.Method, requestPath, err)
+			s.tunnelError(w, r, clientID, http.StatusRequestEntityTooLarge, "Request too large for the tunnel")
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			clientInfo.stats.failures.Add(1)
+			s.tunnelError(w, r, clientID, http.StatusGatewayTimeout, "Tunnel request timed out")
+		} else if errors.Is(err, context.Canceled) {
+			// The visitor went away, record it the way nginx does
+			w.WriteHeader(499)
+		} else {
+			clientInfo.stats.failures.Add(1)
+			s.tunnelError(w, r, clientID, http.StatusBadGateway, "Error forwarding request to agent")
+		}
+		return
+	}
+	if httpResp.Error == protocol.ForwardErrDropped {
+		// The agent's chaos mode asks for the connection to be cut, which
+		// net/http does without logging when the handler panics this way
+		panic(http.ErrAbortHandler)
+	}
+
+	err = httpResp.DecompressBody(s.config.MaxResponseBody)
+	if err == nil && int64(len(httpResp.Body)) > s.config.MaxResponseBody {
+		err = protocol.ErrBodyTooLarge
+	}
+	if errors.Is(err, protocol.ErrBodyTooLarge) {
+		log.Printf("Dropped response from %s for %s %s: body exceeds the %d byte limit", clientID, r.Method, requestPath, s.config.MaxResponseBody)
+		s.tunnelError(w, r, clientID, http.StatusBadGateway, "Response body too large")
+		return
+	} else if err != nil {
+		log.Printf("Error reading response from %s: %v", clientID, err)
+		s.tunnelError(w, r, clientID, http.StatusBadGateway, "Invalid response from agent")
+		return
+	}
+	if err := s.pluginResponse(&httpReq, &httpResp); err != nil {
+		log.Printf("Error processing response from %s for %s %s: %v", clientID, r.Method, requestPath, err)
+		s.tunnelError(w, r, clientID, http.StatusBadGateway, "Error processing response")
+		return
+	}
+	httpResp.Headers = httpheader.Normalize(httpResp.Headers)
+	rewriter := s.newURLRewriter(clientID, httpReq.Headers, clientInfo.hello.LocalHosts)
+	rewriter.rewriteHeaders(httpResp.Headers)
+	if !clientInfo.hello.RawCookies {
+		rewriter.rewriteCookies(httpResp.Headers)
+	}
+	if clientInfo.hello.CORS != nil {
+		fitCORSHeaders(httpResp.Headers, clientInfo.hello.CORS)
+	}
+	s.config.ResponseHeaders.Apply(httpResp.Headers, clientID)
+
+	// Under a path prefix, fix the links of HTML pages so that they keep
+	// working. Subdomain tunnels need no rewriting
+	if rewriter.basePath != "/" {
+		s.rewritePage(&httpResp, rewriter)
+	}
+
+	// Remove Content-Length header as we may have modified the body
+	// Go will set it automatically
+	delete(httpResp.Headers, "Content-Length")
+	httpheader.RemoveHopByHop(httpResp.Headers)
+
+	writeResponse(w, httpResp)
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"log"
+
+	"minitunnel/internal/protocol"
+)
+
+// registerStandby parks a client as hot standby for the tunnel called name.
+// It returns false if there is no primary to stand in for, the primary has
+// another owner (see sameOwner) or the tunnel already has a standby, in
+// which case the client registers normally
+func (s *Server) registerStandby(name string, clientInfo *ClientInfo) bool {
+	if !protocol.ValidName(name) {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Agents sharing a name don't need a standby
+	val, ok := s.clients.Load(name)
+	if !ok || val.(*ClientInfo).pool != nil {
+		return false
+	}
+	// Being promoted takes the tunnel over, which only its owner may
+	if primary := val.(*ClientInfo); !sameOwner(primary, clientInfo) {
+		log.Printf("⚠ Agent on %s can't stand by for %s: it has a different client certificate or -takeover-secret than the primary", clientInfo.remoteAddr, name)
+		return false
+	}
+	clientInfo.standby.Store(true)
+	if _, loaded := s.standbys.LoadOrStore(name, clientInfo); loaded {
+		clientInfo.standby.Store(false)
+		return false
+	}
+	return true
+}
+
+// unregisterClient removes a disconnected client. When a primary goes away
+// its standby, if any, takes over the tunnel immediately. Otherwise its
+// visitors may wait for it to come back, see holdVisitors
+func (s *Server) unregisterClient(clientID string, clientInfo *ClientInfo) {
+	defer s.holdVisitors(clientID, clientInfo)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if clientInfo.standby.Load() {
+		s.standbys.CompareAndDelete(clientID, clientInfo)
+		return
+	}
+	if clientInfo.pool != nil {
+		s.leavePool(clientID, clientInfo)
+		return
+	}
+	for _, name := range clientInfo.extraTunnels {
+		s.clients.CompareAndDelete(name, clientInfo)
+	}
+	if !s.clients.CompareAndDelete(clientID, clientInfo) {
+		return
+	}
+
+	val, ok := s.standbys.LoadAndDelete(clientID)
+	if !ok {
+		return
+	}
+	standby := val.(*ClientInfo)
+	standby.standby.Store(false)
+	s.clients.Store(clientID, standby)
+	log.Printf("Promoted standby agent for %s", clientID)
+	if s.wantsInbox(standby.hello) {
+		s.openInbox(clientID, standby)
+	}
+
+	go func() {
+		if err := standby.send(protocol.NewPromoteMessage()); err != nil {
+			log.Printf("Error notifying promoted agent %s: %v", clientID, err)
+		}
+	}()
+}
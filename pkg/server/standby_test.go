@@ -0,0 +1,48 @@
+package server
+
+import (
+	"crypto/sha256"
+	"testing"
+)
+
+func TestRegisterStandby(t *testing.T) {
+	key := func(secret string) []byte {
+		sum := sha256.Sum256([]byte(secret))
+		return sum[:]
+	}
+	tests := []struct {
+		name      string
+		primary   *ClientInfo // Nil for none
+		standby   *ClientInfo
+		hasOther  bool // The tunnel already has a standby
+		wantParks bool
+	}{
+		{"no primary", nil, &ClientInfo{takeoverKey: key("s")}, false, false},
+		{"same secret", &ClientInfo{takeoverKey: key("s")}, &ClientInfo{takeoverKey: key("s")}, false, true},
+		{"same identity", &ClientInfo{identity: "api"}, &ClientInfo{identity: "api"}, false, true},
+		{"other secret", &ClientInfo{takeoverKey: key("s")}, &ClientInfo{takeoverKey: key("t")}, false, false},
+		{"other identity", &ClientInfo{identity: "api"}, &ClientInfo{identity: "web"}, false, false},
+		{"no proof", &ClientInfo{}, &ClientInfo{}, false, false},
+		{"secret without primary's", &ClientInfo{}, &ClientInfo{takeoverKey: key("s")}, false, false},
+		{"shared name", &ClientInfo{takeoverKey: key("s"), pool: &pool{}}, &ClientInfo{takeoverKey: key("s")}, false, false},
+		{"standby taken", &ClientInfo{takeoverKey: key("s")}, &ClientInfo{takeoverKey: key("s")}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{}
+			if tt.primary != nil {
+				s.clients.Store("api", tt.primary)
+			}
+			if tt.hasOther {
+				s.standbys.Store("api", &ClientInfo{})
+			}
+			if got := s.registerStandby("api", tt.standby); got != tt.wantParks {
+				t.Fatalf("registerStandby = %v, want %v", got, tt.wantParks)
+			}
+			val, _ := s.standbys.Load("api")
+			if parked := val == tt.standby; parked != tt.wantParks || tt.standby.standby.Load() != tt.wantParks {
+				t.Errorf("parked = %v, standby flag = %v, want %v", parked, tt.standby.standby.Load(), tt.wantParks)
+			}
+		})
+	}
+}
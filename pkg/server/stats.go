@@ -0,0 +1,192 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TunnelStats holds traffic counters for a single tunnel, updated by the
+// HTTP handler as it proxies requests
+type TunnelStats struct {
+	requests atomic.Int64
+	errors   atomic.Int64
+	bytesIn  atomic.Int64 // Request bodies received from visitors
+	bytesOut atomic.Int64 // Response bodies sent to visitors
+	failures atomic.Int64 // Requests the tunnel itself failed: agent gone, timed out or broken
+
+	requestSizes  sizeHistogram
+	responseSizes sizeHistogram
+	paths         pathStats
+}
+
+// StatsSnapshot is the JSON representation of a tunnel's statistics
+type StatsSnapshot struct {
+	TunnelID      string    `json:"tunnel_id"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	UptimeSeconds float64   `json:"uptime_seconds"`
+	Requests      int64     `json:"requests"`
+	Errors        int64     `json:"errors"`
+	ErrorRate     float64   `json:"error_rate"`
+	BytesIn       int64     `json:"bytes_in"`
+	BytesOut      int64     `json:"bytes_out"`
+
+	RequestSizes  HistogramSnapshot `json:"request_sizes"`
+	ResponseSizes HistogramSnapshot `json:"response_sizes"`
+}
+
+// record accounts for a finished request. Proxy failures and 5xx responses
+// from the local service both count as errors
+func (s *TunnelStats) record(path string, status int, bytesIn, bytesOut int64) {
+	s.requests.Add(1)
+	if status >= 500 {
+		s.errors.Add(1)
+	}
+	s.bytesIn.Add(bytesIn)
+	s.bytesOut.Add(bytesOut)
+	s.requestSizes.observe(bytesIn)
+	s.responseSizes.observe(bytesOut)
+	s.paths.record(path, status, bytesIn+bytesOut)
+}
+
+// snapshot returns a consistent-enough copy of the counters for reporting
+func (s *TunnelStats) snapshot(tunnelID string, connectedAt time.Time) StatsSnapshot {
+	snap := StatsSnapshot{
+		TunnelID:      tunnelID,
+		ConnectedAt:   connectedAt,
+		UptimeSeconds: time.Since(connectedAt).Seconds(),
+		Requests:      s.requests.Load(),
+		Errors:        s.errors.Load(),
+		BytesIn:       s.bytesIn.Load(),
+		BytesOut:      s.bytesOut.Load(),
+		RequestSizes:  s.requestSizes.snapshot(),
+		ResponseSizes: s.responseSizes.snapshot(),
+	}
+	if snap.Requests > 0 {
+		snap.ErrorRate = float64(snap.Errors) / float64(snap.Requests)
+	}
+	return snap
+}
+
+// sizeBuckets are the upper bounds of the body size histograms, in bytes
+var sizeBuckets = [...]int64{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+
+// sizeHistogram counts body sizes into sizeBuckets
+type sizeHistogram struct {
+	counts [len(sizeBuckets) + 1]atomic.Int64 // The last counts sizes above every bucket
+	sum    atomic.Int64
+}
+
+func (h *sizeHistogram) observe(size int64) {
+	i, _ := slices.BinarySearch(sizeBuckets[:], size)
+	h.counts[i].Add(1)
+	h.sum.Add(size)
+}
+
+// HistogramSnapshot is the JSON representation of a size histogram.
+// Bucket counts are cumulative, Count includes sizes above the last bucket
+type HistogramSnapshot struct {
+	Buckets []HistogramBucket `json:"buckets"`
+	Count   int64             `json:"count"`
+	Sum     int64             `json:"sum"`
+}
+
+// HistogramBucket counts the observations of at most LE bytes
+type HistogramBucket struct {
+	LE    int64 `json:"le"`
+	Count int64 `json:"count"`
+}
+
+func (h *sizeHistogram) snapshot() HistogramSnapshot {
+	snap := HistogramSnapshot{
+		Buckets: make([]HistogramBucket, len(sizeBuckets)),
+		Sum:     h.sum.Load(),
+	}
+	for i := range h.counts {
+		snap.Count += h.counts[i].Load()
+		if i < len(sizeBuckets) {
+			snap.Buckets[i] = HistogramBucket{LE: sizeBuckets[i], Count: snap.Count}
+		}
+	}
+	return snap
+}
+
+// statusRecorder captures the status code and body size written to a
+// ResponseWriter
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController flush streamed responses
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// RequestRecord summarizes a proxied request for the dashboard
+type RequestRecord struct {
+	Time       time.Time     `json:"time"`
+	TunnelID   string        `json:"tunnel_id"`
+	Method     string        `json:"method"`
+	Path       string        `json:"path"`
+	Status     int           `json:"status"`
+	Duration   time.Duration `json:"duration_ns"`
+	BytesIn    int64         `json:"bytes_in"`
+	BytesOut   int64         `json:"bytes_out"`
+	RemoteAddr string        `json:"remote_addr"`
+}
+
+// requestLog keeps the most recent requests across all tunnels
+type requestLog struct {
+	mu      sync.Mutex
+	records []RequestRecord
+	next    int
+	full    bool
+}
+
+func newRequestLog(size int) *requestLog {
+	return &requestLog{records: make([]RequestRecord, size)}
+}
+
+func (l *requestLog) add(rec RequestRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records[l.next] = rec
+	l.next = (l.next + 1) % len(l.records)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// recent returns the logged requests, newest first
+func (l *requestLog) recent() []RequestRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.next
+	if l.full {
+		n = len(l.records)
+	}
+	out := make([]RequestRecord, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, l.records[(l.next-i+len(l.records))%len(l.records)])
+	}
+	return out
+}
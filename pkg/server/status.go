@@ -0,0 +1,72 @@
+package server
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+)
+
+var statusTemplate = template.Must(template.New("status.html").Funcs(template.FuncMap{
+	"duration": formatDuration,
+}).ParseFS(webFS, "web/status.html"))
+
+// statusData is rendered by the status page template
+type statusData struct {
+	Name      string
+	Now       time.Time
+	Connected bool
+	Draining  bool // Agent is shutting down
+	LocalDown bool // The agent's local service fails its health check
+	Agents    int  // Agents serving the tunnel, more than one with -balance
+	Standby   bool // A standby agent is ready to take over
+
+	ConnectedAt   time.Time
+	LastHeartbeat time.Time
+
+	RecentRequests int64 // Over the last 10 to 20 minutes
+	RecentErrors   int64 // 5xx responses among RecentRequests, from the app or the tunnel
+	Failures       int64 // Requests the tunnel failed since the agent connected
+
+	Asleep   bool // The agent polls and is woken by traffic
+	Inbox    bool // Webhooks are buffered while the agent is offline
+	Buffered int  // Webhooks waiting for the agent
+}
+
+// handleStatusPage describes the health of a tunnel to visitors, so that
+// someone hitting a broken URL can tell whether the tunnel or the app behind
+// it is at fault. clientInfo is nil if no agent is connected. Offline tunnels
+// answer 503 so that the page can be probed by monitoring too
+func (s *Server) handleStatusPage(w http.ResponseWriter, name string, clientInfo *ClientInfo) {
+	data := statusData{Name: name, Now: time.Now()}
+	if clientInfo != nil {
+		data.Connected = true
+		data.Draining = clientInfo.draining.Load()
+		data.LocalDown = clientInfo.localDown() != ""
+		data.Agents = max(clientInfo.poolSize(), 1)
+		data.ConnectedAt = clientInfo.connectedAt
+		data.LastHeartbeat = clientInfo.lastHeartbeat()
+		data.RecentRequests, data.RecentErrors = clientInfo.stats.paths.totals()
+		data.Failures = clientInfo.stats.failures.Load()
+		_, data.Standby = s.standbys.Load(name)
+	}
+	if val, ok := s.pollers.Load(name); ok && val.(*poller).active() {
+		data.Asleep = true
+	}
+	if val, ok := s.inboxes.Load(name); ok {
+		b := val.(*inbox)
+		b.mu.Lock()
+		data.Inbox = true
+		data.Buffered = len(b.queue)
+		b.mu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if !data.Connected || data.Draining || data.LocalDown {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := statusTemplate.Execute(w, data); err != nil {
+		log.Printf("Error rendering status page: %v", err)
+	}
+}
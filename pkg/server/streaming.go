@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"minitunnel/internal/httpheader"
+	"minitunnel/internal/protocol"
+
+	"github.com/quic-go/quic-go"
+)
+
+// streamed reports whether a request is a call whose bodies stream both
+// ways, which can't wait for the whole request body. gRPC runs over HTTP/2
+// only
+func streamed(r *http.Request) bool {
+	return r.ProtoMajor >= 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// forwardStream forwards a streamed call to the agent on a call stream of
+// its own, see protocol.CapStreaming. The request body is passed on as the
+// visitor sends it and the response body as the agent sends it, followed
+// by the response trailers. ctx bounds the wait for the response head;
+// after that the call lasts as long as both sides keep it open. It returns
+// the request body bytes sent
+func (s *Server) forwardStream(ctx context.Context, w http.ResponseWriter, r *http.Request, c *ClientInfo, clientID string, req protocol.HTTPRequest) int64 {
+	c.active.Add(1)
+	defer c.active.Add(-1)
+	c.lastRequest.Store(time.Now().UnixNano())
+	req.ID = c.nextRequestID.Add(1)
+	req.Streaming = true
+	if deadline, ok := ctx.Deadline(); ok {
+		req.TimeoutMs = max(time.Until(deadline).Milliseconds(), 1)
+	}
+
+	stream, err := c.conn.OpenStreamSync(ctx)
+	if err != nil {
+		s.streamFailed(w, c, err)
+		return 0
+	}
+	// Abort the call if the visitor goes away, and whatever is left of it
+	// once the response is complete
+	abort := func() {
+		stream.CancelRead(protocol.CallErrCanceled)
+		stream.CancelWrite(protocol.CallErrCanceled)
+	}
+	stop := context.AfterFunc(r.Context(), abort)
+	defer func() {
+		if stop() {
+			abort()
+		}
+	}()
+
+	head, err := protocol.NewRequestMessage(req)
+	if err == nil {
+		err = protocol.WriteBinaryMessage(stream, head)
+	}
+	if err != nil {
+		s.streamFailed(w, c, err)
+		return 0
+	}
+
+	var bytesIn atomic.Int64
+	go func() {
+		n, err := protocol.CopyBody(stream, r.Body)
+		bytesIn.Store(n)
+		if err != nil {
+			stream.CancelWrite(protocol.CallErrCanceled)
+			return
+		}
+		end, err := protocol.NewEndMessage(protocol.EndPayload{})
+		if err == nil {
+			err = protocol.WriteBinaryMessage(stream, end)
+		}
+		if err != nil {
+			stream.CancelWrite(protocol.CallErrCanceled)
+			return
+		}
+		stream.Close()
+	}()
+
+	// Only the response head is bounded by the request timeout
+	reader := protocol.NewCallReader(stream)
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetReadDeadline(deadline)
+	}
+	msg, err := reader.ReadMessage()
+	if err == nil && msg.Type != protocol.MsgTypeResponse {
+		err = fmt.Errorf("expected response message, got %s", msg.Type)
+	}
+	var resp protocol.HTTPResponse
+	if err == nil {
+		resp, err = msg.DecodeResponse()
+	}
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			err = context.DeadlineExceeded
+		} else if r.Context().Err() != nil {
+			err = context.Canceled
+		}
+		s.streamFailed(w, c, err)
+		return bytesIn.Load()
+	}
+	stream.SetReadDeadline(time.Time{})
+	if err := s.pluginResponse(&req, &resp); err != nil {
+		log.Printf("Error processing streamed response from %s: %v", clientID, err)
+		http.Error(w, "Error processing response", http.StatusBadGateway)
+		return bytesIn.Load()
+	}
+
+	headers := httpheader.Normalize(resp.Headers)
+	httpheader.RemoveHopByHop(headers)
+	if c.hello.CORS != nil {
+		fitCORSHeaders(headers, c.hello.CORS)
+	}
+	s.config.ResponseHeaders.Apply(headers, clientID)
+	for key, values := range headers {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	rc := http.NewResponseController(w)
+	rc.Flush()
+
+	for {
+		msg, err := reader.ReadMessage()
+		if err != nil {
+			// Without the end message the visitor sees the call fail
+			if r.Context().Err() == nil {
+				log.Printf("Error reading streamed response from %s: %v", clientID, err)
+			}
+			return bytesIn.Load()
+		}
+		switch msg.Type {
+		case protocol.MsgTypeData:
+			if _, err := w.Write(msg.Body); err != nil {
+				return bytesIn.Load()
+			}
+			rc.Flush()
+		case protocol.MsgTypeEnd:
+			var end protocol.EndPayload
+			json.Unmarshal(msg.Payload, &end)
+			if end.Error != "" {
+				log.Printf("Streamed response from %s was cut short: %s", clientID, end.Error)
+				return bytesIn.Load()
+			}
+			for key, values := range httpheader.Normalize(end.Trailers) {
+				w.Header()[http.TrailerPrefix+key] = values
+			}
+			return bytesIn.Load()
+		default:
+			log.Printf("Unexpected message type on call stream from %s: %s", clientID, msg.Type)
+		}
+	}
+}
+
+// streamFailed answers a streamed call that got no response head, the way
+// failed round trips are answered
+func (s *Server) streamFailed(w http.ResponseWriter, c *ClientInfo, err error) {
+	var appErr *quic.ApplicationError
+	switch {
+	case errors.As(err, &appErr):
+		c.stats.failures.Add(1)
+		http.Error(w, "Agent disconnected", http.StatusBadGateway)
+	case errors.Is(err, context.DeadlineExceeded):
+		c.stats.failures.Add(1)
+		http.Error(w, "Tunnel request timed out", http.StatusGatewayTimeout)
+	case errors.Is(err, context.Canceled):
+		w.WriteHeader(499)
+	default:
+		if !errors.Is(err, io.EOF) {
+			log.Printf("Error forwarding streamed call: %v", err)
+		}
+		c.stats.failures.Add(1)
+		http.Error(w, "Error forwarding request to agent", http.StatusBadGateway)
+	}
+}
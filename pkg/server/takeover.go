@@ -0,0 +1,68 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"time"
+
+	"minitunnel/internal/protocol"
+)
+
+// takeOver lets clientInfo serve the tunnel called name in place of the
+// agent holding it, provided both have the same client certificate identity
+// or takeover secret. New requests go to clientInfo at once; the old agent
+// finishes the ones it has in flight and is then disconnected. It returns
+// false if the name is free, and a rejection if the takeover isn't allowed
+func (s *Server) takeOver(name string, clientInfo *ClientInfo) (bool, *protocol.RejectPayload) {
+	if !protocol.ValidName(name) {
+		return false, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, ok := s.clients.Load(name)
+	if !ok {
+		return false, nil
+	}
+	old := val.(*ClientInfo)
+	var problem string
+	switch {
+	case old.pool != nil:
+		problem = "shared by agents started with -balance"
+	case len(old.extraTunnels) > 0:
+		problem = "served together with other names (-tunnel)"
+	case !sameOwner(old, clientInfo):
+		problem = "held by an agent with a different client certificate or -takeover-secret"
+	}
+	if problem != "" {
+		return false, &protocol.RejectPayload{
+			Message: fmt.Sprintf("cannot take over %s: %s", name, problem),
+			Names:   []protocol.NameError{{Name: name, Code: protocol.NameErrInUse, Message: problem}},
+		}
+	}
+
+	s.clients.Store(name, clientInfo)
+	log.Printf("Agent on %s took over %s from %s", clientInfo.remoteAddr, name, old.remoteAddr)
+	go old.drain(name, s.takeoverTimeout(), protocol.ErrCodeReplaced, "replaced by a newer agent")
+	return true, nil
+}
+
+// sameOwner reports whether two agents proved they belong together, by
+// client certificate or takeover secret
+func sameOwner(a, b *ClientInfo) bool {
+	if a.identity != "" && a.identity == b.identity {
+		return true
+	}
+	return a.takeoverKey != nil && b.takeoverKey != nil &&
+		subtle.ConstantTimeCompare(a.takeoverKey, b.takeoverKey) == 1
+}
+
+// takeoverTimeout bounds how long a replaced agent may take to answer the
+// requests it has in flight
+func (s *Server) takeoverTimeout() time.Duration {
+	if s.config.RequestTimeout > 0 {
+		return s.config.RequestTimeout
+	}
+	return time.Minute
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"minitunnel/internal/tracing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceVisitors gives every visitor request a span, continuing the
+// visitor's trace if the request carries a traceparent header
+func (s *Server) traceVisitors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var client string
+		if addr, ok := s.visitorAddr(r); ok {
+			client = addr.String()
+		}
+		ctx := tracing.Extract(r.Context(), r.Header)
+		ctx, span := tracing.Start(ctx, r.Method, trace.SpanKindServer, tracing.VisitorAttributes(r, client)...)
+		rec := newStatusRecorder(w)
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		tracing.End(span, rec.status, nil)
+	})
+}
+
+// startTunnelSpan starts the span of a request's trip through the tunnel
+// to the agent, naming the tunnel on the visitor's span too. The agent
+// continues the trace from the traceparent header it adds to req
+func startTunnelSpan(ctx context.Context, tunnel string, req *Request) (context.Context, trace.Span) {
+	trace.SpanFromContext(ctx).SetAttributes(tracing.Tunnel.String(tunnel))
+	ctx, span := tracing.Start(ctx, "tunnel "+tunnel, trace.SpanKindClient, tracing.Tunnel.String(tunnel))
+	tracing.Inject(ctx, req.Headers)
+	return ctx, span
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"minitunnel/internal/auditlog"
+	"minitunnel/internal/protocol"
+
+	"github.com/google/uuid"
+)
+
+// registerTunnels grants the hello's main name and all of its additional
+// tunnels in one step. If any name can't be granted, none are registered
+// and the returned rejection lists every problem
+func (s *Server) registerTunnels(clientInfo *ClientInfo) (string, *protocol.RejectPayload) {
+	hello := clientInfo.hello
+	names := append([]string(nil), hello.Tunnels...)
+	if hello.Name != "" {
+		names = append([]string{hello.Name}, names...)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []protocol.NameError
+	seen := make(map[string]bool)
+	for _, name := range names {
+		switch {
+		case !protocol.ValidName(name):
+			errs = append(errs, protocol.NameError{Name: name, Code: protocol.NameErrInvalid, Message: "use 1-63 lowercase letters, digits and hyphens"})
+		case seen[name]:
+			errs = append(errs, protocol.NameError{Name: name, Code: protocol.NameErrDuplicate, Message: "requested more than once"})
+		default:
+			if _, ok := s.clients.Load(name); ok {
+				errs = append(errs, protocol.NameError{Name: name, Code: protocol.NameErrInUse, Message: "held by another agent"})
+			}
+		}
+		seen[name] = true
+	}
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Name < errs[j].Name })
+		return "", &protocol.RejectPayload{
+			Message: fmt.Sprintf("%d of %d tunnel names could not be granted, none were registered", len(errs), len(names)),
+			Names:   errs,
+		}
+	}
+
+	clientID := hello.Name
+	if clientID == "" {
+		clientID = uuid.New().String()
+	}
+	s.clients.Store(clientID, clientInfo)
+	for _, name := range hello.Tunnels {
+		s.clients.Store(name, clientInfo)
+	}
+	clientInfo.extraTunnels = hello.Tunnels
+	return clientID, nil
+}
+
+// reject refuses a hello, telling the agent why, and returns once the
+// agent hung up or had time to read the reason
+func (s *Server) reject(clientInfo *ClientInfo, rejection protocol.RejectPayload) {
+	log.Printf("Rejected agent on %s: %s", clientInfo.remoteAddr, rejection.Message)
+	s.audit.Log(auditlog.Event{
+		Type:       auditlog.AgentRejected,
+		Tunnel:     clientInfo.hello.Name,
+		RemoteAddr: clientInfo.remoteAddr,
+		Identity:   clientInfo.identity,
+		Reason:     rejection.Message,
+	})
+	msg, err := protocol.NewRejectMessage(rejection)
+	if err != nil {
+		log.Printf("Error creating reject message: %v", err)
+		return
+	}
+	if err := clientInfo.send(msg); err != nil {
+		log.Printf("Error sending reject message: %v", err)
+	}
+	// Give the agent a moment to read the reason and hang up
+	select {
+	case <-clientInfo.conn.Context().Done():
+	case <-time.After(5 * time.Second):
+		clientInfo.conn.CloseWithError(0, "")
+	}
+}
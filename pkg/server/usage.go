@@ -0,0 +1,56 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"minitunnel/internal/store"
+)
+
+// named reports whether the agent asked for the tunnel name it serves,
+// rather than being given a random one
+func (c *ClientInfo) named(name string) bool {
+	return name == c.hello.Name || slices.Contains(c.extraTunnels, name)
+}
+
+// recordUsage adds a finished request to the usage of the tunnel, if it is
+// named, and of the agent's token, if it has one. Random names aren't
+// kept, since they never come back
+func (s *Server) recordUsage(name string, c *ClientInfo, status int, bytesIn, bytesOut int64) {
+	usage := store.Usage{Requests: 1, BytesIn: bytesIn, BytesOut: bytesOut}
+	if status >= 500 {
+		usage.Errors = 1
+	}
+	if c.named(name) {
+		if err := s.store.AddUsage(name, usage); err != nil {
+			log.Printf("Error recording usage of %s: %v", name, err)
+		}
+	}
+	if c.tokenDigest != "" {
+		if err := s.store.AddTokenUsage(c.tokenDigest, usage, time.Now()); err != nil {
+			log.Printf("Error recording token usage of %s: %v", name, err)
+		}
+	}
+}
+
+// tunnelConnected notes an agent connecting to a named tunnel in the store
+func (s *Server) tunnelConnected(names []string) {
+	now := time.Now().UTC()
+	for _, name := range names {
+		if err := s.store.TunnelConnected(name, now); err != nil {
+			log.Printf("Error recording connection to %s: %v", name, err)
+		}
+	}
+}
+
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	tunnels, err := s.store.Tunnels()
+	if err != nil {
+		log.Printf("Error loading usage: %v", err)
+		http.Error(w, "Failed to load usage", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, tunnels)
+}
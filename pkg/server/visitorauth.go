@@ -0,0 +1,33 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+
+	"minitunnel/internal/protocol"
+)
+
+// authorizeVisitor checks the visitor's credentials against the ones the
+// agent asked for in its hello. Tunnels without credentials are public
+func (c *ClientInfo) authorizeVisitor(r *http.Request) bool {
+	return checkBasicAuth(c.hello.BasicAuth, r)
+}
+
+// checkBasicAuth reports whether r carries the credentials want, or want
+// is nil
+func checkBasicAuth(want *protocol.BasicAuth, r *http.Request) bool {
+	if want == nil {
+		return true
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	// Compare digests so the time taken doesn't depend on the lengths
+	userHash, wantUserHash := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(want.Username))
+	passHash, wantPassHash := sha256.Sum256([]byte(password)), sha256.Sum256([]byte(want.Password))
+	userOK := subtle.ConstantTimeCompare(userHash[:], wantUserHash[:])
+	passOK := subtle.ConstantTimeCompare(passHash[:], wantPassHash[:])
+	return userOK&passOK == 1
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// maxWaitingVisitors caps the requests held for a tunnel whose agent is
+// reconnecting, later ones fail at once
+const maxWaitingVisitors = 1000
+
+// waitingRoom holds the visitors of a named tunnel for -reconnect-grace
+// after its agent disconnected
+type waitingRoom struct {
+	back    chan struct{} // Closed when an agent takes the name again
+	until   time.Time
+	waiting atomic.Int64
+}
+
+// holdVisitors opens waiting rooms for the names an agent leaves behind.
+// Only names agents ask for by -name can be expected back
+func (s *Server) holdVisitors(clientID string, c *ClientInfo) {
+	grace := s.config.ReconnectGrace
+	if grace <= 0 || clientID != c.hello.Name || c.standby.Load() {
+		return
+	}
+	for _, name := range append([]string{clientID}, c.extraTunnels...) {
+		if _, ok := s.clients.Load(name); ok {
+			continue
+		}
+		room := &waitingRoom{back: make(chan struct{}), until: time.Now().Add(grace)}
+		s.waiting.Store(name, room)
+		time.AfterFunc(grace, func() {
+			if s.waiting.CompareAndDelete(name, room) && room.waiting.Load() > 0 {
+				log.Printf("Agent for %s did not reconnect within %s, failing %d waiting requests", name, grace, room.waiting.Load())
+			}
+		})
+		log.Printf("Holding requests to %s for up to %s while its agent reconnects", name, grace)
+	}
+}
+
+// releaseVisitors lets the visitors waiting for the names of a newly
+// registered agent through
+func (s *Server) releaseVisitors(names ...string) {
+	for _, name := range slices.Compact(names) {
+		val, ok := s.waiting.LoadAndDelete(name)
+		if !ok {
+			continue
+		}
+		room := val.(*waitingRoom)
+		if n := room.waiting.Load(); n > 0 {
+			log.Printf("Agent for %s is back, forwarding %d waiting requests", name, n)
+		}
+		close(room.back)
+	}
+}
+
+// awaitAgent holds a visitor of a tunnel whose agent is reconnecting. It
+// reports whether the agent is back, false if the tunnel has no waiting
+// room, the grace period ran out or the visitor went away
+func (s *Server) awaitAgent(ctx context.Context, name string) bool {
+	val, ok := s.waiting.Load(name)
+	if !ok {
+		return false
+	}
+	room := val.(*waitingRoom)
+	if room.waiting.Add(1) > maxWaitingVisitors {
+		room.waiting.Add(-1)
+		return false
+	}
+	defer room.waiting.Add(-1)
+
+	timer := time.NewTimer(time.Until(room.until))
+	defer timer.Stop()
+	select {
+	case <-room.back:
+		_, ok := s.clients.Load(name)
+		return ok
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"minitunnel/internal/protocol"
+
+	"github.com/quic-go/quic-go"
+)
+
+// poller is an agent in polling mode that is offline until traffic for its
+// tunnel name arrives
+type poller struct {
+	lastPoll atomic.Int64 // Unix nanoseconds
+	interval time.Duration
+	wake     atomic.Bool // Traffic arrived, tell the agent to connect
+}
+
+// active reports whether the agent is still polling. Agents that miss
+// three polls are forgotten
+func (p *poller) active() bool {
+	return time.Since(time.Unix(0, p.lastPoll.Load())) < 3*p.interval
+}
+
+// handlePoll answers a polling agent and records that it is alive
+func (s *Server) handlePoll(conn quic.Connection, stream quic.Stream, msg *protocol.Message) {
+	var poll protocol.PollPayload
+	if err := json.Unmarshal(msg.Payload, &poll); err != nil {
+		log.Printf("Error parsing poll message: %v", err)
+		return
+	}
+	if !protocol.ValidName(poll.Name) || poll.IntervalSeconds <= 0 {
+		log.Printf("Rejecting invalid poll from %s", conn.RemoteAddr())
+		return
+	}
+
+	interval := time.Duration(poll.IntervalSeconds) * time.Second
+	val, _ := s.pollers.LoadOrStore(poll.Name, &poller{interval: interval})
+	p := val.(*poller)
+	p.lastPoll.Store(time.Now().UnixNano())
+	wake := p.wake.Swap(false)
+
+	reply, err := protocol.NewPollResultMessage(protocol.PollResultPayload{Wake: wake})
+	if err != nil {
+		log.Printf("Error creating poll result: %v", err)
+		return
+	}
+	if err := protocol.WriteMessage(stream, reply); err != nil {
+		log.Printf("Error sending poll result: %v", err)
+		return
+	}
+	if wake {
+		log.Printf("Woke polling agent %s", poll.Name)
+	}
+}
+
+// wakePoller queues a wake-up for a sleeping tunnel and answers the visitor
+// with a retry hint. It returns false if no agent is polling for name
+func (s *Server) wakePoller(w http.ResponseWriter, r *http.Request, name string) bool {
+	val, ok := s.pollers.Load(name)
+	if !ok {
+		return false
+	}
+	p := val.(*poller)
+	if !p.active() {
+		s.pollers.Delete(name)
+		return false
+	}
+
+	if !p.wake.Swap(true) {
+		log.Printf("Queued wake-up for sleeping tunnel %s", name)
+	}
+	retry := p.interval - time.Since(time.Unix(0, p.lastPoll.Load()))
+	if retry < time.Second {
+		retry = time.Second
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds()+0.5)))
+	s.tunnelError(w, r, name, http.StatusServiceUnavailable, "Tunnel is waking up, please retry shortly")
+	return true
+}
@@ -27,7 +27,7 @@ echo ""
 
 # Start agent
 echo "Starting agent..."
-timeout 10 ./bin/mt_agent 2>&1 | tee /tmp/mt_agent.log &
+timeout 10 ./bin/mt_agent -ca certs/server.crt 2>&1 | tee /tmp/mt_agent.log &
 AGENT_PID=$!
 
 # Wait a bit for connection